@@ -3,206 +3,613 @@ package IR
 import (
 	//
 
+	"context"
+	"errors"
 	"fmt"
 	"log"
-	"net"
 	"net/rpc"
+	"sort"
 	"sync"
 	"time"
 
 	. "github.com/ViolaChenYT/TAPIR/common"
+	"github.com/ViolaChenYT/TAPIR/common/transport"
 )
 
-const ( // number of replicas that can be down at any one point
-	timeout = 1
-) // total 2f + 1 = 5 replicas?
-type ConsensusDecide func(results []*Response) *Response
+// Decides a consensus operation from the results of f+1 or more replicas of
+// a group of n replicas that tolerates f failures
+type ConsensusDecide func(results []*Response, n, f int) *Response
+
+// A replica in a later epoch answered, the operation runs again in its group
+var errEpochChanged = errors.New("replica group reconfigured")
+
+// How often Reconfigure asks the replicas whether they moved
+const reconfigureInterval = 100 * time.Millisecond
+
+// How long a wait for replies runs before it checks again whether its
+// context was canceled
+const cancelPollInterval = 10 * time.Millisecond
 
 type Client struct {
-	client_id        int
-	operation_cnt    int
-	conn             net.Conn
-	close            chan bool               // close channel
-	allReplicas      map[int]*rpc.Client     // <replica_id, client>
-	replicaAddresses map[int]*ReplicaAddress // <replica_id, address>
-	f                int                     // max number of fault tolerance
+	client_id       int        // unique among the clients of the deployment
+	mu              sync.Mutex // guards operation_cnt, inflight and group
+	operation_cnt   int
+	inflight        map[int]int    // <seq, calls still out> of the logged operations not done yet
+	group           *group         // replicas operations go to
+	pending         sync.WaitGroup // finalizes still being sent
+	transport       Transport      // carries calls to the replicas
+	clock           Clock          // runs the calls and times out waiting for them
+	fastPathTimeout time.Duration
+	slowPathTimeout time.Duration
+	retransmit      time.Duration // wait before resending a failed call, 0 never resends
+}
+
+// Replica group of an epoch. The client starts with the group of the
+// configuration in an unknown epoch, the first replica it calls tells it the
+// current one.
+type group struct {
+	epoch       int                     // -1 until a replica told the client
+	replicas    map[int]*ReplicaAddress // <replica_id, address>
+	ids         []int                   // ids of replicas in order, calls go out in this order
+	f           int                     // max number of fault tolerance
+	superQuorum int                     // matching replies needed for the fast path
+}
+
+// Reply of a single replica
+type replicaReply struct {
+	id       int
+	response *Response
+	err      error // the call failed, only reported for calls to a single replica and for errEpochChanged
+}
+
+// Replies of a broadcast in the order they arrive
+type replyQueue struct {
+	mu      sync.Mutex
+	replies []replicaReply
+	signal  Signal
+	done    bool // the operation no longer waits, calls stop resending
 }
 
 func NewIRClient(config *Configuration) (*Client, error) {
+	// Replicas are dialed on first use, one that is down is a missing reply
+	if len(config.Replicas) == 0 {
+		return nil, errors.New("no replicas to talk to")
+	}
 	client := Client{
-		client_id:        config.Client.IR_ID,
-		operation_cnt:    0,
-		close:            make(chan bool),
-		replicaAddresses: config.Replicas,
-		allReplicas:      make(map[int]*rpc.Client),
-		f:                config.F,
+		client_id:       config.Client.IR_ID,
+		group:           newGroup(-1, config.Replicas, config.F),
+		inflight:        make(map[int]int),
+		transport:       transportOf(config),
+		clock:           clockOf(config),
+		fastPathTimeout: config.FastPathTimeout,
+		slowPathTimeout: config.SlowPathTimeout,
+		retransmit:      config.Retransmit,
 	}
-	// errCh := make(chan error, len(config.Replicas))
+	// Replicas know operations by their ids, a restarted client must not
+	// reuse the ids of the operations it invoked before
+	client.operation_cnt = int(client.clock.Now().UnixNano())
+	return &client, nil
+}
 
-	for idx, addr := range config.Replicas {
-		cli, err := rpc.Dial("tcp", addr.SpecificString())
-		CheckError(err)
-		client.allReplicas[idx] = cli
+func newGroup(epoch int, replicas map[int]*ReplicaAddress, f int) *group {
+	g := &group{
+		epoch:       epoch,
+		replicas:    replicas,
+		ids:         memberIDs(replicas),
+		f:           f,
+		superQuorum: (&Configuration{F: f}).SuperQuorumSize(),
 	}
-	return &client, nil
+	return g
+}
+
+// Group operations go to now
+func (c *Client) currentGroup() *group {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.group
+}
+
+// Move to the group of a later epoch a replica told of. The group of the
+// configuration keeps its f.
+func (c *Client) learn(epoch int, members map[int]*ReplicaAddress) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if epoch <= c.group.epoch {
+		return
+	}
+	f := (len(members) - 1) / 2
+	if sameMembers(members, c.group.replicas) {
+		f = c.group.f
+	}
+	if c.group.epoch >= 0 {
+		log.Println("IR client", c.client_id, "moves to epoch", epoch, "with replicas", memberIDs(members))
+	}
+	c.group = newGroup(epoch, members, f)
+}
+
+// Run op in the group of the current epoch, and again in the next group
+// while reconfigurations end the epoch it runs in. Replicas answer a
+// propose they recorded with the recorded result and execute a finalize
+// only once, so running again is safe.
+func (c *Client) inGroup(op func(g *group) error) error {
+	for {
+		if err := op(c.currentGroup()); !errors.Is(err, errEpochChanged) {
+			return err
+		}
+	}
+}
+
+// Replicas of the group operations go to now, in order, and how many
+// failures the group tolerates
+func (c *Client) Members() ([]int, int) {
+	g := c.currentGroup()
+	return g.ids, g.f
+}
+
+// Epoch of the group operations go to now, -1 before any replica replied
+func (c *Client) Epoch() int {
+	return c.currentGroup().epoch
 }
 
-func (c *Client) callOneReplica(rep int, cli *rpc.Client, msg Message, results map[int]*Response, semaphone chan bool, mu *sync.Mutex) *Message {
-	// port := c.replicaAddresses[rep].Port
-	// real_cli, err := rpc.Dial("tcp", "localhost:"+port)
-	// if msg.Request.Op == OP_PREPARE {
-	// 	log.Println("calling 1 replica for prepare", msg.Request.Prepare.Txn)
-	// }
+// Transport of the configuration, a TCP transport of its own if none is set
+func transportOf(config *Configuration) Transport {
+	if config.Transport != nil {
+		return config.Transport
+	}
+	return transport.NewTCPTransport()
+}
+
+func clockOf(config *Configuration) Clock {
+	if config.Clock != nil {
+		return config.Clock
+	}
+	return SystemClock
+}
+
+func (c *Client) callOneReplica(g *group, rep int, msg Message, replies *replyQueue) (*Message, error) {
+	msg.Epoch = g.epoch
+	msg.Completed = c.completed()
 	reply := Message{}
-	err := cli.Call(fmt.Sprintf("IRReplica%d.HandleOperation", rep), &msg, &reply)
+	err := c.transport.Call(rep, g.replicas[rep], "HandleOperation", &msg, &reply)
 	if err != nil {
-		log.Fatal("arith error: ", err)
+		// A failed call is a missing reply, quorums wait for the other replicas
+		log.Println("Error calling replica", rep, err)
+		return nil, err
 	}
-	if results != nil {
-		mu.Lock()
-		results[rep] = reply.Response
-		mu.Unlock()
-		// log.Println("callOneReplica, client", c.client_id, "Op", msg.Request.Op, "txn", msg.Request.TxnID, "val", reply.Response.Value)
-		semaphone <- true
+	if reply.Epoch > g.epoch && len(reply.Members) > 0 {
+		c.learn(reply.Epoch, reply.Members)
+		return nil, errEpochChanged
 	}
-	return &reply
+	if replies != nil {
+		replies.put(replicaReply{id: rep, response: reply.Response})
+	}
+	return &reply, nil
 }
 
-func (c *Client) msgOneReplica(rep int, cli *rpc.Client, msg Message) {
-	reply := Message{}
-	// if msg.Request.Op == OP_PREPARE {
-	// 	log.Println("messaging 1 replica for prepare", msg.Request.TxnID)
-	// }
-	go cli.Call(fmt.Sprintf("IRReplica%d.HandleOperation", rep), msg, &reply)
+// Send the message to one replica without waiting for its reply. Replicas
+// ignore finalizes they have already seen, so it is resent until it gets through.
+func (c *Client) msgOneReplica(g *group, rep int, msg Message) {
+	c.pending.Add(1)
+	c.hold(msg.OperationID)
+	c.clock.Go(func() {
+		defer c.pending.Done()
+		defer c.release(msg.OperationID)
+		c.callUntilReplied(g, rep, msg, nil, c.clock.Now().Add(c.slowPathTimeout))
+	})
+}
+
+// Queue for the replies of an operation
+func (c *Client) newReplyQueue() *replyQueue {
+	return &replyQueue{signal: c.clock.NewSignal()}
+}
+
+// When a wait of timeout ends on the client's clock, earlier if the deadline
+// of ctx comes first. The deadline of ctx is a time on the same clock, see
+// WithClockDeadline.
+func (c *Client) deadline(ctx context.Context, timeout time.Duration) time.Time {
+	deadline := c.clock.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	return deadline
+}
+
+// Send the message to every replica, replies are delivered to the returned
+// queue. Calls that fail are resent until the timeout passes or the
+// operation closes the queue.
+func (c *Client) broadcast(ctx context.Context, g *group, msg Message, timeout time.Duration) *replyQueue {
+	replies := c.newReplyQueue()
+	deadline := c.deadline(ctx, timeout)
+	for _, id := range g.ids {
+		c.hold(msg.OperationID)
+		c.clock.Go(func() {
+			defer c.release(msg.OperationID)
+			c.callUntilReplied(g, id, msg, replies, deadline)
+		})
+	}
+	return replies
+}
+
+// Call a replica until it replies. A lost request and a lost reply look the
+// same to the client, resending is safe as replicas answer a duplicate
+// propose with the result they recorded and execute a finalize only once.
+// A replica in a later epoch ends the operation.
+func (c *Client) callUntilReplied(g *group, rep int, msg Message, replies *replyQueue, deadline time.Time) {
+	for {
+		_, err := c.callOneReplica(g, rep, msg, replies)
+		if err == nil {
+			return
+		}
+		if errors.Is(err, errEpochChanged) {
+			if replies != nil {
+				replies.put(replicaReply{id: rep, err: err})
+			}
+			return
+		}
+		if c.retransmit <= 0 || (replies != nil && replies.closed()) {
+			return
+		}
+		if !c.clock.Now().Add(c.retransmit).Before(deadline) {
+			return
+		}
+		c.clock.Sleep(c.retransmit)
+		log.Println("Resending", msg.Type.ToString(), msg.OperationID, "to replica", rep)
+	}
+}
+
+// Wait for n replies, or until the timeout fires or ctx is done
+func (c *Client) collect(ctx context.Context, replies *replyQueue, n int, timeout time.Duration) (map[int]*Response, error) {
+	results := make(map[int]*Response)
+	deadline := c.deadline(ctx, timeout)
+	for len(results) < n {
+		reply, err := replies.next(ctx, c.clock, deadline)
+		if err != nil {
+			return results, fmt.Errorf("%w with %d of %d replies", err, len(results), n)
+		}
+		if reply.err != nil {
+			return results, reply.err
+		}
+		results[reply.id] = reply.response
+	}
+	return results, nil
+}
+
+func (q *replyQueue) put(reply replicaReply) {
+	q.mu.Lock()
+	q.replies = append(q.replies, reply)
+	q.mu.Unlock()
+	q.signal.Notify()
+}
+
+// The operation got what it waited for, late calls need not be resent
+func (q *replyQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.done = true
+}
+
+func (q *replyQueue) closed() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.done
+}
+
+// Next reply, ErrTimeout if none arrives before the deadline and the error
+// of ctx if it is done first. Nothing notifies the queue when ctx is
+// canceled, a wait checks ctx at least every cancelPollInterval on the clock.
+func (q *replyQueue) next(ctx context.Context, clock Clock, deadline time.Time) (replicaReply, error) {
+	for {
+		q.mu.Lock()
+		if len(q.replies) > 0 {
+			reply := q.replies[0]
+			q.replies = q.replies[1:]
+			q.mu.Unlock()
+			return reply, nil
+		}
+		q.mu.Unlock()
+		if ctx.Err() != nil {
+			return replicaReply{}, ContextError(ctx)
+		}
+		timeout := deadline.Sub(clock.Now())
+		if timeout <= 0 {
+			return replicaReply{}, ErrTimeout
+		}
+		if ctx.Done() != nil {
+			timeout = min(timeout, cancelPollInterval)
+		}
+		q.signal.Wait(timeout)
+	}
 }
 
 func (c *Client) InvokeInconsistent(req *Request) error {
+	return c.InvokeInconsistentContext(context.Background(), req)
+}
+
+// InvokeInconsistent that gives up once ctx is done. Finalizes go out even
+// then, the operation may already have taken effect.
+func (c *Client) InvokeInconsistentContext(ctx context.Context, req *Request) error {
 	log.Println("InvokeInconsistent", req.Op.ToString(), req.TxnID)
-	results := make(map[int]*Response)
-	mu := sync.Mutex{}
-	semaphone := make(chan bool, c.f+1)
-	for id, cli := range c.allReplicas {
-		msg := NewPropose(req.TxnID, req, INCONSISTENT)
-		msg.Type = MsgPropose
-		go c.callOneReplica(id, cli, msg, results, semaphone, &mu)
-	}
-	log.Println("invoke I propose done")
-	done := make(chan bool)
-	// wait for reply
-	go func() {
-		for i := 0; i < c.f+1; i++ {
-			<-semaphone
-		}
-		done <- true
-	}()
-	<-done
-	log.Println("Invoke I, finalizing")
-	var wg sync.WaitGroup
-	for idx, cli := range c.allReplicas {
-		msg := NewFinalize(req.TxnID, INCONSISTENT)
-		msg.Request = req
-		// go c.msgOneReplica(idx, cli, msg)
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			c.msgOneReplica(idx, cli, msg)
-		}()
-	}
-	wg.Wait()
-	c.operation_cnt++
-	return nil
+	return c.inGroup(func(g *group) error {
+		opID := c.startOp()
+		defer c.release(opID)
+		replies := c.broadcast(ctx, g, NewPropose(opID, req, INCONSISTENT), c.slowPathTimeout)
+		defer replies.close()
+		if _, err := c.collect(ctx, replies, g.f+1, c.slowPathTimeout); err != nil {
+			return err
+		}
+		log.Println("Invoke I, finalizing")
+		for _, idx := range g.ids {
+			msg := NewFinalize(opID, INCONSISTENT)
+			msg.Request = req
+			c.msgOneReplica(g, idx, msg)
+		}
+		return nil
+	})
 }
 
 func (c *Client) InvokeConsensus(req *Request, decide ConsensusDecide) (*Response, error) {
+	return c.InvokeConsensusContext(context.Background(), req, decide)
+}
+
+// InvokeConsensus that gives up once ctx is done, the fast and slow path
+// end at the deadline of ctx if it comes first
+func (c *Client) InvokeConsensusContext(ctx context.Context, req *Request, decide ConsensusDecide) (*Response, error) {
 	log.Println("InvokeConsensus", req.Op, req.Prepare.Txn)
+	var result *Response
+	err := c.inGroup(func(g *group) (err error) {
+		result, err = c.invokeConsensus(ctx, g, req, decide)
+		return err
+	})
+	return result, err
+}
+
+func (c *Client) invokeConsensus(ctx context.Context, g *group, req *Request, decide ConsensusDecide) (*Response, error) {
+	opID := c.startOp()
+	defer c.release(opID)
+	replies := c.broadcast(ctx, g, NewPropose(opID, req, CONSENSUS), c.fastPathTimeout+c.slowPathTimeout)
+	defer replies.close()
 	results := make(map[int]*Response)
-	consensusRes := Response{}
-	sem := make(chan bool, len(c.allReplicas))
-	timer := time.NewTimer(timeout * time.Second)
-	mu := sync.Mutex{}
-	for id, cli := range c.allReplicas {
-		msg := NewPropose(req.TxnID, req, CONSENSUS)
-		go c.callOneReplica(id, cli, msg, results, sem, &mu)
-	}
-	log.Println("waiting for consensus timer")
-	<-timer.C
-	value_cnt := make(map[string]int)
-	max_val, max_cnt := "", 0
-	mu.Lock()
-	for key, res := range results {
-		res_val := res.Value
-		log.Println("------------------", key, ": res_val", res_val)
-		if _, ok := value_cnt[res_val]; ok {
-			value_cnt[res_val]++
-		} else {
-			value_cnt[res_val] = 1
-		}
-		if value_cnt[res_val] > max_cnt {
-			max_val = res_val
-			max_cnt = value_cnt[res_val]
-		}
-	}
-	mu.Unlock()
-	log.Println("max_cnt", max_cnt, "max_val", max_val)
-	if (max_cnt) >= (3*c.f/2)+1 {
-		var wg sync.WaitGroup
-		for idx, cli := range c.allReplicas {
-			consensusRes.Value = max_val
-			log.Println("fast path finalize")
-			msg := Finalize(req.TxnID, &consensusRes)
-			msg.Request = req
-			log.Println("finalizing concensus")
 
-			wg.Add(1)
-			go func() {
-				defer wg.Done()
-				c.msgOneReplica(idx, cli, msg)
-			}()
-			wg.Wait()
+	// Fast path: return as soon as a super quorum of replicas agree
+	deadline := c.deadline(ctx, c.fastPathTimeout)
+	for len(results) < len(g.replicas) {
+		reply, err := replies.next(ctx, c.clock, deadline)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			break
 		}
-		log.Println("fast path done")
-	} else {
-		log.Println("wait for slow path")
-		done := make(chan bool)
-		go func() {
-			for i := 0; i < c.f+1; i++ {
-				<-sem
+		if reply.err != nil {
+			return nil, reply.err
+		}
+		results[reply.id] = reply.response
+		if result, cnt := majorityResult(results); cnt >= g.superQuorum {
+			log.Println("fast path finalize", ReplyTypeString(result.Status))
+			for _, idx := range g.ids {
+				msg := Finalize(opID, result)
+				msg.Request = req
+				msg.ProtoType = CONSENSUS
+				c.msgOneReplica(g, idx, msg)
 			}
-			done <- true
-		}()
-		log.Println("waiting for consensus ")
-		<-done
-		var result_arr []*Response
-		for _, res := range results {
-			result_arr = append(result_arr, res)
-		}
-		consensusRes = *decide(result_arr)
-		finalize_msg := Finalize(req.TxnID, &consensusRes)
-		finalize_msg.Request = req
-		finalize_msg.ProtoType = CONSENSUS
-		var wg sync.WaitGroup
-		for idx, cli := range c.allReplicas {
-			wg.Add(1)
-			go func() {
-				defer wg.Done()
-				c.msgOneReplica(idx, cli, finalize_msg)
-			}()
-		}
-		wg.Wait()
+			return result, nil
+		}
 	}
-	c.operation_cnt++
-	return &consensusRes, nil
+
+	// Slow path: decide from f+1 replies and wait for f+1 replicas to confirm
+	log.Println("wait for slow path")
+	if len(results) < g.f+1 {
+		more, err := c.collect(ctx, replies, g.f+1-len(results), c.slowPathTimeout)
+		for id, res := range more {
+			results[id] = res
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	consensusRes := decide(inOrder(results), len(g.ids), g.f)
+	finalize_msg := Finalize(opID, consensusRes)
+	finalize_msg.Request = req
+	finalize_msg.ProtoType = CONSENSUS
+	confirms := c.broadcast(ctx, g, finalize_msg, c.slowPathTimeout)
+	defer confirms.close()
+	if _, err := c.collect(ctx, confirms, g.f+1, c.slowPathTimeout); err != nil {
+		return nil, err
+	}
+	return consensusRes, nil
 }
 
 func (c *Client) InvokeUnlogged(replicaIdx int, req *Request) (*Response, error) {
-	reqMsg := NewUnlogged(req)
-	results := make(map[int]*Response)
-	sem := make(chan bool, 5)
-	mu := sync.Mutex{}
-	replyMsg := c.callOneReplica(replicaIdx, c.allReplicas[replicaIdx], reqMsg, results, sem, &mu)
-	return replyMsg.Response, nil
+	return c.InvokeUnloggedContext(context.Background(), replicaIdx, req)
+}
+
+// InvokeUnlogged that gives up once ctx is done or the slow path timeout
+// passes. A failed call is not resent, the caller may try another replica.
+// It fails if a reconfiguration removed the replica from the group.
+func (c *Client) InvokeUnloggedContext(ctx context.Context, replicaIdx int, req *Request) (*Response, error) {
+	var response *Response
+	err := c.inGroup(func(g *group) error {
+		if g.replicas[replicaIdx] == nil {
+			return fmt.Errorf("replica %d is not in the group of epoch %d", replicaIdx, g.epoch)
+		}
+		reqMsg := NewUnlogged(c.nextOpID(), req)
+		replies := c.newReplyQueue()
+		defer replies.close()
+		c.clock.Go(func() {
+			if _, err := c.callOneReplica(g, replicaIdx, reqMsg, replies); err != nil {
+				replies.put(replicaReply{id: replicaIdx, err: err})
+			}
+		})
+		reply, err := replies.next(ctx, c.clock, c.deadline(ctx, c.slowPathTimeout))
+		if err != nil {
+			return fmt.Errorf("%w waiting for replica %d", err, replicaIdx)
+		}
+		response = reply.response
+		return reply.err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
 }
 
+// Send an unlogged request to every replica and return the first f+1 replies
+func (c *Client) InvokeUnloggedQuorum(req *Request) ([]*Response, error) {
+	return c.InvokeUnloggedQuorumContext(context.Background(), req)
+}
+
+func (c *Client) InvokeUnloggedQuorumContext(ctx context.Context, req *Request) ([]*Response, error) {
+	var responses []*Response
+	err := c.inGroup(func(g *group) error {
+		replies := c.broadcast(ctx, g, NewUnlogged(c.nextOpID(), req), c.slowPathTimeout)
+		defer replies.close()
+		results, err := c.collect(ctx, replies, g.f+1, c.slowPathTimeout)
+		responses = inOrder(results)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return responses, nil
+}
+
+// Send an unlogged request to every replica and return the replies that
+// arrive before the slow path timeout, by replica id. The error tells that
+// some replica did not reply, the replies that did arrive are still returned.
+func (c *Client) InvokeUnloggedAllContext(ctx context.Context, req *Request) (map[int]*Response, error) {
+	var results map[int]*Response
+	err := c.inGroup(func(g *group) (err error) {
+		replies := c.broadcast(ctx, g, NewUnlogged(c.nextOpID(), req), c.slowPathTimeout)
+		defer replies.close()
+		results, err = c.collect(ctx, replies, len(g.ids), c.slowPathTimeout)
+		return err
+	})
+	return results, err
+}
+
+// Reconfigure moves the replica group to the given replicas and waits until
+// it is in the epoch that has them. f+1 of them must be in the current
+// group. Replicas that join must run Join before, the ones that leave retire
+// and can be stopped once the clients learned the new group.
+func (c *Client) Reconfigure(ctx context.Context, replicas map[int]*ReplicaAddress) error {
+	for {
+		g := c.currentGroup()
+		if g.epoch >= 0 && sameMembers(g.replicas, replicas) {
+			return nil
+		}
+		// Replicas move to the new group once, asking them again is fine.
+		// The replies tell the client the current group.
+		var refusal error
+		refused := 0
+		for _, id := range g.ids {
+			reply := ViewChangeMessage{}
+			err := c.transport.Call(id, g.replicas[id], "Reconfigure", &ViewChangeMessage{Epoch: g.epoch, Next: replicas}, &reply)
+			if _, ok := err.(rpc.ServerError); ok {
+				refusal = err
+				refused++
+			} else if err == nil {
+				c.learn(reply.Epoch, reply.Members)
+			}
+		}
+		if refused == len(g.ids) {
+			return fmt.Errorf("replicas refused to move to %v: %w", memberIDs(replicas), refusal)
+		}
+		if c.currentGroup() != g {
+			continue
+		}
+		if ctx.Err() != nil {
+			return ContextError(ctx)
+		}
+		c.clock.Sleep(reconfigureInterval)
+	}
+}
+
+// Identifier of a new operation, every message of the operation carries it
+func (c *Client) nextOpID() OpID {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.operation_cnt++
+	return OpID{ClientID: c.client_id, Seq: c.operation_cnt}
+}
+
+// Identifier of a new logged operation, it counts as in flight until
+// release is called once for it and once for every hold
+func (c *Client) startOp() OpID {
+	id := c.nextOpID()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.inflight[id.Seq] = 1
+	return id
+}
+
+// Keep the operation in flight while a call of it is out, does nothing for
+// unlogged operations
+func (c *Client) hold(id OpID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if calls, ok := c.inflight[id.Seq]; ok {
+		c.inflight[id.Seq] = calls + 1
+	}
+}
+
+func (c *Client) release(id OpID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if calls, ok := c.inflight[id.Seq]; ok && calls > 1 {
+		c.inflight[id.Seq] = calls - 1
+	} else {
+		delete(c.inflight, id.Seq)
+	}
+}
+
+// Sequence up to which every logged operation of the client is done, no
+// call of them goes out anymore. Replicas refuse late duplicates of them.
+func (c *Client) completed() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	done := c.operation_cnt
+	for seq := range c.inflight {
+		done = min(done, seq-1)
+	}
+	return done
+}
+
+// Wait for the finalizes still being sent, a process that exits before
+// they are sent leaves its operations tentative
 func (c *Client) Close() {
-	c.close <- true
+	c.pending.Wait()
+}
+
+// Replies ordered by replica id
+func inOrder(results map[int]*Response) []*Response {
+	var ids []int
+	for id := range results {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	result_arr := make([]*Response, 0, len(ids))
+	for _, id := range ids {
+		result_arr = append(result_arr, results[id])
+	}
+	return result_arr
+}
+
+// The most common result among the replies and how many replicas returned
+// it, ties go to the replica with the lowest id
+func majorityResult(results map[int]*Response) (*Response, int) {
+	var best *Response
+	bestCnt := 0
+	ordered := inOrder(results)
+	for _, a := range ordered {
+		cnt := 0
+		for _, b := range ordered {
+			if SameResult(a, b) {
+				cnt++
+			}
+		}
+		if cnt > bestCnt {
+			best, bestCnt = a, cnt
+		}
+	}
+	return best, bestCnt
 }
@@ -0,0 +1,312 @@
+package IR
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	. "github.com/ViolaChenYT/TAPIR/common"
+)
+
+// Reconfiguration moves a replica group to other replicas. Every group is
+// in an epoch, its members are the group of the configuration in epoch 0.
+// A reconfiguration is a view change of the old group that starts the next
+// epoch:
+//
+//  1. An operator asks the members to move to a new group (Reconfigure),
+//     they start a view change that carries it.
+//  2. The leader merges f+1 records of the old group like in any view change
+//     and hands the master record to the old members (EndEpoch). Once f+1 of
+//     them have it, the old group can't start another view.
+//  3. The leader starts the view in the new epoch (StartView). New members
+//     sync their application from the master record it carries.
+//
+// Old members that are not in the new group retire. They answer replicas and
+// clients of the old epoch with the new group, and handle nothing else. One
+// reconfiguration runs at a time, and f+1 replicas of the new group must be
+// in the old one, so replace replicas one by one.
+
+// Reconfigure asks the replica to move its group to args.Next, in the epoch
+// after args.Epoch. Asking again while the view change runs is fine, the
+// reply tells the epoch and group of the replica.
+func (r *IRReplicaImpl) Reconfigure(args *ViewChangeMessage, reply *ViewChangeMessage) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	reply.ReplicaID = r.id
+	reply.Epoch = r.epoch
+	reply.Members = r.peers
+	if args.Epoch < r.epoch {
+		// The group moved on already, the reply tells where
+		return nil
+	}
+	if args.Epoch > r.epoch {
+		r.catchUp()
+		return fmt.Errorf("replica %d is behind in epoch %d", r.id, r.epoch)
+	}
+	if r.status != STATUS_NORMAL && r.status != STATUS_VIEW_CHANGING {
+		return fmt.Errorf("replica %d is recovering, retired or stopped", r.id)
+	}
+	if sameMembers(args.Next, r.peers) {
+		return nil
+	}
+	if err := checkMembers(r.peers, args.Next); err != nil {
+		return err
+	}
+	if r.pending != nil && !sameMembers(r.pending, args.Next) {
+		return fmt.Errorf("replica %d is already moving to replicas %v", r.id, memberIDs(r.pending))
+	}
+	r.pending = args.Next
+	if r.status == STATUS_NORMAL {
+		r.enterViewChange(r.view + 1)
+	}
+	return nil
+}
+
+// EndEpoch hands the master record of the view that ends an epoch to an old
+// member, which takes no part in the old epoch from then on. The reply tells
+// the epoch of the replica.
+func (r *IRReplicaImpl) EndEpoch(args *ViewChangeMessage, reply *ViewChangeMessage) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.status != STATUS_STOPPED && (args.Epoch > r.epoch || (args.Epoch == r.epoch && args.View > r.view)) {
+		r.install(args, false)
+	}
+	reply.ReplicaID = r.id
+	reply.Epoch = r.epoch
+	return nil
+}
+
+// GetState sends the master record of the current view to a replica of an
+// earlier epoch. A recovering replica only gets it if it is in the group.
+func (r *IRReplicaImpl) GetState(args *ViewChangeMessage, reply *ViewChangeMessage) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.status != STATUS_NORMAL && r.status != STATUS_RETIRED {
+		return fmt.Errorf("replica %d has no state to send", r.id)
+	}
+	*reply = *r.startViewMessage()
+	if args.Epoch >= r.epoch || (args.Recovering && r.peers[args.ReplicaID] == nil) {
+		reply.Record = nil
+	}
+	return nil
+}
+
+// Join waits until a reconfiguration adds the replica to its group. The
+// replica starts without a record and gets the master record of the epoch
+// that adds it. In case the StartView of the reconfiguration is lost, it
+// asks the replicas it knows for their state every view change timeout.
+func (r *IRReplicaImpl) Join() error {
+	r.mu.Lock()
+	// The reconfiguration may have reached the replica before Join
+	if r.status == STATUS_NORMAL && r.epoch > 0 {
+		log.Println("Replica", r.id, "joined its group in epoch", r.epoch)
+		r.mu.Unlock()
+		return nil
+	}
+	r.status = STATUS_RECOVERING
+	r.record = emptyRecord()
+	r.mu.Unlock()
+
+	var pulled time.Time
+	for {
+		r.mu.Lock()
+		status := r.status
+		r.mu.Unlock()
+		switch status {
+		case STATUS_STOPPED:
+			return errors.New(fmt.Sprintf("replica %d stopped before it joined", r.id))
+		case STATUS_RETIRED:
+			return errors.New(fmt.Sprintf("replica %d joined a group it is not in", r.id))
+		case STATUS_RECOVERING:
+		default:
+			log.Println("Replica", r.id, "joined its group in epoch", r.Epoch())
+			return nil
+		}
+		if now := r.clock.Now(); now.Sub(pulled) >= viewChangeTimeout {
+			pulled = now
+			r.pull(true)
+			continue
+		}
+		r.clock.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Current epoch of the replica
+func (r *IRReplicaImpl) Epoch() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.epoch
+}
+
+// Whether the message comes from another epoch. A sender in an earlier epoch
+// gets the state of this replica, for a later one this replica catches up.
+// Must hold r.mu.
+func (r *IRReplicaImpl) otherEpoch(args *ViewChangeMessage) bool {
+	if args.Epoch < r.epoch {
+		if r.status == STATUS_NORMAL {
+			msg := r.startViewMessage()
+			r.clock.Go(func() { r.sendStartView(args.ReplicaID, msg) })
+		}
+		return true
+	}
+	if args.Epoch > r.epoch {
+		r.catchUp()
+		return true
+	}
+	return false
+}
+
+// Take on the group another replica moves to, unless this one already
+// moves elsewhere. Must hold r.mu.
+func (r *IRReplicaImpl) adopt(next map[int]*ReplicaAddress) {
+	if next == nil || r.pending != nil || checkMembers(r.peers, next) != nil {
+		return
+	}
+	r.pending = next
+}
+
+// Move to the given epoch and group, must hold r.mu
+func (r *IRReplicaImpl) setMembers(epoch int, members map[int]*ReplicaAddress) {
+	r.epoch = epoch
+	r.peers = members
+	r.f = (len(members) - 1) / 2
+	for id, addr := range members {
+		r.addrs[id] = addr
+	}
+	log.Println("Replica", r.id, "in epoch", epoch, "with replicas", memberIDs(members))
+}
+
+// Hand the master record of msg to the old group until f+1 of its members
+// have it, then start the view in the new epoch. If that takes longer than
+// a view change, the new group starts the next view on its own.
+func (r *IRReplicaImpl) endEpoch(msg *ViewChangeMessage, old map[int]*ReplicaAddress, f int) {
+	handed := map[int]bool{r.id: true}
+	deadline := r.clock.Now().Add(viewChangeTimeout)
+	for len(handed) < f+1 {
+		if !r.clock.Now().Before(deadline) {
+			log.Println("Replica", r.id, "could not end epoch", msg.Epoch-1, "with", len(handed), "old replicas")
+			return
+		}
+		for _, id := range memberIDs(old) {
+			if handed[id] {
+				continue
+			}
+			reply := ViewChangeMessage{}
+			if err := r.transport.Call(id, old[id], "EndEpoch", msg, &reply); err == nil && reply.Epoch >= msg.Epoch {
+				handed[id] = true
+			}
+		}
+		if len(handed) < f+1 {
+			r.clock.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	r.mu.Lock()
+	if r.epoch != msg.Epoch || r.view != msg.View || r.status == STATUS_STOPPED {
+		r.mu.Unlock()
+		return
+	}
+	if r.status == STATUS_VIEW_CHANGING {
+		r.status = STATUS_NORMAL
+	}
+	r.mu.Unlock()
+	for _, id := range memberIDs(msg.Members) {
+		if id != r.id {
+			r.clock.Go(func() { r.sendStartView(id, msg) })
+		}
+	}
+	log.Println("Replica", r.id, "started epoch", msg.Epoch, "in view", msg.View)
+}
+
+// Bring a replica that missed the start of an epoch up to date in the
+// background, must hold r.mu
+func (r *IRReplicaImpl) catchUp() {
+	if r.catchingUp || r.status == STATUS_STOPPED {
+		return
+	}
+	r.catchingUp = true
+	r.clock.Go(func() {
+		r.pull(false)
+		r.mu.Lock()
+		r.catchingUp = false
+		r.mu.Unlock()
+	})
+}
+
+// Install the state of the first known replica in a later epoch, one whose
+// group has this replica if joining. Returns whether there was one.
+func (r *IRReplicaImpl) pull(joining bool) bool {
+	r.mu.Lock()
+	epoch := r.epoch
+	ids := memberIDs(r.addrs)
+	r.mu.Unlock()
+	for _, id := range ids {
+		if id == r.id {
+			continue
+		}
+		state := ViewChangeMessage{}
+		args := &ViewChangeMessage{Epoch: epoch, ReplicaID: r.id, Recovering: joining}
+		if err := r.callPeer(id, "GetState", args, &state); err != nil || state.Epoch <= epoch {
+			continue
+		}
+		if joining && state.Members[r.id] == nil {
+			continue
+		}
+		r.mu.Lock()
+		if r.status != STATUS_STOPPED && state.Epoch > r.epoch {
+			// A retired replica is no longer in the view, the group starts
+			// the next one
+			r.install(&state, state.Members[state.ReplicaID] != nil)
+			log.Println("Replica", r.id, "caught up with replica", id, "in epoch", r.epoch)
+		}
+		r.mu.Unlock()
+		return true
+	}
+	return false
+}
+
+// Error if a group can't take over from old: f+1 of its replicas must be in
+// old, so they bring the master record along
+func checkMembers(old, next map[int]*ReplicaAddress) error {
+	if len(next) == 0 {
+		return errors.New("a replica group needs replicas")
+	}
+	shared := 0
+	for id, addr := range next {
+		if addr == nil {
+			return fmt.Errorf("replica %d has no address", id)
+		}
+		if old[id] != nil {
+			shared++
+		}
+	}
+	if f := (len(next) - 1) / 2; shared < f+1 {
+		return fmt.Errorf("replicas %v share %d replicas with %v, at least %d are needed", memberIDs(next), shared, memberIDs(old), f+1)
+	}
+	return nil
+}
+
+// Whether two groups have the same replicas at the same addresses
+func sameMembers(a, b map[int]*ReplicaAddress) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for id, addr := range a {
+		if b[id] == nil || addr == nil || *b[id] != *addr {
+			return false
+		}
+	}
+	return true
+}
+
+// Ids of a group in order
+func memberIDs(members map[int]*ReplicaAddress) []int {
+	ids := make([]int, 0, len(members))
+	for id := range members {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
@@ -8,6 +8,14 @@ import (
 type IRReplica interface {
 	// Handle requests
 	HandleOperation(request *Message, reply *Message) error
+	// Rebuild the record from the other replicas after a restart
+	Recover() error
+	// Wait until a reconfiguration adds the replica to its group
+	Join() error
+	// Current view number
+	View() int
+	// Current epoch, raised by every reconfiguration of the group
+	Epoch() int
 	// Stop the server
 	Stop()
 }
@@ -22,4 +30,18 @@ type IRAppReplica interface {
 
 	// Invoke unlogged operation (only support read)
 	ExecUnloggedUpcall(op *Request) (*Response, error)
+
+	// Bring the application state up to date with the given entries of the master record
+	Sync(record *Record) error
+
+	// Decide results for tentative consensus operations during a view change,
+	// d holds operations with a majority result, u holds the rest
+	Merge(d, u []*RecordEntry) (map[OpID]*Response, error)
+
+	// Encode the application state, it covers every operation executed so far
+	Checkpoint() ([]byte, error)
+
+	// Bring the application state up to a checkpoint of this or another
+	// replica, keeping the effects of operations it doesn't cover
+	Restore(checkpoint []byte) error
 }
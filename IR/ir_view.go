@@ -0,0 +1,361 @@
+package IR
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	. "github.com/ViolaChenYT/TAPIR/common"
+)
+
+const (
+	viewChangeTimeout = 2 * time.Second  // start the next view if the leader does not respond
+	recoveryTimeout   = 10 * time.Second // give up on recovery after this long
+)
+
+// ViewChangeMessage is exchanged between replicas during view changes,
+// recovery and reconfiguration
+type ViewChangeMessage struct {
+	View       int
+	Epoch      int // epoch of the sender, of the view being started for StartView and EndEpoch
+	ReplicaID  int
+	LastNormal int  // latest view in which the sender was in normal status
+	Recovering bool // sender lost its record and can't contribute to the merge
+	Record     []*RecordEntry
+
+	Members map[int]*ReplicaAddress // replica group of Epoch
+	Next    map[int]*ReplicaAddress // replica group the view change moves to, nil if it keeps the group
+
+	// Checkpoint of the sender that holds entries its record lacks, 0 if
+	// its record is complete
+	Checkpoint int
+}
+
+// Leader of the given view, replicas take turns in order of their ids
+func (r *IRReplicaImpl) leader(view int) int {
+	ids := r.peerIDs()
+	return ids[view%len(ids)]
+}
+
+// Ids of every replica of the group in order
+func (r *IRReplicaImpl) peerIDs() []int {
+	return memberIDs(r.peers)
+}
+
+// GetView reports the current view of this replica
+func (r *IRReplicaImpl) GetView(args *ViewChangeMessage, reply *ViewChangeMessage) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.status == STATUS_RECOVERING || r.status == STATUS_STOPPED {
+		return fmt.Errorf("replica %d is recovering or stopped", r.id)
+	}
+	reply.View = r.view
+	reply.Epoch = r.epoch
+	reply.ReplicaID = r.id
+	reply.Members = r.peers
+	return nil
+}
+
+// StartViewChange moves this replica into the given view and sends its record to the new leader
+func (r *IRReplicaImpl) StartViewChange(args *ViewChangeMessage, reply *ViewChangeMessage) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.otherEpoch(args) || args.View <= r.view || r.status == STATUS_STOPPED || r.status == STATUS_RETIRED {
+		return nil
+	}
+	r.adopt(args.Next)
+	r.enterViewChange(args.View)
+	return nil
+}
+
+// DoViewChange is handled by the leader of the new view, once f+1 records
+// have arrived the leader merges them and starts the view
+func (r *IRReplicaImpl) DoViewChange(args *ViewChangeMessage, reply *ViewChangeMessage) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.otherEpoch(args) || args.View < r.view || r.leader(args.View) != r.id || r.status == STATUS_STOPPED || r.status == STATUS_RETIRED {
+		return nil
+	}
+	if args.View > r.view {
+		r.enterViewChange(args.View)
+	}
+	if r.status == STATUS_NORMAL {
+		// View already started, bring the sender up to date
+		msg := r.startViewMessage()
+		r.clock.Go(func() { r.sendStartView(args.ReplicaID, msg) })
+		return nil
+	}
+	if r.viewChanges[args.View] == nil {
+		r.viewChanges[args.View] = make(map[int]*ViewChangeMessage)
+	}
+	r.viewChanges[args.View][args.ReplicaID] = args
+
+	var records []*ViewChangeMessage
+	latest := -1
+	next := r.pending
+	for _, id := range r.peerIDs() {
+		msg, ok := r.viewChanges[args.View][id]
+		if !ok || msg.Recovering {
+			continue
+		}
+		records = append(records, msg)
+		if msg.LastNormal > latest {
+			latest = msg.LastNormal
+		}
+		if next == nil {
+			next = msg.Next
+		}
+	}
+	if len(records) < r.f+1 {
+		return nil
+	}
+
+	// Only merge records from the latest normal view
+	var merging [][]*RecordEntry
+	for _, msg := range records {
+		if msg.LastNormal == latest {
+			merging = append(merging, msg.Record)
+		}
+		// Entries a checkpoint replaced are not in the merge
+		r.restoreCheckpoint(msg.ReplicaID, msg.Checkpoint)
+	}
+	master, d, u := mergeRecords(merging, r.f)
+	if err := r.app.Sync(r.missingEntries(master)); err != nil {
+		log.Println("Sync error: ", err)
+	}
+	results, err := r.app.Merge(d, u)
+	if err != nil {
+		log.Println("Merge error: ", err)
+	}
+	for _, entry := range append(d, u...) {
+		decided := *entry
+		decided.State = FINALIZED
+		if result, ok := results[entry.ID]; ok {
+			decided.Result = result
+		}
+		master.put(&decided)
+	}
+	delete(r.viewChanges, args.View)
+	if next != nil {
+		// The view ends the epoch, the new group starts once the old one
+		// can't start another view
+		old, f := r.peers, r.f
+		r.setMembers(r.epoch+1, next)
+		r.installView(args.View, master)
+		r.status = STATUS_VIEW_CHANGING
+		if r.peers[r.id] == nil {
+			r.status = STATUS_RETIRED
+		}
+		msg := r.startViewMessage()
+		r.clock.Go(func() { r.endEpoch(msg, old, f) })
+		return nil
+	}
+	r.installView(args.View, master)
+
+	msg := r.startViewMessage()
+	for _, id := range r.peerIDs() {
+		if id != r.id {
+			r.clock.Go(func() { r.sendStartView(id, msg) })
+		}
+	}
+	log.Println("Replica", r.id, "started view", r.view, "with", master.Len(), "entries")
+	return nil
+}
+
+// StartView installs the master record sent by the leader of the new view
+func (r *IRReplicaImpl) StartView(args *ViewChangeMessage, reply *ViewChangeMessage) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if args.Epoch < r.epoch || r.status == STATUS_STOPPED {
+		return nil
+	}
+	if args.Epoch == r.epoch && (args.View < r.view || (args.View == r.view && r.status == STATUS_NORMAL) || r.status == STATUS_RETIRED) {
+		return nil
+	}
+	r.install(args, true)
+	log.Println("Replica", r.id, "joined view", r.view, "in epoch", r.epoch)
+	return nil
+}
+
+// Install the master record of a view in the epoch and group of msg.
+// Replicas not in the group retire, one that is not normal yet starts the
+// next view if no StartView follows. Must hold r.mu.
+func (r *IRReplicaImpl) install(msg *ViewChangeMessage, normal bool) {
+	master := NewRecord(msg.Record)
+	r.restoreCheckpoint(msg.ReplicaID, msg.Checkpoint)
+	if err := r.app.Sync(r.missingEntries(master)); err != nil {
+		log.Println("Sync error: ", err)
+	}
+	if msg.Epoch != r.epoch {
+		r.setMembers(msg.Epoch, msg.Members)
+	}
+	r.installView(msg.View, master)
+	if r.peers[r.id] == nil {
+		r.status = STATUS_RETIRED
+	} else if !normal {
+		r.status = STATUS_VIEW_CHANGING
+		r.watchView(msg.View)
+	}
+}
+
+// Recover rebuilds the record of a restarted replica by forcing a view change
+func (r *IRReplicaImpl) Recover() error {
+	r.mu.Lock()
+	r.status = STATUS_RECOVERING
+	r.record = emptyRecord()
+	r.mu.Unlock()
+
+	// Learn the current view from f+1 other replicas, and the group of the
+	// latest epoch one of them is in
+	view, epoch, replies := 0, r.epoch, 0
+	var members map[int]*ReplicaAddress
+	for _, id := range r.peerIDs() {
+		if id == r.id {
+			continue
+		}
+		reply := ViewChangeMessage{}
+		if err := r.callPeer(id, "GetView", &ViewChangeMessage{ReplicaID: r.id}, &reply); err != nil {
+			continue
+		}
+		replies++
+		if reply.Epoch > epoch {
+			view, epoch, members = 0, reply.Epoch, reply.Members
+		}
+		if reply.Epoch == epoch && reply.View > view {
+			view = reply.View
+		}
+	}
+	if replies < r.f+1 {
+		return errors.New(fmt.Sprintf("replica %d can't reach f+1 replicas to recover", r.id))
+	}
+
+	r.mu.Lock()
+	if members != nil {
+		r.setMembers(epoch, members)
+	}
+	if r.peers[r.id] == nil {
+		r.status = STATUS_RETIRED
+		r.mu.Unlock()
+		return errors.New(fmt.Sprintf("replica %d is no longer in its group", r.id))
+	}
+	r.view = view
+	r.enterViewChange(view + 1)
+	r.mu.Unlock()
+
+	deadline := r.clock.Now().Add(recoveryTimeout)
+	for r.clock.Now().Before(deadline) {
+		r.mu.Lock()
+		status := r.status
+		r.mu.Unlock()
+		if status == STATUS_NORMAL {
+			return nil
+		}
+		r.clock.Sleep(10 * time.Millisecond)
+	}
+	return errors.New(fmt.Sprintf("replica %d timed out while recovering", r.id))
+}
+
+// Move into a new view and send our record to its leader, must hold r.mu
+func (r *IRReplicaImpl) enterViewChange(view int) {
+	r.view = view
+	if r.status != STATUS_RECOVERING {
+		r.status = STATUS_VIEW_CHANGING
+	}
+	msg := ViewChangeMessage{
+		View:       view,
+		Epoch:      r.epoch,
+		ReplicaID:  r.id,
+		LastNormal: r.lastNormal,
+		Recovering: r.status == STATUS_RECOVERING,
+		Next:       r.pending,
+	}
+	if !msg.Recovering {
+		msg.Record = r.record.Entries()
+		msg.Checkpoint = r.truncatedAt()
+	}
+	leader := r.leader(view)
+	peers := r.peerIDs()
+
+	r.clock.Go(func() {
+		// Tell everyone else about the new view
+		for _, id := range peers {
+			if id != r.id {
+				r.callPeer(id, "StartViewChange", &ViewChangeMessage{View: view, Epoch: msg.Epoch, ReplicaID: r.id, Next: msg.Next}, &ViewChangeMessage{})
+			}
+		}
+		if leader == r.id {
+			r.DoViewChange(&msg, &ViewChangeMessage{})
+		} else {
+			r.callPeer(leader, "DoViewChange", &msg, &ViewChangeMessage{})
+		}
+	})
+
+	r.watchView(view)
+}
+
+// Move on to the next view if this one never starts
+func (r *IRReplicaImpl) watchView(view int) {
+	r.clock.Go(func() {
+		r.clock.Sleep(viewChangeTimeout)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.view == view && (r.status == STATUS_VIEW_CHANGING || r.status == STATUS_RECOVERING) {
+			log.Println("Replica", r.id, "view", view, "timed out")
+			r.enterViewChange(view + 1)
+		}
+	})
+}
+
+// Replace the record and resume normal processing, must hold r.mu
+func (r *IRReplicaImpl) installView(view int, master *Record) {
+	r.record = master
+	r.view = view
+	r.lastNormal = view
+	r.status = STATUS_NORMAL
+	r.pending = nil
+	r.trackFinalized()
+	r.rewriteLog()
+}
+
+// Entries of the master record that this replica does not have in the same final state
+func (r *IRReplicaImpl) missingEntries(master *Record) *Record {
+	missing := emptyRecord()
+	for _, entry := range master.Entries() {
+		local, ok := r.record.Get(entry.ID)
+		if ok && local.State == FINALIZED && SameResult(local.Result, entry.Result) {
+			continue
+		}
+		missing.put(entry)
+	}
+	return missing
+}
+
+func (r *IRReplicaImpl) startViewMessage() *ViewChangeMessage {
+	return &ViewChangeMessage{
+		View:       r.view,
+		Epoch:      r.epoch,
+		ReplicaID:  r.id,
+		LastNormal: r.lastNormal,
+		Record:     r.record.Entries(),
+		Members:    r.peers,
+		Checkpoint: r.truncatedAt(),
+	}
+}
+
+func (r *IRReplicaImpl) sendStartView(id int, msg *ViewChangeMessage) {
+	if err := r.callPeer(id, "StartView", msg, &ViewChangeMessage{}); err != nil {
+		log.Println("Replica", r.id, "failed to send StartView to", id, err)
+	}
+}
+
+// Call a method on another replica
+func (r *IRReplicaImpl) callPeer(id int, method string, args interface{}, reply interface{}) error {
+	r.mu.Lock()
+	addr := r.addrs[id]
+	r.mu.Unlock()
+	if addr == nil {
+		return errors.New(fmt.Sprintf("replica %d doesn't know the address of replica %d", r.id, id))
+	}
+	return r.transport.Call(id, addr, method, args, reply)
+}
@@ -0,0 +1,148 @@
+// Command tapir-client runs a transaction on the cluster described by a
+// cluster configuration file. The operations on the command line run in
+// order in one transaction, which is retried while it aborts.
+//
+//	tapir-client -config cluster.yaml -id 1 put x 1 put y 2
+//	tapir-client -config cluster.yaml -id 1 get x scan a 10
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/ViolaChenYT/TAPIR/common"
+	"github.com/ViolaChenYT/TAPIR/tapir_kv"
+)
+
+// An operation of the transaction and the arguments it takes
+type operation struct {
+	name string
+	args []string
+}
+
+func main() {
+	configFile := flag.String("config", "cluster.yaml", "cluster configuration file, JSON or YAML")
+	id := flag.Int("id", 0, "id of the client in the cluster configuration file")
+	timeout := flag.Duration("timeout", 10*time.Second, "give up on the transaction after this long")
+	verbose := flag.Bool("v", false, "log what the client does")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] op...\n\nops: get KEY, put KEY VALUE, scan START COUNT\n\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if !*verbose {
+		log.SetOutput(io.Discard)
+	}
+
+	ops, err := parse(flag.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		os.Exit(2)
+	}
+	file, err := common.LoadClusterFile(*configFile)
+	if err != nil {
+		fail(err)
+	}
+	config, err := file.ClientConfiguration(*id)
+	if err != nil {
+		fail(err)
+	}
+	client, err := tapir_kv.NewTapirClient(config)
+	if err != nil {
+		fail(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	var output []string
+	_, err = client.RunTxn(ctx, func(txn *tapir_kv.Txn) error {
+		// Only the output of the attempt that commits is printed
+		output = nil
+		for _, op := range ops {
+			lines, err := run(ctx, txn, op)
+			if err != nil {
+				return err
+			}
+			output = append(output, lines...)
+		}
+		return nil
+	})
+	// The commit or abort must reach the replicas before the process exits
+	client.Close()
+	if err != nil {
+		fail(err)
+	}
+	for _, line := range output {
+		fmt.Println(line)
+	}
+}
+
+// Split the command line into operations
+func parse(args []string) ([]operation, error) {
+	if len(args) == 0 {
+		return nil, errors.New("no operations")
+	}
+	var ops []operation
+	for len(args) > 0 {
+		n := 0
+		switch args[0] {
+		case "get":
+			n = 1
+		case "put", "scan":
+			n = 2
+		default:
+			return nil, fmt.Errorf("unknown operation %q", args[0])
+		}
+		if len(args) < n+1 {
+			return nil, fmt.Errorf("%s takes %d arguments", args[0], n)
+		}
+		ops = append(ops, operation{name: args[0], args: args[1 : n+1]})
+		args = args[n+1:]
+	}
+	return ops, nil
+}
+
+// Run an operation in the transaction, returns the lines it prints
+func run(ctx context.Context, txn *tapir_kv.Txn, op operation) ([]string, error) {
+	switch op.name {
+	case "get":
+		val, err := txn.ReadContext(ctx, op.args[0])
+		if errors.Is(err, common.ErrKeyNotFound) {
+			return []string{op.args[0] + " not found"}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return []string{op.args[0] + " = " + val}, nil
+	case "put":
+		return nil, txn.WriteContext(ctx, op.args[0], op.args[1])
+	case "scan":
+		count, err := strconv.Atoi(op.args[1])
+		if err != nil {
+			return nil, fmt.Errorf("scan count: %w", err)
+		}
+		rows, err := txn.ScanContext(ctx, op.args[0], count)
+		if err != nil {
+			return nil, err
+		}
+		var lines []string
+		for _, row := range rows {
+			lines = append(lines, row.Key+" = "+row.Value)
+		}
+		return lines, nil
+	}
+	return nil, fmt.Errorf("unknown operation %q", op.name)
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
@@ -0,0 +1,75 @@
+// Command tapir-reconfigure moves the shards of a running cluster to the
+// replicas of another cluster configuration file. Replicas that join must
+// run with tapir-replica -join first, the ones that leave retire and can be
+// stopped once it returns.
+//
+//	tapir-reconfigure -config cluster.yaml -id 1 -to next.yaml
+//
+// f+1 replicas of every new group must be in the old one, so replace a
+// replica at a time and run the clients with the new file afterwards.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/ViolaChenYT/TAPIR/IR"
+	"github.com/ViolaChenYT/TAPIR/common"
+)
+
+func main() {
+	configFile := flag.String("config", "cluster.yaml", "cluster configuration file the cluster runs with")
+	id := flag.Int("id", 0, "id of a client in the cluster configuration file")
+	toFile := flag.String("to", "", "cluster configuration file to move to")
+	timeout := flag.Duration("timeout", 30*time.Second, "give up on a shard after this long")
+	flag.Parse()
+	if *toFile == "" {
+		fmt.Fprintln(os.Stderr, "-to is required")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	file, err := common.LoadClusterFile(*configFile)
+	if err != nil {
+		fail(err)
+	}
+	config, err := file.ClientConfiguration(*id)
+	if err != nil {
+		fail(err)
+	}
+	next, err := common.LoadClusterFile(*toFile)
+	if err != nil {
+		fail(err)
+	}
+	nextConfig, err := next.Configuration()
+	if err != nil {
+		fail(err)
+	}
+	if nextConfig.NumShards() != config.NumShards() {
+		fail(fmt.Errorf("%s has %d shards, %s has %d", *toFile, nextConfig.NumShards(), *configFile, config.NumShards()))
+	}
+
+	for i := 0; i < config.NumShards(); i++ {
+		client, err := IR.NewIRClient(config.Shard(i))
+		if err != nil {
+			fail(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		err = client.Reconfigure(ctx, nextConfig.Shard(i).Replicas)
+		cancel()
+		if err != nil {
+			fail(fmt.Errorf("shard %d: %w", i, err))
+		}
+		ids, _ := client.Members()
+		log.Println("Shard", i, "in epoch", client.Epoch(), "with replicas", ids)
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
@@ -0,0 +1,68 @@
+// Command tapir-replica runs one replica of the cluster described by a
+// cluster configuration file, until it is interrupted.
+//
+//	tapir-replica -config cluster.yaml -id 1
+//
+// A replica added to a running cluster starts with -join and the cluster
+// file that has it, before tapir-reconfigure moves its shard to that file.
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/ViolaChenYT/TAPIR/IR"
+	"github.com/ViolaChenYT/TAPIR/common"
+	"github.com/ViolaChenYT/TAPIR/tapir_kv"
+)
+
+func main() {
+	configFile := flag.String("config", "cluster.yaml", "cluster configuration file, JSON or YAML")
+	id := flag.Int("id", -1, "id of the replica to run")
+	recoverLog := flag.Bool("recover", false, "rebuild the replica from the others, for a replica that lost its state")
+	join := flag.Bool("join", false, "wait for tapir-reconfigure to add the replica to a running cluster")
+	flag.Parse()
+
+	file, err := common.LoadClusterFile(*configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	config, err := file.Configuration()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if config.Replicas[*id] == nil {
+		log.Fatalf("no replica %d in %s", *id, *configFile)
+	}
+
+	app, err := tapir_kv.NewTapirServerWithConfig(*id, config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	replica, err := IR.NewIRReplicaWithConfig(*id, config, app)
+	if err != nil {
+		app.(*tapir_kv.TapirServer).Close()
+		log.Fatal(err)
+	}
+	if *recoverLog {
+		if err := replica.Recover(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *join {
+		go func() {
+			if err := replica.Join(); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+	log.Println("Replica", *id, "serving on", config.Replicas[*id].SpecificString())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	replica.Stop()
+}
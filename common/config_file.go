@@ -0,0 +1,136 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ClusterFile is the layout of a cluster configuration file, for example
+//
+//	f: 1
+//	replicas:
+//	  - {id: 1, address: "10.0.0.1:7001"}
+//	  - {id: 2, address: "10.0.0.2:7001"}
+//	  - {id: 3, address: "10.0.0.3:7001"}
+//	clients:
+//	  - {id: 1, ir_id: 1, closest_replica: 1}
+//
+// Every replica and client process of a deployment reads the same file.
+type ClusterFile struct {
+	F        int           `json:"f" yaml:"f"` // failures every replica group tolerates, (n-1)/2 of the group if left out
+	Replicas []ReplicaFile `json:"replicas" yaml:"replicas"`
+	Shards   [][]int       `json:"shards,omitempty" yaml:"shards,omitempty"` // replica ids of each shard, left out for a single group
+	Clients  []ClientFile  `json:"clients,omitempty" yaml:"clients,omitempty"`
+	DataDir  string        `json:"data_dir,omitempty" yaml:"data_dir,omitempty"` // replicas keep their state in memory only if left out
+}
+
+type ReplicaFile struct {
+	ID      int    `json:"id" yaml:"id"`
+	Address string `json:"address" yaml:"address"` // host:port the replica listens on
+}
+
+type ClientFile struct {
+	ID             int `json:"id" yaml:"id"`
+	IRID           int `json:"ir_id" yaml:"ir_id"`
+	ClosestReplica int `json:"closest_replica" yaml:"closest_replica"`
+}
+
+// LoadClusterFile reads a cluster configuration file, JSON if its name ends
+// in .json and YAML otherwise. Unknown fields are errors, so a typo doesn't
+// go unnoticed.
+func LoadClusterFile(path string) (*ClusterFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	file := &ClusterFile{}
+	if strings.HasSuffix(path, ".json") {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(file)
+	} else {
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		err = decoder.Decode(file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return file, nil
+}
+
+// Configuration of the cluster for a replica process, it has no client
+func (f *ClusterFile) Configuration() (*Configuration, error) {
+	if len(f.Replicas) == 0 {
+		return nil, errors.New("no replicas in the cluster file")
+	}
+	replicas := make(map[int]*ReplicaAddress)
+	for _, replica := range f.Replicas {
+		if _, ok := replicas[replica.ID]; ok {
+			return nil, fmt.Errorf("replica %d is listed twice", replica.ID)
+		}
+		host, port, err := net.SplitHostPort(replica.Address)
+		if err != nil {
+			return nil, fmt.Errorf("replica %d: %w", replica.ID, err)
+		}
+		replicas[replica.ID] = NewReplicaAddress(host, port)
+	}
+
+	var groups []map[int]*ReplicaAddress
+	for i, ids := range f.Shards {
+		group := make(map[int]*ReplicaAddress)
+		for _, id := range ids {
+			if replicas[id] == nil {
+				return nil, fmt.Errorf("shard %d: unknown replica %d", i, id)
+			}
+			group[id] = replicas[id]
+		}
+		groups = append(groups, group)
+	}
+	config := NewConfiguration(nil, replicas)
+	if groups != nil {
+		config = NewShardedConfiguration(nil, groups)
+		if config.N != len(replicas) {
+			return nil, errors.New("every replica must be in exactly one shard")
+		}
+	}
+	for i := 0; i < config.NumShards(); i++ {
+		if group := config.Shard(i); group.N < 2*f.F+1 {
+			return nil, fmt.Errorf("shard %d has %d replicas, f=%d needs %d", i, group.N, f.F, 2*f.F+1)
+		}
+	}
+	if f.F > 0 {
+		// Every shard tolerates f failures
+		if groups == nil {
+			config.F = f.F
+		} else {
+			config.ShardF = f.F
+		}
+	}
+	if f.DataDir != "" {
+		config.Storage = NewStorageConfiguration(f.DataDir)
+	}
+	return config, nil
+}
+
+// Configuration of the cluster for the client with the given id
+func (f *ClusterFile) ClientConfiguration(id int) (*Configuration, error) {
+	config, err := f.Configuration()
+	if err != nil {
+		return nil, err
+	}
+	for _, client := range f.Clients {
+		if client.ID == id {
+			config.Client = NewClientConfiguration(client.ID, client.IRID, client.ClosestReplica)
+			return config, nil
+		}
+	}
+	return nil, fmt.Errorf("no client %d in the cluster file", id)
+}
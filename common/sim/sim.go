@@ -0,0 +1,282 @@
+package sim
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"math/rand"
+	"runtime/debug"
+	"time"
+
+	. "github.com/ViolaChenYT/TAPIR/common"
+	"github.com/ViolaChenYT/TAPIR/common/transport"
+)
+
+const DefaultMaxTime = time.Hour // virtual time a run may take before it is considered stuck
+
+// Virtual time every simulation starts at
+var Epoch = time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// Simulator runs clients and replicas on a virtual clock. Goroutines started
+// on it run one at a time and only the simulator decides which one runs next
+// and how long a message takes, from a seed, so a run replays exactly.
+//
+// Every goroutine of the deployment has to be started through Go and wait
+// through Sleep or a Signal, it implements Clock for this. A goroutine that
+// blocks on anything else blocks the whole simulation.
+type Simulator struct {
+	seed    int64
+	rand    *rand.Rand
+	now     time.Time
+	seq     int        // orders events at the same time
+	events  eventQueue // timers, in order of when they fire
+	ready   []*task    // goroutines that can run
+	live    []*task    // goroutines that have not returned
+	current *task      // goroutine running right now, nil while the scheduler runs
+	yield   chan bool  // the running goroutine gives control back
+	failure error      // first panic of a goroutine
+	stopped bool       // set by Close, parked goroutines unwind
+	network *transport.FaultyNetwork
+
+	MaxTime time.Duration
+}
+
+// A goroutine of the simulation
+type task struct {
+	resume chan bool
+	done   bool
+	woken  bool // whether the last signal wait ended with a notify
+}
+
+type event struct {
+	at        time.Time
+	seq       int
+	fn        func()
+	cancelled bool
+}
+
+// Panic unwinding goroutines that were parked when the simulator closed
+type stopped struct{}
+
+func New(seed int64) *Simulator {
+	s := &Simulator{
+		seed:    seed,
+		rand:    rand.New(rand.NewSource(seed)),
+		now:     Epoch,
+		yield:   make(chan bool),
+		MaxTime: DefaultMaxTime,
+	}
+	s.network = transport.NewFaultyNetworkWithClock(s.rand.Int63(), s)
+	return s
+}
+
+func (s *Simulator) Seed() int64 {
+	return s.seed
+}
+
+// Network of the simulation, messages on it take virtual time
+func (s *Simulator) Network() *transport.FaultyNetwork {
+	return s.network
+}
+
+// Random source of the simulation, workloads drawing from it replay with
+// the rest of the run. Only use it from goroutines of the simulation.
+func (s *Simulator) Rand() *rand.Rand {
+	return s.rand
+}
+
+// Run main as the first goroutine of the simulation and schedule every
+// goroutine until main returns. Returns an error if a goroutine panicked,
+// every goroutine is blocked or the virtual time limit passed.
+func (s *Simulator) Run(main func()) error {
+	finished := false
+	s.Go(func() {
+		main()
+		finished = true
+	})
+	for !finished && s.failure == nil {
+		if len(s.ready) > 0 {
+			// Any ready goroutine may run next, the seed picks one
+			i := s.rand.Intn(len(s.ready))
+			t := s.ready[i]
+			s.ready = append(s.ready[:i], s.ready[i+1:]...)
+			s.current = t
+			t.resume <- true
+			<-s.yield
+			s.current = nil
+			continue
+		}
+		if s.events.Len() == 0 {
+			return errors.New(fmt.Sprintf("seed %d: every goroutine is blocked at %v", s.seed, s.Elapsed()))
+		}
+		e := heap.Pop(&s.events).(*event)
+		if e.cancelled {
+			continue
+		}
+		if e.at.After(s.now) {
+			s.now = e.at
+		}
+		if s.Elapsed() > s.MaxTime {
+			return errors.New(fmt.Sprintf("seed %d: still running after %v", s.seed, s.MaxTime))
+		}
+		e.fn()
+	}
+	return s.failure
+}
+
+// Virtual time since the start of the simulation
+func (s *Simulator) Elapsed() time.Duration {
+	return s.now.Sub(Epoch)
+}
+
+// Unwind every goroutine still parked, the simulator can't run again
+func (s *Simulator) Close() {
+	s.stopped = true
+	for len(s.live) > 0 {
+		t := s.live[0]
+		s.live = s.live[1:]
+		if t.done {
+			continue
+		}
+		s.current = t
+		t.resume <- true
+		<-s.yield
+		s.current = nil
+	}
+}
+
+func (s *Simulator) Now() time.Time {
+	return s.now
+}
+
+func (s *Simulator) Sleep(d time.Duration) {
+	t := s.running()
+	s.after(d, func() { s.wake(t) })
+	s.park(t)
+}
+
+func (s *Simulator) Go(f func()) {
+	t := &task{resume: make(chan bool)}
+	s.live = append(s.live, t)
+	go func() {
+		<-t.resume
+		defer func() {
+			if r := recover(); r != nil {
+				if _, ok := r.(stopped); !ok && s.failure == nil {
+					s.failure = errors.New(fmt.Sprintf("seed %d: panic at %v: %v\n%s", s.seed, s.Elapsed(), r, debug.Stack()))
+				}
+			}
+			t.done = true
+			s.yield <- true
+		}()
+		if s.stopped {
+			return
+		}
+		f()
+	}()
+	s.wake(t)
+}
+
+func (s *Simulator) NewSignal() Signal {
+	return &signal{sim: s}
+}
+
+// The goroutine running right now
+func (s *Simulator) running() *task {
+	if s.current == nil {
+		panic("sim: blocking call outside of a goroutine of the simulation")
+	}
+	return s.current
+}
+
+// Give control back to the scheduler until t is resumed
+func (s *Simulator) park(t *task) {
+	s.yield <- true
+	<-t.resume
+	if s.stopped {
+		panic(stopped{})
+	}
+}
+
+func (s *Simulator) wake(t *task) {
+	s.ready = append(s.ready, t)
+}
+
+// Run fn from the scheduler once d of virtual time passed
+func (s *Simulator) after(d time.Duration, fn func()) *event {
+	s.seq++
+	e := &event{at: s.now.Add(d), seq: s.seq, fn: fn}
+	heap.Push(&s.events, e)
+	return e
+}
+
+// signal is a Signal on the virtual clock, for one waiter at a time
+type signal struct {
+	sim     *Simulator
+	pending bool
+	waiter  *task
+	timeout *event
+}
+
+func (g *signal) Notify() {
+	if g.waiter == nil {
+		g.pending = true
+		return
+	}
+	t := g.waiter
+	g.waiter = nil
+	if g.timeout != nil {
+		g.timeout.cancelled = true
+		g.timeout = nil
+	}
+	t.woken = true
+	g.sim.wake(t)
+}
+
+func (g *signal) Wait(timeout time.Duration) bool {
+	if g.pending {
+		g.pending = false
+		return true
+	}
+	t := g.sim.running()
+	g.waiter = t
+	t.woken = false
+	if timeout > 0 {
+		g.timeout = g.sim.after(timeout, func() {
+			g.waiter = nil
+			g.timeout = nil
+			g.sim.wake(t)
+		})
+	}
+	g.sim.park(t)
+	return t.woken
+}
+
+// eventQueue is a heap of events by time, then by the order they were added
+type eventQueue []*event
+
+func (q eventQueue) Len() int {
+	return len(q)
+}
+
+func (q eventQueue) Less(i, j int) bool {
+	if !q[i].at.Equal(q[j].at) {
+		return q[i].at.Before(q[j].at)
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q eventQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+}
+
+func (q *eventQueue) Push(x interface{}) {
+	*q = append(*q, x.(*event))
+}
+
+func (q *eventQueue) Pop() interface{} {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return e
+}
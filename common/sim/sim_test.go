@@ -0,0 +1,127 @@
+package sim
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Run a few goroutines that sleep, signal each other and draw random
+// numbers, and return what happened in order
+func trace(t *testing.T, seed int64) []string {
+	s := New(seed)
+	defer s.Close()
+	var events []string
+	err := s.Run(func() {
+		done := s.NewSignal()
+		finished := 0
+		for i := 0; i < 5; i++ {
+			s.Go(func() {
+				for j := 0; j < 3; j++ {
+					s.Sleep(time.Duration(s.Rand().Intn(10)) * time.Millisecond)
+					events = append(events, fmt.Sprintf("%d.%d at %v", i, j, s.Elapsed()))
+				}
+				finished++
+				done.Notify()
+			})
+		}
+		for finished < 5 {
+			done.Wait(0)
+		}
+	})
+	if err != nil {
+		t.Fatal("Run failed:", err)
+	}
+	return events
+}
+
+func TestSameSeedSameRun(t *testing.T) {
+	first := trace(t, 42)
+	if len(first) != 15 {
+		t.Fatalf("Expected 15 events, got: %v", first)
+	}
+	for i := 0; i < 5; i++ {
+		if again := trace(t, 42); !reflect.DeepEqual(first, again) {
+			t.Fatalf("Expected seed 42 to replay, got:\n%v\n%v", first, again)
+		}
+	}
+	if other := trace(t, 43); reflect.DeepEqual(first, other) {
+		t.Errorf("Expected another seed to run differently, got: %v", other)
+	}
+}
+
+func TestVirtualTime(t *testing.T) {
+	s := New(1)
+	defer s.Close()
+	start := time.Now()
+	err := s.Run(func() {
+		s.Sleep(time.Hour - time.Second)
+	})
+	if err != nil || s.Elapsed() != time.Hour-time.Second {
+		t.Errorf("Expected run to end after an hour of virtual time, got: %v after %v", err, s.Elapsed())
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("Expected virtual time to pass without waiting, took %v", time.Since(start))
+	}
+}
+
+func TestSignal(t *testing.T) {
+	s := New(1)
+	defer s.Close()
+	err := s.Run(func() {
+		signal := s.NewSignal()
+		if signal.Wait(time.Second) || s.Elapsed() != time.Second {
+			t.Errorf("Expected wait to time out after a second, %v passed", s.Elapsed())
+		}
+		// A notify before the wait is kept for it
+		signal.Notify()
+		if !signal.Wait(time.Second) || s.Elapsed() != time.Second {
+			t.Errorf("Expected pending notify to end the wait at once")
+		}
+		s.Go(func() {
+			s.Sleep(time.Millisecond)
+			signal.Notify()
+		})
+		if !signal.Wait(time.Second) || s.Elapsed() != time.Second+time.Millisecond {
+			t.Errorf("Expected notify to end the wait after a millisecond, %v passed", s.Elapsed())
+		}
+	})
+	if err != nil {
+		t.Fatal("Run failed:", err)
+	}
+}
+
+func TestFailures(t *testing.T) {
+	s := New(1)
+	err := s.Run(func() {
+		s.NewSignal().Wait(0)
+	})
+	if err == nil || !strings.Contains(err.Error(), "blocked") {
+		t.Errorf("Expected deadlock to be reported, got: %v", err)
+	}
+	s.Close()
+
+	s = New(1)
+	err = s.Run(func() {
+		s.Go(func() { panic("boom") })
+		s.Sleep(time.Second)
+	})
+	if err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Errorf("Expected panic to be reported, got: %v", err)
+	}
+	s.Close()
+
+	s = New(1)
+	s.MaxTime = time.Minute
+	err = s.Run(func() {
+		for {
+			s.Sleep(time.Second)
+		}
+	})
+	if err == nil || !strings.Contains(err.Error(), "still running") {
+		t.Errorf("Expected run past the time limit to fail, got: %v", err)
+	}
+	s.Close()
+}
@@ -55,7 +55,21 @@ func (t *Timestamp) LessThanOrEqualTo(other *Timestamp) bool {
 	return t.Equals(other) || t.LessThan(other)
 }
 
+// Next returns the smallest timestamp of the given client that is later than t
+func (t *Timestamp) Next(clientID int) *Timestamp {
+	if clientID > t.ID {
+		return NewCustomTimestamp(clientID, t.Timestamp)
+	}
+	return NewCustomTimestamp(clientID, t.Timestamp.Add(time.Nanosecond))
+}
+
 func LaterTime(t1 *Timestamp, t2 *Timestamp) *Timestamp {
+	if t1 == nil {
+		return t2
+	}
+	if t2 == nil {
+		return t1
+	}
 	if t1.GreaterThan(t2) {
 		return t1
 	}
@@ -2,18 +2,60 @@ package common
 
 import (
 	"fmt"
+	"sort"
 )
 
+// TxnID identifies a transaction across every client: the client that began
+// it and the number of transactions that client had begun. Client ids must be
+// unique in a deployment.
+type TxnID struct {
+	ClientID int
+	Seq      int
+}
+
+func NewTxnID(clientID int, seq int) TxnID {
+	return TxnID{ClientID: clientID, Seq: seq}
+}
+
+// Order by client, then by sequence number
+func (id TxnID) Less(other TxnID) bool {
+	if id.ClientID != other.ClientID {
+		return id.ClientID < other.ClientID
+	}
+	return id.Seq < other.Seq
+}
+
+func (id TxnID) String() string {
+	return fmt.Sprintf("%d.%d", id.ClientID, id.Seq)
+}
+
 // Transaction represents a transaction with read and write sets
 type Transaction struct {
-	ID       int
+	ID       TxnID
 	ReadSet  map[string]string
-	ReadTime map[string]*Timestamp
+	ReadTime map[string]*Timestamp // absent for reads that found no version, gob can't encode nil values
 	WriteSet map[string]string
+	ScanSet  []*KeyRange // ranges read by scans, keys found in them are also in the read set
+
+	// Shards the transaction prepares on, replicas ask them for its outcome
+	// when its client goes away. Empty for a transaction on a single shard.
+	Participants []int
+}
+
+// KeyRange is the range of keys [Start, End] covered by a scan, an empty End
+// means the scan read every key after Start
+type KeyRange struct {
+	Start string
+	End   string
+}
+
+// Contains reports whether key falls in the range
+func (r *KeyRange) Contains(key string) bool {
+	return key >= r.Start && (r.End == "" || key <= r.End)
 }
 
 // NewTransaction creates a new Transaction instance
-func NewTransaction(id int) *Transaction {
+func NewTransaction(id TxnID) *Transaction {
 	return &Transaction{
 		ID:       id,
 		ReadSet:  make(map[string]string), // value and read time from store
@@ -25,14 +67,42 @@ func NewTransaction(id int) *Transaction {
 // AddReadSet adds an entry to the read set of the transaction
 func (t *Transaction) AddReadSet(key string, value string, readTime *Timestamp) {
 	t.ReadSet[key] = value
+	if readTime == nil {
+		delete(t.ReadTime, key)
+		return
+	}
 	t.ReadTime[key] = readTime
 }
 
+// AddScanSet adds a range read by a scan to the transaction
+func (t *Transaction) AddScanSet(start, end string) {
+	t.ScanSet = append(t.ScanSet, &KeyRange{Start: start, End: end})
+}
+
 // AddWriteSet adds an entry to the write set of the transaction
 func (t *Transaction) AddWriteSet(key, value string) {
 	t.WriteSet[key] = value
 }
 
+// Keys of the read set in order
+func (t *Transaction) ReadKeys() []string {
+	return sortedKeys(t.ReadSet)
+}
+
+// Keys of the write set in order
+func (t *Transaction) WriteKeys() []string {
+	return sortedKeys(t.WriteSet)
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 func (t Transaction) String() string {
 	readSetStr := "{"
 	for key, value := range t.ReadSet {
@@ -46,5 +116,11 @@ func (t Transaction) String() string {
 	}
 	writeSetStr += "}"
 
-	return fmt.Sprintf("Transaction ID: %d\nRead Set: %s\n Write Set: %s\n", t.ID, readSetStr, writeSetStr)
+	scanSetStr := "{"
+	for _, r := range t.ScanSet {
+		scanSetStr += fmt.Sprintf("[%s, %s], ", r.Start, r.End)
+	}
+	scanSetStr += "}"
+
+	return fmt.Sprintf("Transaction ID: %v\nRead Set: %s\n Write Set: %s\n Scan Set: %s\n", t.ID, readSetStr, writeSetStr, scanSetStr)
 }
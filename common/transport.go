@@ -0,0 +1,16 @@
+package common
+
+import (
+	"io"
+)
+
+// Transport carries calls between IR clients and replicas, see common/transport
+// for the TCP and in-memory implementations
+type Transport interface {
+	// Deliver calls addressed to replica id at addr to the exported methods of
+	// receiver, until the returned closer is closed
+	Listen(id int, addr *ReplicaAddress, receiver interface{}) (io.Closer, error)
+
+	// Call method of replica id at addr and wait for its reply
+	Call(id int, addr *ReplicaAddress, method string, args interface{}, reply interface{}) error
+}
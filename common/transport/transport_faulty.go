@@ -0,0 +1,197 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"reflect"
+	"sync"
+	"time"
+
+	. "github.com/ViolaChenYT/TAPIR/common"
+)
+
+// Rule describes how a link treats the messages crossing it. A call is a
+// request and its reply, either may be lost or delayed on the way.
+type Rule struct {
+	Drop      float64       // probability a request or a reply is lost
+	Duplicate float64       // probability a request is delivered a second time
+	MinDelay  time.Duration // every message waits a random time in [MinDelay, MaxDelay],
+	MaxDelay  time.Duration // so messages on the same link overtake each other
+}
+
+// FaultyNetwork is an in-memory network that loses, duplicates, delays and
+// reorders messages. Every node talks through its own Transport from Node,
+// so rules apply to the link between two nodes and can change at any time.
+type FaultyNetwork struct {
+	network *Network
+	clock   Clock // messages wait on it, copies run on it
+
+	mu          sync.Mutex
+	rand        *rand.Rand
+	defaultRule Rule
+	rules       map[link]Rule
+	partition   map[int]int // <node, side>, nodes on different sides can't talk
+}
+
+// Direction matters, a rule on the link from a to b leaves b to a alone
+type link struct {
+	from int
+	to   int
+}
+
+// node is the Transport of one node on a FaultyNetwork
+type node struct {
+	network *FaultyNetwork
+	id      int
+}
+
+// NewFaultyNetwork creates a network that delivers everything until told
+// otherwise, seed makes its faults repeatable
+func NewFaultyNetwork(seed int64) *FaultyNetwork {
+	return NewFaultyNetworkWithClock(seed, SystemClock)
+}
+
+// NewFaultyNetworkWithClock creates a faulty network whose messages take
+// their time on the given clock, a simulation passes its virtual clock
+func NewFaultyNetworkWithClock(seed int64, clock Clock) *FaultyNetwork {
+	return &FaultyNetwork{
+		network: NewNetwork(),
+		clock:   clock,
+		rand:    rand.New(rand.NewSource(seed)),
+		rules:   make(map[link]Rule),
+	}
+}
+
+// Transport for node id, its calls cross the links from id
+func (n *FaultyNetwork) Node(id int) Transport {
+	return &node{network: n, id: id}
+}
+
+// Apply rule to every link without a rule of its own
+func (n *FaultyNetwork) SetDefaultRule(rule Rule) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.defaultRule = rule
+}
+
+// Apply rule to the link from one node to another
+func (n *FaultyNetwork) SetRule(from int, to int, rule Rule) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.rules[link{from, to}] = rule
+}
+
+// Drop the rule of a link, it follows the default rule again
+func (n *FaultyNetwork) ClearRule(from int, to int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.rules, link{from, to})
+}
+
+// Split the network, nodes only reach the nodes of their own group. Nodes
+// in no group are cut off from everyone but themselves.
+func (n *FaultyNetwork) Partition(groups ...[]int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.partition = make(map[int]int)
+	for side, group := range groups {
+		for _, id := range group {
+			n.partition[id] = side
+		}
+	}
+}
+
+// Remove the partition, every node reaches every other node again
+func (n *FaultyNetwork) Heal() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.partition = nil
+}
+
+// Rule of the link, and whether the partition cuts it
+func (n *FaultyNetwork) rule(from int, to int) (Rule, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	rule, ok := n.rules[link{from, to}]
+	if !ok {
+		rule = n.defaultRule
+	}
+	if n.partition != nil && from != to {
+		fromSide, ok1 := n.partition[from]
+		toSide, ok2 := n.partition[to]
+		if !ok1 || !ok2 || fromSide != toSide {
+			return rule, true
+		}
+	}
+	return rule, false
+}
+
+// Whether an event of the given probability happens
+func (n *FaultyNetwork) chance(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.rand.Float64() < p
+}
+
+// Wait for the delay of a message crossing the link
+func (n *FaultyNetwork) delay(rule Rule) {
+	d := rule.MinDelay
+	if rule.MaxDelay > rule.MinDelay {
+		n.mu.Lock()
+		d += time.Duration(n.rand.Int63n(int64(rule.MaxDelay - rule.MinDelay)))
+		n.mu.Unlock()
+	}
+	if d > 0 {
+		n.clock.Sleep(d)
+	}
+}
+
+// Carry a message from one node to another, false if it is lost on the way
+func (n *FaultyNetwork) send(from int, to int) bool {
+	rule, cut := n.rule(from, to)
+	n.delay(rule)
+	if cut {
+		return false
+	}
+	// The rule may have changed while the message was in flight
+	rule, cut = n.rule(from, to)
+	return !cut && !n.chance(rule.Drop)
+}
+
+func (t *node) Listen(id int, addr *ReplicaAddress, receiver interface{}) (io.Closer, error) {
+	return t.network.network.Listen(id, addr, receiver)
+}
+
+func (t *node) Call(id int, addr *ReplicaAddress, method string, args interface{}, reply interface{}) error {
+	n := t.network
+	if !n.send(t.id, id) {
+		return errors.New(fmt.Sprintf("request from %d to %d lost", t.id, id))
+	}
+	if rule, _ := n.rule(t.id, id); n.chance(rule.Duplicate) {
+		// The copy takes its own time, the reply to it goes nowhere
+		dup := reflect.New(reflect.TypeOf(args).Elem()).Interface()
+		if err := copyValue(args, dup); err != nil {
+			return err
+		}
+		n.clock.Go(func() {
+			if n.send(t.id, id) {
+				n.network.Call(id, addr, method, dup, reflect.New(reflect.TypeOf(reply).Elem()).Interface())
+			}
+		})
+	}
+	out := reflect.New(reflect.TypeOf(reply).Elem())
+	if err := n.network.Call(id, addr, method, args, out.Interface()); err != nil {
+		return err
+	}
+	if !n.send(id, t.id) {
+		// The replica handled the call, the caller never learns how
+		return errors.New(fmt.Sprintf("reply from %d to %d lost", id, t.id))
+	}
+	reflect.ValueOf(reply).Elem().Set(out.Elem())
+	return nil
+}
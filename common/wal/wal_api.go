@@ -0,0 +1,22 @@
+package wal
+
+// Log is an append-only log of records, split into numbered segment files
+type Log interface {
+	// Append a record, it is on disk once the fsync policy says so
+	Append(data []byte) error
+
+	// Call fn on every record in the log, in the order they were appended.
+	// A torn record at the end of the log is dropped.
+	Replay(fn func(data []byte) error) error
+
+	// Replace every record of the log with the given ones, e.g. once a
+	// checkpoint covers the older records. After a crash the log holds either
+	// the old or the new records.
+	Rewrite(records [][]byte) error
+
+	// Flush all appended records to disk
+	Sync() error
+
+	// Sync and close the log
+	Close() error
+}
@@ -0,0 +1,391 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/ViolaChenYT/TAPIR/common"
+)
+
+const (
+	segmentSuffix = ".wal"
+	rewriteSuffix = ".rewrite" // a rewritten segment until the base file names it
+	baseFile      = "base"     // sequence number of the first segment of the log
+	headerSize    = 8          // <length, crc32> of every record
+)
+
+// LogImpl writes records as <length, crc32, data> frames into segment files
+// named by their sequence number
+type LogImpl struct {
+	dir         string
+	fsync       FsyncPolicy
+	segmentSize int64
+
+	mu      sync.Mutex
+	file    *os.File // segment being appended to
+	seq     int      // sequence number of the current segment
+	base    int      // segments before it were replaced by a rewrite
+	size    int64    // bytes in the current segment
+	dirty   bool     // appended since the last fsync
+	closed  bool
+	stopped Signal // stops background fsyncs
+}
+
+// Open the log in dir, creating it if needed. A torn record left at the end
+// of the last segment by a crash is cut off before appending.
+func Open(dir string, storage *StorageConfiguration, clock Clock) (Log, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	l := &LogImpl{
+		dir:         dir,
+		fsync:       storage.Fsync,
+		segmentSize: storage.SegmentSize,
+		stopped:     clock.NewSignal(),
+	}
+	if err := l.finishRewrite(); err != nil {
+		return nil, err
+	}
+	seqs, err := l.segments()
+	if err != nil {
+		return nil, err
+	}
+	if len(seqs) == 0 {
+		seqs = []int{l.base + 1}
+	}
+	if err := l.openSegment(seqs[len(seqs)-1]); err != nil {
+		return nil, err
+	}
+	valid, err := scanSegment(l.file, nil)
+	if err != nil {
+		l.file.Close()
+		return nil, err
+	}
+	if err := l.file.Truncate(valid); err != nil {
+		l.file.Close()
+		return nil, err
+	}
+	if _, err := l.file.Seek(valid, io.SeekStart); err != nil {
+		l.file.Close()
+		return nil, err
+	}
+	l.size = valid
+
+	if l.fsync == FSYNC_INTERVAL {
+		interval := storage.FsyncInterval
+		if interval <= 0 {
+			interval = DefaultFsyncInterval
+		}
+		clock.Go(func() { l.syncLoop(interval) })
+	}
+	return l, nil
+}
+
+func (l *LogImpl) Append(data []byte) error {
+	frame := frame(data)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return errors.New(fmt.Sprintf("append to closed log %s", l.dir))
+	}
+	if _, err := l.file.Write(frame); err != nil {
+		return err
+	}
+	l.size += int64(len(frame))
+	l.dirty = true
+	if l.fsync == FSYNC_ALWAYS {
+		if err := l.syncLocked(); err != nil {
+			return err
+		}
+	}
+	if l.segmentSize > 0 && l.size >= l.segmentSize {
+		return l.rotate()
+	}
+	return nil
+}
+
+func (l *LogImpl) Replay(fn func(data []byte) error) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	seqs, err := l.segments()
+	if err != nil {
+		return err
+	}
+	for _, seq := range seqs {
+		if seq < l.base {
+			// Replaced by a rewrite
+			continue
+		}
+		file, err := os.Open(l.segmentPath(seq))
+		if err != nil {
+			return err
+		}
+		valid, err := scanSegment(file, fn)
+		file.Close()
+		if err != nil {
+			return err
+		}
+		if seq != l.seq {
+			// Only the segment written at the time of a crash may be torn
+			if info, err := os.Stat(l.segmentPath(seq)); err == nil && info.Size() != valid {
+				return errors.New(fmt.Sprintf("corrupt log segment %s at offset %d", l.segmentPath(seq), valid))
+			}
+		}
+	}
+	return nil
+}
+
+func (l *LogImpl) Rewrite(records [][]byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return errors.New(fmt.Sprintf("rewrite of closed log %s", l.dir))
+	}
+	// The new segment only counts once the base file names it
+	seq := l.seq + 1
+	tmp, err := os.OpenFile(l.segmentPath(seq)+rewriteSuffix, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	var size int64
+	for _, data := range records {
+		n, err := tmp.Write(frame(data))
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		size += int64(n)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := l.setBase(seq); err != nil {
+		tmp.Close()
+		return err
+	}
+	l.file.Close()
+	l.file, l.seq, l.size, l.dirty = tmp, seq, size, false
+	return l.finishRewrite()
+}
+
+func (l *LogImpl) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	return l.syncLocked()
+}
+
+func (l *LogImpl) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	l.stopped.Notify()
+	if err := l.syncLocked(); err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
+
+// Must hold l.mu
+func (l *LogImpl) syncLocked() error {
+	if !l.dirty || l.fsync == FSYNC_NEVER {
+		return nil
+	}
+	l.dirty = false
+	return l.file.Sync()
+}
+
+func (l *LogImpl) syncLoop(interval time.Duration) {
+	for !l.stopped.Wait(interval) {
+		if err := l.Sync(); err != nil {
+			log.Println("Error syncing log", l.dir, err)
+		}
+	}
+}
+
+// Finish the current segment and continue in the next one, must hold l.mu
+func (l *LogImpl) rotate() error {
+	if err := l.syncLocked(); err != nil {
+		return err
+	}
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	l.size = 0
+	return l.openSegment(l.seq + 1)
+}
+
+func (l *LogImpl) openSegment(seq int) error {
+	file, err := os.OpenFile(l.segmentPath(seq), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	l.file = file
+	l.seq = seq
+	return nil
+}
+
+func (l *LogImpl) segmentPath(seq int) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%016d%s", seq, segmentSuffix))
+}
+
+// Record the first segment of the log, the atomic step of a rewrite
+func (l *LogImpl) setBase(seq int) error {
+	path := filepath.Join(l.dir, baseFile)
+	if err := os.WriteFile(path+".tmp", []byte(fmt.Sprint(seq)), 0644); err != nil {
+		return err
+	}
+	file, err := os.Open(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	err = file.Sync()
+	file.Close()
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	l.base = seq
+	return syncDir(l.dir)
+}
+
+// Read the base file, then move a rewritten segment it names into place and
+// drop the segments it replaced. A rewrite the base file doesn't name yet
+// never happened.
+func (l *LogImpl) finishRewrite() error {
+	if data, err := os.ReadFile(filepath.Join(l.dir, baseFile)); err == nil {
+		if _, err := fmt.Sscanf(string(data), "%d", &l.base); err != nil {
+			return errors.New(fmt.Sprintf("corrupt log base %s: %v", l.dir, err))
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	files, err := os.ReadDir(l.dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasSuffix(name, segmentSuffix+rewriteSuffix) {
+			continue
+		}
+		path := filepath.Join(l.dir, name)
+		if path == l.segmentPath(l.base)+rewriteSuffix {
+			if err := os.Rename(path, l.segmentPath(l.base)); err != nil {
+				return err
+			}
+		} else if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	seqs, err := l.segments()
+	if err != nil {
+		return err
+	}
+	for _, seq := range seqs {
+		if seq < l.base {
+			if err := os.Remove(l.segmentPath(seq)); err != nil {
+				return err
+			}
+		}
+	}
+	return syncDir(l.dir)
+}
+
+// Sequence numbers of all segments in ascending order
+func (l *LogImpl) segments() ([]int, error) {
+	files, err := os.ReadDir(l.dir)
+	if err != nil {
+		return nil, err
+	}
+	var seqs []int
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		var seq int
+		if _, err := fmt.Sscanf(strings.TrimSuffix(name, segmentSuffix), "%d", &seq); err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+	return seqs, nil
+}
+
+// A record as written to a segment
+func frame(data []byte) []byte {
+	frame := make([]byte, headerSize+len(data))
+	binary.LittleEndian.PutUint32(frame[0:4], uint32(len(data)))
+	binary.LittleEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(data))
+	copy(frame[headerSize:], data)
+	return frame
+}
+
+// Make renames and removals in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Read frames from the start of a segment, calling fn on each of them when
+// it is not nil. Returns the offset right after the last intact frame.
+func scanSegment(file *os.File, fn func(data []byte) error) (int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	var offset int64
+	header := make([]byte, headerSize)
+	for {
+		if _, err := io.ReadFull(file, header); err != nil {
+			return offset, nil
+		}
+		length := binary.LittleEndian.Uint32(header[0:4])
+		if int64(length) > info.Size()-offset-headerSize {
+			// Garbage length of a torn header
+			return offset, nil
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(file, data); err != nil {
+			return offset, nil
+		}
+		if crc32.ChecksumIEEE(data) != binary.LittleEndian.Uint32(header[4:8]) {
+			return offset, nil
+		}
+		if fn != nil {
+			if err := fn(data); err != nil {
+				return offset, err
+			}
+		}
+		offset += int64(headerSize + len(data))
+	}
+}
@@ -0,0 +1,161 @@
+package wal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/ViolaChenYT/TAPIR/common"
+	"github.com/ViolaChenYT/TAPIR/common/sim"
+)
+
+func replayAll(t *testing.T, l Log) []string {
+	var records []string
+	if err := l.Replay(func(data []byte) error {
+		records = append(records, string(data))
+		return nil
+	}); err != nil {
+		t.Fatal("Replay failed:", err)
+	}
+	return records
+}
+
+func TestAppendReplay(t *testing.T) {
+	dir := t.TempDir()
+	storage := NewStorageConfiguration(dir)
+	storage.Fsync = FSYNC_ALWAYS
+	l, err := Open(dir, storage, SystemClock)
+	if err != nil {
+		t.Fatal("Open failed:", err)
+	}
+	for i := 0; i < 10; i++ {
+		l.Append([]byte(fmt.Sprintf("record %d", i)))
+	}
+	l.Close()
+
+	l, _ = Open(dir, storage, SystemClock)
+	defer l.Close()
+	l.Append([]byte("record 10"))
+	records := replayAll(t, l)
+	if len(records) != 11 {
+		t.Fatalf("Expected 11 records after reopening, got: %d", len(records))
+	}
+	for i, record := range records {
+		if record != fmt.Sprintf("record %d", i) {
+			t.Errorf("Expected record %d in order, got: %s", i, record)
+		}
+	}
+}
+
+func TestSegmentRotation(t *testing.T) {
+	dir := t.TempDir()
+	storage := NewStorageConfiguration(dir)
+	storage.SegmentSize = 64
+	l, _ := Open(dir, storage, SystemClock)
+	for i := 0; i < 20; i++ {
+		l.Append([]byte(fmt.Sprintf("record %d", i)))
+	}
+	l.Close()
+
+	files, _ := os.ReadDir(dir)
+	if len(files) < 5 {
+		t.Errorf("Expected the log to rotate into several segments, got: %d", len(files))
+	}
+	l, _ = Open(dir, storage, SystemClock)
+	defer l.Close()
+	records := replayAll(t, l)
+	if len(records) != 20 || records[19] != "record 19" {
+		t.Errorf("Expected 20 records across segments, got: %v", records)
+	}
+}
+
+func TestTornTail(t *testing.T) {
+	dir := t.TempDir()
+	storage := NewStorageConfiguration(dir)
+	l, _ := Open(dir, storage, SystemClock)
+	l.Append([]byte("complete"))
+	l.Close()
+
+	// A crash in the middle of an append leaves half a frame behind
+	file, _ := os.OpenFile(l.(*LogImpl).segmentPath(1), os.O_WRONLY|os.O_APPEND, 0644)
+	file.Write([]byte{42, 0, 0, 0, 1, 2})
+	file.Close()
+
+	l, err := Open(dir, storage, SystemClock)
+	if err != nil {
+		t.Fatal("Open failed:", err)
+	}
+	defer l.Close()
+	l.Append([]byte("after crash"))
+	records := replayAll(t, l)
+	if len(records) != 2 || records[0] != "complete" || records[1] != "after crash" {
+		t.Errorf("Expected torn record to be dropped, got: %v", records)
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	dir := t.TempDir()
+	storage := NewStorageConfiguration(dir)
+	storage.SegmentSize = 64
+	l, _ := Open(dir, storage, SystemClock)
+	for i := 0; i < 10; i++ {
+		l.Append([]byte(fmt.Sprintf("record %d", i)))
+	}
+	if err := l.Rewrite([][]byte{[]byte("a"), []byte("b")}); err != nil {
+		t.Fatal("Rewrite failed:", err)
+	}
+	l.Append([]byte("c"))
+	if records := replayAll(t, l); fmt.Sprint(records) != "[a b c]" {
+		t.Errorf("Expected the rewritten records, got: %v", records)
+	}
+	l.Close()
+
+	files, _ := os.ReadDir(dir)
+	if len(files) != 2 {
+		t.Errorf("Expected one segment and the base file after the rewrite, got: %d files", len(files))
+	}
+	l, _ = Open(dir, storage, SystemClock)
+	if records := replayAll(t, l); fmt.Sprint(records) != "[a b c]" {
+		t.Errorf("Expected the rewritten records after reopening, got: %v", records)
+	}
+	l.Close()
+
+	// A crash before the base file names the rewritten segment leaves the
+	// old records
+	os.WriteFile(filepath.Join(dir, "0000000000000099.wal.rewrite"), frame([]byte("lost")), 0644)
+	l, _ = Open(dir, storage, SystemClock)
+	defer l.Close()
+	if records := replayAll(t, l); fmt.Sprint(records) != "[a b c]" {
+		t.Errorf("Expected an unfinished rewrite to be dropped, got: %v", records)
+	}
+}
+
+func TestIntervalFsyncOnClock(t *testing.T) {
+	dir := t.TempDir()
+	storage := NewStorageConfiguration(dir)
+	storage.FsyncInterval = 10 * time.Millisecond
+	s := sim.New(1)
+	defer s.Close()
+	err := s.Run(func() {
+		l, err := Open(dir, storage, s)
+		if err != nil {
+			t.Error("Open failed:", err)
+			return
+		}
+		defer l.Close()
+		l.Append([]byte("record"))
+		// Only virtual time passes, the fsync runs on the clock of the log
+		s.Sleep(2 * storage.FsyncInterval)
+		impl := l.(*LogImpl)
+		impl.mu.Lock()
+		defer impl.mu.Unlock()
+		if impl.dirty {
+			t.Errorf("Expected the record to be synced after %v of virtual time", 2*storage.FsyncInterval)
+		}
+	})
+	if err != nil {
+		t.Fatal("Simulation failed:", err)
+	}
+}
@@ -2,9 +2,10 @@ module github.com/ViolaChenYT/TAPIR
 
 go 1.22
 
+require gopkg.in/yaml.v3 v3.0.1
+
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/stretchr/testify v1.9.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
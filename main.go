@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"log"
 
 	"github.com/ViolaChenYT/TAPIR/common"
@@ -8,16 +9,22 @@ import (
 )
 
 func main() {
-	app := NewTapirApp(common.GetConfigA())
-	app.Start()
+	app, err := NewTapirApp(common.GetConfigA())
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx := app.InitThread(context.Background())
+	app.Start(ctx)
 	row := make(map[string][]byte)
 	row["name"] = []byte("ruyu")
 	row["netid"] = []byte("ry9811")
-	app.Insert("123", "456", row)
-	app.Read("123", "456", []string{"name"})
-	app.Commit()
+	app.Insert(ctx, "123", "456", row)
+	app.Read(ctx, "123", "456", []string{"name"})
+	if err := app.Commit(ctx); err != nil {
+		log.Println(err)
+	}
 
-	app.Start()
-	val, err := app.Read("123", "456", []string{"name"})
+	app.Start(ctx)
+	val, err := app.Read(ctx, "123", "456", []string{"name"})
 	log.Println(val, err)
 }
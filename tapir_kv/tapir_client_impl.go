@@ -1,12 +1,25 @@
 package tapir_kv
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"math/rand"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/ViolaChenYT/TAPIR/IR"
 	. "github.com/ViolaChenYT/TAPIR/common"
+	"github.com/ViolaChenYT/TAPIR/common/libstore"
+)
+
+const (
+	snapshotRetryInterval    = 5 * time.Millisecond // first wait for prepared writes below a snapshot
+	snapshotMaxRetryInterval = 100 * time.Millisecond
+	snapshotReadTimeout      = 2 * time.Second // give up waiting for a stable snapshot
+	maxRetryBackoff          = time.Second     // RunTxn waits at most this long between attempts
 )
 
 // TapirClientImpl is an implementation of the TapirClient interface
@@ -14,144 +27,830 @@ type TapirClientImpl struct {
 	// Unique ID for this client
 	client_id int
 
-	// Ongoing transaction ID
-	t_id int
+	// Sequence number of the latest transaction begun. It starts from the
+	// clock, so a client that restarts doesn't reuse the ids of its earlier
+	// transactions.
+	txn_seq int
+
+	// Replica group of every shard, shared by all transactions
+	shards []*shardClient
+
+	// Maps keys to shards
+	partitioner Partitioner
+
+	// Number of times a prepare is retried with a new timestamp before aborting
+	max_retries int
+
+	// Replicas end transactions prepared this long ago, 0 if they never do
+	prepare_timeout time.Duration
+
+	// Number of times RunTxn runs a transaction, and its first backoff
+	max_attempts  int
+	retry_backoff time.Duration
+
+	// Jitter of the RunTxn backoff
+	rand *rand.Rand
+
+	// Counters over all transactions of this client
+	stats ClientStats
+
+	// Latest timestamp proposed by any transaction of this client
+	last_ts *Timestamp
+
+	// Source of timestamps, runs the calls to the shards
+	clock Clock
+
+	// Guards txn_seq, stats, last_ts and rand, transactions of the client run concurrently
+	mu sync.Mutex
+}
+
+// Txn is the TapirTxn of a TapirClientImpl. A client runs any number of
+// transactions at once, each from its own goroutine.
+type Txn struct {
+	// Client that began the transaction
+	client *TapirClientImpl
+
+	// Transaction ID
+	t_id TxnID
 
 	// Buffered transaction
 	txn *Transaction
 
+	// Snapshot timestamp of a read-only transaction, nil otherwise
+	snapshot *Timestamp
+
+	// Timestamp the transaction committed at, nil until it commits
+	commit_ts *Timestamp
+
+	// Committed or aborted, nothing more can be done with it
+	finished bool
+}
+
+// shardClient talks to the replica group of one shard
+type shardClient struct {
 	// IR protocol client
 	ir_client *IR.Client
 
-	// Closet replica for read ops
+	// Closet replica for read ops, reads fall back to the other replicas
+	// of the group the IR client sends to
 	replica_id int
 
-	// Size of majority replicas
-	quorum_size int
+	// A read that no replica answers, e.g. while the group changes views,
+	// goes round the group again every retransmit until the timeout
+	clock      Clock
+	retransmit time.Duration
+	timeout    time.Duration
+}
 
-	lock sync.Mutex
+// Partitioner maps a key to one of n shards
+type Partitioner func(key string, n int) int
+
+// HashPartitioner spreads keys over the shards by libstore.StoreHash, keys
+// sharing the prefix before a ':' land on the same shard
+func HashPartitioner(key string, n int) int {
+	return int(libstore.StoreHash(key) % uint32(n))
 }
 
 func NewTapirClient(config *Configuration) (TapirClient, error) {
+	return NewTapirClientWithPartitioner(config, HashPartitioner)
+}
+
+// NewTapirClientWithPartitioner creates a client that routes keys to the
+// shards of config with the given partitioner
+func NewTapirClientWithPartitioner(config *Configuration, partitioner Partitioner) (TapirClient, error) {
 	client := TapirClientImpl{
-		client_id:   config.Client.TAPIR_ID,
-		t_id:        0,
-		replica_id:  config.Client.ClosestReplicaID,
-		quorum_size: config.QuorumSize(),
+		client_id:       config.Client.TAPIR_ID,
+		partitioner:     partitioner,
+		max_retries:     config.Client.MaxRetries,
+		prepare_timeout: config.PrepareTimeout,
+		max_attempts:    config.Client.MaxAttempts,
+		retry_backoff:   config.Client.RetryBackoff,
+		clock:           config.Clock,
 	}
-
-	// Create replica proxy
-	cl, err := IR.NewIRClient(config)
-	if err != nil {
-		log.Panicf("Error creating IR client: %v", err)
-		return nil, err
+	if client.clock == nil {
+		client.clock = SystemClock
+	}
+	client.txn_seq = int(client.clock.Now().UnixNano())
+	// Clients that abort each other back off differently, the seed comes
+	// from the clock so simulations replay
+	client.rand = rand.New(rand.NewSource(client.clock.Now().UnixNano() + int64(client.client_id)))
+
+	// Create replica proxies
+	for i := 0; i < config.NumShards(); i++ {
+		group := config.Shard(i)
+		cl, err := IR.NewIRClient(group)
+		if err != nil {
+			return nil, fmt.Errorf("shard %d: %w", i, err)
+		}
+		client.shards = append(client.shards, &shardClient{
+			ir_client:  cl,
+			replica_id: closestReplica(group),
+			clock:      client.clock,
+			retransmit: group.Retransmit,
+			timeout:    group.SlowPathTimeout,
+		})
 	}
-	client.ir_client = cl
 	// Run the transport in a new thread
 	go client.run_client()
 
 	return &client, nil
 }
 
+// The configured closest replica if it is in the group, the lowest replica ID otherwise
+func closestReplica(group *Configuration) int {
+	if _, ok := group.Replicas[group.Client.ClosestReplicaID]; ok {
+		return group.Client.ClosestReplicaID
+	}
+	closest := -1
+	for id := range group.Replicas {
+		if closest == -1 || id < closest {
+			closest = id
+		}
+	}
+	return closest
+}
+
+// Send an unlogged request to the closest replica, or to the next one while
+// replicas fail to answer. Once none did, the group is tried again until the
+// timeout passes.
+func (s *shardClient) unlogged(ctx context.Context, req *Request) (*Response, error) {
+	response, err := s.ir_client.InvokeUnloggedContext(ctx, s.replica_id, req)
+	if err == nil {
+		return response, nil
+	}
+	var deadline time.Time
+	if s.clock != nil {
+		deadline = s.clock.Now().Add(s.timeout)
+	}
+	for {
+		// The group may have changed, a removed replica fails right away
+		ids, _ := s.ir_client.Members()
+		for _, id := range ids {
+			if id == s.replica_id {
+				continue
+			}
+			if ctx.Err() != nil {
+				return nil, ContextError(ctx)
+			}
+			if response, err = s.ir_client.InvokeUnloggedContext(ctx, id, req); err == nil {
+				return response, nil
+			}
+		}
+		if s.retransmit <= 0 || s.clock == nil || !s.clock.Now().Add(s.retransmit).Before(deadline) {
+			return nil, err
+		}
+		s.clock.Sleep(s.retransmit)
+		if response, err = s.ir_client.InvokeUnloggedContext(ctx, s.replica_id, req); err == nil {
+			return response, nil
+		}
+	}
+}
+
 // Runs the transport event loop.
 func (c *TapirClientImpl) run_client() {
 	// TODO
 }
 
-func (c *TapirClientImpl) Begin() {
-	// TODO: Implement a lock if previous transaction has not completed
-	c.lock.Lock()
-	c.t_id++
+func (c *TapirClientImpl) Begin() *Txn {
+	c.mu.Lock()
+	c.txn_seq++
+	t_id := NewTxnID(c.client_id, c.txn_seq)
+	c.mu.Unlock()
 
 	// Create a transaction
-	c.txn = NewTransaction(c.t_id)
+	return &Txn{
+		client: c,
+		t_id:   t_id,
+		txn:    NewTransaction(t_id),
+	}
+}
+
+func (c *TapirClientImpl) BeginReadOnly(timestamp *Timestamp) *Txn {
+	t := c.Begin()
+	if timestamp == nil {
+		timestamp = NewCustomTimestamp(c.client_id, c.clock.Now())
+	}
+	t.snapshot = timestamp
+	return t
+}
+
+// Run fn in a new transaction and commit it. A transaction that aborts is
+// run again after a random backoff, up to MaxAttempts times. Returns how
+// many times fn ran and the error of the last attempt. Only aborts are
+// retried, any other error of fn aborts the transaction and is returned.
+func (c *TapirClientImpl) RunTxn(ctx context.Context, fn func(txn *Txn) error) (int, error) {
+	backoff := c.retry_backoff
+	for attempt := 1; ; attempt++ {
+		txn := c.Begin()
+		err := fn(txn)
+		if err != nil {
+			txn.AbortContext(ctx)
+		} else {
+			err = txn.CommitContext(ctx)
+		}
+		if err == nil || !errors.Is(err, ErrAborted) {
+			return attempt, err
+		}
+		if attempt >= c.max_attempts {
+			return attempt, fmt.Errorf("gave up after %d attempts: %w", attempt, err)
+		}
+		if ctx.Err() != nil {
+			return attempt, ContextError(ctx)
+		}
+		log.Println("transaction", txn.ID(), "aborted, attempt", attempt, "of", c.max_attempts)
+		c.clock.Sleep(c.jitter(ctx, backoff))
+		backoff = min(2*backoff, maxRetryBackoff)
+	}
 }
 
-func (c *TapirClientImpl) Read(key string) (string, error) {
+// Random wait up to backoff, no longer than the deadline of ctx on the
+// client's clock
+func (c *TapirClientImpl) jitter(ctx context.Context, backoff time.Duration) time.Duration {
+	if backoff <= 0 {
+		return 0
+	}
+	c.mu.Lock()
+	wait := time.Duration(c.rand.Int63n(int64(backoff)))
+	c.mu.Unlock()
+	if deadline, ok := ctx.Deadline(); ok {
+		wait = max(0, min(wait, deadline.Sub(c.clock.Now())))
+	}
+	return wait
+}
+
+func (c *TapirClientImpl) Close() {
+	for _, shard := range c.shards {
+		shard.ir_client.Close()
+	}
+}
+
+func (c *TapirClientImpl) Stats() ClientStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// Timestamp to propose a prepare at, the current time or right after the
+// timestamp replicas asked for in a retry. Transactions of the client prepare
+// at the same time, so no two of them may propose the same timestamp.
+func (c *TapirClientImpl) proposeAfter(after *Timestamp) *Timestamp {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	timestamp := NewCustomTimestamp(c.client_id, c.clock.Now())
+	if after != nil {
+		timestamp = after.Next(c.client_id)
+	}
+	if c.last_ts != nil && !timestamp.GreaterThan(c.last_ts) {
+		timestamp = c.last_ts.Next(c.client_id)
+	}
+	c.last_ts = timestamp
+	return timestamp
+}
+
+// Count the outcome of a transaction and the prepares it retried
+func (c *TapirClientImpl) record(committed bool, retries int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if committed {
+		c.stats.Committed++
+	} else {
+		c.stats.Aborted++
+	}
+	c.stats.Retries += retries
+	c.stats.LastRetries = retries
+}
+
+var _ TapirTxn = (*Txn)(nil)
+
+func (t *Txn) ID() TxnID {
+	return t.t_id
+}
+
+// Error for operations on a transaction that already committed or aborted
+func (t *Txn) checkActive(op string) error {
+	if t.finished {
+		return errors.New(fmt.Sprintf("%s in finished transaction %v", op, t.t_id))
+	}
+	return nil
+}
+
+func (t *Txn) Read(key string) (string, error) {
+	return t.ReadContext(context.Background(), key)
+}
+
+func (t *Txn) ReadContext(ctx context.Context, key string) (string, error) {
+	if err := t.checkActive("read of " + key); err != nil {
+		return "", err
+	}
+	c := t.client
 	// If key is in the transaction's write set, the client returns value from the write set
-	if val, ok := c.txn.WriteSet[key]; ok {
+	if val, ok := t.txn.WriteSet[key]; ok {
 		return val, nil
 	}
 	// If the transaction has already read key, it returns a cached copy
-	readSet, timeset := c.txn.ReadSet, c.txn.ReadTime
-	if val, ok := readSet[key]; ok {
+	if val, ok := t.txn.ReadSet[key]; ok {
 		return val, nil
 	}
-	timestamp := timeset[key]
 
-	// Otherwise, the client sends Read(key) to the replica
+	if t.snapshot != nil {
+		return t.snapshotRead(ctx, key)
+	}
+
+	// Otherwise, the client sends Read(key) to the closest replica of its shard
 	read_request := &Request{
 		Op:    OP_GET,
-		TxnID: c.t_id,
-		Get:   &GetMessage{Key: key, Timestamp: NewTimestamp(c.client_id)},
+		TxnID: t.t_id,
+		Get:   &GetMessage{Key: key}, // the latest version, OCC validates it at prepare
+	}
+	response, err := c.shards[c.shardOf(key)].unlogged(ctx, read_request)
+	if err != nil {
+		return "", err
 	}
-	response, err := c.ir_client.InvokeUnlogged(c.replica_id, read_request)
-	CheckError(err)
 
 	// On response, client puts (key, version) into the transaction's read set, and returns object to the application
 	val, timestamp := response.Value, response.Timestamp // Placeholders
 
-	c.txn.AddReadSet(key, val, timestamp)
+	t.txn.AddReadSet(key, val, timestamp)
+	if timestamp == nil {
+		// The read still counts, a later write of the key conflicts with it
+		return "", fmt.Errorf("%w: %s", ErrKeyNotFound, key)
+	}
 	return val, nil
 }
 
-func (c *TapirClientImpl) Write(key string, value string) error {
+func (t *Txn) Scan(startKey string, count int) ([]*ScanRow, error) {
+	return t.ScanContext(context.Background(), startKey, count)
+}
+
+func (t *Txn) ScanContext(ctx context.Context, startKey string, count int) ([]*ScanRow, error) {
+	if err := t.checkActive("scan"); err != nil {
+		return nil, err
+	}
+	if t.snapshot != nil {
+		return t.snapshotScan(ctx, startKey, count)
+	}
+
+	c := t.client
+	scan_request := &Request{
+		Op:    OP_SCAN,
+		TxnID: t.t_id,
+		Scan:  &ScanMessage{StartKey: startKey, Count: count},
+	}
+	// Every shard returns its first count keys, the first count keys of all of
+	// them are the result and every key of a shard up to the last one is among them
+	responses := make([]*Response, len(c.shards))
+	err := c.eachShard(c.allShards(), func(i int) error {
+		response, err := c.shards[i].unlogged(ctx, scan_request)
+		responses[i] = response
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	byKey := make(map[string]*ScanRow)
+	for _, response := range responses {
+		for _, row := range response.Rows {
+			byKey[row.Key] = row
+		}
+	}
+
+	// Keys found go into the read set like single reads, the range itself into
+	// the scan set so the replicas can check it for phantoms
+	rows := sortedRows(byKey, count)
+	for _, row := range rows {
+		if val, ok := t.txn.ReadSet[row.Key]; ok {
+			// Repeat the version read before
+			row.Value, row.Timestamp = val, t.txn.ReadTime[row.Key]
+		} else if _, ok := t.txn.WriteSet[row.Key]; !ok {
+			t.txn.AddReadSet(row.Key, row.Value, row.Timestamp)
+		}
+	}
+	scanned := scannedRange(startKey, count, rows)
+	t.txn.AddScanSet(scanned.Start, scanned.End)
+	return t.mergeWrites(rows, scanned, count), nil
+}
+
+// Overlay the buffered writes of the transaction that fall in the scanned range
+func (t *Txn) mergeWrites(rows []*ScanRow, scanned *KeyRange, count int) []*ScanRow {
+	byKey := make(map[string]*ScanRow, len(rows))
+	for _, row := range rows {
+		byKey[row.Key] = row
+	}
+	for key, value := range t.txn.WriteSet {
+		if scanned.Contains(key) {
+			byKey[key] = &ScanRow{Key: key, Value: value}
+		}
+	}
+	return sortedRows(byKey, count)
+}
+
+func (t *Txn) Write(key string, value string) error {
+	return t.WriteContext(context.Background(), key, value)
+}
+
+// Writes are buffered until Commit, the context is only checked
+func (t *Txn) WriteContext(ctx context.Context, key string, value string) error {
+	if err := t.checkActive("write of " + key); err != nil {
+		return err
+	}
+	if ctx.Err() != nil {
+		return ContextError(ctx)
+	}
+	if t.snapshot != nil {
+		return errors.New(fmt.Sprintf("write of %s in read-only transaction %v", key, t.t_id))
+	}
 	// Client buffers key and value in the write set until commit and returns immediately
-	c.txn.AddWriteSet(key, value)
+	t.txn.AddWriteSet(key, value)
 
 	// TODO: return some response
 	return nil
 }
 
-func (c *TapirClientImpl) Commit() bool {
-	// Client selects a proposed timestamp (local_time, client_id)
-	// timestamp := NewTimestamp(c.client_id)
-	// Client invokes Prepare(tx, timestamp) as an IR consensus operation.
+func (t *Txn) Commit() bool {
+	return t.CommitContext(context.Background()) == nil
+}
 
-	prepare_request := &Request{
-		Op:      OP_PREPARE,
-		TxnID:   c.t_id,
-		Prepare: &PrepareMessage{Txn: c.txn, Timestamp: NewTimestamp(c.client_id)},
+// Commit the transaction, nil if it committed. Once the prepare fails, times
+// out or ctx is done the transaction is aborted. Errors wrap ErrAborted,
+// ErrRetryExhausted, ErrTimeout or the error of ctx.
+func (t *Txn) CommitContext(ctx context.Context) error {
+	if t.finished {
+		return errors.New(fmt.Sprintf("commit of finished transaction %v", t.t_id))
 	}
-	response, err := c.ir_client.InvokeConsensus(prepare_request, c.decide) // pass decide function
-	if err != nil {
-		log.Panicf("Error invoking consensus: %v", err)
-		return false
+	c := t.client
+	if t.snapshot != nil {
+		// Snapshot reads are already consistent, nothing to prepare
+		t.finished = true
+		c.record(true, 0)
+		return nil
+	}
+
+	// Client selects a proposed timestamp (local_time, client_id)
+	timestamp := c.proposeAfter(nil)
+	retries := 0
+	participants := t.participants()
+	start := c.clock.Now()
+
+	// Client invokes Prepare(tx, timestamp) as an IR consensus operation on every participant shard.
+	var failure error
+	for retry := 0; ; retry++ {
+		response, err := t.prepare(ctx, participants, timestamp, retry)
+		if err != nil {
+			log.Printf("Error invoking consensus: %v", err)
+			failure = fmt.Errorf("prepare of transaction %v: %w", t.t_id, err)
+			break
+		}
+		log.Println("prepare passed, status: " + ReplyTypeString(response.Status))
+
+		if response.Status == RPLY_OK && c.prepare_timeout > 0 && c.clock.Now().Sub(start) >= c.prepare_timeout/2 {
+			// Replicas may be about to end the transaction themselves, only
+			// an abort is sure to agree with them. The commit or abort must
+			// reach them within the other half, see PrepareTimeout.
+			failure = fmt.Errorf("%w: transaction %v took %v to prepare", ErrAborted, t.t_id, c.clock.Now().Sub(start))
+			break
+		}
+		if response.Status == RPLY_OK {
+			t.commit(ctx, participants, timestamp, retries)
+			return nil
+		}
+
+		if response.Status != RPLY_RETRY {
+			failure = fmt.Errorf("%w: transaction %v, prepare returned %s", ErrAborted, t.t_id, ReplyTypeString(response.Status))
+			break
+		}
+		if retry >= c.max_retries {
+			failure = fmt.Errorf("%w: %w: transaction %v after %d retries", ErrAborted, ErrRetryExhausted, t.t_id, retries)
+			break
+		}
+		// Propose again at the latest timestamp the replicas asked for
+		timestamp = c.proposeAfter(response.Timestamp)
+		retries++
+		log.Println("retrying prepare of transaction", t.t_id, "at", timestamp)
 	}
-	log.Println("prepare passed, status: " + ReplyTypeString(response.Status))
 
-	if response.Status == RPLY_OK {
+	// Otherwise, abort
+	t.abort(ctx, retries, failure)
+	return failure
+}
+
+// Commit the prepared transaction at timestamp to all replicas of every
+// participant. The transaction is decided, so the commit goes out even if
+// ctx is done by now.
+func (t *Txn) commit(ctx context.Context, participants map[int]*Transaction, timestamp *Timestamp, retries int) {
+	c := t.client
+	log.Println("started commit request")
+	ctx = context.WithoutCancel(ctx)
+	err := c.eachShard(shardIDs(participants), func(i int) error {
 		commit_request := &Request{
 			Op:     OP_COMMIT,
-			TxnID:  c.t_id,
-			Commit: &CommitMessage{Timestamp: NewTimestamp(c.client_id)},
+			TxnID:  t.t_id,
+			Commit: &CommitMessage{Timestamp: timestamp, Txn: participants[i]}, // commit at the timestamp that passed OCC
 		}
-		// Commit to all replicas
-		log.Println("started commit request")
-		c.ir_client.InvokeInconsistent(commit_request) // TODO: how to evoke Commit() on replicas?
-		c.Continue()
-		return true
+		return c.shards[i].ir_client.InvokeInconsistentContext(ctx, commit_request)
+	})
+	if err != nil {
+		log.Println("commit of transaction", t.t_id, "not confirmed:", err)
 	}
+	t.commit_ts = timestamp
+	t.finished = true
+	c.record(true, retries)
+}
 
-	// TODO: handle retry
+func (t *Txn) Abort() {
+	t.AbortContext(context.Background())
+}
 
-	// Otherwise, abort
-	c.Abort()
-	return false
+// Abort the transaction. If ctx is done it returns right away and the
+// participants learn of the abort in the background.
+func (t *Txn) AbortContext(ctx context.Context) error {
+	if t.finished {
+		return nil
+	}
+	return t.abort(ctx, 0, nil)
 }
 
-func (c *TapirClientImpl) Abort() {
-	// TODO: evoke abort through ir_client
+// Abort after retries prepares, cause is why the commit failed if it did
+func (t *Txn) abort(ctx context.Context, retries int, cause error) error {
+	c := t.client
+	t.finished = true
+	if t.snapshot != nil {
+		c.record(false, retries)
+		return nil
+	}
 	abort_request := &Request{
 		Op:    OP_ABORT,
-		TxnID: c.t_id,
+		TxnID: t.t_id,
+	}
+	participants := shardIDs(t.participants())
+	c.record(false, retries)
+	// Prepared participants hold on to the transaction until they learn of
+	// the abort, it must not be cut short
+	send := func() error {
+		return c.eachShard(participants, func(i int) error {
+			return c.shards[i].ir_client.InvokeInconsistentContext(context.WithoutCancel(ctx), abort_request)
+		})
+	}
+	// A prepare can time out at the deadline just before ctx is done
+	if ctx.Err() != nil || errors.Is(cause, ErrTimeout) {
+		c.clock.Go(func() { send() })
+		if ctx.Err() != nil {
+			return ContextError(ctx)
+		}
+		return cause
+	}
+	return send()
+}
+
+// Read key at the snapshot timestamp from f+1 replicas. Any committed write
+// below the snapshot was prepared on at least one of them, so the latest
+// version returned is the one valid at the snapshot.
+func (t *Txn) snapshotRead(ctx context.Context, key string) (string, error) {
+	c := t.client
+	read_request := &Request{
+		Op:    OP_GET,
+		TxnID: t.t_id,
+		Get:   &GetMessage{Key: key, Timestamp: t.snapshot},
+	}
+	responses, err := t.snapshotQuorum(ctx, c.shards[c.shardOf(key)], read_request)
+	if err != nil {
+		return "", err
+	}
+	var latest *Response
+	for _, response := range responses {
+		if latest == nil || LaterTime(latest.Timestamp, response.Timestamp) != latest.Timestamp {
+			latest = response
+		}
+	}
+	if latest.Timestamp == nil {
+		return "", fmt.Errorf("%w: %s at %v", ErrKeyNotFound, key, t.snapshot)
+	}
+	t.txn.AddReadSet(key, latest.Value, latest.Timestamp)
+	return latest.Value, nil
+}
+
+// Scan at the snapshot timestamp on f+1 replicas of every shard. Each replica
+// returns the first count keys it has, a key missing on one of them is
+// returned by another one, so the first count keys of the union with the
+// latest version of each key are the ones valid at the snapshot.
+func (t *Txn) snapshotScan(ctx context.Context, startKey string, count int) ([]*ScanRow, error) {
+	c := t.client
+	scan_request := &Request{
+		Op:    OP_SCAN,
+		TxnID: t.t_id,
+		Scan:  &ScanMessage{StartKey: startKey, Count: count, Timestamp: t.snapshot},
+	}
+	replies := make([][]*Response, len(c.shards))
+	err := c.eachShard(c.allShards(), func(i int) error {
+		responses, err := t.snapshotQuorum(ctx, c.shards[i], scan_request)
+		replies[i] = responses
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	latest := make(map[string]*ScanRow)
+	for _, responses := range replies {
+		for _, response := range responses {
+			for _, row := range response.Rows {
+				if prev, ok := latest[row.Key]; !ok || prev.Timestamp.LessThan(row.Timestamp) {
+					latest[row.Key] = row
+				}
+			}
+		}
+	}
+	rows := sortedRows(latest, count)
+	for _, row := range rows {
+		t.txn.AddReadSet(row.Key, row.Value, row.Timestamp)
+	}
+	return rows, nil
+}
+
+// Send a request at the snapshot timestamp to f+1 replicas of the shard until none of them
+// abstains. Replicas abstain while a prepared write below the snapshot is
+// undecided, then the request is retried.
+func (t *Txn) snapshotQuorum(ctx context.Context, shard *shardClient, request *Request) ([]*Response, error) {
+	c := t.client
+	wait := snapshotRetryInterval
+	deadline := c.clock.Now().Add(snapshotReadTimeout)
+	for {
+		responses, err := shard.ir_client.InvokeUnloggedQuorumContext(ctx, request)
+		if err != nil {
+			return nil, err
+		}
+		stable := true
+		for _, response := range responses {
+			if response.Status == RPLY_ABORT {
+				return nil, errors.New(fmt.Sprintf("snapshot at %v is older than the garbage collection watermark %v", t.snapshot, response.Timestamp))
+			}
+			if response.Status == RPLY_ABSTAIN {
+				stable = false
+				break
+			}
+		}
+		if stable {
+			return responses, nil
+		}
+		if c.clock.Now().After(deadline) {
+			return nil, fmt.Errorf("%w: snapshot %s at %v blocked by prepared writes", ErrTimeout, request.Op.ToString(), t.snapshot)
+		}
+		if ctx.Err() != nil {
+			return nil, ContextError(ctx)
+		}
+		log.Println("snapshot", request.Op.ToString(), "waiting for prepared writes")
+		c.clock.Sleep(wait)
+		wait = min(2*wait, snapshotMaxRetryInterval)
+	}
+}
+
+// The first count rows in key order, all of them if count is 0
+func sortedRows(byKey map[string]*ScanRow, count int) []*ScanRow {
+	rows := make([]*ScanRow, 0, len(byKey))
+	for _, row := range byKey {
+		rows = append(rows, row)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i].Key < rows[j].Key
+	})
+	if count > 0 && len(rows) > count {
+		rows = rows[:count]
+	}
+	return rows
+}
+
+// Prepare the part of the transaction of every participant shard at the
+// timestamp. The transaction is prepared once all of them are, any abort
+// aborts it and otherwise it is retried at the latest timestamp asked for.
+func (t *Txn) prepare(ctx context.Context, participants map[int]*Transaction, timestamp *Timestamp, retry int) (*Response, error) {
+	c := t.client
+	responses := make(map[int]*Response)
+	var mu sync.Mutex
+	err := c.eachShard(shardIDs(participants), func(i int) error {
+		prepare_request := &Request{
+			Op:      OP_PREPARE,
+			TxnID:   t.t_id,
+			Retry:   retry,
+			Prepare: &PrepareMessage{Txn: participants[i], Timestamp: timestamp},
+		}
+		response, err := c.shards[i].ir_client.InvokeConsensusContext(ctx, prepare_request, decide)
+		mu.Lock()
+		responses[i] = response
+		mu.Unlock()
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
-	c.ir_client.InvokeInconsistent(abort_request)
-	c.Continue()
+
+	var max_retry_ts *Timestamp = nil
+	for i, response := range responses {
+		log.Println("shard", i, "prepared with status", ReplyTypeString(response.Status))
+		switch response.Status {
+		case RPLY_OK:
+		case RPLY_RETRY:
+			max_retry_ts = LaterTime(max_retry_ts, response.Timestamp)
+		default:
+			return NewResponse(RPLY_ABORT), nil
+		}
+	}
+	if max_retry_ts != nil {
+		return NewResponseWithTime(RPLY_RETRY, max_retry_ts), nil
+	}
+	return NewResponse(RPLY_OK), nil
+}
+
+// Split the transaction into the part every participant shard validates,
+// shards of the keys read or written. Keys of any shard may fall into a
+// scanned range, so a scan makes every shard a participant.
+func (t *Txn) participants() map[int]*Transaction {
+	c := t.client
+	participants := make(map[int]*Transaction)
+	part := func(i int) *Transaction {
+		if participants[i] == nil {
+			participants[i] = NewTransaction(t.t_id)
+			participants[i].ScanSet = t.txn.ScanSet
+		}
+		return participants[i]
+	}
+	for key, value := range t.txn.ReadSet {
+		part(c.shardOf(key)).AddReadSet(key, value, t.txn.ReadTime[key])
+	}
+	for key, value := range t.txn.WriteSet {
+		part(c.shardOf(key)).AddWriteSet(key, value)
+	}
+	if len(t.txn.ScanSet) > 0 {
+		for _, i := range c.allShards() {
+			part(i)
+		}
+	}
+	if len(participants) > 1 {
+		// Replicas of each shard must find the others to end the transaction
+		shards := shardIDs(participants)
+		for _, part := range participants {
+			part.Participants = shards
+		}
+	}
+	return participants
+}
+
+func (c *TapirClientImpl) shardOf(key string) int {
+	return c.partitioner(key, len(c.shards))
+}
+
+func (c *TapirClientImpl) allShards() []int {
+	shards := make([]int, len(c.shards))
+	for i := range shards {
+		shards[i] = i
+	}
+	return shards
+}
+
+// Shards of the participants in ascending order
+func shardIDs(participants map[int]*Transaction) []int {
+	shards := make([]int, 0, len(participants))
+	for i := range participants {
+		shards = append(shards, i)
+	}
+	sort.Ints(shards)
+	return shards
+}
+
+// Run fn for every shard in parallel, returns the first error
+func (c *TapirClientImpl) eachShard(shards []int, fn func(i int) error) error {
+	errs := make([]error, len(shards))
+	var mu sync.Mutex
+	remaining := len(shards)
+	done := c.clock.NewSignal()
+	for j, i := range shards {
+		c.clock.Go(func() {
+			err := fn(i)
+			mu.Lock()
+			errs[j] = err
+			remaining--
+			if remaining == 0 {
+				done.Notify()
+			}
+			mu.Unlock()
+		})
+	}
+	for {
+		mu.Lock()
+		finished := remaining == 0
+		mu.Unlock()
+		if finished {
+			break
+		}
+		done.Wait(0)
+	}
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 /** IR support method: TAPIR decide algorithm */
-func (c *TapirClientImpl) decide(results []*Response) *Response {
+func decide(results []*Response, n, f int) *Response {
 	// Merges inconsistent Prepare results from replicas into a single result
 	ok_count := 0
 	abstain_count := 0
@@ -169,15 +868,17 @@ func (c *TapirClientImpl) decide(results []*Response) *Response {
 			abstain_count++
 		}
 		if result == RPLY_RETRY {
-			max_retry_ts = LaterTime(max_retry_ts, NewTimestamp(c.client_id))
+			max_retry_ts = LaterTime(max_retry_ts, result_struct.Timestamp)
 		}
 	}
 
-	if ok_count > c.quorum_size {
+	// Size of majority replicas of the group the results come from
+	quorum_size := n - f
+	if ok_count >= quorum_size {
 		return NewResponse(RPLY_OK)
 	}
 
-	if abstain_count > c.quorum_size {
+	if abstain_count >= quorum_size {
 		return NewResponse(RPLY_ABORT)
 	}
 
@@ -189,15 +890,12 @@ func (c *TapirClientImpl) decide(results []*Response) *Response {
 }
 
 func (c *TapirClientImpl) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	return fmt.Sprintf("TAPIR Client {\n"+
 		"  id: %d,\n"+
-		"  ongoing_transaction: %d,\n"+
-		"  closest_replica_id: %d\n"+
+		"  transactions: %d,\n"+
+		"  shards: %d\n"+
 		"}",
-		c.client_id, c.t_id, c.replica_id)
-}
-
-func (c *TapirClientImpl) Continue() {
-	log.Println("Releaseing lock")
-	c.lock.Unlock()
+		c.client_id, c.txn_seq, len(c.shards))
 }
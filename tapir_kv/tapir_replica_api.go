@@ -1,7 +1,10 @@
 package tapir_kv
 
 import (
+	"time"
+
 	. "github.com/ViolaChenYT/TAPIR/common"
+	. "github.com/ViolaChenYT/TAPIR/tapir_kv/versionstore"
 )
 
 // TapirReplica represents a Key-value store with support for transactions using TAPIR.
@@ -13,9 +16,92 @@ type TapirReplica interface {
 	// Read the value corresponding to key, return value and version
 	Read(key string) (string, *Timestamp, error)
 
+	// Read the version of key valid at the given timestamp, a nil version means
+	// the key did not exist. The reply abstains while a prepared write below the
+	// timestamp may still commit.
+	ReadAt(key string, timestamp *Timestamp) (*Response, error)
+
+	// Read up to count keys at or after startKey in key order, a count of 0 reads
+	// every key after it. A nil timestamp reads the latest versions for a
+	// read-write transaction, the scan is validated when it prepares. A scan at a
+	// timestamp reads the versions valid then and abstains like ReadAt while a
+	// prepared write into the scanned range is below the timestamp.
+	Scan(startKey string, count int, timestamp *Timestamp) (*Response, error)
+
 	// Commit the transaction
-	Commit(txnID int, timestamp *Timestamp) error
+	Commit(txnID TxnID, timestamp *Timestamp) error
 
 	// Abort the transaction
-	Abort(txnID int) error
+	Abort(txnID TxnID) error
+
+	// Add the transaction to the prepared list without running OCC checks,
+	// used when the replica group already decided the prepare succeeded
+	ForcePrepare(txn *Transaction, timestamp *Timestamp)
+
+	// Remove the transaction from the prepared list without deciding its outcome
+	Unprepare(txnID TxnID)
+
+	// Report whether the transaction has committed or aborted on this replica
+	Outcome(txnID TxnID) (committed bool, finished bool)
+
+	// What the replica knows of the transaction, with the timestamp it
+	// committed or prepared at and the part of it prepared here
+	Status(txnID TxnID) (TxnStatus, *Timestamp, *Transaction)
+
+	// Transactions prepared at least timeout ago, in order of their ids
+	Orphaned(timeout time.Duration) []*Transaction
+
+	// Collect versions no transaction or snapshot at or after the watermark can
+	// see. The watermark is held back by prepared transactions and by snapshots
+	// that read from the replica since the time of the watermark, and never
+	// moves backwards. Later prepares and snapshots below it are turned away, so
+	// a snapshot quiet for longer than the retention period may abort. The
+	// first call starts watching snapshots, nothing is collected until the
+	// watermark passes the time it did.
+	CollectGarbage(watermark *Timestamp) GCStats
+
+	// Forget the transactions committed or aborted before the given timestamp
+	// and below the watermark. A late prepare of one is turned away by the
+	// watermark, but a replica of another shard may still ask for the outcome
+	// until it ends the transaction, see Configuration.PrepareTimeout.
+	ForgetOutcomes(before *Timestamp) GCStats
+
+	// What garbage collection reclaimed so far
+	GCStats() GCStats
+
+	// Copy the state of the replica: its store, the transactions it has
+	// prepared and the outcomes it knows
+	Checkpoint() *ReplicaCheckpoint
+
+	// Bring the replica up to a checkpoint of itself or of another replica,
+	// keeping what it knows already. Outcomes win over prepares.
+	Restore(checkpoint *ReplicaCheckpoint)
+
+	// Release the underlying store
+	Close() error
+}
+
+// GCStats counts what garbage collection reclaimed on a replica
+type GCStats struct {
+	Runs              int
+	VersionsReclaimed int
+	ReadsReclaimed    int
+	OutcomesForgotten int
+	Watermark         *Timestamp // latest watermark, nil before the first run
+}
+
+// ReplicaCheckpoint is the state of a replica at a timestamp
+type ReplicaCheckpoint struct {
+	Timestamp *Timestamp // when the replica took it
+	Store     *StoreSnapshot
+	Prepared  []*PreparedTxn
+	Committed map[TxnID]*Timestamp
+	Aborted   map[TxnID]*Timestamp // when they aborted
+	Watermark *Timestamp           // nil before the first garbage collection
+}
+
+// PreparedTxn is a prepared transaction of a checkpoint
+type PreparedTxn struct {
+	Txn       *Transaction
+	Timestamp *Timestamp
 }
@@ -4,35 +4,77 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"sort"
+	"sync"
+	"time"
 
 	. "github.com/ViolaChenYT/TAPIR/common"
 	. "github.com/ViolaChenYT/TAPIR/tapir_kv/versionstore"
 )
 
 type TimedTransaction struct {
-	txn  *Transaction
-	time *Timestamp
+	txn   *Transaction
+	time  *Timestamp
+	since time.Time // when the replica prepared it
 }
 
 // TapirReplicaImpl represents an implementation of the TapirReplica interface
 type TapirReplicaImpl struct {
-	store    VersionedKVStore          // versioned data store
-	prepared map[int]*TimedTransaction // list of transactions replica is prepared to commit
-	ID       int                       // same as corredponding tapir server ID, may change
+	store     VersionedKVStore            // versioned data store
+	prepared  map[TxnID]*TimedTransaction // list of transactions replica is prepared to commit
+	committed map[TxnID]*Timestamp        // transactions that have committed on this replica, and when
+	aborted   map[TxnID]*Timestamp        // transactions that have aborted on this replica, and when
+	ID        int                         // same as corredponding tapir server ID, may change
+	clock     Clock                       // tells how long transactions have been prepared
+
+	watermark *Timestamp                      // versions below it may be collected, nil before the first collection
+	snapshots map[snapshotKey]*activeSnapshot // snapshots that read from the replica since watching began
+	watching  time.Time                       // when the first collection began watching snapshots, zero before
+	gcStats   GCStats
+	mu        sync.Mutex
+}
+
+// A snapshot timestamp as a map key
+type snapshotKey struct {
+	time int64
+	id   int
+}
+
+// Timestamp of a snapshot and when it last read from the replica
+type activeSnapshot struct {
+	time *Timestamp
+	seen time.Time
 }
 
 func NewReplica(id int) TapirReplica {
+	return NewReplicaWithStore(id, NewVersionedKVStore(), SystemClock)
+}
+
+// NewReplicaWithStore creates a replica on top of an existing versioned store
+func NewReplicaWithStore(id int, store VersionedKVStore, clock Clock) TapirReplica {
 	r := TapirReplicaImpl{
-		store:    NewVersionedKVStore(),
-		prepared: make(map[int]*TimedTransaction),
-		ID:       id,
+		store:     store,
+		prepared:  make(map[TxnID]*TimedTransaction),
+		committed: make(map[TxnID]*Timestamp),
+		aborted:   make(map[TxnID]*Timestamp),
+		ID:        id,
+		clock:     clock,
+		snapshots: make(map[snapshotKey]*activeSnapshot),
 	}
 	return &r
 }
 
 func (r *TapirReplicaImpl) Prepare(txn *Transaction, timestamp *Timestamp) (*Response, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	// Check prepared for txn.id
 	log.Println(r.ID, "Trying Preparing transaction", txn)
+	if r.committed[txn.ID] != nil {
+		return NewResponse(RPLY_OK), nil
+	}
+	if r.aborted[txn.ID] != nil {
+		return NewResponse(RPLY_ABORT), nil
+	}
 	if prepared_txn, ok := r.prepared[txn.ID]; ok {
 		if prepared_txn.time.Equals(timestamp) {
 			// Transaction already prepared
@@ -41,11 +83,10 @@ func (r *TapirReplicaImpl) Prepare(txn *Transaction, timestamp *Timestamp) (*Res
 			// Re-run the checks again for a new timestamp
 			delete(r.prepared, txn.ID)
 		}
-	} else {
-		// New transaction
-		newtime := NewTimestamp(timestamp.ID)
-		r.prepared[txn.ID] = &TimedTransaction{txn, newtime}
-		return r.occCheck(txn, newtime), nil
+	}
+	if r.watermark != nil && timestamp.LessThan(r.watermark) {
+		// Versions the checks need may already be collected
+		return NewResponseWithTime(RPLY_RETRY, r.watermark), nil
 	}
 
 	// Run OCC checks
@@ -53,34 +94,112 @@ func (r *TapirReplicaImpl) Prepare(txn *Transaction, timestamp *Timestamp) (*Res
 }
 
 func (r *TapirReplicaImpl) Read(key string) (string, *Timestamp, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	// Returns value and version, where version is the timestamp of the transaction that wrote that version
 	versionedVal, ok := r.store.Get(key)
 	if ok {
 		return versionedVal.Value, versionedVal.WriteTime, nil
 	} else {
-		return versionedVal.Value, versionedVal.WriteTime, errors.New(fmt.Sprintf("Key %s not exist in replica %d.", key, r.ID))
+		// No version was read, OCC treats the read as older than any write
+		return versionedVal.Value, nil, errors.New(fmt.Sprintf("Key %s not exist in replica %d.", key, r.ID))
+	}
+}
+
+func (r *TapirReplicaImpl) ReadAt(key string, timestamp *Timestamp) (*Response, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.watermark != nil && timestamp.LessThan(r.watermark) {
+		// Snapshot too old, its versions may already be collected
+		return NewResponseWithTime(RPLY_ABORT, r.watermark), nil
+	}
+	r.readAt(timestamp)
+	for _, writeTime := range r.getPreparedWrites()[key] {
+		if writeTime.LessThan(timestamp) {
+			// The snapshot is not stable until this transaction commits or aborts
+			return NewResponseWithTime(RPLY_ABSTAIN, writeTime), nil
+		}
+	}
+
+	versionedVal, ok := r.store.GetAt(key, timestamp)
+	var version *Timestamp
+	if ok {
+		version = versionedVal.WriteTime
+	}
+	// Treat the snapshot as a read at the timestamp, so no later write can commit below it
+	r.store.CommitGet(key, version, timestamp)
+	if !ok {
+		// A nil version tells the client the key did not exist at the timestamp
+		return NewReadResponse("", nil), nil
 	}
+	return NewReadResponse(versionedVal.Value, version), nil
 }
 
-func (r *TapirReplicaImpl) Commit(txnID int, timestamp *Timestamp) error {
+func (r *TapirReplicaImpl) Scan(startKey string, count int, timestamp *Timestamp) (*Response, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if timestamp == nil {
+		return NewScanResponse(scanRows(r.store.Scan(startKey, count, nil))), nil
+	}
+	if r.watermark != nil && timestamp.LessThan(r.watermark) {
+		// Snapshot too old, its versions may already be collected
+		return NewResponseWithTime(RPLY_ABORT, r.watermark), nil
+	}
+	r.readAt(timestamp)
+
+	found := r.store.Scan(startKey, count, timestamp)
+	rows := scanRows(found)
+	scanned := scannedRange(startKey, count, rows)
+	for _, timedTxn := range r.preparedInOrder() {
+		if !timedTxn.time.LessThan(timestamp) {
+			continue
+		}
+		for _, key := range timedTxn.txn.WriteKeys() {
+			if scanned.Contains(key) {
+				// The snapshot is not stable until this transaction commits or aborts
+				return NewResponseWithTime(RPLY_ABSTAIN, timedTxn.time), nil
+			}
+		}
+	}
+	// Treat the snapshot as reads at the timestamp, so no later write can
+	// commit below it, neither to a key found nor into a gap between them
+	for _, kv := range found {
+		r.store.CommitGet(kv.Key, kv.WriteTime, timestamp)
+	}
+	r.store.CommitScan(scanned.Start, scanned.End, timestamp)
+	return NewScanResponse(rows), nil
+}
+
+func (r *TapirReplicaImpl) Commit(txnID TxnID, timestamp *Timestamp) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	// for id, timedTxn := range r.prepared {
 	// 	log.Println("Prepared transaction", id, ":", timedTxn)
 	// }
 	log.Println(r.ID, "currently", len(r.prepared), "prepared transactions-----------------")
+	if r.committed[txnID] != nil {
+		// Already applied
+		return nil
+	}
 	timedTxn := r.prepared[txnID]
 
 	// Updates its versioned store
 	log.Println("Committing transaction", txnID, "trying to get read set")
 	if timedTxn == nil {
-		log.Panicln("AHHHHHHHHHHHHHHHHHHH")
+		return errors.New(fmt.Sprintf("Transaction %v is not prepared on replica %d.", txnID, r.ID))
 	}
 	log.Println(timedTxn.txn)
 	readTimes := timedTxn.txn.ReadTime
-	for key, version := range readTimes {
-		// Update version for read operations
+	for key := range timedTxn.txn.ReadSet {
+		// Update version for read operations, a missing version is a read of no version
+		version := readTimes[key]
 		log.Println("About to call Commit Get for key: ", key)
 		r.store.CommitGet(key, version, timestamp)
 	}
+	for _, scan := range timedTxn.txn.ScanSet {
+		// Order writes into the gaps of scanned ranges after the transaction
+		r.store.CommitScan(scan.Start, scan.End, timestamp)
+	}
 	for key, value := range timedTxn.txn.WriteSet {
 		// Update value and version for write operations
 		log.Println("About to call Put for key: ", key)
@@ -92,16 +211,71 @@ func (r *TapirReplicaImpl) Commit(txnID int, timestamp *Timestamp) error {
 	// Removes the transaction from prepared list
 	log.Println(r.ID, "deleting transaction", txnID)
 	delete(r.prepared, txnID)
+	r.committed[txnID] = timestamp
 	return nil
 }
 
-func (r *TapirReplicaImpl) Abort(txnID int) error {
+func (r *TapirReplicaImpl) Abort(txnID TxnID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	// Removes the transaction from prepared list
 	log.Println(r.ID, "Aborting transaction", txnID)
 	delete(r.prepared, txnID)
+	if r.committed[txnID] == nil {
+		r.aborted[txnID] = NewCustomTimestamp(r.ID, r.clock.Now())
+	}
 	return nil
 }
 
+func (r *TapirReplicaImpl) ForcePrepare(txn *Transaction, timestamp *Timestamp) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.committed[txn.ID] != nil || r.aborted[txn.ID] != nil {
+		return
+	}
+	r.prepared[txn.ID] = &TimedTransaction{txn, timestamp, r.clock.Now()}
+}
+
+func (r *TapirReplicaImpl) Unprepare(txnID TxnID) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.prepared, txnID)
+}
+
+func (r *TapirReplicaImpl) Outcome(txnID TxnID) (bool, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	committed := r.committed[txnID] != nil
+	return committed, committed || r.aborted[txnID] != nil
+}
+
+func (r *TapirReplicaImpl) Status(txnID TxnID) (TxnStatus, *Timestamp, *Transaction) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if timestamp := r.committed[txnID]; timestamp != nil {
+		return TXN_COMMITTED, timestamp, nil
+	}
+	if r.aborted[txnID] != nil {
+		return TXN_ABORTED, nil, nil
+	}
+	if timedTxn, ok := r.prepared[txnID]; ok {
+		return TXN_PREPARED, timedTxn.time, timedTxn.txn
+	}
+	return TXN_UNKNOWN, nil, nil
+}
+
+func (r *TapirReplicaImpl) Orphaned(timeout time.Duration) []*Transaction {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var orphaned []*Transaction
+	for _, timedTxn := range r.preparedInOrder() {
+		if r.clock.Now().Sub(timedTxn.since) >= timeout {
+			orphaned = append(orphaned, timedTxn.txn)
+		}
+	}
+	return orphaned
+}
+
 // Private functions
 
 func (r *TapirReplicaImpl) occCheck(txn *Transaction, timestamp *Timestamp) *Response {
@@ -110,51 +284,114 @@ func (r *TapirReplicaImpl) occCheck(txn *Transaction, timestamp *Timestamp) *Res
 	preparedReads := r.getPreparedReads()
 	preparedWrites := r.getPreparedWrites()
 
+	// Keys are checked in order, so the same state always gives the same answer
 	readVals, readTimes := txn.ReadSet, txn.ReadTime
-	for key := range readVals {
+	for _, key := range txn.ReadKeys() {
 		version := readTimes[key]
 		lastVersionedVal, ok := r.store.Get(key)
 
-		if !ok {
-			// No conflict if we don't have this version
+		if version == nil {
+			// The key did not exist when it was read
+			if ok {
+				return NewResponse(RPLY_ABORT)
+			} else if len(preparedWrites[key]) > 0 {
+				return NewResponse(RPLY_ABSTAIN)
+			}
 			continue
 		}
 
-		if version.LessThan(lastVersionedVal.WriteTime) {
+		if timestamp.LessThan(version) {
+			// Can't serialize before a version the transaction has seen
+			return NewResponseWithTime(RPLY_RETRY, version)
+		}
+
+		if ok && version.LessThan(lastVersionedVal.WriteTime) {
 			return NewResponse(RPLY_ABORT)
-		} else if len(preparedWrites[key]) > 0 && version.LessThan(MinTimestamp(preparedWrites[key])) {
+		}
+		// A replica that missed the version read still knows the writes prepared after it
+		if len(preparedWrites[key]) > 0 && version.LessThan(MaxTimestamp(preparedWrites[key])) {
+			// A newer version may be about to commit
 			return NewResponse(RPLY_ABSTAIN)
 		}
 	}
 
-	for key := range txn.WriteSet {
-		lastRead, ok := r.store.GetLastRead(key, timestamp)
+	for _, scan := range txn.ScanSet {
+		// The scan saw every key of the range that it read, any other key with a
+		// version at the timestamp is a phantom. Only n+1 keys need to be looked at
+		// if the scan read n keys in the range.
+		seen := 0
+		for key := range readVals {
+			if scan.Contains(key) {
+				seen++
+			}
+		}
+		for _, kv := range r.store.Scan(scan.Start, seen+1, timestamp) {
+			if !scan.Contains(kv.Key) {
+				break
+			}
+			if _, ok := readVals[kv.Key]; !ok {
+				return NewResponse(RPLY_ABORT)
+			}
+		}
+		for key, writeTimes := range preparedWrites {
+			if _, ok := readVals[key]; ok || !scan.Contains(key) {
+				continue
+			}
+			for _, writeTime := range writeTimes {
+				if writeTime.LessThan(timestamp) {
+					// A phantom may be about to commit
+					return NewResponse(RPLY_ABSTAIN)
+				}
+			}
+		}
+	}
 
-		if !ok {
-			// No conflict if it has not been read
-			continue
+	for _, key := range txn.WriteKeys() {
+		// A prepared transaction read this key at a later timestamp
+		if maxReadTimestamp := MaxTimestamp(preparedReads[key]); maxReadTimestamp != nil && timestamp.LessThan(maxReadTimestamp) {
+			return NewResponseWithTime(RPLY_RETRY, maxReadTimestamp)
 		}
-		maxReadTimestamp := MaxTimestamp(preparedReads[key])
-		if maxReadTimestamp == nil {
-			continue
-		} else if timestamp.LessThan(maxReadTimestamp) {
-			// log.Panicln("possible B")
-			lastPreparedRead := maxReadTimestamp
-			return NewResponseWithTime(RPLY_RETRY, lastPreparedRead)
-		} else if timestamp.LessThan(lastRead) {
+		// A prepared transaction scanned a range holding this key at a later timestamp
+		if maxScanTimestamp := r.getPreparedScan(key); maxScanTimestamp != nil && timestamp.LessThan(maxScanTimestamp) {
+			return NewResponseWithTime(RPLY_RETRY, maxScanTimestamp)
+		}
+		// A committed transaction scanned a range holding this key at a later timestamp
+		if lastScan, ok := r.store.GetLastScan(key); ok && timestamp.LessThan(lastScan) {
+			return NewResponseWithTime(RPLY_RETRY, lastScan)
+		}
+		// A committed transaction read the version we would overwrite at a later timestamp
+		if lastRead, ok := r.store.GetLastRead(key, timestamp); ok && timestamp.LessThan(lastRead) {
 			return NewResponseWithTime(RPLY_RETRY, lastRead)
 		}
+		// A later version was already committed
+		if lastVersionedVal, ok := r.store.Get(key); ok && timestamp.LessThan(lastVersionedVal.WriteTime) {
+			return NewResponseWithTime(RPLY_RETRY, lastVersionedVal.WriteTime)
+		}
 	}
 
-	r.prepared[txn.ID] = &TimedTransaction{txn, timestamp}
+	r.prepared[txn.ID] = &TimedTransaction{txn, timestamp, r.clock.Now()}
 
 	return NewResponse(RPLY_OK)
 }
 
+// Prepared transactions in order of their ids
+func (r *TapirReplicaImpl) preparedInOrder() []*TimedTransaction {
+	ids := make([]TxnID, 0, len(r.prepared))
+	for id := range r.prepared {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].Less(ids[j]) })
+	prepared := make([]*TimedTransaction, len(ids))
+	for i, id := range ids {
+		prepared[i] = r.prepared[id]
+	}
+	return prepared
+}
+
 // Return timestamps of prepared reads
 func (r *TapirReplicaImpl) getPreparedReads() map[string][]*Timestamp {
 	reads := make(map[string][]*Timestamp)
-	for _, timedTxn := range r.prepared {
+	for _, timedTxn := range r.preparedInOrder() {
 		readVals := timedTxn.txn.ReadSet
 		for key := range readVals {
 			if readsKey, ok := reads[key]; ok {
@@ -170,7 +407,7 @@ func (r *TapirReplicaImpl) getPreparedReads() map[string][]*Timestamp {
 // Return timestamps of prepared writes
 func (r *TapirReplicaImpl) getPreparedWrites() map[string][]*Timestamp {
 	writes := make(map[string][]*Timestamp)
-	for _, timedTxn := range r.prepared {
+	for _, timedTxn := range r.preparedInOrder() {
 		for key := range timedTxn.txn.WriteSet {
 			if writesKey, ok := writes[key]; ok {
 				writes[key] = append(writesKey, timedTxn.time)
@@ -181,3 +418,177 @@ func (r *TapirReplicaImpl) getPreparedWrites() map[string][]*Timestamp {
 	}
 	return writes
 }
+
+// Return the latest timestamp of the prepared scans covering key, nil if none
+func (r *TapirReplicaImpl) getPreparedScan(key string) *Timestamp {
+	var latest *Timestamp
+	for _, timedTxn := range r.prepared {
+		for _, scan := range timedTxn.txn.ScanSet {
+			if scan.Contains(key) {
+				latest = LaterTime(latest, timedTxn.time)
+				break
+			}
+		}
+	}
+	return latest
+}
+
+// Convert keys found by the store into scan replies
+func scanRows(found []*KeyVersion) []*ScanRow {
+	rows := make([]*ScanRow, len(found))
+	for i, kv := range found {
+		rows[i] = &ScanRow{Key: kv.Key, Value: kv.Value, Timestamp: kv.WriteTime}
+	}
+	return rows
+}
+
+// The range of keys a scan covered: up to the last key it returned if it
+// stopped at count, every key after startKey otherwise
+func scannedRange(startKey string, count int, rows []*ScanRow) *KeyRange {
+	if count > 0 && len(rows) >= count {
+		return &KeyRange{Start: startKey, End: rows[count-1].Key}
+	}
+	return &KeyRange{Start: startKey}
+}
+
+// Remember that a snapshot read at timestamp, it may read again. Must hold r.mu.
+func (r *TapirReplicaImpl) readAt(timestamp *Timestamp) {
+	if r.watching.IsZero() {
+		// Nothing collects garbage yet
+		return
+	}
+	key := snapshotKey{timestamp.Timestamp.UnixNano(), timestamp.ID}
+	r.snapshots[key] = &activeSnapshot{timestamp, r.clock.Now()}
+}
+
+func (r *TapirReplicaImpl) CollectGarbage(watermark *Timestamp) GCStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// Snapshots that read since the time of the watermark may read again,
+	// the ones quiet for longer are presumed done. Until the replica watched
+	// snapshots for that long it can't tell which ones are.
+	if r.watching.IsZero() {
+		r.watching = r.clock.Now()
+	}
+	if watermark.Timestamp.Before(r.watching) {
+		return r.gcStats
+	}
+	since := watermark.Timestamp
+	for key, snapshot := range r.snapshots {
+		if snapshot.seen.Before(since) {
+			delete(r.snapshots, key)
+		} else if snapshot.time.LessThan(watermark) {
+			watermark = snapshot.time
+		}
+	}
+	// Prepared transactions may still commit or be read at their timestamp
+	for _, timedTxn := range r.prepared {
+		if timedTxn.time.LessThan(watermark) {
+			watermark = timedTxn.time
+		}
+	}
+	if r.watermark != nil && !r.watermark.LessThan(watermark) {
+		return r.gcStats
+	}
+	r.watermark = watermark
+	versions, reads := r.store.CollectGarbage(watermark)
+	r.gcStats.Runs++
+	r.gcStats.VersionsReclaimed += versions
+	r.gcStats.ReadsReclaimed += reads
+	r.gcStats.Watermark = watermark
+	if versions > 0 || reads > 0 {
+		log.Println("Replica", r.ID, "collected", versions, "versions and", reads, "reads below", watermark)
+	}
+	return r.gcStats
+}
+
+func (r *TapirReplicaImpl) ForgetOutcomes(before *Timestamp) GCStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// Above the watermark a late prepare would pass OCC again
+	if r.watermark == nil {
+		return r.gcStats
+	}
+	if r.watermark.LessThan(before) {
+		before = r.watermark
+	}
+	forgotten := 0
+	for id, timestamp := range r.committed {
+		if timestamp.LessThan(before) {
+			delete(r.committed, id)
+			forgotten++
+		}
+	}
+	for id, timestamp := range r.aborted {
+		if timestamp.LessThan(before) {
+			delete(r.aborted, id)
+			forgotten++
+		}
+	}
+	r.gcStats.OutcomesForgotten += forgotten
+	if forgotten > 0 {
+		log.Println("Replica", r.ID, "forgot", forgotten, "outcomes below", before)
+	}
+	return r.gcStats
+}
+
+func (r *TapirReplicaImpl) GCStats() GCStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.gcStats
+}
+
+func (r *TapirReplicaImpl) Checkpoint() *ReplicaCheckpoint {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	checkpoint := &ReplicaCheckpoint{
+		Timestamp: NewCustomTimestamp(r.ID, r.clock.Now()),
+		Store:     r.store.Snapshot(),
+		Committed: make(map[TxnID]*Timestamp, len(r.committed)),
+		Aborted:   make(map[TxnID]*Timestamp, len(r.aborted)),
+		Watermark: r.watermark,
+	}
+	for _, timedTxn := range r.preparedInOrder() {
+		checkpoint.Prepared = append(checkpoint.Prepared, &PreparedTxn{Txn: timedTxn.txn, Timestamp: timedTxn.time})
+	}
+	for id, timestamp := range r.committed {
+		checkpoint.Committed[id] = timestamp
+	}
+	for id, timestamp := range r.aborted {
+		checkpoint.Aborted[id] = timestamp
+	}
+	return checkpoint
+}
+
+func (r *TapirReplicaImpl) Restore(checkpoint *ReplicaCheckpoint) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// The versions of committed transactions come with the store
+	r.store.Restore(checkpoint.Store)
+	for id, timestamp := range checkpoint.Committed {
+		delete(r.prepared, id)
+		delete(r.aborted, id)
+		r.committed[id] = timestamp
+	}
+	for id, timestamp := range checkpoint.Aborted {
+		if r.committed[id] == nil && r.aborted[id] == nil {
+			delete(r.prepared, id)
+			r.aborted[id] = timestamp
+		}
+	}
+	for _, p := range checkpoint.Prepared {
+		id := p.Txn.ID
+		if _, ok := r.prepared[id]; ok || r.committed[id] != nil || r.aborted[id] != nil {
+			continue
+		}
+		r.prepared[id] = &TimedTransaction{p.Txn, p.Timestamp, r.clock.Now()}
+	}
+	if checkpoint.Watermark != nil && (r.watermark == nil || r.watermark.LessThan(checkpoint.Watermark)) {
+		r.watermark = checkpoint.Watermark
+	}
+	log.Println("Replica", r.ID, "restored checkpoint of", checkpoint.Timestamp, "with", len(checkpoint.Store.Versions), "versions")
+}
+
+func (r *TapirReplicaImpl) Close() error {
+	return r.store.Close()
+}
@@ -1,32 +1,271 @@
 package tapir_kv
 
 import (
+	"bytes"
+	"context"
+	"encoding/gob"
 	"errors"
 	"fmt"
 	"log"
+	"sort"
+	"sync"
+	"time"
 
 	. "github.com/ViolaChenYT/TAPIR/IR"
 	. "github.com/ViolaChenYT/TAPIR/common"
+	. "github.com/ViolaChenYT/TAPIR/tapir_kv/versionstore"
 )
 
 // Server represents a Tapir server
 type TapirServer struct {
 	store TapirReplica
 	id    int
+
+	clock         Clock
+	stopGC        Signal             // stops background garbage collection
+	stopTerminate Signal             // stops ending orphaned transactions
+	gcDone        Signal             // background garbage collection stopped, nil if it never ran
+	terminateDone Signal             // ending orphaned transactions stopped, nil if it never ran
+	closing       context.Context    // done once the server closes, cuts short the calls ending orphaned transactions
+	cancel        context.CancelFunc // of closing
+	closeOnce     sync.Once
+
+	config *Configuration  // deployment of the server, nil if it knows no other replica
+	shard  int             // shard of the server in config
+	shards map[int]*Client // calls to the shards of orphaned transactions, made on first use
 }
 
 // NewServer creates a new instance of Server
 func NewTapirServer(id int) IRAppReplica {
+	closing, cancel := context.WithCancel(context.Background())
 	return &TapirServer{
-		store: NewReplica(id),
-		id:    id,
+		store:         NewReplica(id),
+		id:            id,
+		clock:         SystemClock,
+		stopGC:        SystemClock.NewSignal(),
+		stopTerminate: SystemClock.NewSignal(),
+		closing:       closing,
+		cancel:        cancel,
+	}
+}
+
+// NewTapirServerWithConfig creates a server whose store is durable when the
+// configuration has storage, an existing store of the replica is reopened
+// with the configured engine. Old versions are collected in the background,
+// and if PrepareTimeout is set transactions left prepared by their client are
+// ended after it.
+func NewTapirServerWithConfig(id int, config *Configuration) (IRAppReplica, error) {
+	store := NewVersionedKVStore()
+	if config.Storage != nil {
+		var err error
+		store, err = OpenVersionedKVStore(config.Storage.Dir(id, "store"), config.Storage, config.Clock)
+		if err != nil {
+			return nil, err
+		}
+	}
+	closing, cancel := context.WithCancel(context.Background())
+	server := &TapirServer{
+		store:         NewReplicaWithStore(id, store, config.Clock),
+		id:            id,
+		clock:         config.Clock,
+		stopGC:        config.Clock.NewSignal(),
+		stopTerminate: config.Clock.NewSignal(),
+		closing:       closing,
+		cancel:        cancel,
+		config:        config,
+		shards:        make(map[int]*Client),
+	}
+	for i, shard := range config.Shards {
+		if _, ok := shard[id]; ok {
+			server.shard = i
+		}
+	}
+	server.runInBackground(config)
+	return server, nil
+}
+
+// Start collecting garbage and ending orphaned transactions as configured,
+// Close waits for both to stop
+func (server *TapirServer) runInBackground(config *Configuration) {
+	if config.GCInterval > 0 {
+		server.gcDone = server.clock.NewSignal()
+		server.clock.Go(func() {
+			defer server.gcDone.Notify()
+			server.collectGarbage(config.GCInterval, config.GCRetention, config.PrepareTimeout)
+		})
+	}
+	if config.PrepareTimeout > 0 {
+		server.terminateDone = server.clock.NewSignal()
+		server.clock.Go(func() {
+			defer server.terminateDone.Notify()
+			server.terminateOrphans(config.PrepareTimeout)
+		})
+	}
+}
+
+// Close the store of the server once its background work stopped
+func (server *TapirServer) Close() error {
+	var err error
+	server.closeOnce.Do(func() {
+		server.stopGC.Notify()
+		server.stopTerminate.Notify()
+		server.cancel()
+		// A pass that already started must not reach a closed store
+		if server.gcDone != nil {
+			server.gcDone.Wait(0)
+		}
+		if server.terminateDone != nil {
+			server.terminateDone.Wait(0)
+		}
+		err = server.store.Close()
+	})
+	return err
+}
+
+// Periodically drop versions older than the retention period. Outcomes are
+// kept for another prepare timeout, until no replica of another shard can
+// still be ending the transaction.
+func (server *TapirServer) collectGarbage(interval time.Duration, retention time.Duration, prepareTimeout time.Duration) {
+	for !server.stopGC.Wait(interval) {
+		now := server.clock.Now()
+		server.store.CollectGarbage(NewCustomTimestamp(0, now.Add(-retention)))
+		server.store.ForgetOutcomes(NewCustomTimestamp(0, now.Add(-retention-prepareTimeout)))
+	}
+}
+
+// Periodically end the transactions prepared longer than timeout ago
+func (server *TapirServer) terminateOrphans(timeout time.Duration) {
+	for !server.stopTerminate.Wait(timeout / 2) {
+		for _, txn := range server.store.Orphaned(timeout) {
+			server.terminate(txn)
+		}
+	}
+}
+
+// Cooperative termination of a transaction whose client is presumed gone:
+// ask every replica of the participant shards what they know of it, then
+// commit or abort it on all of them. A transaction whose outcome the
+// replicas that replied can't tell is left for the next round.
+func (server *TapirServer) terminate(txn *Transaction) {
+	shards := txn.Participants
+	if len(shards) == 0 {
+		shards = []int{server.shard}
+	}
+	log.Println("Replica", server.id, "ending orphaned transaction", txn.ID, "on shards", shards)
+	replies := make(map[int]map[int]*Response)
+	groups := make(map[int]*Configuration)
+	parts := make(map[int]*Transaction)
+	for _, i := range shards {
+		client, err := server.shardClient(i)
+		if err != nil {
+			log.Println("Replica", server.id, "can't reach shard", i, err)
+			return
+		}
+		replies[i], _ = client.InvokeUnloggedAllContext(server.closing, &Request{Op: OP_STATUS, TxnID: txn.ID})
+		// The group the replies came from, a reconfiguration may have changed it
+		ids, f := client.Members()
+		groups[i] = &Configuration{N: len(ids), F: f}
+		for id, reply := range replies[i] {
+			if reply == nil {
+				// The replica could not answer, same as no reply
+				delete(replies[i], id)
+			} else if reply.Txn != nil {
+				parts[i] = reply.Txn
+			}
+		}
+	}
+
+	status, timestamp := decideOrphan(replies, groups)
+	for _, i := range shards {
+		var request *Request
+		switch status {
+		case TXN_COMMITTED:
+			// Replicas that missed the prepare commit the part another one had
+			request = &Request{Op: OP_COMMIT, TxnID: txn.ID, Commit: &CommitMessage{Timestamp: timestamp, Txn: parts[i]}}
+		case TXN_ABORTED:
+			request = &Request{Op: OP_ABORT, TxnID: txn.ID}
+		default:
+			log.Println("Replica", server.id, "can't tell the outcome of transaction", txn.ID, "yet")
+			return
+		}
+		if err := server.shards[i].InvokeInconsistentContext(server.closing, request); err != nil {
+			log.Println("Replica", server.id, "could not end transaction", txn.ID, "on shard", i, err)
+		}
+	}
+}
+
+// Client of the replica group of shard i
+func (server *TapirServer) shardClient(i int) (*Client, error) {
+	if client, ok := server.shards[i]; ok {
+		return client, nil
+	}
+	group := *server.config.Shard(i)
+	// Clients have ids from 0 up, replicas call from below them
+	group.Client = NewClientConfiguration(-1-server.id, -1-server.id, server.id)
+	client, err := NewIRClient(&group)
+	if err != nil {
+		return nil, err
 	}
+	server.shards[i] = client
+	return client, nil
+}
+
+// Outcome of an orphaned transaction from the status replies of the replicas
+// of each participant shard, by shard and replica. A replica that finished
+// the transaction tells its outcome. Otherwise it commits if a majority of
+// every shard prepared it at the same timestamp, as it does once its client
+// decided to commit, and aborts if no timestamp can have such a majority
+// even with the replicas that did not reply. TXN_UNKNOWN if neither holds.
+func decideOrphan(replies map[int]map[int]*Response, groups map[int]*Configuration) (TxnStatus, *Timestamp) {
+	// Timestamps the transaction may have prepared at, nil stands for one
+	// only replicas that did not reply know of
+	candidates := []*Timestamp{nil}
+	for _, shard := range replies {
+		for _, reply := range shard {
+			switch reply.TxnStatus {
+			case TXN_COMMITTED:
+				return TXN_COMMITTED, reply.Timestamp
+			case TXN_ABORTED:
+				return TXN_ABORTED, nil
+			case TXN_PREPARED:
+				candidates = append(candidates, reply.Timestamp)
+			}
+		}
+	}
+
+	possible := false
+	for _, timestamp := range candidates {
+		prepared, impossible := true, false
+		for i, shard := range replies {
+			cnt := 0
+			for _, reply := range shard {
+				if timestamp != nil && reply.TxnStatus == TXN_PREPARED && reply.Timestamp.Equals(timestamp) {
+					cnt++
+				}
+			}
+			unknown := groups[i].N - len(shard)
+			prepared = prepared && cnt >= groups[i].F+1
+			impossible = impossible || cnt+unknown < groups[i].F+1
+		}
+		if prepared {
+			return TXN_COMMITTED, timestamp
+		}
+		possible = possible || !impossible
+	}
+	if !possible {
+		return TXN_ABORTED, nil
+	}
+	return TXN_UNKNOWN, nil
 }
 
 func (server *TapirServer) ExecInconsistentUpcall(op *Request) error {
 	switch op.Op {
 	case OP_COMMIT:
 		log.Println("asking for commit", op.Commit.Timestamp)
+		if op.Commit.Txn != nil {
+			// The prepare may still be on its way, the group already decided
+			server.store.ForcePrepare(op.Commit.Txn, op.Commit.Timestamp)
+		}
 		server.store.Commit(op.TxnID, op.Commit.Timestamp)
 	case OP_ABORT:
 		server.store.Abort(op.TxnID)
@@ -47,12 +286,118 @@ func (server *TapirServer) ExecConsensusUpcall(op *Request) (*Response, error) {
 
 func (server *TapirServer) ExecUnloggedUpcall(op *Request) (*Response, error) {
 	if op.Op == OP_GET {
+		if op.Get.Timestamp != nil {
+			// Snapshot read
+			return server.store.ReadAt(op.Get.Key, op.Get.Timestamp)
+		}
 		val, timestamp, err := server.store.Read(op.Get.Key)
 		return NewReadResponse(val, timestamp), err
 	}
+	if op.Op == OP_SCAN {
+		return server.store.Scan(op.Scan.StartKey, op.Scan.Count, op.Scan.Timestamp)
+	}
+	if op.Op == OP_STATUS {
+		status, timestamp, txn := server.store.Status(op.TxnID)
+		reply := NewResponseWithTime(RPLY_OK, timestamp)
+		reply.TxnStatus, reply.Txn = status, txn
+		return reply, nil
+	}
 	return nil, errors.New("Unrecognized unlogged operation")
 }
 
+// Sync makes the prepared list agree with the master record, then applies
+// the commits and aborts this replica missed
+func (server *TapirServer) Sync(record *Record) error {
+	var decided []*RecordEntry
+	for _, entry := range record.Entries() {
+		if entry.Proto == INCONSISTENT {
+			decided = append(decided, entry)
+			continue
+		}
+		if entry.Request.Op != OP_PREPARE {
+			continue
+		}
+		if entry.Result != nil && entry.Result.Status == RPLY_OK {
+			server.store.ForcePrepare(entry.Request.Prepare.Txn, entry.Request.Prepare.Timestamp)
+		} else {
+			server.store.Unprepare(entry.Request.TxnID)
+		}
+	}
+
+	// Apply commits and aborts in timestamp order
+	sort.Slice(decided, func(i, j int) bool {
+		a, b := decided[i].Request.Commit, decided[j].Request.Commit
+		if a == nil || b == nil {
+			return b != nil
+		}
+		return a.Timestamp.LessThan(b.Timestamp)
+	})
+	for _, entry := range decided {
+		if err := server.ExecInconsistentUpcall(entry.Request); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Merge decides the prepares left tentative by a view change. Prepares in d
+// keep their majority result, prepares in u are validated again with OCC.
+func (server *TapirServer) Merge(d, u []*RecordEntry) (map[OpID]*Response, error) {
+	results := make(map[OpID]*Response)
+
+	// Forget what this replica prepared for these transactions, the merged result replaces it
+	for _, entry := range append(d, u...) {
+		if entry.Request.Op != OP_PREPARE {
+			return nil, errors.New("Unrecognized consensus operation")
+		}
+		server.store.Unprepare(entry.Request.TxnID)
+	}
+
+	for _, entry := range d {
+		if entry.Result.Status == RPLY_OK {
+			server.store.ForcePrepare(entry.Request.Prepare.Txn, entry.Request.Prepare.Timestamp)
+		}
+		results[entry.ID] = entry.Result
+	}
+
+	for _, entry := range u {
+		committed, finished := server.store.Outcome(entry.Request.TxnID)
+		if finished {
+			if committed {
+				results[entry.ID] = NewResponse(RPLY_OK)
+			} else {
+				results[entry.ID] = NewResponse(RPLY_ABORT)
+			}
+			continue
+		}
+		reply, err := server.store.Prepare(entry.Request.Prepare.Txn, entry.Request.Prepare.Timestamp)
+		if err != nil {
+			return nil, err
+		}
+		results[entry.ID] = reply
+	}
+	return results, nil
+}
+
+// Checkpoint encodes the state of the store, see TapirReplica.Checkpoint
+func (server *TapirServer) Checkpoint() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(server.store.Checkpoint()); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Restore merges an encoded checkpoint into the store
+func (server *TapirServer) Restore(data []byte) error {
+	var checkpoint ReplicaCheckpoint
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&checkpoint); err != nil {
+		return fmt.Errorf("decoding checkpoint: %w", err)
+	}
+	server.store.Restore(&checkpoint)
+	return nil
+}
+
 func (server *TapirServer) String() string {
 	return fmt.Sprintf("TAPIR Server(id: %d)", server.id)
 }
@@ -1,13 +1,23 @@
 package tapir_kv
 
 import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
 	"fmt"
 	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	. "github.com/ViolaChenYT/TAPIR/IR"
 	. "github.com/ViolaChenYT/TAPIR/common"
+	"github.com/ViolaChenYT/TAPIR/common/transport"
 )
 
 const (
@@ -26,6 +36,11 @@ const (
 // go test -run <name of specific test>
 // eg. go test -run TestReplicaSetup
 
+// Transaction seq of the test client
+func tid(seq int) TxnID {
+	return NewTxnID(1, seq)
+}
+
 // createAscendingTimes generates a slice of Timestamps with ascending timestamps
 func createAscendingTimes(count int) []*Timestamp {
 	now := time.Now()
@@ -57,7 +72,7 @@ func TestReplicaCommit(t *testing.T) {
 	timestamps := createAscendingTimes(5)
 
 	// Create test transaction
-	txn := NewTransaction(txn_id)
+	txn := NewTransaction(tid(txn_id))
 	txn.AddWriteSet(key0, val0)
 	txn.AddWriteSet(key1, val1)
 	txn.AddReadSet(key0, val0, timestamps[0])
@@ -95,20 +110,14 @@ func TestReplicaCommit(t *testing.T) {
 }
 
 func TestSimpleCommit(t *testing.T) {
-	config := GetConfigA()
-	var replica IRReplica = nil
-	for id, addr := range config.Replicas {
-		store := NewTapirServer(id)
-		replica = NewIRReplica(id, addr, store)
-	}
-	log.Println("Replica created: ", replica)
+	config := startCluster(t, nil, "55272")
 
 	client, err := NewTapirClient(config)
 
-	client.Begin()
-	client.Write(key0, val0)
+	txn := client.Begin()
+	txn.Write(key0, val0)
 
-	val, err := client.Read(key0)
+	val, err := txn.Read(key0)
 	if val != val0 {
 		t.Errorf("Expected val to be %s, got: %s", val0, val)
 	}
@@ -117,7 +126,7 @@ func TestSimpleCommit(t *testing.T) {
 	}
 
 	log.Println("test commit")
-	ok := client.Commit()
+	ok := txn.Commit()
 	if !ok {
 		t.Errorf("Commit failed, expected to suceed")
 	}
@@ -126,28 +135,24 @@ func TestSimpleCommit(t *testing.T) {
 }
 
 func TestSimpleReadFromStore(t *testing.T) {
-	config := GetConfigA()
-
-	for id, addr := range config.Replicas {
-		store := NewTapirServer(id)
-		NewIRReplica(id, addr, store)
-	}
+	config := startCluster(t, nil, "55273")
 
 	client, _ := NewTapirClient(config)
 	// First Transaction: Commit a write
-	client.Begin()
-	client.Write(key0, val0)
-	ok := client.Commit()
+	txn := client.Begin()
+	txn.Write(key0, val0)
+	ok := txn.Commit()
 	// time.Sleep(time.Second)
 
 	if !ok {
 		t.Errorf("First commit failed, expected to suceed")
 	}
 	log.Println("Write transaction done!")
+	waitRead(t, client, key0, val0)
 
 	// Second Transaction: Read from the previous written entry
-	client.Begin()
-	val, err := client.Read(key0)
+	txn = client.Begin()
+	val, err := txn.Read(key0)
 	if err != nil {
 		t.Errorf("Expected err to be nil, got: %v", err)
 	}
@@ -155,38 +160,34 @@ func TestSimpleReadFromStore(t *testing.T) {
 		t.Errorf("Expected val to be %s, got: %s", val0, val)
 	}
 
-	ok = client.Commit()
+	ok = txn.Commit()
 	if !ok {
 		t.Errorf("Second commit failed, expected to suceed")
 	}
 }
 
 func TestSimpleAbort(t *testing.T) {
-	config := GetConfigA()
-
-	for id, addr := range config.Replicas {
-		store := NewTapirServer(id)
-		NewIRReplica(id, addr, store)
-	}
+	config := startCluster(t, nil, "55274")
 
 	client, _ := NewTapirClient(config)
 	// First Transaction: Commit a write
-	client.Begin()
-	client.Write(key0, val0)
-	client.Commit()
+	txn := client.Begin()
+	txn.Write(key0, val0)
+	txn.Commit()
+	waitRead(t, client, key0, val0)
 
 	// Second Transaction: Abort a write
-	client.Begin()
-	client.Write(key0, val1)
-	val, _ := client.Read(key0)
+	txn = client.Begin()
+	txn.Write(key0, val1)
+	val, _ := txn.Read(key0)
 	if val != val1 {
 		t.Errorf("Expected val to be %s, got: %s", val1, val)
 	}
-	client.Abort()
+	txn.Abort()
 
 	// Third Transaction: Read
-	client.Begin()
-	val, err := client.Read(key0)
+	txn = client.Begin()
+	val, err := txn.Read(key0)
 	if err != nil {
 		t.Errorf("Expected err to be nil, got: %v", err)
 	}
@@ -194,25 +195,13 @@ func TestSimpleAbort(t *testing.T) {
 		t.Errorf("Expected val to be %s, got: %s", val0, val)
 	}
 
-	client.Commit()
+	txn.Commit()
 }
 
 func TestCommit(t *testing.T) {
 	fmt.Println("TestCommit")
-	config := GetConfigB()
-	var replicas = []IRReplica{}
-	for id, addr := range config.Replicas {
-		store := NewTapirServer(id)
-		replica := NewIRReplica(id, addr, store)
-		replicas = append(replicas, replica)
-		log.Println("ok", replica)
-		// time.Sleep(time.Second)
-	}
-	log.Println("ok", replicas[0], replicas[1], replicas[2])
-	// client 1:
-	// now there's 3 servers
-	// closest replica port = 55209
-	// all replica = []string{"55209", "55210", "55211"}
+	// 3 servers, the closest replica is the first
+	config := startCluster(t, nil, "55275", "55276", "55277")
 	client, err := NewTapirClient(config)
 	if err != nil {
 		t.Fatal("Failed to dial server:", err)
@@ -220,25 +209,26 @@ func TestCommit(t *testing.T) {
 	log.Println("start testing txn")
 	timestamps := createAscendingTimes(5)
 	// Create test transaction
-	txn := NewTransaction(txn_id)
+	txn := NewTransaction(tid(txn_id))
 	txn.AddWriteSet(key0, val0)
 	txn.AddWriteSet(key1, val1)
 	txn.AddReadSet(key0, val0, timestamps[0])
-	client.Begin()
-	client.Write(key0, val0)
-	client.Write(key1, val1)
-	client.Write(key0, val2)
-	val, err := client.Read(key0)
+	tx := client.Begin()
+	tx.Write(key0, val0)
+	tx.Write(key1, val1)
+	tx.Write(key0, val2)
+	val, err := tx.Read(key0)
 	if val != val2 {
 		t.Errorf("Expected val to be %s, got: %s", val2, val)
 		return
 	}
 	log.Println("ok read write")
 	log.Println("test commit")
-	client.Commit()
+	tx.Commit()
 	log.Println("after commit")
-	client.Begin()
-	v1, err := client.Read(key1)
+	waitRead(t, client, key1, val1)
+	tx = client.Begin()
+	v1, err := tx.Read(key1)
 	if v1 != val1 {
 		t.Errorf("Expected val to be %s, got: %s", val1, v1)
 		return
@@ -248,41 +238,18 @@ func TestCommit(t *testing.T) {
 }
 
 func TestMostBasicSetup(t *testing.T) {
-	config := GetConfigA()
-	// server 1: address localhost:55209
-	var replica IRReplica = nil
-	for id, addr := range config.Replicas {
-		store := NewTapirServer(id)
-		replica = NewIRReplica(id, addr, store)
-		log.Println("ok", replica)
-		// time.Sleep(time.Second)
-	}
-	// client 1:
-	// now there's only 1 server
-	// closest replica port = 55209
-	// all replica = []string{"55209"}
+	// only 1 server
+	config := startCluster(t, nil, "55278")
 	client, err := NewTapirClient(config)
 	if err != nil {
 		t.Fatal("Failed to dial server:", err)
 	}
 	log.Println("ok", client)
-	replica.Stop()
 }
 
 func Test3ReplicaSetup(t *testing.T) {
-	config := GetConfigB()
-	var replicas = []IRReplica{}
-	for id, addr := range config.Replicas {
-		store := NewTapirServer(id)
-		replica := NewIRReplica(id, addr, store)
-		replicas = append(replicas, replica)
-		log.Println("ok", replica)
-	}
-	log.Println("ok", replicas[0], replicas[1], replicas[2])
-	// client 1:
-	// now there's 3 servers
-	// closest replica port = 55209
-	// all replica = []string{"55209", "55210", "55211"}
+	// 3 servers, the closest replica is the first
+	config := startCluster(t, nil, "55279", "55280", "55281")
 	client, err := NewTapirClient(config)
 	if err != nil {
 		t.Fatal("Failed to dial server:", err)
@@ -291,18 +258,14 @@ func Test3ReplicaSetup(t *testing.T) {
 }
 
 func TestAbort(t *testing.T) {
-	config := GetConfigB()
-	for id, addr := range config.Replicas {
-		store := NewTapirServer(id)
-		NewIRReplica(id, addr, store)
-	}
+	config := startCluster(t, nil, "55282", "55283", "55284")
 
 	client, err := NewTapirClient(config)
 
-	client.Begin()
-	client.Write(key0, val0)
+	txn := client.Begin()
+	txn.Write(key0, val0)
 
-	val, err := client.Read(key0)
+	val, err := txn.Read(key0)
 	if val != val0 {
 		t.Errorf("Expected val to be %s, got: %s", val0, val)
 	}
@@ -311,28 +274,1804 @@ func TestAbort(t *testing.T) {
 	}
 
 	log.Println("test commit")
-	ok := client.Commit()
+	ok := txn.Commit()
 	if !ok {
 		t.Errorf("Commit failed, expected to suceed")
 	}
-	client.Abort()
+	txn.Abort()
 }
 
 func TestSuperHardTransactions(t *testing.T) {
 	// log.SetOutput(ioutil.Discard)
-	config := GetConfigB()
-	for id, addr := range config.Replicas {
-		store := NewTapirServer(id)
-		NewIRReplica(id, addr, store)
-	}
+	config := startCluster(t, nil, "55285", "55286", "55287")
 
 	client, _ := NewTapirClient(config)
 
 	for j := range 10 {
-		client.Begin()
+		txn := client.Begin()
 		for i := range 25 {
-			client.Write(fmt.Sprintf("%d", i+j*10), fmt.Sprintf("%d", i+j*10))
+			txn.Write(fmt.Sprintf("%d", i+j*10), fmt.Sprintf("%d", i+j*10))
+		}
+		txn.Commit()
+	}
+}
+
+func prepareEntry(txn *Transaction, timestamp *Timestamp, status ReplyType) *RecordEntry {
+	req := &Request{
+		Op:      OP_PREPARE,
+		TxnID:   txn.ID,
+		Prepare: &PrepareMessage{Txn: txn, Timestamp: timestamp},
+	}
+	// The client numbers the prepare and the commit of a transaction after it
+	return &RecordEntry{
+		ID:      OpID{ClientID: txn.ID.ClientID, Seq: 2 * txn.ID.Seq},
+		Request: req,
+		Proto:   CONSENSUS,
+		State:   TENTATIVE,
+		Result:  NewResponse(status),
+	}
+}
+
+func TestServerMerge(t *testing.T) {
+	timestamps := createAscendingTimes(5)
+	server := NewTapirServer(replica_id).(*TapirServer)
+
+	// Transaction 1 already committed on this replica
+	committed := NewTransaction(tid(1))
+	committed.AddWriteSet(key0, val0)
+	server.store.ForcePrepare(committed, timestamps[1])
+	server.store.Commit(committed.ID, timestamps[1])
+
+	// Transaction 2 read key0 before transaction 1 wrote it, OCC must reject it
+	stale := NewTransaction(tid(2))
+	stale.AddReadSet(key0, "", timestamps[0])
+
+	// Transaction 3 was prepared by a majority but would fail OCC now
+	decided := NewTransaction(tid(3))
+	decided.AddReadSet(key0, "", timestamps[0])
+	decided.AddWriteSet(key1, val1)
+
+	d := []*RecordEntry{prepareEntry(decided, timestamps[2], RPLY_OK)}
+	u := []*RecordEntry{
+		prepareEntry(committed, timestamps[1], RPLY_ABSTAIN),
+		prepareEntry(stale, timestamps[3], RPLY_OK),
+	}
+	results, err := server.Merge(d, u)
+	if err != nil {
+		t.Fatalf("Expected merge without error, got: %v", err)
+	}
+	if status := results[d[0].ID].Status; status != RPLY_OK {
+		t.Errorf("Expected majority result to be kept, got: %s", ReplyTypeString(status))
+	}
+	if status := results[u[0].ID].Status; status != RPLY_OK {
+		t.Errorf("Expected committed transaction to be OK, got: %s", ReplyTypeString(status))
+	}
+	if status := results[u[1].ID].Status; status != RPLY_ABORT {
+		t.Errorf("Expected stale read to abort, got: %s", ReplyTypeString(status))
+	}
+
+	// The decided transaction must be committable
+	if err := server.store.Commit(decided.ID, timestamps[2]); err != nil {
+		t.Errorf("Expected decided transaction to be prepared, got: %v", err)
+	}
+	if val, _, _ := server.store.Read(key1); val != val1 {
+		t.Errorf("Expected val to be %s, got: %s", val1, val)
+	}
+}
+
+func TestServerSync(t *testing.T) {
+	timestamps := createAscendingTimes(3)
+	server := NewTapirServer(replica_id).(*TapirServer)
+
+	txn := NewTransaction(tid(txn_id))
+	txn.AddWriteSet(key0, val0)
+	prepare := prepareEntry(txn, timestamps[1], RPLY_OK)
+	prepare.State = FINALIZED
+	commitReq := &Request{Op: OP_COMMIT, TxnID: txn.ID, Commit: &CommitMessage{Timestamp: timestamps[1]}}
+	commit := &RecordEntry{ID: OpID{ClientID: txn.ID.ClientID, Seq: 2*txn.ID.Seq + 1}, Request: commitReq, Proto: INCONSISTENT, State: FINALIZED}
+
+	// Syncing twice must not apply the commit twice
+	for i := 0; i < 2; i++ {
+		if err := server.Sync(NewRecord([]*RecordEntry{prepare, commit})); err != nil {
+			t.Fatalf("Expected sync without error, got: %v", err)
+		}
+	}
+	val, timestamp, err := server.store.Read(key0)
+	if err != nil || val != val0 || timestamp != timestamps[1] {
+		t.Errorf("Expected (%s, %v), got: (%s, %v, %v)", val0, timestamps[1], val, timestamp, err)
+	}
+	if committed, _ := server.store.Outcome(txn.ID); !committed {
+		t.Errorf("Expected transaction to be committed after sync")
+	}
+}
+
+func TestServerCheckpoint(t *testing.T) {
+	timestamps := createAscendingTimes(4)
+	server := NewTapirServer(replica_id).(*TapirServer)
+
+	committed := NewTransaction(tid(1))
+	committed.AddWriteSet(key0, val0)
+	server.store.Prepare(committed, timestamps[1])
+	server.store.Commit(committed.ID, timestamps[1])
+	aborted := NewTransaction(tid(2))
+	aborted.AddWriteSet(key1, val1)
+	server.store.Prepare(aborted, timestamps[2])
+	server.store.Abort(aborted.ID)
+	prepared := NewTransaction(tid(3))
+	prepared.AddWriteSet(key2, val2)
+	server.store.Prepare(prepared, timestamps[3])
+
+	data, err := server.Checkpoint()
+	if err != nil {
+		t.Fatalf("Expected checkpoint without error, got: %v", err)
+	}
+	// Restoring twice must be the same as restoring once
+	restored := NewTapirServer(replica_id + 1).(*TapirServer)
+	for i := 0; i < 2; i++ {
+		if err := restored.Restore(data); err != nil {
+			t.Fatalf("Expected restore without error, got: %v", err)
+		}
+	}
+	val, timestamp, err := restored.store.Read(key0)
+	if err != nil || val != val0 || !timestamp.Equals(timestamps[1]) {
+		t.Errorf("Expected (%s, %v), got: (%s, %v, %v)", val0, timestamps[1], val, timestamp, err)
+	}
+	if status, _, _ := restored.store.Status(aborted.ID); status != TXN_ABORTED {
+		t.Errorf("Expected transaction 2 to be aborted, got: %v", status)
+	}
+	if status, timestamp, _ := restored.store.Status(prepared.ID); status != TXN_PREPARED || !timestamp.Equals(timestamps[3]) {
+		t.Errorf("Expected transaction 3 to be prepared at %v, got: %v at %v", timestamps[3], status, timestamp)
+	}
+	// The restored prepare still decides conflicts and can commit
+	if err := restored.store.Commit(prepared.ID, timestamps[3]); err != nil {
+		t.Errorf("Expected prepared transaction to commit, got: %v", err)
+	}
+	if val, _, _ := restored.store.Read(key2); val != val2 {
+		t.Errorf("Expected val to be %s, got: %s", val2, val)
+	}
+	if err := restored.Restore([]byte("garbage")); err == nil {
+		t.Errorf("Expected a corrupt checkpoint to be rejected")
+	}
+}
+
+func TestDecideRetry(t *testing.T) {
+	timestamps := createAscendingTimes(3)
+	// A group of three replicas, decided by a quorum of two
+	result := decide([]*Response{
+		NewResponseWithTime(RPLY_RETRY, timestamps[2]),
+		NewResponseWithTime(RPLY_RETRY, timestamps[1]),
+	}, 3, 1)
+	if result.Status != RPLY_RETRY || result.Timestamp != timestamps[2] {
+		t.Errorf("Expected retry at %v, got: %s %v", timestamps[2], ReplyTypeString(result.Status), result.Timestamp)
+	}
+
+	result = decide([]*Response{NewResponse(RPLY_OK), NewResponseWithTime(RPLY_RETRY, timestamps[0]), NewResponse(RPLY_OK)}, 3, 1)
+	if result.Status != RPLY_OK {
+		t.Errorf("Expected f+1 OKs to decide RPLY_OK, got: %s", ReplyTypeString(result.Status))
+	}
+}
+
+func TestReplicaRetry(t *testing.T) {
+	timestamps := createAscendingTimes(5)
+	replica := NewReplica(replica_id)
+
+	writer := NewTransaction(tid(1))
+	writer.AddWriteSet(key0, val0)
+	replica.Prepare(writer, timestamps[1])
+	replica.Commit(writer.ID, timestamps[1])
+
+	// A reader commits at a later timestamp than the next writer proposes
+	reader := NewTransaction(tid(2))
+	reader.AddReadSet(key0, val0, timestamps[1])
+	replica.Prepare(reader, timestamps[4])
+	replica.Commit(reader.ID, timestamps[4])
+
+	overwriter := NewTransaction(tid(3))
+	overwriter.AddWriteSet(key0, val1)
+	timestamp := timestamps[2]
+	response, _ := replica.Prepare(overwriter, timestamp)
+	for retry := 0; response.Status == RPLY_RETRY && retry < 3; retry++ {
+		timestamp = response.Timestamp.Next(timestamp.ID)
+		response, _ = replica.Prepare(overwriter, timestamp)
+	}
+	if response.Status != RPLY_OK {
+		t.Fatalf("Expected retried prepare to succeed, got: %s", ReplyTypeString(response.Status))
+	}
+	if !timestamps[4].LessThan(timestamp) {
+		t.Errorf("Expected prepare to be retried after the last read %v, got: %v", timestamps[4], timestamp)
+	}
+}
+
+// A replica that missed the commit of the version a reader saw must still
+// hold the reader back while a newer write is prepared
+func TestReplicaMissedVersion(t *testing.T) {
+	timestamps := createAscendingTimes(4)
+	replica := NewReplica(replica_id)
+
+	writer := NewTransaction(tid(1))
+	writer.AddWriteSet(key0, val1)
+	if response, _ := replica.Prepare(writer, timestamps[2]); response.Status != RPLY_OK {
+		t.Fatalf("Expected writer to prepare, got: %s", ReplyTypeString(response.Status))
+	}
+
+	// The reader saw a version committed elsewhere, before the prepared write
+	reader := NewTransaction(tid(2))
+	reader.AddReadSet(key0, val0, timestamps[1])
+	reader.AddWriteSet(key1, val1)
+	if response, _ := replica.Prepare(reader, timestamps[3]); response.Status != RPLY_ABSTAIN {
+		t.Errorf("Expected reader to abstain behind the prepared write, got: %s", ReplyTypeString(response.Status))
+	}
+}
+
+// Start a TAPIR cluster on the given ports, replica ids are the ports themselves.
+// Replicas keep their state in memory if storage is nil.
+func startCluster(t *testing.T, storage *StorageConfiguration, ports ...string) *Configuration {
+	replicas := make(map[int]*ReplicaAddress)
+	for _, port := range ports {
+		id, _ := strconv.Atoi(port)
+		replicas[id] = NewReplicaAddress("localhost", port)
+	}
+	closest, _ := strconv.Atoi(ports[0])
+	config := NewConfiguration(NewClientConfiguration(1, 1, closest), replicas)
+	config.Storage = storage
+	startServers(t, config)
+	return config
+}
+
+// Start a tapir server for every replica of the configuration
+func startServers(t *testing.T, config *Configuration) {
+	var servers []IRReplica
+	t.Cleanup(func() {
+		for _, server := range servers {
+			server.Stop()
+		}
+	})
+	for id := range config.Replicas {
+		app, err := NewTapirServerWithConfig(id, config)
+		if err != nil {
+			t.Fatal("Failed to create server:", err)
+		}
+		server, err := NewIRReplicaWithConfig(id, config, app)
+		if err != nil {
+			t.Fatal("Failed to start server:", err)
+		}
+		servers = append(servers, server)
+	}
+}
+
+// Wait until a transaction of the client reads the value, commits reach the
+// replicas after Commit returns
+func waitRead(t *testing.T, client TapirClient, key string, value string) {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		txn := client.Begin()
+		val, _ := txn.Read(key)
+		txn.Abort()
+		if val == value {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected to read %s for %s, got: %s", value, key, val)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestReplicaReadAt(t *testing.T) {
+	timestamps := createAscendingTimes(5)
+	replica := NewReplica(replica_id)
+
+	writer := NewTransaction(tid(1))
+	writer.AddWriteSet(key0, val0)
+	replica.Prepare(writer, timestamps[1])
+	replica.Commit(writer.ID, timestamps[1])
+
+	overwriter := NewTransaction(tid(2))
+	overwriter.AddWriteSet(key0, val1)
+	replica.Prepare(overwriter, timestamps[3])
+
+	// The prepared write may still commit below the snapshot
+	response, _ := replica.ReadAt(key0, timestamps[4])
+	if response.Status != RPLY_ABSTAIN {
+		t.Errorf("Expected RPLY_ABSTAIN while a write below the snapshot is prepared, got: %s", ReplyTypeString(response.Status))
+	}
+
+	// Snapshots below the prepared write are stable
+	response, _ = replica.ReadAt(key0, timestamps[2])
+	if response.Status != RPLY_OK || response.Value != val0 || !response.Timestamp.Equals(timestamps[1]) {
+		t.Errorf("Expected %s at %v, got: %v", val0, timestamps[1], response)
+	}
+	response, _ = replica.ReadAt(key0, timestamps[0])
+	if response.Status != RPLY_OK || response.Timestamp != nil {
+		t.Errorf("Expected no version before the first write, got: %v", response)
+	}
+
+	// The snapshot read keeps later writes from committing below it
+	replica.Abort(overwriter.ID)
+	late := NewTransaction(tid(3))
+	late.AddWriteSet(key0, val2)
+	response, _ = replica.Prepare(late, NewCustomTimestamp(3, timestamps[1].Timestamp.Add(time.Millisecond)))
+	if response.Status != RPLY_RETRY || !timestamps[2].Equals(response.Timestamp) {
+		t.Errorf("Expected RPLY_RETRY at the snapshot timestamp, got: %v", response)
+	}
+}
+
+func TestSnapshotRead(t *testing.T) {
+	config := startCluster(t, nil, "55221", "55222", "55223")
+	client, err := NewTapirClient(config)
+	if err != nil {
+		t.Fatal("Failed to dial server:", err)
+	}
+
+	txn := client.Begin()
+	txn.Write(key0, val0)
+	if !txn.Commit() {
+		t.Fatal("Expected first transaction to commit")
+	}
+	snapshot := NewTimestamp(0)
+	txn = client.Begin()
+	txn.Write(key0, val1)
+	if !txn.Commit() {
+		t.Fatal("Expected second transaction to commit")
+	}
+
+	txn = client.BeginReadOnly(snapshot)
+	if val, err := txn.Read(key0); err != nil || val != val0 {
+		t.Errorf("Expected %s at the earlier snapshot, got: %s, %v", val0, val, err)
+	}
+	if err := txn.Write(key1, val1); err == nil {
+		t.Errorf("Expected write in read-only transaction to fail")
+	}
+	if !txn.Commit() {
+		t.Errorf("Expected read-only transaction to commit")
+	}
+
+	txn = client.BeginReadOnly(nil)
+	if val, err := txn.Read(key0); err != nil || val != val1 {
+		t.Errorf("Expected %s at the current snapshot, got: %s, %v", val1, val, err)
+	}
+	if _, err := txn.Read(key1); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected missing key %s to fail with ErrKeyNotFound, got: %v", key1, err)
+	}
+	txn.Commit()
+}
+
+func TestDurableServerRestart(t *testing.T) {
+	for _, engine := range []StorageEngine{ENGINE_MEMORY, ENGINE_DISK} {
+		timestamps := createAscendingTimes(5)
+		config := GetConfigA()
+		config.Storage = NewStorageConfiguration(t.TempDir())
+		config.Storage.Engine = engine
+
+		server, err := NewTapirServerWithConfig(replica_id, config)
+		if err != nil {
+			t.Fatal("Failed to create server:", err)
+		}
+		writer := NewTransaction(tid(1))
+		writer.AddWriteSet(key0, val0)
+		server.ExecConsensusUpcall(&Request{Op: OP_PREPARE, TxnID: tid(1), Prepare: &PrepareMessage{Txn: writer, Timestamp: timestamps[1]}})
+		server.ExecInconsistentUpcall(&Request{Op: OP_COMMIT, TxnID: tid(1), Commit: &CommitMessage{Timestamp: timestamps[1]}})
+		reader := NewTransaction(tid(2))
+		reader.AddReadSet(key0, val0, timestamps[1])
+		server.ExecConsensusUpcall(&Request{Op: OP_PREPARE, TxnID: tid(2), Prepare: &PrepareMessage{Txn: reader, Timestamp: timestamps[3]}})
+		server.ExecInconsistentUpcall(&Request{Op: OP_COMMIT, TxnID: tid(2), Commit: &CommitMessage{Timestamp: timestamps[3]}})
+		server.(*TapirServer).Close()
+
+		restarted, err := NewTapirServerWithConfig(replica_id, config)
+		if err != nil {
+			t.Fatal("Failed to reopen server:", err)
+		}
+		store := restarted.(*TapirServer).store
+		if val, version, _ := store.Read(key0); val != val0 || !version.Equals(timestamps[1]) {
+			t.Errorf("Engine %d: expected %s at %v after restart, got: %s at %v", engine, val0, timestamps[1], val, version)
+		}
+		// The committed read survives too, so a write below it must retry
+		overwriter := NewTransaction(tid(3))
+		overwriter.AddWriteSet(key0, val1)
+		if response, _ := store.Prepare(overwriter, timestamps[2]); response.Status != RPLY_RETRY {
+			t.Errorf("Engine %d: expected RPLY_RETRY below the restored read, got: %s", engine, ReplyTypeString(response.Status))
+		}
+		restarted.(*TapirServer).Close()
+	}
+}
+
+func TestDurableReplicaRestart(t *testing.T) {
+	timestamps := createAscendingTimes(2)
+	id := 55231
+	config := NewConfiguration(NewClientConfiguration(1, 1, id), map[int]*ReplicaAddress{id: NewReplicaAddress("localhost", "55231")})
+	config.Storage = NewStorageConfiguration(t.TempDir())
+
+	server, _ := NewTapirServerWithConfig(id, config)
+	replica, err := NewIRReplicaWithConfig(id, config, server)
+	if err != nil {
+		t.Fatal("Failed to start replica:", err)
+	}
+	txn := NewTransaction(tid(1))
+	txn.AddWriteSet(key0, val0)
+	prepare := &Request{Op: OP_PREPARE, TxnID: tid(1), Prepare: &PrepareMessage{Txn: txn, Timestamp: timestamps[1]}}
+	commit := &Request{Op: OP_COMMIT, TxnID: tid(1), Commit: &CommitMessage{Timestamp: timestamps[1]}}
+	propose := NewPropose(OpID{ClientID: 1, Seq: 1}, prepare, CONSENSUS)
+	replica.HandleOperation(&propose, &Message{})
+	finalize := Finalize(OpID{ClientID: 1, Seq: 1}, NewResponse(RPLY_OK))
+	finalize.Request, finalize.ProtoType = prepare, CONSENSUS
+	replica.HandleOperation(&finalize, &Message{})
+	propose = NewPropose(OpID{ClientID: 1, Seq: 2}, commit, INCONSISTENT)
+	replica.HandleOperation(&propose, &Message{})
+	finalize = NewFinalize(OpID{ClientID: 1, Seq: 2}, INCONSISTENT)
+	finalize.Request = commit
+	replica.HandleOperation(&finalize, &Message{})
+	replica.Stop()
+
+	// Lose the store, the IR record alone brings the replica back
+	os.RemoveAll(config.Storage.Dir(id, "store"))
+	server, _ = NewTapirServerWithConfig(id, config)
+	replica, err = NewIRReplicaWithConfig(id, config, server)
+	if err != nil {
+		t.Fatal("Failed to restart replica:", err)
+	}
+	defer replica.Stop()
+	if val, version, _ := server.(*TapirServer).store.Read(key0); val != val0 || !version.Equals(timestamps[1]) {
+		t.Errorf("Expected %s at %v after restart, got: %s at %v", val0, timestamps[1], val, version)
+	}
+}
+
+func TestReplicaGarbageCollection(t *testing.T) {
+	timestamps := createAscendingTimes(6)
+	replica := NewReplica(replica_id)
+	for i := 1; i <= 3; i++ {
+		writer := NewTransaction(tid(i))
+		writer.AddWriteSet(key0, fmt.Sprint(i))
+		replica.Prepare(writer, timestamps[i])
+		replica.Commit(writer.ID, timestamps[i])
+	}
+	pending := NewTransaction(tid(4))
+	pending.AddWriteSet(key1, val1)
+	replica.Prepare(pending, timestamps[2])
+
+	// The prepared transaction holds the watermark back
+	stats := replica.CollectGarbage(timestamps[5])
+	if !stats.Watermark.Equals(timestamps[2]) || stats.VersionsReclaimed != 1 {
+		t.Errorf("Expected 1 version collected below %v, got: %+v", timestamps[2], stats)
+	}
+	replica.Abort(pending.ID)
+	stats = replica.CollectGarbage(timestamps[5])
+	if stats.Runs != 2 || stats.VersionsReclaimed != 2 {
+		t.Errorf("Expected 2 versions collected over 2 runs, got: %+v", stats)
+	}
+	if stats = replica.CollectGarbage(timestamps[4]); stats.Runs != 2 {
+		t.Errorf("Expected the watermark never to move backwards, got: %+v", stats)
+	}
+
+	// Nothing is served below the watermark
+	late := NewTransaction(tid(5))
+	late.AddWriteSet(key0, val0)
+	if response, _ := replica.Prepare(late, timestamps[4]); response.Status != RPLY_RETRY || !response.Timestamp.Equals(timestamps[5]) {
+		t.Errorf("Expected RPLY_RETRY at the watermark, got: %v", response)
+	}
+	if response, _ := replica.ReadAt(key0, timestamps[4]); response.Status != RPLY_ABORT {
+		t.Errorf("Expected snapshot below the watermark to abort, got: %s", ReplyTypeString(response.Status))
+	}
+	if response, _ := replica.ReadAt(key0, timestamps[5]); response.Status != RPLY_OK || response.Value != "3" {
+		t.Errorf("Expected latest version at the watermark, got: %v", response)
+	}
+}
+
+func TestReplicaGCKeepsActiveSnapshots(t *testing.T) {
+	replica := NewReplica(replica_id)
+	if stats := replica.CollectGarbage(NewCustomTimestamp(0, time.Time{})); stats.Runs != 0 {
+		t.Errorf("Expected the first collection only to start watching snapshots, got: %+v", stats)
+	}
+	now := time.Now()
+	for i := 1; i <= 3; i++ {
+		timestamp := NewCustomTimestamp(1, now.Add(time.Duration(i-5)*time.Second))
+		writer := NewTransaction(tid(i))
+		writer.AddWriteSet(key0, fmt.Sprint(i))
+		replica.Prepare(writer, timestamp)
+		replica.Commit(writer.ID, timestamp)
+	}
+	snapshot := NewCustomTimestamp(2, now.Add(-3*time.Second))
+	if response, _ := replica.ReadAt(key0, snapshot); response.Value != "2" {
+		t.Fatalf("Expected 2 at the snapshot, got: %v", response)
+	}
+
+	// The snapshot read within the retention period, it holds the watermark back
+	stats := replica.CollectGarbage(NewCustomTimestamp(0, now))
+	if !stats.Watermark.Equals(snapshot) || stats.VersionsReclaimed != 1 {
+		t.Errorf("Expected 1 version collected below the snapshot, got: %+v", stats)
+	}
+	if response, _ := replica.ReadAt(key0, snapshot); response.Status != RPLY_OK || response.Value != "2" {
+		t.Errorf("Expected the snapshot to keep reading 2, got: %v", response)
+	}
+
+	// Quiet for longer than the retention period it is presumed done
+	stats = replica.CollectGarbage(NewCustomTimestamp(0, time.Now().Add(time.Second)))
+	if stats.VersionsReclaimed != 2 {
+		t.Errorf("Expected the version of the snapshot collected, got: %+v", stats)
+	}
+	if response, _ := replica.ReadAt(key0, snapshot); response.Status != RPLY_ABORT {
+		t.Errorf("Expected the snapshot below the watermark to abort, got: %s", ReplyTypeString(response.Status))
+	}
+}
+
+func TestReplicaForgetOutcomes(t *testing.T) {
+	timestamps := createAscendingTimes(6)
+	replica := NewReplica(replica_id)
+	committed := NewTransaction(tid(1))
+	committed.AddWriteSet(key0, val0)
+	replica.Prepare(committed, timestamps[1])
+	replica.Commit(committed.ID, timestamps[1])
+	aborted := NewTransaction(tid(2))
+	aborted.AddWriteSet(key1, val1)
+	replica.Prepare(aborted, timestamps[2])
+	replica.Abort(aborted.ID)
+
+	// Nothing is forgotten above the watermark
+	if stats := replica.ForgetOutcomes(timestamps[5]); stats.OutcomesForgotten != 0 {
+		t.Errorf("Expected no outcome forgotten before the first collection, got: %+v", stats)
+	}
+	replica.CollectGarbage(timestamps[1])
+	if stats := replica.ForgetOutcomes(timestamps[5]); stats.OutcomesForgotten != 1 {
+		t.Errorf("Expected the abort below the watermark to be forgotten, got: %+v", stats)
+	}
+	if status, _, _ := replica.Status(committed.ID); status != TXN_COMMITTED {
+		t.Errorf("Expected the commit at the watermark to be kept, got: %v", status)
+	}
+	replica.CollectGarbage(timestamps[3])
+	if stats := replica.ForgetOutcomes(timestamps[2]); stats.OutcomesForgotten != 2 {
+		t.Errorf("Expected the commit to be forgotten, got: %+v", stats)
+	}
+	if status, _, _ := replica.Status(committed.ID); status != TXN_UNKNOWN {
+		t.Errorf("Expected a forgotten commit to be unknown, got: %v", status)
+	}
+	if checkpoint := replica.Checkpoint(); len(checkpoint.Committed) != 0 || len(checkpoint.Aborted) != 0 {
+		t.Errorf("Expected no outcome in the checkpoint, got: %v and %v", checkpoint.Committed, checkpoint.Aborted)
+	}
+
+	// The watermark turns a late prepare of a forgotten transaction away
+	if response, _ := replica.Prepare(aborted, timestamps[2]); response.Status != RPLY_RETRY {
+		t.Errorf("Expected RPLY_RETRY for a late prepare, got: %s", ReplyTypeString(response.Status))
+	}
+	if status, _, _ := replica.Status(aborted.ID); status != TXN_UNKNOWN {
+		t.Errorf("Expected the late prepare to leave the transaction unknown, got: %v", status)
+	}
+}
+
+func TestServerBackgroundGC(t *testing.T) {
+	config := GetConfigA()
+	config.GCInterval = 10 * time.Millisecond
+	config.GCRetention = time.Second
+	server, _ := NewTapirServerWithConfig(replica_id, config)
+	defer server.(*TapirServer).Close()
+
+	past := time.Now().Add(-time.Minute)
+	for i := 1; i <= 3; i++ {
+		timestamp := NewCustomTimestamp(i, past.Add(time.Duration(i)*time.Second))
+		writer := NewTransaction(tid(i))
+		writer.AddWriteSet(key0, fmt.Sprint(i))
+		server.ExecConsensusUpcall(&Request{Op: OP_PREPARE, TxnID: tid(i), Prepare: &PrepareMessage{Txn: writer, Timestamp: timestamp}})
+		server.ExecInconsistentUpcall(&Request{Op: OP_COMMIT, TxnID: tid(i), Commit: &CommitMessage{Timestamp: timestamp}})
+	}
+
+	// Collection starts once the replica watched snapshots for the retention period
+	store := server.(*TapirServer).store
+	deadline := time.Now().Add(3 * time.Second)
+	for store.GCStats().VersionsReclaimed < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats := store.GCStats(); stats.VersionsReclaimed != 2 {
+		t.Errorf("Expected background collection to reclaim 2 versions, got: %+v", stats)
+	}
+	if val, _, _ := store.Read(key0); val != "3" {
+		t.Errorf("Expected latest version to survive, got: %s", val)
+	}
+}
+
+// Store that tells whether a garbage collection pass reached it after Close
+type closeCheckingStore struct {
+	TapirReplica
+	collecting chan struct{} // closed once the first pass starts
+	collected  chan struct{} // closed once it ends
+	once       sync.Once
+	closed     atomic.Bool
+	late       atomic.Bool
+}
+
+func (s *closeCheckingStore) CollectGarbage(watermark *Timestamp) GCStats {
+	first := false
+	s.once.Do(func() {
+		first = true
+		close(s.collecting)
+	})
+	// Leave Close the time to get ahead of the pass
+	time.Sleep(20 * time.Millisecond)
+	if s.closed.Load() {
+		s.late.Store(true)
+	}
+	if first {
+		defer close(s.collected)
+	}
+	return s.TapirReplica.CollectGarbage(watermark)
+}
+
+func (s *closeCheckingStore) Close() error {
+	s.closed.Store(true)
+	return s.TapirReplica.Close()
+}
+
+func TestServerCloseWaitsForGC(t *testing.T) {
+	config := GetConfigA()
+	config.GCInterval = 0
+	config.Storage = NewStorageConfiguration(t.TempDir())
+	config.Storage.Engine = ENGINE_DISK
+	app, err := NewTapirServerWithConfig(replica_id, config)
+	if err != nil {
+		t.Fatal("Failed to create server:", err)
+	}
+	server := app.(*TapirServer)
+	store := &closeCheckingStore{TapirReplica: server.store, collecting: make(chan struct{}), collected: make(chan struct{})}
+	server.store = store
+	config.GCInterval = time.Millisecond
+	server.runInBackground(config)
+
+	<-store.collecting
+	if err := server.Close(); err != nil {
+		t.Fatal("Failed to close server:", err)
+	}
+	<-store.collected
+	if store.late.Load() {
+		t.Error("Expected Close to wait for the garbage collection pass")
+	}
+}
+
+func TestMissingReadOverTheWire(t *testing.T) {
+	timestamps := createAscendingTimes(3)
+	txn := NewTransaction(tid(1))
+	txn.AddReadSet(key0, "", nil)
+	txn.AddWriteSet(key0, val0)
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&PrepareMessage{Txn: txn, Timestamp: timestamps[1]}); err != nil {
+		t.Fatal("Failed to encode a read of a missing key:", err)
+	}
+	var prepare PrepareMessage
+	if err := gob.NewDecoder(&buf).Decode(&prepare); err != nil {
+		t.Fatal("Failed to decode prepare:", err)
+	}
+
+	replica := NewReplica(replica_id)
+	if response, _ := replica.Prepare(prepare.Txn, prepare.Timestamp); response.Status != RPLY_OK {
+		t.Fatalf("Expected prepare to succeed, got: %s", ReplyTypeString(response.Status))
+	}
+	replica.Commit(prepare.Txn.ID, prepare.Timestamp)
+
+	// The read of no version still orders later writes of the key after it
+	late := NewTransaction(tid(2))
+	late.AddWriteSet(key1, val1)
+	late.AddReadSet(key0, "", nil)
+	if response, _ := replica.Prepare(late, timestamps[2]); response.Status != RPLY_ABORT {
+		t.Errorf("Expected RPLY_ABORT for a stale read of no version, got: %s", ReplyTypeString(response.Status))
+	}
+}
+
+func TestReplicaScan(t *testing.T) {
+	timestamps := createAscendingTimes(8)
+	replica := NewReplica(replica_id)
+	writer := NewTransaction(tid(1))
+	writer.AddWriteSet(key0, val0)
+	writer.AddWriteSet(key1, val1)
+	replica.Prepare(writer, timestamps[1])
+	replica.Commit(writer.ID, timestamps[1])
+
+	scan := func(txn *Transaction, count int) {
+		response, _ := replica.Scan(key0, count, nil)
+		for _, row := range response.Rows {
+			txn.AddReadSet(row.Key, row.Value, row.Timestamp)
+		}
+		scanned := scannedRange(key0, count, response.Rows)
+		txn.AddScanSet(scanned.Start, scanned.End)
+	}
+	scanner := NewTransaction(tid(2))
+	scan(scanner, 0)
+	if len(scanner.ReadSet) != 2 || scanner.ReadSet[key0] != val0 || scanner.ReadSet[key1] != val1 {
+		t.Fatalf("Expected scan to read %s and %s, got: %v", key0, key1, scanner)
+	}
+
+	// key2 falls between the keys the scanner read
+	inserter := NewTransaction(tid(3))
+	inserter.AddWriteSet(key2, val2)
+	replica.Prepare(inserter, timestamps[2])
+	if response, _ := replica.Prepare(scanner, timestamps[3]); response.Status != RPLY_ABSTAIN {
+		t.Errorf("Expected RPLY_ABSTAIN while a phantom is prepared, got: %s", ReplyTypeString(response.Status))
+	}
+	replica.Commit(inserter.ID, timestamps[2])
+	if response, _ := replica.Prepare(scanner, timestamps[3]); response.Status != RPLY_ABORT {
+		t.Errorf("Expected RPLY_ABORT after a phantom committed, got: %s", ReplyTypeString(response.Status))
+	}
+
+	// Inserts into the range of a prepared or committed scan are ordered after it
+	rescanner := NewTransaction(tid(4))
+	scan(rescanner, 0)
+	if response, _ := replica.Prepare(rescanner, timestamps[4]); response.Status != RPLY_OK {
+		t.Fatalf("Expected rescan to prepare, got: %s", ReplyTypeString(response.Status))
+	}
+	late := NewTransaction(tid(5))
+	late.AddWriteSet("zzz", val0)
+	if response, _ := replica.Prepare(late, timestamps[3]); response.Status != RPLY_RETRY || !response.Timestamp.Equals(timestamps[4]) {
+		t.Errorf("Expected RPLY_RETRY at the prepared scan, got: %v", response)
+	}
+	replica.Commit(rescanner.ID, timestamps[4])
+	if response, _ := replica.Prepare(late, timestamps[3]); response.Status != RPLY_RETRY || !response.Timestamp.Equals(timestamps[4]) {
+		t.Errorf("Expected RPLY_RETRY at the committed scan, got: %v", response)
+	}
+
+	// A scan that stopped at count only covers keys up to the last one it read
+	bounded := NewTransaction(tid(6))
+	scan(bounded, 1)
+	if len(bounded.ReadSet) != 1 || bounded.ScanSet[0].End != key0 {
+		t.Fatalf("Expected scan to stop at %s, got: %v", key0, bounded)
+	}
+	bounded.AddWriteSet(key0, val2)
+	if response, _ := replica.Prepare(bounded, timestamps[5]); response.Status != RPLY_OK {
+		t.Errorf("Expected bounded scan to prepare, got: %s", ReplyTypeString(response.Status))
+	}
+
+	// Snapshot scans abstain while a write into their range is prepared below them
+	if response, _ := replica.Scan(key0, 0, timestamps[6]); response.Status != RPLY_ABSTAIN {
+		t.Errorf("Expected RPLY_ABSTAIN below the prepared write, got: %s", ReplyTypeString(response.Status))
+	}
+	response, _ := replica.Scan(key1, 0, timestamps[6])
+	if response.Status != RPLY_OK || len(response.Rows) != 1 || response.Rows[0].Key != key1 {
+		t.Errorf("Expected snapshot scan outside the prepared write, got: %v", response)
+	}
+	response, _ = replica.Scan(key0, 2, timestamps[2])
+	if response.Status != RPLY_OK || len(response.Rows) != 2 || response.Rows[1].Key != key2 || response.Rows[1].Value != val2 {
+		t.Errorf("Expected snapshot scan at %v, got: %v", timestamps[2], response)
+	}
+}
+
+func TestScan(t *testing.T) {
+	config := startCluster(t, nil, "55241", "55242", "55243")
+	client, err := NewTapirClient(config)
+	if err != nil {
+		t.Fatal("Failed to dial server:", err)
+	}
+
+	txn := client.Begin()
+	txn.Write(key0, val0)
+	txn.Write(key1, val1)
+	if !txn.Commit() {
+		t.Fatal("Expected first transaction to commit")
+	}
+	snapshot := NewTimestamp(0)
+	// Commits are applied asynchronously, wait for the closest replica to have them
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		txn = client.Begin()
+		rows, _ := txn.Scan(key0, 0)
+		txn.Abort()
+		if len(rows) == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A scan sees the writes of its own transaction
+	txn = client.Begin()
+	txn.Write(key2, val2)
+	rows, err := txn.Scan(key0, 2)
+	if err != nil || len(rows) != 2 || rows[0].Value != val0 || rows[1].Key != key2 || rows[1].Value != val2 {
+		t.Errorf("Expected %s and the buffered %s, got: %v, %v", key0, key2, rows, err)
+	}
+	if !txn.Commit() {
+		t.Fatal("Expected scanning transaction to commit")
+	}
+
+	txn = client.BeginReadOnly(snapshot)
+	rows, err = txn.Scan("", 0)
+	if err != nil || len(rows) != 2 || rows[0].Key != key0 || rows[1].Key != key1 {
+		t.Errorf("Expected %s and %s at the earlier snapshot, got: %v, %v", key0, key1, rows, err)
+	}
+	txn.Commit()
+
+	app := &TapirAppImpl{client: client}
+	ctx := app.InitThread(context.Background())
+	app.Start(ctx)
+	app.Insert(ctx, "t", "1", map[string][]byte{"f": []byte("1")})
+	app.Insert(ctx, "t", "2", map[string][]byte{"f": []byte("2")})
+	app.Insert(ctx, "u", "1", map[string][]byte{"f": []byte("3")})
+	if err := app.Commit(ctx); err != nil {
+		t.Fatal("Expected inserts to commit:", err)
+	}
+	app.Start(ctx)
+	app.Delete(ctx, "t", "1")
+	records, err := app.Scan(ctx, "t", "", 5, []string{"f"})
+	if err != nil || len(records) != 1 || string(records[0]["f"]) != "2" {
+		t.Errorf("Expected only the remaining record of the table, got: %v, %v", records, err)
+	}
+	app.Commit(ctx)
+}
+
+// Keys before "m" live on shard 0, the rest on shard 1
+func splitPartitioner(key string, n int) int {
+	if key < "m" {
+		return 0
+	}
+	return 1
+}
+
+func startShardedCluster(t *testing.T, shards ...[]string) *Configuration {
+	var groups []map[int]*ReplicaAddress
+	for _, ports := range shards {
+		replicas := make(map[int]*ReplicaAddress)
+		for _, port := range ports {
+			id, _ := strconv.Atoi(port)
+			replicas[id] = NewReplicaAddress("localhost", port)
+		}
+		groups = append(groups, replicas)
+	}
+	closest, _ := strconv.Atoi(shards[0][0])
+	config := NewShardedConfiguration(NewClientConfiguration(1, 1, closest), groups)
+	startServers(t, config)
+	return config
+}
+
+func TestParticipants(t *testing.T) {
+	client := &TapirClientImpl{
+		shards:      []*shardClient{{}, {}},
+		partitioner: splitPartitioner,
+	}
+	txn := &Txn{client: client, t_id: tid(7), txn: NewTransaction(tid(7))}
+	txn.txn.AddReadSet(key0, val0, NewTimestamp(0))
+	txn.txn.AddWriteSet(key1, val1)
+	participants := txn.participants()
+	if len(participants) != 2 || len(participants[0].ReadSet) != 1 || len(participants[0].WriteSet) != 0 || participants[1].WriteSet[key1] != val1 {
+		t.Errorf("Expected read on shard 0 and write on shard 1, got: %v", participants)
+	}
+
+	txn.txn = NewTransaction(tid(7))
+	txn.txn.AddWriteSet(key0, val0)
+	if participants := txn.participants(); len(participants) != 1 || participants[0] == nil {
+		t.Errorf("Expected only shard 0 to participate, got: %v", participants)
+	}
+	txn.txn.AddScanSet(key0, "")
+	if participants := txn.participants(); len(participants) != 2 || len(participants[1].ScanSet) != 1 {
+		t.Errorf("Expected a scan to involve every shard, got: %v", participants)
+	}
+}
+
+func TestShardedCommit(t *testing.T) {
+	config := startShardedCluster(t, []string{"55251", "55252", "55253"}, []string{"55254", "55255", "55256"})
+	if config.NumShards() != 2 || config.GroupOf(55255).N != 3 || config.GroupOf(55255).Replicas[55252] != nil {
+		t.Fatalf("Expected two groups of three replicas, got: %+v", config)
+	}
+	client, err := NewTapirClientWithPartitioner(config, splitPartitioner)
+	if err != nil {
+		t.Fatal("Failed to dial server:", err)
+	}
+
+	// key0 lives on shard 0, key1 and key2 on shard 1
+	txn := client.Begin()
+	txn.Write(key0, val0)
+	txn.Write(key1, val1)
+	txn.Write(key2, val2)
+	if !txn.Commit() {
+		t.Fatal("Expected transaction across both shards to commit")
+	}
+
+	txn = client.BeginReadOnly(nil)
+	for key, val := range map[string]string{key0: val0, key1: val1, key2: val2} {
+		if got, err := txn.Read(key); err != nil || got != val {
+			t.Errorf("Expected %s for %s, got: %s, %v", val, key, got, err)
+		}
+	}
+	rows, err := txn.Scan("", 0)
+	if err != nil || len(rows) != 3 || rows[0].Key != key0 || rows[1].Key != key2 || rows[2].Key != key1 {
+		t.Errorf("Expected scan to merge both shards in key order, got: %v, %v", rows, err)
+	}
+	txn.Commit()
+
+	// The scan prepares on both shards
+	txn = client.Begin()
+	rows, _ = txn.Scan(key0, 2)
+	txn.Write(key0, val1)
+	if len(rows) != 2 || !txn.Commit() {
+		t.Errorf("Expected scanning transaction to commit, got: %v", rows)
+	}
+}
+
+func TestClusterOverNetwork(t *testing.T) {
+	replicas := map[int]*ReplicaAddress{
+		1: NewReplicaAddress("replica1", "0"),
+		2: NewReplicaAddress("replica2", "0"),
+		3: NewReplicaAddress("replica3", "0"),
+	}
+	config := NewConfiguration(NewClientConfiguration(1, 1, 1), replicas)
+	config.Transport = transport.NewNetwork()
+	startServers(t, config)
+	client, err := NewTapirClient(config)
+	if err != nil {
+		t.Fatal("Failed to create client:", err)
+	}
+
+	txn := client.Begin()
+	txn.Write(key0, val0)
+	txn.Write(key1, val1)
+	if !txn.Commit() {
+		t.Fatal("Expected transaction to commit")
+	}
+	txn = client.BeginReadOnly(nil)
+	if val, err := txn.Read(key0); err != nil || val != val0 {
+		t.Errorf("Expected %s, got: %s, %v", val0, val, err)
+	}
+	if rows, err := txn.Scan("", 0); err != nil || len(rows) != 2 || rows[0].Key != key0 || rows[1].Key != key1 {
+		t.Errorf("Expected both keys in the scan, got: %v, %v", rows, err)
+	}
+	txn.Commit()
+}
+
+// Node of the client on a faulty network, replicas are nodes 1 to n
+const clientNode = 0
+
+// Start n tapir replicas on a faulty network, each on its own node. Returns
+// the configuration of the client and the replicas by id.
+func startFaultyCluster(t *testing.T, n int, closest int, network *transport.FaultyNetwork) (*Configuration, map[int]*TapirServer) {
+	replicas := make(map[int]*ReplicaAddress)
+	for id := 1; id <= n; id++ {
+		replicas[id] = NewReplicaAddress("replica"+strconv.Itoa(id), "0")
+	}
+	config := NewConfiguration(NewClientConfiguration(1, 1, closest), replicas)
+	config.FastPathTimeout = 20 * time.Millisecond
+	config.SlowPathTimeout = time.Second
+	apps := make(map[int]*TapirServer)
+	var servers []IRReplica
+	t.Cleanup(func() {
+		for _, server := range servers {
+			server.Stop()
+		}
+	})
+	for id := range replicas {
+		own := *config
+		own.Transport = network.Node(id)
+		app, _ := NewTapirServerWithConfig(id, &own)
+		apps[id] = app.(*TapirServer)
+		server, err := NewIRReplicaWithConfig(id, &own, app)
+		if err != nil {
+			t.Fatal("Failed to start server:", err)
+		}
+		servers = append(servers, server)
+	}
+	config.Transport = network.Node(clientNode)
+	return config, apps
+}
+
+// Wait until the replicas hold value for key
+func waitValue(t *testing.T, apps map[int]*TapirServer, key string, value string) {
+	deadline := time.Now().Add(2 * time.Second)
+	for id, app := range apps {
+		for {
+			val, _, _ := app.store.Read(key)
+			if val == value {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected replica %d to hold %s for %s, got: %s", id, value, key, val)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+}
+
+// Wait until the replicas know the transaction has the given status
+func waitStatus(t *testing.T, apps map[int]*TapirServer, txnID TxnID, status TxnStatus) {
+	deadline := time.Now().Add(2 * time.Second)
+	for id, app := range apps {
+		for {
+			got, _, _ := app.store.Status(txnID)
+			if got == status {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected transaction %v %v on replica %d, got: %v", txnID, status, id, got)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+}
+
+func TestCommitSurvivesReplicaFailure(t *testing.T) {
+	network := transport.NewFaultyNetwork(1)
+	// The closest replica is the one that fails, reads go to the others
+	config, apps := startFaultyCluster(t, 3, 3, network)
+	client, _ := NewTapirClient(config)
+
+	network.Partition([]int{clientNode, 1, 2})
+	txn := client.Begin()
+	txn.Write(key0, val0)
+	if !txn.Commit() {
+		t.Fatal("Expected commit with f replicas down")
+	}
+	waitValue(t, map[int]*TapirServer{1: apps[1], 2: apps[2]}, key0, val0)
+	txn = client.Begin()
+	if val, err := txn.Read(key0); err != nil || val != val0 {
+		t.Errorf("Expected %s from a replica still up, got: %s, %v", val0, val, err)
+	}
+	txn.Write(key1, val1)
+	if !txn.Commit() {
+		t.Fatal("Expected read-write transaction to commit with f replicas down")
+	}
+	// Finalizes go out in the background, let them arrive before moving the partition
+	waitValue(t, map[int]*TapirServer{1: apps[1], 2: apps[2]}, key1, val1)
+
+	// The other side of the partition does not block the ones after it heals
+	network.Heal()
+	network.Partition([]int{clientNode, 2, 3})
+	txn = client.Begin()
+	txn.Write(key2, val2)
+	if !txn.Commit() {
+		t.Fatal("Expected commit with another replica down")
+	}
+	network.Heal()
+	txn = client.BeginReadOnly(nil)
+	for key, val := range map[string]string{key0: val0, key1: val1, key2: val2} {
+		if got, err := txn.Read(key); err != nil || got != val {
+			t.Errorf("Expected %s for %s, got: %s, %v", val, key, got, err)
+		}
+	}
+	txn.Commit()
+}
+
+func TestCommitSurvivesReordering(t *testing.T) {
+	network := transport.NewFaultyNetwork(2)
+	network.SetDefaultRule(transport.Rule{Duplicate: 0.2, MaxDelay: 10 * time.Millisecond})
+	config, apps := startFaultyCluster(t, 3, 1, network)
+	client, _ := NewTapirClient(config)
+
+	// Every transaction increments a counter, commits and prepares overtake
+	// each other so reads are often stale and OCC has to catch them
+	committed := 0
+	for i := 0; i < 20; i++ {
+		txn := client.Begin()
+		val, err := txn.Read(key0)
+		if err != nil && !errors.Is(err, ErrKeyNotFound) {
+			t.Fatal("Read failed:", err)
+		}
+		counter, _ := strconv.Atoi(val)
+		txn.Write(key0, strconv.Itoa(counter+1))
+		if txn.Commit() {
+			committed++
+		}
+	}
+	if committed == 0 {
+		t.Fatal("Expected some transactions to commit")
+	}
+	waitValue(t, apps, key0, strconv.Itoa(committed))
+}
+
+// Clock of a client running behind the others
+type skewedClock struct {
+	Clock
+	skew time.Duration
+}
+
+func (c skewedClock) Now() time.Time {
+	return c.Clock.Now().Add(-c.skew)
+}
+
+func TestTypedErrors(t *testing.T) {
+	replicas := map[int]*ReplicaAddress{
+		1: NewReplicaAddress("replica1", "0"),
+		2: NewReplicaAddress("replica2", "0"),
+		3: NewReplicaAddress("replica3", "0"),
+	}
+	config := NewConfiguration(NewClientConfiguration(1, 1, 1), replicas)
+	config.Transport = transport.NewNetwork()
+	startServers(t, config)
+	client, _ := NewTapirClient(config)
+	ctx := context.Background()
+
+	txn := client.Begin()
+	if _, err := txn.ReadContext(ctx, key0); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound for a missing key, got: %v", err)
+	}
+	txn.WriteContext(ctx, key0, val0)
+	if err := txn.CommitContext(ctx); err != nil {
+		t.Fatal("Expected first transaction to commit:", err)
+	}
+
+	// A write commits between the read and the commit of another transaction
+	stale := client.Begin()
+	stale.ReadContext(ctx, key0)
+	overwrite := client.Begin()
+	overwrite.WriteContext(ctx, key0, val1)
+	if err := overwrite.CommitContext(ctx); err != nil {
+		t.Fatal("Expected overwrite to commit:", err)
+	}
+	stale.WriteContext(ctx, key1, val1)
+	if err := stale.CommitContext(ctx); !errors.Is(err, ErrAborted) || errors.Is(err, ErrRetryExhausted) {
+		t.Errorf("Expected stale read to abort with ErrAborted, got: %v", err)
+	}
+
+	// A client far behind has to retry its writes after the reads of the
+	// others, without retries it gives up
+	reader := client.Begin()
+	reader.ReadContext(ctx, key0)
+	if err := reader.CommitContext(ctx); err != nil {
+		t.Fatal("Expected reader to commit:", err)
+	}
+	behind := *config
+	behind.Client = NewClientConfiguration(2, 2, 1)
+	behind.Client.MaxRetries = 0
+	behind.Clock = skewedClock{SystemClock, time.Hour}
+	late, _ := NewTapirClient(&behind)
+	txn = late.Begin()
+	txn.WriteContext(ctx, key0, val2)
+	if err := txn.CommitContext(ctx); !errors.Is(err, ErrRetryExhausted) || !errors.Is(err, ErrAborted) {
+		t.Errorf("Expected ErrRetryExhausted, got: %v", err)
+	}
+
+	// Operations of a done context fail without touching the replicas
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	txn = client.Begin()
+	if _, err := txn.ReadContext(cancelled, key0); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected read to fail with context.Canceled, got: %v", err)
+	}
+	if err := txn.WriteContext(cancelled, key0, val2); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected write to fail with context.Canceled, got: %v", err)
+	}
+	txn.Abort()
+
+	app := &TapirAppImpl{client: client}
+	thread := app.InitThread(ctx)
+	app.Start(thread)
+	if _, err := app.Read(thread, "t", "missing", nil); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected app read of a missing record to fail with ErrKeyNotFound, got: %v", err)
+	}
+	if err := app.Update(thread, "t", "missing", map[string][]byte{"f": []byte("1")}); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected update of a missing record to fail with ErrKeyNotFound, got: %v", err)
+	}
+	app.Abort(thread)
+}
+
+func TestContextDeadline(t *testing.T) {
+	network := transport.NewFaultyNetwork(3)
+	config, _ := startFaultyCluster(t, 3, 1, network)
+	client, _ := NewTapirClient(config)
+
+	// Replies take longer than the deadline, it ends every operation long
+	// before the client's own timeouts
+	network.SetDefaultRule(transport.Rule{MinDelay: time.Second, MaxDelay: time.Second})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	txn := client.Begin()
+	if _, err := txn.ReadContext(ctx, key0); !errors.Is(err, ErrTimeout) {
+		t.Errorf("Expected read to time out, got: %v", err)
+	}
+	txn.WriteContext(context.Background(), key0, val0)
+	if err := txn.CommitContext(ctx); !errors.Is(err, ErrTimeout) {
+		t.Errorf("Expected commit to time out, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected operations to end at the deadline, took %v", elapsed)
+	}
+	if stats := client.Stats(); stats.Aborted != 1 {
+		t.Errorf("Expected timed out transaction to be aborted, got: %+v", stats)
+	}
+}
+
+func TestRunTxn(t *testing.T) {
+	replicas := map[int]*ReplicaAddress{
+		1: NewReplicaAddress("replica1", "0"),
+		2: NewReplicaAddress("replica2", "0"),
+		3: NewReplicaAddress("replica3", "0"),
+	}
+	config := NewConfiguration(NewClientConfiguration(1, 1, 1), replicas)
+	config.Transport = transport.NewNetwork()
+	config.Client.MaxAttempts = 100
+	config.Client.RetryBackoff = time.Millisecond
+	startServers(t, config)
+	client, _ := NewTapirClient(config)
+	ctx := context.Background()
+
+	// Increments of one counter abort each other, every one of them gets
+	// through in the end
+	const workers, increments = 4, 5
+	var mu sync.Mutex
+	attempts := 0
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < increments; j++ {
+				n, err := client.RunTxn(ctx, func(txn *Txn) error {
+					val, err := txn.ReadContext(ctx, key0)
+					if err != nil && !errors.Is(err, ErrKeyNotFound) {
+						return err
+					}
+					counter, _ := strconv.Atoi(val)
+					return txn.WriteContext(ctx, key0, strconv.Itoa(counter+1))
+				})
+				if err != nil {
+					t.Errorf("Expected increment to commit, got: %v after %d attempts", err, n)
+				}
+				mu.Lock()
+				attempts += n
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	stats := client.Stats()
+	if stats.Committed != workers*increments || stats.Aborted != attempts-workers*increments {
+		t.Errorf("Expected every attempt but the last of each increment to abort, got %d attempts: %+v", attempts, stats)
+	}
+	// A read is only known to be current once its transaction commits
+	var val string
+	_, err := client.RunTxn(ctx, func(txn *Txn) (err error) {
+		val, err = txn.ReadContext(ctx, key0)
+		return err
+	})
+	if err != nil || val != strconv.Itoa(workers*increments) {
+		t.Errorf("Expected counter at %d, got: %s, %v", workers*increments, val, err)
+	}
+
+	// Other errors of fn are not retried
+	boom := errors.New("boom")
+	if n, err := client.RunTxn(ctx, func(txn *Txn) error { return boom }); n != 1 || err != boom {
+		t.Errorf("Expected error of fn after one attempt, got: %v after %d attempts", err, n)
+	}
+	// Aborts are retried up to the limit
+	limited := *config
+	limited.Client = NewClientConfiguration(2, 2, 1)
+	limited.Client.MaxAttempts = 3
+	limited.Client.RetryBackoff = time.Millisecond
+	client, _ = NewTapirClient(&limited)
+	if n, err := client.RunTxn(ctx, func(txn *Txn) error { return ErrAborted }); n != 3 || !errors.Is(err, ErrAborted) {
+		t.Errorf("Expected ErrAborted after 3 attempts, got: %v after %d attempts", err, n)
+	}
+}
+
+func TestDecideOrphan(t *testing.T) {
+	timestamps := createAscendingTimes(2)
+	groups := map[int]*Configuration{0: {N: 3, F: 1}, 1: {N: 3, F: 1}}
+	prepared := func(i int) *Response {
+		reply := NewResponseWithTime(RPLY_OK, timestamps[i])
+		reply.TxnStatus = TXN_PREPARED
+		return reply
+	}
+	status := func(s TxnStatus) *Response {
+		reply := NewResponseWithTime(RPLY_OK, timestamps[0])
+		reply.TxnStatus = s
+		return reply
+	}
+	tests := []struct {
+		name    string
+		replies map[int]map[int]*Response
+		status  TxnStatus
+	}{
+		{"committed somewhere", map[int]map[int]*Response{0: {1: prepared(0)}, 1: {4: status(TXN_COMMITTED)}}, TXN_COMMITTED},
+		{"aborted somewhere", map[int]map[int]*Response{0: {1: prepared(0), 2: prepared(0)}, 1: {4: status(TXN_ABORTED)}}, TXN_ABORTED},
+		{"majority of every shard", map[int]map[int]*Response{0: {1: prepared(0), 2: prepared(0)}, 1: {4: prepared(0), 5: prepared(0), 6: status(TXN_UNKNOWN)}}, TXN_COMMITTED},
+		{"majority at different timestamps", map[int]map[int]*Response{0: {1: prepared(0), 2: prepared(0)}, 1: {4: prepared(1), 5: prepared(1), 6: prepared(1)}}, TXN_ABORTED},
+		{"minority of one shard", map[int]map[int]*Response{0: {1: prepared(0), 2: prepared(0)}, 1: {4: prepared(0), 5: status(TXN_UNKNOWN), 6: status(TXN_UNKNOWN)}}, TXN_ABORTED},
+		{"missing replica may tip it", map[int]map[int]*Response{0: {1: prepared(0), 2: prepared(0)}, 1: {4: prepared(0), 5: status(TXN_UNKNOWN)}}, TXN_UNKNOWN},
+		{"shard did not reply", map[int]map[int]*Response{0: {1: prepared(0), 2: prepared(0)}, 1: {}}, TXN_UNKNOWN},
+	}
+	for _, test := range tests {
+		if status, timestamp := decideOrphan(test.replies, groups); status != test.status {
+			t.Errorf("%s: expected %v, got: %v at %v", test.name, test.status, status, timestamp)
+		} else if status == TXN_COMMITTED && !timestamp.Equals(timestamps[0]) {
+			t.Errorf("%s: expected commit at %v, got: %v", test.name, timestamps[0], timestamp)
+		}
+	}
+}
+
+func TestTerminateOrphan(t *testing.T) {
+	network := transport.NewFaultyNetwork(3)
+	_, apps := startFaultyCluster(t, 3, 1, network)
+
+	// Only one replica got the prepare before its client went away, the
+	// others can't have agreed to commit
+	orphan := NewTransaction(tid(1))
+	orphan.AddWriteSet(key0, val0)
+	apps[1].store.Prepare(orphan, NewTimestamp(1))
+	apps[1].terminate(orphan)
+	waitStatus(t, apps, orphan.ID, TXN_ABORTED)
+	if orphaned := apps[1].store.Orphaned(0); len(orphaned) != 0 {
+		t.Errorf("Expected no prepared transaction left, got: %v", orphaned)
+	}
+}
+
+// A client that stalls past the prepare timeout finds its transaction
+// ended by the replicas, and agrees with them once it resumes
+func TestCoordinatorResumesAfterTermination(t *testing.T) {
+	network := transport.NewFaultyNetwork(3)
+	config, apps := startFaultyCluster(t, 3, 1, network)
+	client, _ := NewTapirClient(config)
+	ctx := context.Background()
+
+	// Every replica prepared the transaction, its client stalls before it
+	// commits and the replicas commit it themselves
+	prepared := client.Begin()
+	prepared.WriteContext(ctx, key0, val0)
+	participants := prepared.participants()
+	timestamp := client.(*TapirClientImpl).proposeAfter(nil)
+	if response, err := prepared.prepare(ctx, participants, timestamp, 0); err != nil || response.Status != RPLY_OK {
+		t.Fatalf("Expected transaction to prepare, got: %v, %v", response, err)
+	}
+	apps[1].terminate(prepared.txn)
+	waitStatus(t, apps, prepared.ID(), TXN_COMMITTED)
+	prepared.commit(ctx, participants, timestamp, 0)
+	for id, app := range apps {
+		if status, at, _ := app.store.Status(prepared.ID()); status != TXN_COMMITTED || !at.Equals(timestamp) {
+			t.Errorf("Expected replica %d to commit at %v, got: %v at %v", id, timestamp, status, at)
+		}
+	}
+
+	// Only one replica got the prepare before the client stalled, the
+	// replicas abort it and so does the client once it resumes
+	partial := client.Begin()
+	partial.WriteContext(ctx, key0, val1)
+	apps[1].store.Prepare(partial.txn, client.(*TapirClientImpl).proposeAfter(nil))
+	apps[1].terminate(partial.txn)
+	waitStatus(t, apps, partial.ID(), TXN_ABORTED)
+	if err := partial.CommitContext(ctx); !errors.Is(err, ErrAborted) {
+		t.Errorf("Expected resumed commit to abort, got: %v", err)
+	}
+	waitStatus(t, apps, partial.ID(), TXN_ABORTED)
+
+	var val string
+	client.RunTxn(ctx, func(txn *Txn) (err error) {
+		val, err = txn.ReadContext(ctx, key0)
+		return err
+	})
+	if val != val0 {
+		t.Errorf("Expected the committed write, got: %s", val)
+	}
+}
+
+func TestPrepareTimeout(t *testing.T) {
+	replicas := map[int]*ReplicaAddress{
+		1: NewReplicaAddress("replica1", "0"),
+		2: NewReplicaAddress("replica2", "0"),
+		3: NewReplicaAddress("replica3", "0"),
+	}
+	config := NewConfiguration(NewClientConfiguration(1, 1, 1), replicas)
+	config.Transport = transport.NewNetwork()
+	config.PrepareTimeout = 200 * time.Millisecond
+	config.Client.MaxAttempts = 100
+	startServers(t, config)
+	ctx := context.Background()
+
+	// A client prepares and goes away before it commits
+	crashed, _ := NewTapirClient(config)
+	orphan := crashed.Begin()
+	orphan.WriteContext(ctx, key0, val0)
+	if response, err := orphan.prepare(ctx, orphan.participants(), crashed.(*TapirClientImpl).proposeAfter(nil), 0); err != nil || response.Status != RPLY_OK {
+		t.Fatalf("Expected orphan to prepare, got: %v, %v", response, err)
+	}
+
+	// Every replica prepared it, the replicas commit it once it times out
+	// and the write that conflicts with it goes through
+	config.Client = NewClientConfiguration(2, 2, 1)
+	config.Client.MaxAttempts = 100
+	client, _ := NewTapirClient(config)
+	start := time.Now()
+	n, err := client.RunTxn(ctx, func(txn *Txn) error {
+		val, err := txn.ReadContext(ctx, key0)
+		if err != nil && !errors.Is(err, ErrKeyNotFound) {
+			return err
+		}
+		return txn.WriteContext(ctx, key0, val+val1)
+	})
+	if err != nil {
+		t.Fatalf("Expected write to commit once the orphan ended, got: %v after %d attempts", err, n)
+	}
+	if elapsed := time.Since(start); elapsed < config.PrepareTimeout/2 {
+		t.Errorf("Expected write to wait for the orphan to time out, took %v", elapsed)
+	}
+	var val string
+	client.RunTxn(ctx, func(txn *Txn) (err error) {
+		val, err = txn.ReadContext(ctx, key0)
+		return err
+	})
+	if val != val0+val1 {
+		t.Errorf("Expected write after the orphan's, got: %s", val)
+	}
+}
+
+func TestSlowPrepareAborts(t *testing.T) {
+	network := transport.NewFaultyNetwork(3)
+	config, apps := startFaultyCluster(t, 3, 1, network)
+	config.PrepareTimeout = 100 * time.Millisecond
+	client, _ := NewTapirClient(config)
+
+	// The replicas may end a transaction whose prepare took this long, the
+	// client must not commit it
+	network.SetDefaultRule(transport.Rule{MinDelay: 60 * time.Millisecond, MaxDelay: 60 * time.Millisecond})
+	txn := client.Begin()
+	txn.WriteContext(context.Background(), key0, val0)
+	if err := txn.CommitContext(context.Background()); !errors.Is(err, ErrAborted) {
+		t.Errorf("Expected slow prepare to abort, got: %v", err)
+	}
+	waitStatus(t, apps, txn.ID(), TXN_ABORTED)
+}
+
+// Write a cluster configuration file and load it
+func loadClusterFile(t *testing.T, name string, contents string) (*ClusterFile, error) {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return LoadClusterFile(path)
+}
+
+func TestLoadClusterFile(t *testing.T) {
+	file, err := loadClusterFile(t, "cluster.yaml", `
+f: 1
+replicas:
+  - {id: 1, address: "10.0.0.1:7001"}
+  - {id: 2, address: "10.0.0.2:7001"}
+  - {id: 3, address: "10.0.0.3:7001"}
+  - {id: 4, address: "10.0.0.4:7001"}
+clients:
+  - {id: 7, ir_id: 8, closest_replica: 2}
+data_dir: /var/lib/tapir
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := file.ClientConfiguration(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.N != 4 || config.F != 1 || config.Replicas[2].SpecificString() != "10.0.0.2:7001" || config.Storage == nil || config.Storage.DataDir != "/var/lib/tapir" {
+		t.Errorf("Expected 4 replicas tolerating 1 failure with storage, got: %+v", config)
+	}
+	if config.Client.TAPIR_ID != 7 || config.Client.IR_ID != 8 || config.Client.ClosestReplicaID != 2 || config.Client.MaxRetries != DefaultMaxRetries {
+		t.Errorf("Expected client 7, got: %+v", config.Client)
+	}
+	if _, err := file.ClientConfiguration(9); err == nil {
+		t.Error("Expected error for a client not in the file")
+	}
+
+	// The same deployment in two shards, as JSON
+	file, err = loadClusterFile(t, "cluster.json", `{
+	"replicas": [
+		{"id": 1, "address": "localhost:7001"}, {"id": 2, "address": "localhost:7002"}, {"id": 3, "address": "localhost:7003"},
+		{"id": 4, "address": "localhost:7004"}, {"id": 5, "address": "localhost:7005"}, {"id": 6, "address": "localhost:7006"}
+	],
+	"shards": [[1, 2, 3], [4, 5, 6]]
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err = file.Configuration()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.NumShards() != 2 || config.Shard(1).N != 3 || config.Shard(1).Replicas[5].Port != "7005" || config.Client != nil {
+		t.Errorf("Expected two shards of three replicas, got: %+v", config)
+	}
+
+	// f applies to every shard
+	file, err = loadClusterFile(t, "cluster.yaml", `
+f: 1
+replicas:
+  - {id: 1, address: "localhost:7001"}
+  - {id: 2, address: "localhost:7002"}
+  - {id: 3, address: "localhost:7003"}
+  - {id: 4, address: "localhost:7004"}
+  - {id: 5, address: "localhost:7005"}
+  - {id: 6, address: "localhost:7006"}
+  - {id: 7, address: "localhost:7007"}
+  - {id: 8, address: "localhost:7008"}
+shards: [[1, 2, 3, 4, 5], [6, 7, 8]]
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err = file.Configuration()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Shard(0).F != 1 || config.Shard(1).F != 1 || config.GroupOf(2).F != 1 {
+		t.Errorf("Expected every shard to tolerate 1 failure, got: %d and %d", config.Shard(0).F, config.Shard(1).F)
+	}
+
+	invalid := map[string]string{
+		"unknown field":         "replicas: [{id: 1, address: \"localhost:7001\"}]\nreplica: []",
+		"no port":               "replicas: [{id: 1, address: localhost}]",
+		"duplicate replica":     "replicas: [{id: 1, address: \"localhost:7001\"}, {id: 1, address: \"localhost:7002\"}]",
+		"too few replicas":      "f: 1\nreplicas: [{id: 1, address: \"localhost:7001\"}, {id: 2, address: \"localhost:7002\"}]",
+		"replica in no shard":   "replicas: [{id: 1, address: \"localhost:7001\"}, {id: 2, address: \"localhost:7002\"}]\nshards: [[1]]",
+		"unknown shard replica": "replicas: [{id: 1, address: \"localhost:7001\"}]\nshards: [[1, 2]]",
+	}
+	for name, contents := range invalid {
+		file, err := loadClusterFile(t, "cluster.yaml", contents)
+		if err == nil {
+			_, err = file.Configuration()
+		}
+		if err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestAttachTapirApp(t *testing.T) {
+	file, err := loadClusterFile(t, "cluster.yaml", `
+replicas:
+  - {id: 55261, address: "localhost:55261"}
+  - {id: 55262, address: "localhost:55262"}
+  - {id: 55263, address: "localhost:55263"}
+clients:
+  - {id: 1, ir_id: 1, closest_replica: 55261}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The replicas run on their own, as tapir-replica runs them
+	config, err := file.Configuration()
+	if err != nil {
+		t.Fatal(err)
+	}
+	startServers(t, config)
+
+	config, err = file.ClientConfiguration(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app, err := AttachTapirApp(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+	ctx := app.InitThread(context.Background())
+	app.Start(ctx)
+	app.Insert(ctx, "table", key0, map[string][]byte{"field": []byte(val0)})
+	if err := app.Commit(ctx); err != nil {
+		t.Fatal("Expected insert to commit, got:", err)
+	}
+	// The commit reaches the closest replica in the background
+	var row map[string][]byte
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		app.Start(ctx)
+		row, err = app.Read(ctx, "table", key0, nil)
+		app.Commit(ctx)
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil || string(row["field"]) != val0 {
+		t.Errorf("Expected to read the inserted row, got: %v, %v", row, err)
+	}
+
+	config.Client = nil
+	if _, err := AttachTapirApp(config); err == nil {
+		t.Error("Expected error attaching without a client")
+	}
+}
+
+// Threads of one app run their transactions side by side, each in its own
+func TestAppThreads(t *testing.T) {
+	config, _ := startFaultyCluster(t, 3, 1, transport.NewFaultyNetwork(1))
+	client, err := NewTapirClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &TapirAppImpl{client: client}
+	defer app.Close()
+	if err := app.Start(context.Background()); err == nil {
+		t.Error("Expected start without a thread to fail")
+	}
+
+	a, b := app.InitThread(context.Background()), app.InitThread(context.Background())
+	app.Start(a)
+	app.Start(b)
+	app.Insert(a, "t", "a", map[string][]byte{"f": []byte("a")})
+	app.Insert(b, "t", "b", map[string][]byte{"f": []byte("b")})
+	if err := app.Commit(b); err != nil {
+		t.Fatal("Expected the later transaction to commit first, got:", err)
+	}
+	if err := app.Commit(a); err != nil {
+		t.Fatal("Expected the earlier transaction to commit, got:", err)
+	}
+
+	const threads = 8
+	var wg sync.WaitGroup
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx := app.InitThread(context.Background())
+			for j := 0; j < 3; j++ {
+				app.Start(ctx)
+				app.Insert(ctx, "t", fmt.Sprintf("%d.%d", i, j), map[string][]byte{"f": []byte("x")})
+				if err := app.Commit(ctx); err != nil {
+					t.Errorf("Thread %d: expected insert %d to commit, got: %v", i, j, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// The closest replica may still miss a commit, the scan aborts then
+	ctx := app.InitThread(context.Background())
+	var records []map[string][]byte
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		app.Start(ctx)
+		records, err = app.Scan(ctx, "t", "", 100, nil)
+		if app.Commit(ctx) == nil && err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(records) != 2+3*threads {
+		t.Errorf("Expected %d records, got %d: %v", 2+3*threads, len(records), err)
+	}
+}
+
+// Clusters whose replica ids overlap run side by side in one process, and a
+// cluster torn down can start again on the same ports
+func TestClustersShareProcess(t *testing.T) {
+	newCluster := func(ports ...string) *Configuration {
+		replicas := make(map[int]*ReplicaAddress)
+		for i, port := range ports {
+			replicas[i+1] = NewReplicaAddress("localhost", port)
+		}
+		return NewConfiguration(NewClientConfiguration(1, 1, 1), replicas)
+	}
+	put := func(app TapirApp, value string) error {
+		ctx := app.InitThread(context.Background())
+		app.Start(ctx)
+		app.Insert(ctx, "table", key0, map[string][]byte{"field": []byte(value)})
+		return app.Commit(ctx)
+	}
+	get := func(app TapirApp) (string, error) {
+		ctx := app.InitThread(context.Background())
+		app.Start(ctx)
+		defer app.Commit(ctx)
+		row, err := app.Read(ctx, "table", key0, nil)
+		return string(row["field"]), err
+	}
+
+	a, err := NewTapirApp(newCluster("55264", "55265", "55266"))
+	if err != nil {
+		t.Fatal("Failed to start cluster a:", err)
+	}
+	b, err := NewTapirApp(newCluster("55267", "55268", "55269"))
+	if err != nil {
+		t.Fatal("Failed to start cluster b:", err)
+	}
+	defer b.Close()
+	if _, err := NewTapirApp(newCluster("55264", "55270", "55271")); err == nil {
+		t.Error("Expected a cluster on a port in use to fail")
+	}
+	if err := put(a, val0); err != nil {
+		t.Fatal("Expected put to cluster a to commit, got:", err)
+	}
+	if err := put(b, val1); err != nil {
+		t.Fatal("Expected put to cluster b to commit, got:", err)
+	}
+	if val, err := get(a); err != nil || val != val0 {
+		t.Errorf("Expected cluster a to read %s, got: %s, %v", val0, val, err)
+	}
+	if val, err := get(b); err != nil || val != val1 {
+		t.Errorf("Expected cluster b to read %s, got: %s, %v", val1, val, err)
+	}
+
+	// Replicas keep their state in memory, the new cluster a starts empty
+	for round := 0; round < 3; round++ {
+		a.Close()
+		a, err = NewTapirApp(newCluster("55264", "55265", "55266"))
+		if err != nil {
+			t.Fatalf("Failed to restart cluster a in round %d: %v", round, err)
+		}
+		if _, err := get(a); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Expected restarted cluster a to be empty in round %d, got: %v", round, err)
+		}
+		if err := put(a, val2); err != nil {
+			t.Errorf("Expected put to restarted cluster a to commit in round %d, got: %v", round, err)
+		}
+	}
+	a.Close()
+	if val, err := get(b); err != nil || val != val1 {
+		t.Errorf("Expected cluster b to be unaffected, got: %s, %v", val, err)
+	}
+}
+
+// Transactions keep committing while a replica is replaced
+func TestReconfigureCluster(t *testing.T) {
+	replicas := map[int]*ReplicaAddress{
+		1: NewReplicaAddress("replica1", "0"),
+		2: NewReplicaAddress("replica2", "0"),
+		3: NewReplicaAddress("replica3", "0"),
+	}
+	config := NewConfiguration(NewClientConfiguration(1, 1, 1), replicas)
+	config.Transport = transport.NewNetwork()
+	config.Client.MaxAttempts = 100
+	config.Client.RetryBackoff = time.Millisecond
+	start := func(id int, config *Configuration) IRReplica {
+		app, err := NewTapirServerWithConfig(id, config)
+		if err != nil {
+			t.Fatal("Failed to create server:", err)
+		}
+		server, err := NewIRReplicaWithConfig(id, config, app)
+		if err != nil {
+			t.Fatal("Failed to start server:", err)
+		}
+		t.Cleanup(server.Stop)
+		return server
+	}
+	for id := range replicas {
+		start(id, config)
+	}
+
+	added := *config
+	added.Replicas = map[int]*ReplicaAddress{4: NewReplicaAddress("replica4", "0")}
+	for id, addr := range replicas {
+		added.Replicas[id] = addr
+	}
+	added.N, added.F = 4, 1
+	joining := start(4, &added)
+	joined := make(chan error, 1)
+	go func() { joined <- joining.Join() }()
+	replaced := map[int]*ReplicaAddress{1: replicas[1], 2: replicas[2], 4: added.Replicas[4]}
+
+	client, _ := NewTapirClient(config)
+	ctx := context.Background()
+	const workers, increments = 3, 10
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			for j := 0; j < increments; j++ {
+				_, err := client.RunTxn(ctx, func(txn *Txn) error {
+					val, err := txn.ReadContext(ctx, key)
+					if err != nil && !errors.Is(err, ErrKeyNotFound) {
+						return err
+					}
+					counter, _ := strconv.Atoi(val)
+					return txn.WriteContext(ctx, key, strconv.Itoa(counter+1))
+				})
+				if err != nil {
+					t.Errorf("Expected increment of %s to commit, got: %v", key, err)
+				}
+			}
+		}("key" + strconv.Itoa(i))
+	}
+
+	admin, _ := NewIRClient(config)
+	reconfigure, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if err := admin.Reconfigure(reconfigure, added.Replicas); err != nil {
+		t.Fatal("Failed to add replica 4:", err)
+	}
+	if err := <-joined; err != nil {
+		t.Fatal("Replica 4 failed to join:", err)
+	}
+	if err := admin.Reconfigure(reconfigure, replaced); err != nil {
+		t.Fatal("Failed to retire replica 3:", err)
+	}
+	wg.Wait()
+
+	// A client of the original configuration finds the new group
+	reader, _ := NewTapirClient(config)
+	for i := 0; i < workers; i++ {
+		key := "key" + strconv.Itoa(i)
+		var val string
+		_, err := reader.RunTxn(ctx, func(txn *Txn) (err error) {
+			val, err = txn.ReadContext(ctx, key)
+			return err
+		})
+		if err != nil || val != strconv.Itoa(increments) {
+			t.Errorf("Expected %s to be %d, got: %s, %v", key, increments, val, err)
 		}
-		client.Commit()
 	}
 }
@@ -9,20 +9,80 @@ type VersionedValue struct {
 	Value     string
 }
 
+// KeyVersion is a key returned by a scan with its version
+type KeyVersion struct {
+	Key string
+	*VersionedValue
+}
+
+// StoreSnapshot holds the contents of a store, restoring it into another
+// store commits the same versions, last reads and scans
+type StoreSnapshot struct {
+	Versions []*KeyVersion // every version of every key, in key order
+	Reads    []*StoreRead
+	Scans    []*StoreScan
+}
+
+// StoreRead is the last read of a version, a nil Version stands for reads
+// that found no version of the key
+type StoreRead struct {
+	Key      string
+	Version  *Timestamp
+	ReadTime *Timestamp
+}
+
+// StoreScan is the last scan of a key range
+type StoreScan struct {
+	Range    KeyRange
+	ScanTime *Timestamp
+}
+
 // Define VersionedKVStore interface
 type VersionedKVStore interface {
 	// Read the most recent value and timestamp of the given key
 	Get(key string) (*VersionedValue, bool)
 
+	// Read the value and timestamp of the given key valid at the given timestamp
+	GetAt(key string, time *Timestamp) (*VersionedValue, bool)
+
+	// Read up to count keys at or after startKey in key order, with their versions
+	// valid at the given timestamp or their latest versions if it is nil. Keys
+	// with no version at the timestamp are skipped, a count of 0 reads all keys.
+	Scan(startKey string, count int, time *Timestamp) []*KeyVersion
+
 	// Write the given key-value pair to the store
 	Put(key string, value string, time *Timestamp)
 
-	// Commit a read by udpating the timestamp of the latest read transaction for the version of the key that the transaction read
+	// Commit a read by udpating the timestamp of the latest read transaction for the version of the key that the transaction read,
+	// a nil readTime stands for a read that found no version of the key
 	CommitGet(key string, readTime *Timestamp, commitTime *Timestamp)
 
+	// Commit a scan of the keys in [startKey, endKey], an empty endKey stands for
+	// every key after startKey. Writes of keys the scan found no version of must
+	// be ordered after it, the versions it found are committed with CommitGet.
+	CommitScan(startKey string, endKey string, commitTime *Timestamp)
+
+	// Get the latest commit time of the scans covering the key
+	GetLastScan(key string) (*Timestamp, bool)
+
 	// Get the last read for the write valid at the given timestamp
 	GetLastRead(key string, time *Timestamp) (*Timestamp, bool)
 
 	// Get the valid time frame for the write valid at the given timestamp
 	GetRange(key string, time *Timestamp) (*Timestamp, *Timestamp, bool)
+
+	// Drop versions that no read at or after the watermark can see, and last
+	// reads that can't order a write at or after the watermark. Returns the
+	// number of versions and last reads reclaimed.
+	CollectGarbage(watermark *Timestamp) (int, int)
+
+	// Copy the versions, last reads and scans of the store
+	Snapshot() *StoreSnapshot
+
+	// Commit the versions, last reads and scans of a snapshot on top of what
+	// the store has, durable stores log them like any other change
+	Restore(snapshot *StoreSnapshot)
+
+	// Release the resources of the store, durable stores flush their log
+	Close() error
 }
@@ -1,26 +1,113 @@
 package versionstore
 
 import (
+	"bytes"
+	"encoding/gob"
+	"errors"
 	"fmt"
 	"log"
 	"sort"
 	"sync"
+	"time"
 
 	. "github.com/ViolaChenYT/TAPIR/common"
+	"github.com/ViolaChenYT/TAPIR/common/wal"
 )
 
 type VersionedKVStoreImpl struct {
-	store     map[string][]*VersionedValue           // <key, (write_time, value)> pairs of storage
-	lastReads map[string](map[*Timestamp]*Timestamp) // <key, <write_time, last_read_time>> recording last read time of each version
+	store     map[string][]*VersionedValue        // <key, (write_time, value)> pairs of storage
+	lastReads map[string](map[version]*Timestamp) // <key, <write_time, last_read_time>> recording last read time of each version
+	keys      []string                            // keys of store in ascending order
+	scans     map[KeyRange]*Timestamp             // <scanned range, last scan time>
 	storelock sync.Mutex
 	readslock sync.Mutex
+	log       wal.Log // nil if the store is in memory only
+}
+
+// storeEntry is a Put, CommitGet or garbage collection in the write-ahead log of the store
+type storeEntry struct {
+	Key       string
+	Value     string
+	WriteTime *Timestamp // version written, or version read by a CommitGet
+	ReadTime  *Timestamp // commit time of the read, nil for a Put
+	Scan      *KeyRange  // set for a CommitScan
+	Watermark *Timestamp // set for a garbage collection
+}
+
+// version identifies a write by value, timestamps arriving over RPC are new pointers
+type version struct {
+	nanos int64
+	id    int
+}
+
+// versionOf(nil) stands for reads of a key before its first write
+func versionOf(t *Timestamp) version {
+	if t == nil {
+		return version{}
+	}
+	return version{nanos: t.Timestamp.UnixNano(), id: t.ID}
+}
+
+// timeOf is the inverse of versionOf
+func timeOf(v version) *Timestamp {
+	if v == (version{}) {
+		return nil
+	}
+	return NewCustomTimestamp(v.id, time.Unix(0, v.nanos))
 }
 
 func NewVersionedKVStore() VersionedKVStore {
 	return &VersionedKVStoreImpl{
 		store:     make(map[string][]*VersionedValue),
-		lastReads: make(map[string](map[*Timestamp]*Timestamp)),
+		lastReads: make(map[string](map[version]*Timestamp)),
+		scans:     make(map[KeyRange]*Timestamp),
+	}
+}
+
+// OpenVersionedKVStore opens the store in dir with the engine selected by the storage configuration
+func OpenVersionedKVStore(dir string, storage *StorageConfiguration, clock Clock) (VersionedKVStore, error) {
+	switch storage.Engine {
+	case ENGINE_MEMORY:
+		return NewDurableVersionedKVStore(dir, storage, clock)
+	case ENGINE_DISK:
+		return NewDiskVersionedKVStore(dir, storage, clock)
 	}
+	return nil, errors.New(fmt.Sprintf("unknown storage engine %d", storage.Engine))
+}
+
+// NewDurableVersionedKVStore creates a store that logs every change to a
+// write-ahead log in dir, the contents of an existing log are replayed first
+func NewDurableVersionedKVStore(dir string, storage *StorageConfiguration, clock Clock) (VersionedKVStore, error) {
+	vs := NewVersionedKVStore().(*VersionedKVStoreImpl)
+	l, err := wal.Open(dir, storage, clock)
+	if err != nil {
+		return nil, err
+	}
+	replayed := 0
+	err = l.Replay(func(data []byte) error {
+		var entry storeEntry
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&entry); err != nil {
+			return err
+		}
+		if entry.Watermark != nil {
+			vs.collectGarbage(entry.Watermark)
+		} else if entry.Scan != nil {
+			vs.commitScan(*entry.Scan, entry.ReadTime)
+		} else if entry.ReadTime != nil {
+			vs.commitGet(entry.Key, entry.WriteTime, entry.ReadTime)
+		} else {
+			vs.put(entry.Key, entry.Value, entry.WriteTime)
+		}
+		replayed++
+		return nil
+	})
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	log.Println("Replayed", replayed, "store entries from", dir)
+	vs.log = l
+	return vs, nil
 }
 
 func EmptyEntry() *VersionedValue {
@@ -31,6 +118,8 @@ func EmptyEntry() *VersionedValue {
 }
 
 func (vs *VersionedKVStoreImpl) Get(key string) (*VersionedValue, bool) {
+	vs.storelock.Lock()
+	defer vs.storelock.Unlock()
 	versionedVals, ok := vs.store[key]
 	if !ok {
 		// key not found
@@ -43,39 +132,122 @@ func (vs *VersionedKVStoreImpl) Get(key string) (*VersionedValue, bool) {
 	return EmptyEntry(), false
 }
 
+func (vs *VersionedKVStoreImpl) GetAt(key string, time *Timestamp) (*VersionedValue, bool) {
+	vs.storelock.Lock()
+	defer vs.storelock.Unlock()
+	return vs.getValue(key, time)
+}
+
+func (vs *VersionedKVStoreImpl) Scan(startKey string, count int, time *Timestamp) []*KeyVersion {
+	vs.storelock.Lock()
+	defer vs.storelock.Unlock()
+	var result []*KeyVersion
+	for i := sort.SearchStrings(vs.keys, startKey); i < len(vs.keys) && (count <= 0 || len(result) < count); i++ {
+		key := vs.keys[i]
+		versionedVals := vs.store[key]
+		versionedVal, ok := versionedVals[len(versionedVals)-1], true
+		if time != nil {
+			versionedVal, ok = vs.getValue(key, time)
+		}
+		if ok {
+			result = append(result, &KeyVersion{Key: key, VersionedValue: versionedVal})
+		}
+	}
+	return result
+}
+
 func (vs *VersionedKVStoreImpl) Put(key string, value string, time *Timestamp) {
 	log.Println("Commiting to KV: ", key, value)
 	vs.storelock.Lock()
-	if key_entry, ok := vs.store[key]; ok {
-		vs.store[key] = append(key_entry, &VersionedValue{WriteTime: time, Value: value})
-	} else {
+	defer vs.storelock.Unlock()
+	vs.logEntry(&storeEntry{Key: key, Value: value, WriteTime: time})
+	vs.put(key, value, time)
+}
+
+// Must hold vs.storelock
+func (vs *VersionedKVStoreImpl) put(key string, value string, time *Timestamp) {
+	key_entry, ok := vs.store[key]
+	if !ok {
 		log.Println("New entry created")
-		vs.store[key] = []*VersionedValue{{WriteTime: time, Value: value}}
+		i := sort.SearchStrings(vs.keys, key)
+		vs.keys = append(vs.keys, "")
+		copy(vs.keys[i+1:], vs.keys[i:])
+		vs.keys[i] = key
 	}
-	vs.storelock.Unlock()
+	// Keep versions ordered by write time, commits may arrive out of timestamp order
+	i := sort.Search(len(key_entry), func(i int) bool {
+		return !key_entry[i].WriteTime.LessThan(time)
+	})
+	if i < len(key_entry) && key_entry[i].WriteTime.Equals(time) {
+		// Same commit applied again
+		key_entry[i].Value = value
+		return
+	}
+	key_entry = append(key_entry, nil)
+	copy(key_entry[i+1:], key_entry[i:])
+	key_entry[i] = &VersionedValue{WriteTime: time, Value: value}
+	vs.store[key] = key_entry
 }
 
 func (vs *VersionedKVStoreImpl) CommitGet(key string, readTime *Timestamp, commitTime *Timestamp) {
-	// Create the <version, last_read_time> map if not exists
 	vs.readslock.Lock()
+	defer vs.readslock.Unlock()
+	vs.logEntry(&storeEntry{Key: key, WriteTime: readTime, ReadTime: commitTime})
+	vs.commitGet(key, readTime, commitTime)
+}
+
+// Must hold vs.readslock
+func (vs *VersionedKVStoreImpl) commitGet(key string, readTime *Timestamp, commitTime *Timestamp) {
+	// Create the <version, last_read_time> map if not exists
 	if vs.lastReads[key] == nil {
-		vs.lastReads[key] = make(map[*Timestamp]*Timestamp)
+		vs.lastReads[key] = make(map[version]*Timestamp)
+	}
+	v := versionOf(readTime)
+	vs.lastReads[key][v] = LaterTime(vs.lastReads[key][v], commitTime)
+}
+
+func (vs *VersionedKVStoreImpl) CommitScan(startKey string, endKey string, commitTime *Timestamp) {
+	vs.readslock.Lock()
+	defer vs.readslock.Unlock()
+	scan := KeyRange{Start: startKey, End: endKey}
+	vs.logEntry(&storeEntry{Scan: &scan, ReadTime: commitTime})
+	vs.commitScan(scan, commitTime)
+}
+
+// Must hold vs.readslock
+func (vs *VersionedKVStoreImpl) commitScan(scan KeyRange, commitTime *Timestamp) {
+	vs.scans[scan] = LaterTime(vs.scans[scan], commitTime)
+}
+
+func (vs *VersionedKVStoreImpl) GetLastScan(key string) (*Timestamp, bool) {
+	vs.readslock.Lock()
+	defer vs.readslock.Unlock()
+	var lastScan *Timestamp
+	for scan, scanTime := range vs.scans {
+		if scan.Contains(key) {
+			lastScan = LaterTime(lastScan, scanTime)
+		}
 	}
-	vs.lastReads[key][readTime] = commitTime
-	vs.readslock.Unlock()
+	return lastScan, lastScan != nil
 }
 
 func (vs *VersionedKVStoreImpl) GetLastRead(key string, time *Timestamp) (*Timestamp, bool) {
-	versionedVal, ok := vs.getValue(key, time)
-	if !ok {
-		// key not found
-		return EmptyTime(), false
+	var writeTime *Timestamp
+	vs.storelock.Lock()
+	if versionedVal, ok := vs.getValue(key, time); ok {
+		writeTime = versionedVal.WriteTime
 	}
+	vs.storelock.Unlock()
 
-	return vs.lastReads[key][versionedVal.WriteTime], true
+	vs.readslock.Lock()
+	defer vs.readslock.Unlock()
+	lastRead, ok := vs.lastReads[key][versionOf(writeTime)]
+	return lastRead, ok
 }
 
 func (vs *VersionedKVStoreImpl) GetRange(key string, time *Timestamp) (*Timestamp, *Timestamp, bool) {
+	vs.storelock.Lock()
+	defer vs.storelock.Unlock()
 	versionedVals, ok := vs.store[key]
 	if !ok {
 		// key not found
@@ -89,7 +261,7 @@ func (vs *VersionedKVStoreImpl) GetRange(key string, time *Timestamp) (*Timestam
 	for i := len(versionedVals) - 1; i >= 0; i-- {
 		if versionedVals[i].WriteTime.LessThanOrEqualTo(time) {
 			startTime = versionedVals[i].WriteTime
-			if i < len(versionedVals)-2 {
+			if i < len(versionedVals)-1 {
 				endTime = versionedVals[i+1].WriteTime
 			}
 			valid = true
@@ -99,6 +271,127 @@ func (vs *VersionedKVStoreImpl) GetRange(key string, time *Timestamp) (*Timestam
 	return startTime, endTime, valid
 }
 
+func (vs *VersionedKVStoreImpl) CollectGarbage(watermark *Timestamp) (int, int) {
+	vs.storelock.Lock()
+	defer vs.storelock.Unlock()
+	vs.readslock.Lock()
+	defer vs.readslock.Unlock()
+	vs.logEntry(&storeEntry{Watermark: watermark})
+	return vs.collectGarbage(watermark)
+}
+
+// Must hold vs.storelock and vs.readslock
+func (vs *VersionedKVStoreImpl) collectGarbage(watermark *Timestamp) (int, int) {
+	versions, reads := 0, 0
+	for key, versionedVals := range vs.store {
+		// Keep the version valid at the watermark and everything after it
+		i := sort.Search(len(versionedVals), func(i int) bool {
+			return watermark.LessThan(versionedVals[i].WriteTime)
+		}) - 1
+		if i <= 0 {
+			continue
+		}
+		for _, vv := range versionedVals[:i] {
+			if _, ok := vs.lastReads[key][versionOf(vv.WriteTime)]; ok {
+				delete(vs.lastReads[key], versionOf(vv.WriteTime))
+				reads++
+			}
+		}
+		vs.store[key] = append([]*VersionedValue(nil), versionedVals[i:]...)
+		versions += i
+	}
+	for key, lastReads := range vs.lastReads {
+		// No write at or after the watermark can be ordered before these reads
+		for v, lastRead := range lastReads {
+			if lastRead.LessThan(watermark) {
+				delete(lastReads, v)
+				reads++
+			}
+		}
+		if len(lastReads) == 0 {
+			delete(vs.lastReads, key)
+		}
+	}
+	for scan, scanTime := range vs.scans {
+		if scanTime.LessThan(watermark) {
+			delete(vs.scans, scan)
+			reads++
+		}
+	}
+	return versions, reads
+}
+
+func (vs *VersionedKVStoreImpl) Snapshot() *StoreSnapshot {
+	vs.storelock.Lock()
+	defer vs.storelock.Unlock()
+	vs.readslock.Lock()
+	defer vs.readslock.Unlock()
+	snapshot := &StoreSnapshot{}
+	for _, key := range vs.keys {
+		for _, vv := range vs.store[key] {
+			snapshot.Versions = append(snapshot.Versions, &KeyVersion{Key: key, VersionedValue: &VersionedValue{WriteTime: vv.WriteTime, Value: vv.Value}})
+		}
+	}
+	for key, lastReads := range vs.lastReads {
+		for v, lastRead := range lastReads {
+			snapshot.Reads = append(snapshot.Reads, &StoreRead{Key: key, Version: timeOf(v), ReadTime: lastRead})
+		}
+	}
+	for scan, scanTime := range vs.scans {
+		snapshot.Scans = append(snapshot.Scans, &StoreScan{Range: scan, ScanTime: scanTime})
+	}
+	return snapshot
+}
+
+func (vs *VersionedKVStoreImpl) Restore(snapshot *StoreSnapshot) {
+	restore(vs, snapshot)
+}
+
+// Commit the contents of a snapshot through the interface of the store,
+// skipping versions and reads the store has already, so restoring into a
+// durable store that has them logs nothing
+func restore(vs VersionedKVStore, snapshot *StoreSnapshot) {
+	for _, kv := range snapshot.Versions {
+		if vv, ok := vs.GetAt(kv.Key, kv.WriteTime); ok && vv.WriteTime.Equals(kv.WriteTime) && vv.Value == kv.Value {
+			continue
+		}
+		vs.Put(kv.Key, kv.Value, kv.WriteTime)
+	}
+	for _, read := range snapshot.Reads {
+		if read.Version != nil {
+			if lastRead, ok := vs.GetLastRead(read.Key, read.Version); ok && !lastRead.LessThan(read.ReadTime) {
+				continue
+			}
+		}
+		vs.CommitGet(read.Key, read.Version, read.ReadTime)
+	}
+	for _, scan := range snapshot.Scans {
+		vs.CommitScan(scan.Range.Start, scan.Range.End, scan.ScanTime)
+	}
+}
+
+func (vs *VersionedKVStoreImpl) Close() error {
+	if vs.log == nil {
+		return nil
+	}
+	return vs.log.Close()
+}
+
+// Append a change to the write-ahead log before applying it, a change that
+// can't be made durable must not be applied
+func (vs *VersionedKVStoreImpl) logEntry(entry *storeEntry) {
+	if vs.log == nil {
+		return
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(entry); err != nil {
+		log.Panicf("Error encoding store entry: %v", err)
+	}
+	if err := vs.log.Append(buf.Bytes()); err != nil {
+		log.Panicf("Error writing store log: %v", err)
+	}
+}
+
 // Return <value, write_time> valid at the given timestamp
 func (vs *VersionedKVStoreImpl) getValue(key string, validTime *Timestamp) (*VersionedValue, bool) {
 	versionedVals, ok := vs.store[key]
@@ -125,7 +418,7 @@ func (kv *VersionedKVStoreImpl) String() string {
 			return versions[i].WriteTime.LessThan(versions[j].WriteTime)
 		})
 		for _, vv := range versions {
-			lastRead := kv.lastReads[key][vv.WriteTime]
+			lastRead := kv.lastReads[key][versionOf(vv.WriteTime)]
 			result += fmt.Sprintf("\tWrite Time: %v, Value: %v, Last Read Time: %v\n",
 				vv.WriteTime, vv.Value, lastRead)
 		}
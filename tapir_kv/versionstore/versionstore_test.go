@@ -0,0 +1,364 @@
+package versionstore
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	. "github.com/ViolaChenYT/TAPIR/common"
+)
+
+func ascendingTimes(count int) []*Timestamp {
+	now := time.Now()
+	output := make([]*Timestamp, count)
+	for i := 0; i < count; i++ {
+		output[i] = NewCustomTimestamp(i, now.Add(time.Duration(i)*time.Second))
+	}
+	return output
+}
+
+// Every engine, opened in a fresh directory
+func engines(t *testing.T) map[string]func() VersionedKVStore {
+	open := func(engine StorageEngine) func() VersionedKVStore {
+		return func() VersionedKVStore {
+			storage := NewStorageConfiguration(t.TempDir())
+			storage.Engine = engine
+			vs, err := OpenVersionedKVStore(storage.DataDir, storage, SystemClock)
+			if err != nil {
+				t.Fatal("Failed to open store:", err)
+			}
+			t.Cleanup(func() { vs.Close() })
+			return vs
+		}
+	}
+	return map[string]func() VersionedKVStore{
+		"memory":  NewVersionedKVStore,
+		"durable": open(ENGINE_MEMORY),
+		"disk":    open(ENGINE_DISK),
+	}
+}
+
+func TestEngines(t *testing.T) {
+	timestamps := ascendingTimes(6)
+	for name, open := range engines(t) {
+		t.Run(name, func(t *testing.T) {
+			vs := open()
+			// Versions arrive out of timestamp order
+			vs.Put("a", "3", timestamps[3])
+			vs.Put("a", "1", timestamps[1])
+			vs.Put("a\x00b", "other", timestamps[2])
+			vs.Put("ab", "other", timestamps[2])
+
+			if val, ok := vs.Get("a"); !ok || val.Value != "3" || !val.WriteTime.Equals(timestamps[3]) {
+				t.Errorf("Expected latest version 3, got: %v", val)
+			}
+			if val, ok := vs.GetAt("a", timestamps[2]); !ok || val.Value != "1" {
+				t.Errorf("Expected version 1 at %v, got: %v", timestamps[2], val)
+			}
+			if _, ok := vs.GetAt("a", timestamps[0]); ok {
+				t.Errorf("Expected no version before the first write")
+			}
+			start, end, ok := vs.GetRange("a", timestamps[2])
+			if !ok || !start.Equals(timestamps[1]) || !end.Equals(timestamps[3]) {
+				t.Errorf("Expected range [%v, %v), got: [%v, %v)", timestamps[1], timestamps[3], start, end)
+			}
+
+			// Re-applying a commit replaces its value
+			vs.Put("a", "3'", timestamps[3])
+			if val, _ := vs.Get("a"); val.Value != "3'" {
+				t.Errorf("Expected replaced value, got: %v", val)
+			}
+
+			vs.CommitGet("a", timestamps[1], timestamps[2])
+			vs.CommitGet("a", timestamps[1], timestamps[1])
+			if lastRead, ok := vs.GetLastRead("a", timestamps[2]); !ok || !lastRead.Equals(timestamps[2]) {
+				t.Errorf("Expected last read %v, got: %v", timestamps[2], lastRead)
+			}
+			if _, ok := vs.GetLastRead("a", timestamps[4]); ok {
+				t.Errorf("Expected no read of the latest version")
+			}
+			vs.CommitGet("b", nil, timestamps[5])
+			if lastRead, ok := vs.GetLastRead("b", timestamps[4]); !ok || !lastRead.Equals(timestamps[5]) {
+				t.Errorf("Expected read of missing key at %v, got: %v", timestamps[5], lastRead)
+			}
+		})
+	}
+}
+
+func TestDiskReopen(t *testing.T) {
+	timestamps := ascendingTimes(3)
+	storage := NewStorageConfiguration(t.TempDir())
+	storage.Engine = ENGINE_DISK
+	vs, _ := OpenVersionedKVStore(storage.DataDir, storage, SystemClock)
+	vs.Put("a", "1", timestamps[1])
+	vs.CommitGet("a", timestamps[1], timestamps[2])
+	vs.CommitScan("a", "", timestamps[2])
+	vs.Close()
+
+	vs, err := OpenVersionedKVStore(storage.DataDir, storage, SystemClock)
+	if err != nil {
+		t.Fatal("Failed to reopen store:", err)
+	}
+	defer vs.Close()
+	if val, ok := vs.Get("a"); !ok || val.Value != "1" || !val.WriteTime.Equals(timestamps[1]) {
+		t.Errorf("Expected version 1 after reopening, got: %v", val)
+	}
+	if lastRead, ok := vs.GetLastRead("a", timestamps[2]); !ok || !lastRead.Equals(timestamps[2]) {
+		t.Errorf("Expected last read %v after reopening, got: %v", timestamps[2], lastRead)
+	}
+	if lastScan, ok := vs.GetLastScan("b"); !ok || !lastScan.Equals(timestamps[2]) {
+		t.Errorf("Expected last scan %v after reopening, got: %v", timestamps[2], lastScan)
+	}
+}
+
+func TestCollectGarbage(t *testing.T) {
+	timestamps := ascendingTimes(6)
+	watermark := NewCustomTimestamp(0, timestamps[2].Timestamp.Add(time.Millisecond))
+	for name, open := range engines(t) {
+		t.Run(name, func(t *testing.T) {
+			vs := open()
+			for i := 1; i <= 4; i++ {
+				vs.Put("a", fmt.Sprint(i), timestamps[i])
+			}
+			vs.Put("b", "1", timestamps[1])
+			vs.CommitGet("a", timestamps[1], timestamps[2])
+			vs.CommitGet("a", timestamps[2], timestamps[2])
+			vs.CommitGet("a", timestamps[3], timestamps[5])
+
+			versions, reads := vs.CollectGarbage(watermark)
+			if versions != 1 || reads != 2 {
+				t.Errorf("Expected 1 version and 2 reads reclaimed, got: %d and %d", versions, reads)
+			}
+			if val, ok := vs.GetAt("a", watermark); !ok || val.Value != "2" {
+				t.Errorf("Expected version valid at the watermark to survive, got: %v", val)
+			}
+			if val, ok := vs.Get("b"); !ok || val.Value != "1" {
+				t.Errorf("Expected only version of b to survive, got: %v", val)
+			}
+			if lastRead, ok := vs.GetLastRead("a", timestamps[3]); !ok || !lastRead.Equals(timestamps[5]) {
+				t.Errorf("Expected read after the watermark to survive, got: %v", lastRead)
+			}
+			if versions, reads := vs.CollectGarbage(watermark); versions != 0 || reads != 0 {
+				t.Errorf("Expected nothing left to collect, got: %d and %d", versions, reads)
+			}
+		})
+	}
+}
+
+func TestDiskCompaction(t *testing.T) {
+	timestamps := ascendingTimes(100)
+	storage := NewStorageConfiguration(t.TempDir())
+	storage.Engine = ENGINE_DISK
+	store, _ := OpenVersionedKVStore(storage.DataDir, storage, SystemClock)
+	vs := store.(*DiskVersionedKVStore)
+	vs.compactMinGarbage = 0
+	for i, timestamp := range timestamps {
+		vs.Put("a", fmt.Sprint(i), timestamp)
+	}
+	before := vs.size
+	vs.CollectGarbage(timestamps[99])
+	if vs.size*10 > before {
+		t.Errorf("Expected data file to shrink from %d bytes, got: %d", before, vs.size)
+	}
+	vs.Close()
+
+	store, _ = OpenVersionedKVStore(storage.DataDir, storage, SystemClock)
+	defer store.Close()
+	if val, ok := store.Get("a"); !ok || val.Value != "99" {
+		t.Errorf("Expected latest version after compaction, got: %v", val)
+	}
+	if _, ok := store.GetAt("a", timestamps[98]); ok {
+		t.Errorf("Expected collected version to stay gone after reopening")
+	}
+}
+
+func TestScan(t *testing.T) {
+	timestamps := ascendingTimes(6)
+	for name, open := range engines(t) {
+		t.Run(name, func(t *testing.T) {
+			vs := open()
+			vs.Put("c", "c1", timestamps[1])
+			vs.Put("a", "a1", timestamps[1])
+			vs.Put("a", "a3", timestamps[3])
+			vs.Put("b\x00", "b3", timestamps[3])
+			vs.Put("d", "d4", timestamps[4])
+
+			rows := vs.Scan("a", 0, nil)
+			if len(rows) != 4 || rows[0].Key != "a" || rows[0].Value != "a3" || rows[1].Key != "b\x00" || rows[3].Key != "d" {
+				t.Errorf("Expected latest versions of all keys in order, got: %v", rows)
+			}
+			rows = vs.Scan("a", 2, timestamps[2])
+			if len(rows) != 2 || rows[0].Value != "a1" || rows[1].Key != "c" {
+				t.Errorf("Expected keys with a version at %v, got: %v", timestamps[2], rows)
+			}
+			if rows := vs.Scan("b", 1, nil); len(rows) != 1 || rows[0].Key != "b\x00" {
+				t.Errorf("Expected scan to start after the start key, got: %v", rows)
+			}
+			if rows := vs.Scan("e", 0, nil); len(rows) != 0 {
+				t.Errorf("Expected nothing after the last key, got: %v", rows)
+			}
+
+			vs.CommitScan("b", "c", timestamps[2])
+			vs.CommitScan("b", "c", timestamps[1])
+			vs.CommitScan("c", "", timestamps[5])
+			if lastScan, ok := vs.GetLastScan("b\x00"); !ok || !lastScan.Equals(timestamps[2]) {
+				t.Errorf("Expected last scan %v, got: %v", timestamps[2], lastScan)
+			}
+			if lastScan, ok := vs.GetLastScan("z"); !ok || !lastScan.Equals(timestamps[5]) {
+				t.Errorf("Expected open ended scan to cover z, got: %v", lastScan)
+			}
+			if _, ok := vs.GetLastScan("a"); ok {
+				t.Errorf("Expected no scan before the first range")
+			}
+
+			watermark := NewCustomTimestamp(0, timestamps[3].Timestamp)
+			if _, reads := vs.CollectGarbage(watermark); reads != 1 {
+				t.Errorf("Expected the older scan to be reclaimed, got: %d reads", reads)
+			}
+			if _, ok := vs.GetLastScan("b\x00"); ok {
+				t.Errorf("Expected scan below the watermark to be gone")
+			}
+		})
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	timestamps := ascendingTimes(5)
+	for name, open := range engines(t) {
+		for target, openTarget := range engines(t) {
+			t.Run(name+" to "+target, func(t *testing.T) {
+				vs := open()
+				vs.Put("a", "1", timestamps[1])
+				vs.Put("a", "2", timestamps[2])
+				vs.Put("a\x00b", "other", timestamps[1])
+				vs.CommitGet("a", timestamps[1], timestamps[3])
+				vs.CommitGet("b", nil, timestamps[4])
+				vs.CommitScan("a", "c", timestamps[3])
+
+				// What the target already has stays
+				restored := openTarget()
+				restored.Put("c", "3", timestamps[3])
+				restored.CommitGet("a", timestamps[1], timestamps[4])
+				restored.Restore(vs.Snapshot())
+
+				if val, ok := restored.GetAt("a", timestamps[1]); !ok || val.Value != "1" {
+					t.Errorf("Expected version 1 of a, got: %v", val)
+				}
+				if val, ok := restored.Get("a"); !ok || val.Value != "2" {
+					t.Errorf("Expected version 2 of a, got: %v", val)
+				}
+				if val, ok := restored.Get("a\x00b"); !ok || val.Value != "other" {
+					t.Errorf("Expected a\\x00b, got: %v", val)
+				}
+				if val, ok := restored.Get("c"); !ok || val.Value != "3" {
+					t.Errorf("Expected c to stay, got: %v", val)
+				}
+				if lastRead, ok := restored.GetLastRead("a", timestamps[1]); !ok || !lastRead.Equals(timestamps[4]) {
+					t.Errorf("Expected the later last read to stay, got: %v", lastRead)
+				}
+				if lastRead, ok := restored.GetLastRead("b", timestamps[4]); !ok || !lastRead.Equals(timestamps[4]) {
+					t.Errorf("Expected read of missing key at %v, got: %v", timestamps[4], lastRead)
+				}
+				if lastScan, ok := restored.GetLastScan("b"); !ok || !lastScan.Equals(timestamps[3]) {
+					t.Errorf("Expected last scan %v, got: %v", timestamps[3], lastScan)
+				}
+			})
+		}
+	}
+}
+
+func TestDiskIndexRuns(t *testing.T) {
+	timestamps := ascendingTimes(40)
+	storage := NewStorageConfiguration(t.TempDir())
+	storage.Engine = ENGINE_DISK
+	store, _ := OpenVersionedKVStore(storage.DataDir, storage, SystemClock)
+	disk := store.(*DiskVersionedKVStore)
+	disk.index.memtableEntries = 8
+	disk.compactMinGarbage = 1 << 30
+	memory := NewVersionedKVStore()
+
+	// The index spills into runs, which merge and hide each other's entries
+	rng := rand.New(rand.NewSource(1))
+	runs := 0
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprint("k", rng.Intn(60))
+		timestamp := timestamps[rng.Intn(30)]
+		// Reads commit the version they found
+		var readTime *Timestamp
+		if version, ok := memory.GetAt(key, timestamp); ok {
+			readTime = version.WriteTime
+		}
+		commitTime := timestamps[30+rng.Intn(10)]
+		end := fmt.Sprint("k", rng.Intn(60))
+		for _, vs := range []VersionedKVStore{disk, memory} {
+			switch op := i % 10; {
+			case op < 6:
+				vs.Put(key, fmt.Sprint(i), timestamp)
+			case op < 8:
+				vs.CommitGet(key, readTime, commitTime)
+			case op < 9:
+				vs.CommitScan(key, end, timestamp)
+			default:
+				if i%100 == 99 {
+					vs.CollectGarbage(timestamps[i/100])
+				}
+			}
+		}
+		runs = max(runs, len(disk.index.runs))
+	}
+	if runs < 2 || len(disk.index.memtable) >= 8 {
+		t.Errorf("Expected the index to spill into runs, got %d runs and %d entries in memory", runs, len(disk.index.memtable))
+	}
+	if len(disk.index.runs) > 12 {
+		t.Errorf("Expected runs to merge, got: %d", len(disk.index.runs))
+	}
+
+	compare := func(vs VersionedKVStore) {
+		for k := 0; k < 60; k++ {
+			key := fmt.Sprint("k", k)
+			for _, timestamp := range timestamps {
+				want, wantOk := memory.GetAt(key, timestamp)
+				got, ok := vs.GetAt(key, timestamp)
+				if ok != wantOk || ok && (got.Value != want.Value || !got.WriteTime.Equals(want.WriteTime)) {
+					t.Fatalf("Expected %s at %v to be %v, got: %v", key, timestamp, want, got)
+				}
+				wantRead, wantOk := memory.GetLastRead(key, timestamp)
+				if read, ok := vs.GetLastRead(key, timestamp); ok != wantOk || ok && !read.Equals(wantRead) {
+					t.Fatalf("Expected last read of %s at %v to be %v, got: %v", key, timestamp, wantRead, read)
+				}
+				wantStart, wantEnd, wantOk := memory.GetRange(key, timestamp)
+				if start, end, ok := vs.GetRange(key, timestamp); ok != wantOk || ok && (!start.Equals(wantStart) || end.ID != wantEnd.ID || end.ID >= 0 && !end.Equals(wantEnd)) {
+					t.Fatalf("Expected range of %s at %v to be [%v, %v), got: [%v, %v)", key, timestamp, wantStart, wantEnd, start, end)
+				}
+			}
+			wantScan, wantOk := memory.GetLastScan(key)
+			if scan, ok := vs.GetLastScan(key); ok != wantOk || ok && !scan.Equals(wantScan) {
+				t.Fatalf("Expected last scan of %s to be %v, got: %v", key, wantScan, scan)
+			}
+		}
+		want, got := memory.Scan("k1", 0, timestamps[20]), vs.Scan("k1", 0, timestamps[20])
+		if len(got) != len(want) {
+			t.Fatalf("Expected scan of %d keys, got: %d", len(want), len(got))
+		}
+		for i := range want {
+			if got[i].Key != want[i].Key || got[i].Value != want[i].Value {
+				t.Fatalf("Expected scan row %v, got: %v", want[i], got[i])
+			}
+		}
+	}
+	compare(disk)
+	if versions, reads := disk.CollectGarbage(timestamps[25]); versions == 0 || reads == 0 {
+		t.Errorf("Expected garbage to collect, got: %d and %d", versions, reads)
+	}
+	memory.CollectGarbage(timestamps[25])
+	compare(disk)
+	disk.Close()
+
+	store, err := OpenVersionedKVStore(storage.DataDir, storage, SystemClock)
+	if err != nil {
+		t.Fatal("Failed to reopen store:", err)
+	}
+	defer store.Close()
+	compare(store)
+}
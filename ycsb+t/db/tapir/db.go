@@ -2,7 +2,6 @@ package tapir_kvdb
 
 import (
 	"context"
-	"errors"
 	"fmt"
 
 	"io/ioutil"
@@ -15,6 +14,11 @@ import (
 	tapir "github.com/pingcap/go-ycsb/tapir/tapir_kv"
 )
 
+const (
+	tapirConfig   = "tapir.config"    // cluster configuration file, the replicas run in the benchmark if unset
+	tapirClientID = "tapir.client_id" // client of the cluster configuration file the benchmark runs as
+)
+
 type TapirDB struct {
 	app tapir.TapirApp
 }
@@ -22,16 +26,40 @@ type TapirDB struct {
 type TapirCreator struct{}
 
 func (c TapirCreator) Create(p *properties.Properties) (ycsb.DB, error) {
-	d := CreateTapirDB()
+	d, err := CreateTapirDB(p.GetString(tapirConfig, ""), p.GetInt(tapirClientID, 0))
+	if err != nil {
+		return nil, err
+	}
 	log.SetOutput(ioutil.Discard)
 	return d, nil
 }
 
-// CreateTapirDB creates a new instance of the TapirDB.
-func CreateTapirDB() *TapirDB {
-	return &TapirDB{
-		app: tapir.NewTapirApp(common.GetConfigC()),
+// CreateTapirDB creates a new instance of the TapirDB. It attaches to the
+// cluster of the configuration file as the given client, without a file it
+// starts a cluster of its own.
+func CreateTapirDB(configFile string, clientID int) (*TapirDB, error) {
+	if configFile == "" {
+		app, err := tapir.NewTapirApp(common.GetConfigC())
+		if err != nil {
+			return nil, err
+		}
+		return &TapirDB{app: app}, nil
 	}
+	file, err := common.LoadClusterFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+	config, err := file.ClientConfiguration(clientID)
+	if err != nil {
+		return nil, err
+	}
+	app, err := tapir.AttachTapirApp(config)
+	if err != nil {
+		return nil, err
+	}
+	return &TapirDB{
+		app: app,
+	}, nil
 }
 
 // Close closes the database layer.
@@ -41,10 +69,11 @@ func (d *TapirDB) Close() error {
 	return nil
 }
 
-// InitThread initializes the state associated with the goroutine worker.
+// InitThread initializes the state associated with the goroutine worker,
+// every worker runs its own transactions.
 func (d *TapirDB) InitThread(ctx context.Context, threadID int, threadCount int) context.Context {
 	fmt.Printf("Initializing thread %d out of %d\n", threadID, threadCount)
-	return ctx
+	return d.app.InitThread(ctx)
 }
 
 // CleanupThread cleans up the state when the worker finishes.
@@ -55,48 +84,48 @@ func (d *TapirDB) CleanupThread(ctx context.Context) {
 // Read reads a record from the database and returns a map of each field/value pair.
 func (d *TapirDB) Read(ctx context.Context, table string, key string, fields []string) (map[string][]byte, error) {
 	// fmt.Printf("Reading record with key %s from table %s\n", key, table)
-	return d.app.Read(table, key, fields)
+	return d.app.Read(ctx, table, key, fields)
 }
 
 // Scan scans records from the database.
 func (d *TapirDB) Scan(ctx context.Context, table string, startKey string, count int, fields []string) ([]map[string][]byte, error) {
-	return nil, errors.New("Scan operation not implemented!")
+	return d.app.Scan(ctx, table, startKey, count, fields)
 }
 
 // Update updates a record in the database.
 func (d *TapirDB) Update(ctx context.Context, table string, key string, values map[string][]byte) error {
 	// fmt.Printf("Updating record with key %s in table %s\n", key, table)
-	return d.app.Update(table, key, values)
+	return d.app.Update(ctx, table, key, values)
 }
 
 // Insert inserts a record into the database.
 func (d *TapirDB) Insert(ctx context.Context, table string, key string, values map[string][]byte) error {
 	// fmt.Printf("Inserting record with key %s into table %s\n", key, table)
-	return d.app.Insert(table, key, values)
+	return d.app.Insert(ctx, table, key, values)
 }
 
 // Delete deletes a record from the database.
 func (d *TapirDB) Delete(ctx context.Context, table string, key string) error {
-	return d.app.Delete(table, key)
+	return d.app.Delete(ctx, table, key)
 }
 
-func (d *TapirDB) Start() error {
+func (d *TapirDB) Start(ctx context.Context) error {
 	// fmt.Printf("Starting a transaction\n")
 	// log.Println("----------------------Starting a transaction")
 	// time.Sleep(time.Millisecond * 100)
-	return d.app.Start()
+	return d.app.Start(ctx)
 }
 
-func (d *TapirDB) Commit() error {
+func (d *TapirDB) Commit(ctx context.Context) error {
 	// fmt.Printf("Committing a transaction\n")
 	// log.Println("----------------------Committing a transaction")
-	return d.app.Commit()
+	return d.app.Commit(ctx)
 }
 
-func (d *TapirDB) Abort() error {
+func (d *TapirDB) Abort(ctx context.Context) error {
 	// log.Println("----------------------Aborting a transaction")
 	// fmt.Printf("Aborting a transaction\n")
-	return d.app.Abort()
+	return d.app.Abort(ctx)
 }
 
 // Register with the server
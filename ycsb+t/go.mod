@@ -35,6 +35,7 @@ require (
 	go.mongodb.org/mongo-driver v1.11.3
 	google.golang.org/api v0.114.0
 	google.golang.org/genproto v0.0.0-20230410155749-daa745c078e1
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
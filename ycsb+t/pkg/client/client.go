@@ -126,12 +126,12 @@ func (w *worker) run(ctx context.Context) {
 				err = w.workload.DoBatchTransaction(ctx, w.batchSize, w.workDB)
 				opsCount = w.batchSize
 			} else {
-				w.workDB.Start()
+				w.workDB.Start(ctx)
 				err = w.workload.DoTransaction(ctx, w.workDB)
 				if err == nil {
-					err = w.workDB.Commit()
+					err = w.workDB.Commit(ctx)
 				} else {
-					err = w.workDB.Abort()
+					err = w.workDB.Abort(ctx)
 				}
 			}
 		} else {
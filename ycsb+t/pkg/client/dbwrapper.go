@@ -174,29 +174,29 @@ func (db DbWrapper) Analyze(ctx context.Context, table string) error {
 	return nil
 }
 
-func (db DbWrapper) Start() (err error) {
+func (db DbWrapper) Start(ctx context.Context) (err error) {
 	start := time.Now()
 	defer func() {
 		measure(start, "START", err)
 	}()
 
-	return db.DB.Start()
+	return db.DB.Start(ctx)
 }
 
-func (db DbWrapper) Commit() (err error) {
+func (db DbWrapper) Commit(ctx context.Context) (err error) {
 	start := time.Now()
 	defer func() {
 		measure(start, "COMMIT", err)
 	}()
 
-	return db.DB.Commit()
+	return db.DB.Commit(ctx)
 }
 
-func (db DbWrapper) Abort() (err error) {
+func (db DbWrapper) Abort(ctx context.Context) (err error) {
 	start := time.Now()
 	defer func() {
 		measure(start, "ABORT", err)
 	}()
 
-	return db.DB.Abort()
+	return db.DB.Abort(ctx)
 }
\ No newline at end of file
@@ -69,10 +69,11 @@ type DB interface {
 	// key: The record key of the record to delete.
 	Delete(ctx context.Context, table string, key string) error
 
-	// Methods for transactional database.
-	Start() error 
-	Commit() error
-	Abort() error
+	// Methods for transactional database. A thread runs one transaction at
+	// a time, with the context InitThread returned for it.
+	Start(ctx context.Context) error
+	Commit(ctx context.Context) error
+	Abort(ctx context.Context) error
 }
 
 type BatchDB interface {
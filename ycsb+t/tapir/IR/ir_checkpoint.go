@@ -0,0 +1,312 @@
+package IR
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/pingcap/go-ycsb/tapir/common"
+)
+
+// Checkpoints keep the record from growing without bound. Every checkpoint
+// interval a normal replica encodes the state of its application, which
+// covers every operation executed so far, and drops the entries of its
+// record finalized at least the record retention ago. Duplicates of dropped
+// operations that arrive late must not execute again. Every message of a
+// client tells up to which sequence all of its logged operations are done,
+// the replica refuses operations of the client up to there that the record
+// lacks, and remembers the dropped operations past it.
+//
+// The record of a replica that truncated no longer brings the others up to
+// date in a view change. Its view change and start view messages name its
+// latest checkpoint, a replica that installs a view streams the checkpoints
+// they name from their replicas in the background (GetCheckpoint) and
+// restores them, so a replica that lagged, lost its state or joins catches
+// up. Restoring merges into the application state, a checkpoint older than
+// what the replica knows does no harm.
+
+// Default size of the chunks a checkpoint is streamed in
+const defaultCheckpointChunk = 1 << 20
+
+// checkpoint of the application state of a replica, kept next to its log
+type checkpoint struct {
+	Seq       int         // raised by every checkpoint of the replica
+	Truncated bool        // the record lacks entries the checkpoint covers
+	Completed map[int]int // <client_id, seq> up to which every logged operation of each IR client is done
+	Dropped   []OpID      // operations the record dropped past the completed seq of their client
+	Data      []byte
+}
+
+// CheckpointMessage carries a chunk of the latest checkpoint of a replica
+type CheckpointMessage struct {
+	ReplicaID int
+	Seq       int // checkpoint the chunk belongs to
+	Offset    int // of the chunk in the checkpoint
+	Size      int // of the whole checkpoint
+	Data      []byte
+}
+
+// Checkpoint the application now and drop the entries of the record that
+// the retention policy lets go
+func (r *IRReplicaImpl) Checkpoint() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.status != STATUS_NORMAL {
+		return fmt.Errorf("replica %d is not in normal status", r.id)
+	}
+	return r.takeCheckpoint()
+}
+
+// GetCheckpoint sends the chunk of the latest checkpoint of the replica at
+// args.Offset. The caller asks for the next chunk until it has Size bytes,
+// and starts over if Seq changes in between.
+func (r *IRReplicaImpl) GetCheckpoint(args *CheckpointMessage, reply *CheckpointMessage) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.checkpoint == nil || r.status == STATUS_STOPPED {
+		return fmt.Errorf("replica %d has no checkpoint", r.id)
+	}
+	data := r.checkpoint.Data
+	if args.Offset < 0 || args.Offset > len(data) {
+		return fmt.Errorf("offset %d is outside checkpoint %d of %d bytes", args.Offset, r.checkpoint.Seq, len(data))
+	}
+	end := args.Offset + r.checkpointChunk
+	if end > len(data) {
+		end = len(data)
+	}
+	reply.ReplicaID = r.id
+	reply.Seq = r.checkpoint.Seq
+	reply.Offset = args.Offset
+	reply.Size = len(data)
+	reply.Data = data[args.Offset:end]
+	return nil
+}
+
+// Checkpoint every interval until the replica stops
+func (r *IRReplicaImpl) checkpointLoop(interval time.Duration) {
+	for !r.stopCheckpoints.Wait(interval) {
+		r.mu.Lock()
+		if r.status == STATUS_NORMAL {
+			if err := r.takeCheckpoint(); err != nil {
+				log.Println("Replica", r.id, "failed to checkpoint:", err)
+			}
+		}
+		r.mu.Unlock()
+	}
+}
+
+// Checkpoint the application and drop the entries finalized at least the
+// record retention ago, the checkpoint is on disk before the log loses
+// them. Must hold r.mu.
+func (r *IRReplicaImpl) takeCheckpoint() error {
+	data, err := r.app.Checkpoint()
+	if err != nil {
+		return err
+	}
+	now := r.clock.Now()
+	var kept []*RecordEntry
+	var dropped []OpID
+	for _, entry := range r.record.Entries() {
+		if at, ok := r.finalizedAt[entry.ID]; ok && now.Sub(at) >= r.recordRetention {
+			dropped = append(dropped, entry.ID)
+		} else {
+			kept = append(kept, entry)
+		}
+	}
+	completed := make(map[int]int)
+	for client, seq := range r.completed {
+		completed[client] = seq
+	}
+	// Dropped operations the completed seq of their client covers need not
+	// be remembered one by one
+	forgotten := make(map[OpID]bool)
+	for key := range r.dropped {
+		if key.Seq > completed[key.ClientID] {
+			forgotten[key] = true
+		}
+	}
+	for _, key := range dropped {
+		if key.Seq > completed[key.ClientID] {
+			forgotten[key] = true
+		}
+	}
+	cp := &checkpoint{Seq: 1, Truncated: len(dropped) > 0, Completed: completed, Data: data}
+	for key := range forgotten {
+		cp.Dropped = append(cp.Dropped, key)
+	}
+	if r.checkpoint != nil {
+		cp.Seq = r.checkpoint.Seq + 1
+		cp.Truncated = cp.Truncated || r.checkpoint.Truncated
+	}
+	if err := r.saveCheckpoint(cp); err != nil {
+		return err
+	}
+	r.checkpoint = cp
+	r.dropped = forgotten
+	if len(dropped) == 0 {
+		return nil
+	}
+	r.record = NewRecord(kept)
+	for _, key := range dropped {
+		delete(r.finalizedAt, key)
+	}
+	r.rewriteLog()
+	log.Println("Replica", r.id, "checkpoint", cp.Seq, "replaced", len(dropped), "entries,", len(kept), "left")
+	return nil
+}
+
+// Whether a propose or finalize of an operation the record lacks is a late
+// duplicate: the record dropped it, or its client told it is done. An
+// operation of a lower sequence than one dropped may still be in flight.
+// Must hold r.mu.
+func (r *IRReplicaImpl) forgot(id OpID) bool {
+	if _, ok := r.record.Get(id); ok {
+		return false
+	}
+	return r.dropped[id] || id.Seq <= r.completed[id.ClientID]
+}
+
+// Sequence of the checkpoint holding entries the record lacks, 0 if the
+// record is complete. Must hold r.mu.
+func (r *IRReplicaImpl) truncatedAt() int {
+	if r.checkpoint == nil || !r.checkpoint.Truncated {
+		return 0
+	}
+	return r.checkpoint.Seq
+}
+
+// Note when entries of the record were finalized, for entries that came
+// with a new record. Must hold r.mu.
+func (r *IRReplicaImpl) trackFinalized() {
+	now := r.clock.Now()
+	for key := range r.finalizedAt {
+		if _, ok := r.record.Get(key); !ok {
+			delete(r.finalizedAt, key)
+		}
+	}
+	for _, entry := range r.record.Entries() {
+		if _, ok := r.finalizedAt[entry.ID]; !ok && entry.State == FINALIZED {
+			r.finalizedAt[entry.ID] = now
+		}
+	}
+}
+
+// Restore the checkpoint of another replica in the background, unless this
+// one restored it already. Must hold r.mu.
+func (r *IRReplicaImpl) restoreCheckpoint(id int, seq int) {
+	if id == r.id || seq == 0 || r.restored[id] >= seq || r.fetching[id] || r.status == STATUS_STOPPED {
+		return
+	}
+	r.fetching[id] = true
+	r.clock.Go(func() {
+		data, seq, err := r.fetchCheckpoint(id)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.fetching[id] = false
+		if err != nil {
+			log.Println("Replica", r.id, "failed to fetch the checkpoint of replica", id, err)
+			return
+		}
+		if r.status == STATUS_STOPPED || r.restored[id] >= seq {
+			return
+		}
+		if err := r.app.Restore(data); err != nil {
+			log.Println("Replica", r.id, "failed to restore the checkpoint of replica", id, err)
+			return
+		}
+		// The checkpoint may be older than the record, which has the last word
+		if err := r.app.Sync(r.finalizedRecord()); err != nil {
+			log.Println("Sync error: ", err)
+		}
+		r.restored[id] = seq
+		log.Println("Replica", r.id, "restored checkpoint", seq, "of replica", id)
+	})
+}
+
+// Stream the latest checkpoint of a replica in chunks, returns it with its
+// sequence. Starts over a few times if the replica checkpoints meanwhile.
+func (r *IRReplicaImpl) fetchCheckpoint(id int) ([]byte, int, error) {
+	var data []byte
+	seq := 0
+	for restarts := 0; restarts < 3; {
+		reply := CheckpointMessage{}
+		if err := r.callPeer(id, "GetCheckpoint", &CheckpointMessage{ReplicaID: r.id, Offset: len(data)}, &reply); err != nil {
+			return nil, 0, err
+		}
+		if len(data) > 0 && reply.Seq != seq {
+			data, restarts = nil, restarts+1
+			continue
+		}
+		seq = reply.Seq
+		data = append(data, reply.Data...)
+		if len(data) >= reply.Size {
+			return data, seq, nil
+		}
+	}
+	return nil, 0, errors.New(fmt.Sprintf("replica %d kept checkpointing while sending its checkpoint", id))
+}
+
+// The finalized entries of the record, must hold r.mu
+func (r *IRReplicaImpl) finalizedRecord() *Record {
+	var entries []*RecordEntry
+	for _, entry := range r.record.Entries() {
+		if entry.State == FINALIZED {
+			entries = append(entries, entry)
+		}
+	}
+	return NewRecord(entries)
+}
+
+// Write the checkpoint next to the log, replacing the previous one
+// atomically. Does nothing for a replica without storage.
+func (r *IRReplicaImpl) saveCheckpoint(cp *checkpoint) error {
+	if r.storage == nil {
+		return nil
+	}
+	dir := r.storage.Dir(r.id, "checkpoint")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(cp); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, "checkpoint")
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(buf.Bytes()); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Read the checkpoint saved before a restart, nil if there is none
+func loadCheckpoint(storage *StorageConfiguration, id int) (*checkpoint, error) {
+	data, err := os.ReadFile(filepath.Join(storage.Dir(id, "checkpoint"), "checkpoint"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cp checkpoint
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&cp); err != nil {
+		return nil, fmt.Errorf("decoding checkpoint of replica %d: %w", id, err)
+	}
+	return &cp, nil
+}
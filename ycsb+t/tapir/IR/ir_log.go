@@ -0,0 +1,107 @@
+package IR
+
+import (
+	"bytes"
+	"encoding/gob"
+	"log"
+
+	. "github.com/pingcap/go-ycsb/tapir/common"
+	"github.com/pingcap/go-ycsb/tapir/common/wal"
+)
+
+// logEntry is a change to the replica state in its write-ahead log
+type logEntry struct {
+	View       int
+	LastNormal int
+	Reset      bool         // a new view replaced the record, its entries follow
+	Entry      *RecordEntry // nil for a reset
+
+	// Group of the new view of a reset, nil while the group is the one of
+	// the configuration
+	Epoch   int
+	Members map[int]*ReplicaAddress
+}
+
+// Open the write-ahead log of the replica and rebuild the record from it.
+// Returns whether the log had any entries.
+func (r *IRReplicaImpl) openLog(storage *StorageConfiguration) (bool, error) {
+	l, err := wal.Open(storage.Dir(r.id, "ir"), storage, r.clock)
+	if err != nil {
+		return false, err
+	}
+	replayed := 0
+	err = l.Replay(func(data []byte) error {
+		var entry logEntry
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&entry); err != nil {
+			return err
+		}
+		r.view = entry.View
+		r.lastNormal = entry.LastNormal
+		if entry.Reset {
+			r.record = emptyRecord()
+			if entry.Members != nil {
+				r.epoch, r.peers, r.f = entry.Epoch, entry.Members, (len(entry.Members)-1)/2
+				for id, addr := range entry.Members {
+					r.addrs[id] = addr
+				}
+			}
+		} else {
+			r.record.put(entry.Entry)
+		}
+		replayed++
+		return nil
+	})
+	if err != nil {
+		l.Close()
+		return false, err
+	}
+	log.Println("Replica", r.id, "replayed", replayed, "log entries, view", r.view)
+	r.log = l
+	return replayed > 0, nil
+}
+
+// Add an entry to the record, logging it first, must hold r.mu
+func (r *IRReplicaImpl) putEntry(entry *RecordEntry) {
+	r.appendLog(&logEntry{View: r.view, LastNormal: r.lastNormal, Entry: entry})
+	r.record.put(entry)
+	if _, ok := r.finalizedAt[entry.ID]; !ok && entry.State == FINALIZED {
+		r.finalizedAt[entry.ID] = r.clock.Now()
+	}
+}
+
+// Replace the log with the record, after a new view installed a master
+// record or a checkpoint replaced entries. Must hold r.mu.
+func (r *IRReplicaImpl) rewriteLog() {
+	if r.log == nil {
+		return
+	}
+	reset := &logEntry{View: r.view, LastNormal: r.lastNormal, Reset: true}
+	if r.epoch > 0 {
+		// The configuration has the group of epoch 0
+		reset.Epoch, reset.Members = r.epoch, r.peers
+	}
+	records := [][]byte{encodeLogEntry(reset)}
+	for _, entry := range r.record.Entries() {
+		records = append(records, encodeLogEntry(&logEntry{View: r.view, LastNormal: r.lastNormal, Entry: entry}))
+	}
+	if err := r.log.Rewrite(records); err != nil {
+		log.Panicf("Error writing replica log: %v", err)
+	}
+}
+
+func (r *IRReplicaImpl) appendLog(entry *logEntry) {
+	if r.log == nil {
+		return
+	}
+	if err := r.log.Append(encodeLogEntry(entry)); err != nil {
+		log.Panicf("Error writing replica log: %v", err)
+	}
+}
+
+func encodeLogEntry(entry *logEntry) []byte {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(entry); err != nil {
+		log.Panicf("Error encoding log entry: %v", err)
+	}
+	return buf.Bytes()
+}
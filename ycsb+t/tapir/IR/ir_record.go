@@ -0,0 +1,146 @@
+package IR
+
+import (
+	"sort"
+
+	. "github.com/pingcap/go-ycsb/tapir/common"
+)
+
+// RecordEntry is a single operation stored in a replica's record, under the
+// id its client gave it
+type RecordEntry struct {
+	ID      OpID
+	View    int // view in which the entry was last updated
+	Request *Request
+	Proto   ProtoType
+	State   int       // TENTATIVE or FINALIZED
+	Result  *Response // nil for inconsistent operations
+}
+
+type Record struct {
+	values map[OpID]*RecordEntry
+}
+
+func emptyRecord() *Record {
+	return &Record{
+		values: make(map[OpID]*RecordEntry),
+	}
+}
+
+// NewRecord builds a record from a list of entries
+func NewRecord(entries []*RecordEntry) *Record {
+	record := emptyRecord()
+	for _, entry := range entries {
+		record.values[entry.ID] = entry
+	}
+	return record
+}
+
+func (rec *Record) Get(id OpID) (*RecordEntry, bool) {
+	entry, ok := rec.values[id]
+	return entry, ok
+}
+
+func (rec *Record) Len() int {
+	return len(rec.values)
+}
+
+// Entries returns all entries of the record, ordered by transaction and
+// operation, and operations of the same kind by their ids
+func (rec *Record) Entries() []*RecordEntry {
+	entries := make([]*RecordEntry, 0, len(rec.values))
+	for _, entry := range rec.values {
+		entries = append(entries, entry)
+	}
+	sortEntries(entries)
+	return entries
+}
+
+func (rec *Record) put(entry *RecordEntry) {
+	rec.values[entry.ID] = entry
+}
+
+func sortEntries(entries []*RecordEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i].Request, entries[j].Request
+		if a.TxnID != b.TxnID {
+			return a.TxnID.Less(b.TxnID)
+		}
+		if a.Op != b.Op {
+			return a.Op < b.Op
+		}
+		if a.Retry != b.Retry {
+			return a.Retry < b.Retry
+		}
+		return entries[i].ID.Less(entries[j].ID)
+	})
+}
+
+// SameResult reports whether two consensus results match
+func SameResult(a, b *Response) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if a.Status != b.Status || a.Value != b.Value {
+		return false
+	}
+	if a.Timestamp == nil || b.Timestamp == nil {
+		return a.Timestamp == b.Timestamp
+	}
+	return a.Timestamp.Equals(b.Timestamp)
+}
+
+// mergeRecords implements IR-MERGE-RECORDS over the records of f+1 replicas.
+// It returns the entries that are already decided (R), the tentative consensus
+// operations whose result matches in at least ⌈f/2⌉+1 records (d) and the
+// remaining tentative consensus operations (u).
+func mergeRecords(records [][]*RecordEntry, f int) (*Record, []*RecordEntry, []*RecordEntry) {
+	master := emptyRecord()
+	candidates := make(map[OpID][]*RecordEntry)
+
+	for _, record := range records {
+		for _, entry := range record {
+			if entry.Proto == INCONSISTENT || entry.State == FINALIZED {
+				if existing, ok := master.values[entry.ID]; !ok || existing.State != FINALIZED {
+					decided := *entry
+					decided.State = FINALIZED
+					master.put(&decided)
+				}
+				continue
+			}
+			candidates[entry.ID] = append(candidates[entry.ID], entry)
+		}
+	}
+
+	d, u := []*RecordEntry{}, []*RecordEntry{}
+	for id, entries := range candidates {
+		if _, ok := master.values[id]; ok {
+			// Finalized in some other record
+			continue
+		}
+		var best *RecordEntry
+		bestCnt := 0
+		for _, a := range entries {
+			if a.Result == nil {
+				continue
+			}
+			cnt := 0
+			for _, b := range entries {
+				if SameResult(a.Result, b.Result) {
+					cnt++
+				}
+			}
+			if cnt > bestCnt {
+				best, bestCnt = a, cnt
+			}
+		}
+		if best != nil && bestCnt >= (f+1)/2+1 {
+			d = append(d, best)
+		} else {
+			u = append(u, entries[0])
+		}
+	}
+	sortEntries(d)
+	sortEntries(u)
+	return master, d, u
+}
@@ -1,21 +1,56 @@
 package IR
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"log"
-	"net"
-	"net/rpc"
+	"sync"
+	"time"
 
 	. "github.com/pingcap/go-ycsb/tapir/common"
+	"github.com/pingcap/go-ycsb/tapir/common/wal"
 )
 
 // Server represents a Tapir server
 type IRReplicaImpl struct {
-	app      IRAppReplica
-	id       int
-	listener net.Listener
-	record   *Record
-	addr     *ReplicaAddress
+	app       IRAppReplica
+	id        int
+	transport Transport
+	clock     Clock
+	listener  io.Closer
+	record    *Record
+	addr      *ReplicaAddress
+	mu        *sync.Mutex
+	log       wal.Log // nil if the record is in memory only
+
+	// view change state
+	view        int
+	lastNormal  int // latest view in which the replica was normal
+	status      int
+	f           int
+	peers       map[int]*ReplicaAddress            // <replica_id, address>, including itself
+	viewChanges map[int]map[int]*ViewChangeMessage // <view, <replica_id, DoViewChange>>
+
+	// reconfiguration state
+	epoch      int                     // raised by every reconfiguration of the group
+	pending    map[int]*ReplicaAddress // group an operator asked to move to, nil if none
+	addrs      map[int]*ReplicaAddress // every replica of every group this one knew
+	catchingUp bool                    // fetching the state of a later epoch
+
+	// checkpoint state
+	checkpoint      *checkpoint           // latest checkpoint of the application, nil before the first
+	finalizedAt     map[OpID]time.Time    // when the finalized entries of the record were finalized here
+	recordRetention time.Duration         // how long finalized entries stay in the record
+	restored        map[int]int           // <replica_id, seq> of the latest checkpoint restored from each replica
+	fetching        map[int]bool          // replicas a checkpoint is being fetched from
+	checkpointChunk int                   // bytes of a checkpoint sent per GetCheckpoint
+	storage         *StorageConfiguration // nil if the replica keeps nothing on disk
+	stopCheckpoints Signal
+
+	// duplicate detection, past what the record holds
+	completed map[int]int   // <client_id, seq> up to which every logged operation of each IR client is done, as it told
+	dropped   map[OpID]bool // operations the record dropped past the completed seq of their client
 }
 
 const ( // state of operations
@@ -28,67 +63,209 @@ const ( // state of reply)
 	REPLY_FAIL = iota
 )
 
-type Record struct {
-	values map[Request]int
+const ( // status of replica
+	STATUS_NORMAL = iota
+	STATUS_VIEW_CHANGING
+	STATUS_RECOVERING
+	STATUS_STOPPED
+	STATUS_RETIRED // a reconfiguration removed the replica from its group
+)
+
+// NewServer creates a new instance of Server
+func NewIRReplica(id int, serverAddr *ReplicaAddress, app IRAppReplica) (IRReplica, error) {
+	return NewIRReplicaWithConfig(id, NewConfiguration(nil, map[int]*ReplicaAddress{id: serverAddr}), app)
 }
 
-func emptyRecord() *Record {
-	return &Record{
-		values: make(map[Request]int),
+// NewIRReplicaWithConfig creates a replica that knows the rest of its replica
+// group and listens on its address. A replica that can't restore its record
+// or listen closes what it opened, the app stays with the caller. Once
+// stopped, a replica with the same id may start on the same address.
+func NewIRReplicaWithConfig(id int, config *Configuration, app IRAppReplica) (IRReplica, error) {
+	server, err := newIRReplica(id, config, app)
+	if err != nil {
+		server.release()
+		return nil, err
 	}
+	return server, nil
 }
 
-// NewServer creates a new instance of Server
-func NewIRReplica(id int, serverAddr *ReplicaAddress, app IRAppReplica) IRReplica {
-	server := IRReplicaImpl{
-		id:     id,
-		app:    app,
-		record: emptyRecord(),
-		addr:   serverAddr,
-	}
-	server.Listen(serverAddr)
-	return &server
+// Replica of the group of id, with the first error of restoring its record
+// and listening
+func newIRReplica(id int, config *Configuration, app IRAppReplica) (*IRReplicaImpl, error) {
+	// Replicas only talk to the other replicas of their shard
+	config = config.GroupOf(id)
+	server := &IRReplicaImpl{
+		id:          id,
+		app:         app,
+		transport:   transportOf(config),
+		clock:       clockOf(config),
+		record:      emptyRecord(),
+		addr:        config.Replicas[id],
+		mu:          &sync.Mutex{},
+		status:      STATUS_NORMAL,
+		f:           config.F,
+		peers:       config.Replicas,
+		viewChanges: make(map[int]map[int]*ViewChangeMessage),
+		addrs:       make(map[int]*ReplicaAddress),
+
+		finalizedAt:     make(map[OpID]time.Time),
+		recordRetention: config.RecordRetention,
+		restored:        make(map[int]int),
+		fetching:        make(map[int]bool),
+		checkpointChunk: defaultCheckpointChunk,
+		storage:         config.Storage,
+		completed:       make(map[int]int),
+		dropped:         make(map[OpID]bool),
+	}
+	server.stopCheckpoints = server.clock.NewSignal()
+	for id, addr := range config.Replicas {
+		server.addrs[id] = addr
+	}
+	if server.addr == nil {
+		return server, errors.New(fmt.Sprintf("no replica %d in the configuration", id))
+	}
+	if config.Storage != nil {
+		// Come back with the checkpoint and record we had before a restart,
+		// the record has the last word
+		cp, err := loadCheckpoint(config.Storage, id)
+		if err != nil {
+			return server, err
+		}
+		if cp != nil {
+			if err := app.Restore(cp.Data); err != nil {
+				return server, fmt.Errorf("restoring checkpoint of replica %d: %w", id, err)
+			}
+			server.checkpoint = cp
+			if cp.Completed != nil {
+				server.completed = cp.Completed
+			}
+			for _, key := range cp.Dropped {
+				server.dropped[key] = true
+			}
+		}
+		restored, err := server.openLog(config.Storage)
+		if err != nil {
+			return server, err
+		}
+		server.trackFinalized()
+		if restored {
+			if err := app.Sync(server.record); err != nil {
+				log.Println("Sync error: ", err)
+			}
+		}
+		if server.peers[id] == nil {
+			server.status = STATUS_RETIRED
+		}
+	}
+	if err := server.Listen(server.addr); err != nil {
+		return server, err
+	}
+	if config.CheckpointInterval > 0 {
+		server.clock.Go(func() { server.checkpointLoop(config.CheckpointInterval) })
+	}
+	return server, nil
 }
 
 func dummyIRReplica() IRReplica {
 	return &IRReplicaImpl{}
 }
 
-func (r *IRReplicaImpl) Listen(serverAddr *ReplicaAddress) {
-	log.Println("client", r.id, "Listening on", r.addr.SpecificString())
-	rpc.RegisterName(fmt.Sprintf("IRReplica%d", r.id), r)
-	ln, err := net.Listen("tcp", r.addr.SpecificString())
-	CheckError(err)
-	log.Println("Replica", r.id, r.addr.Port, "listening")
+func (r *IRReplicaImpl) Listen(serverAddr *ReplicaAddress) error {
+	log.Println("client", r.id, "Listening on", serverAddr.SpecificString())
+	ln, err := r.transport.Listen(r.id, serverAddr, r)
+	if err != nil {
+		return fmt.Errorf("replica %d: %w", r.id, err)
+	}
+	log.Println("Replica", r.id, serverAddr.Port, "listening")
 	r.listener = ln
-	go rpc.Accept(ln)
+	return nil
 }
 
 func (r *IRReplicaImpl) HandleOperation(request *Message, reply *Message) error {
 	log.Println(r.id, "Handling Operation", request.Request.Op.ToString(), request.Type.ToString())
-	// if request.ProtoType == CONSENSUS {
-	// 	log.Println(request.Request.Prepare.Txn)
-	// }
+	if request.Request.Commit != nil {
+		log.Println("TS", request.Request.Commit.Timestamp)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if request.Epoch < r.epoch && r.status != STATUS_RECOVERING && r.status != STATUS_STOPPED {
+		// The client sends to an old group, tell it the current one
+		reply.Epoch = r.epoch
+		reply.Members = r.peers
+		return nil
+	}
+	if request.Epoch > r.epoch {
+		r.catchUp()
+		return fmt.Errorf("replica %d is behind in epoch %d", r.id, r.epoch)
+	}
+	if r.status != STATUS_NORMAL {
+		return fmt.Errorf("replica %d is not in normal status (view %d)", r.id, r.view)
+	}
+	reply.View = r.view
+	reply.Epoch = r.epoch
+	key := request.OperationID
+	r.completed[key.ClientID] = max(r.completed[key.ClientID], request.Completed)
 
 	// write operation id and op to its record as tentative and responds to client with <reply,id>
 	if request.Type == MsgPropose {
-		// r.app.ExecInconsistentUpcall(request.Request)
-		// r.record.values[*request.Request] = TENTATIVE
-		reply.Response = NewResponse(RPLY_OK)
+		if entry, ok := r.record.Get(key); ok {
+			// Duplicate propose, reply with what we recorded the first time
+			reply.Response = entry.Result
+			if reply.Response == nil {
+				reply.Response = NewResponse(RPLY_OK)
+			}
+			return nil
+		}
+		if r.forgot(key) {
+			// Its client is long done with it, executing it again would
+			// apply it twice
+			return fmt.Errorf("replica %d dropped operation %v from its record", r.id, key)
+		}
+		entry := &RecordEntry{
+			ID:      key,
+			View:    r.view,
+			Request: request.Request,
+			Proto:   request.ProtoType,
+			State:   TENTATIVE,
+		}
+		if request.ProtoType == CONSENSUS {
+			// Consensus operations execute right away, the result may still change at finalize
+			result, err := r.app.ExecConsensusUpcall(request.Request)
+			if err != nil {
+				return err
+			}
+			entry.Result = result
+			reply.Response = result
+		} else {
+			reply.Response = NewResponse(RPLY_OK)
+		}
+		r.putEntry(entry)
 		log.Println("received propose")
 		return nil
 	} else if request.Type == MsgFinalize {
-		log.Println("received finalize", request.Request.Op)
+		log.Println("received finalize", request.Request.Op.ToString())
 		if request.Request.Op == OP_PREPARE {
 			log.Println("received prepare txn", request.Request.Prepare.Txn)
-			r.app.ExecConsensusUpcall(request.Request)
-			// r.record.values[*request.Request] = TENTATIVE
-			reply.Response = NewResponse(RPLY_OK)
-			reply.Response.Value = "ok"
+			entry, ok := r.record.Get(key)
+			if ok && entry.State == FINALIZED && SameResult(entry.Result, request.Response) || r.forgot(key) {
+				// Duplicate finalize, the application already agrees
+				reply.Response = request.Response
+				return nil
+			}
+			r.finalize(key, request.Request, CONSENSUS, request.Response)
+			if !ok || !SameResult(entry.Result, request.Response) {
+				// Our tentative result lost, make the application agree with the group
+				finalized, _ := r.record.Get(key)
+				if err := r.app.Sync(NewRecord([]*RecordEntry{finalized})); err != nil {
+					log.Println("Sync error: ", err)
+				}
+			}
+			reply.Response = request.Response
 			return nil
 		}
-		if request.Request.Op == OP_GET {
-			log.Println("received get")
+		if request.Request.Op == OP_GET || request.Request.Op == OP_SCAN || request.Request.Op == OP_STATUS {
+			log.Println("received", request.Request.Op.ToString())
 			val, err := r.app.ExecUnloggedUpcall(request.Request)
 			if err != nil {
 				log.Println("ExecUnloggedUpcall error: ", err)
@@ -98,8 +275,12 @@ func (r *IRReplicaImpl) HandleOperation(request *Message, reply *Message) error
 		}
 		if request.Request.Op == OP_ABORT {
 			log.Println("received abort")
-			r.app.ExecInconsistentUpcall(request.Request)
 			reply.Response = NewResponse(RPLY_ABORT)
+			if r.finalized(key) {
+				return nil
+			}
+			r.app.ExecInconsistentUpcall(request.Request)
+			r.finalize(key, request.Request, INCONSISTENT, nil)
 			return nil
 		}
 		if request.Request.Op != OP_COMMIT {
@@ -110,7 +291,7 @@ func (r *IRReplicaImpl) HandleOperation(request *Message, reply *Message) error
 		// write id and op to its record as finalized
 		proto := request.ProtoType
 		if proto == CONSENSUS {
-			log.Println("request.Request: consensus ", request.Request)
+			log.Println("request.Request: consensus ", request.Request, request.Request.Commit.Timestamp)
 			response, err := r.app.ExecConsensusUpcall(request.Request)
 			if err != nil {
 				log.Println("ExeConsensus error: ", err)
@@ -118,11 +299,15 @@ func (r *IRReplicaImpl) HandleOperation(request *Message, reply *Message) error
 			reply.Response = response
 		} else if proto == INCONSISTENT {
 			log.Println("request.Request: inconsistent", request.Request.Op, request.Request.TxnID, request.Request.Commit.Timestamp)
+			reply.Response = NewResponse(RPLY_OK)
+			if r.finalized(key) {
+				return nil
+			}
 			err := r.app.ExecInconsistentUpcall(request.Request)
 			if err != nil {
 				log.Println("ExeInconsistent error: ", err)
 			}
-			reply.Response = NewResponse(RPLY_OK)
+			r.finalize(key, request.Request, INCONSISTENT, nil)
 		} else {
 			return fmt.Errorf("replica shouldn't get message reply or confirm")
 		}
@@ -133,14 +318,79 @@ func (r *IRReplicaImpl) HandleOperation(request *Message, reply *Message) error
 	}
 }
 
-// Stops the server gracefully
+// Whether the operation already took effect on this replica, a retransmitted
+// or duplicated finalize must not execute it again. Must hold r.mu.
+func (r *IRReplicaImpl) finalized(key OpID) bool {
+	entry, ok := r.record.Get(key)
+	if ok && entry.State == FINALIZED {
+		log.Println("duplicate finalize", key, entry.Request.Op.ToString(), entry.Request.TxnID)
+		return true
+	}
+	if r.forgot(key) {
+		log.Println("duplicate finalize", key, "of an operation the record dropped")
+		return true
+	}
+	return false
+}
+
+// Mark an operation as finalized in the record, must hold r.mu
+func (r *IRReplicaImpl) finalize(key OpID, req *Request, proto ProtoType, result *Response) {
+	r.putEntry(&RecordEntry{
+		ID:      key,
+		View:    r.view,
+		Request: req,
+		Proto:   proto,
+		State:   FINALIZED,
+		Result:  result,
+	})
+}
+
+func (r *IRReplicaImpl) View() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.view
+}
+
+// Stops the server gracefully, stopping it again does nothing
 func (r *IRReplicaImpl) Stop() {
+	if !r.release() {
+		return
+	}
+	if closer, ok := r.app.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Printf("Error closing app: %v", err)
+		}
+	}
+	log.Println("Server stopped")
+}
+
+// Stop the replica and close what it opened itself, its listener and log.
+// Returns false if it was stopped already.
+func (r *IRReplicaImpl) release() bool {
+	r.mu.Lock()
+	if r.status == STATUS_STOPPED {
+		r.mu.Unlock()
+		return false
+	}
+	r.status = STATUS_STOPPED
+	r.mu.Unlock()
+	if r.stopCheckpoints != nil {
+		r.stopCheckpoints.Notify()
+	}
+	// The port is free for a restart once Stop returns
 	if r.listener != nil {
 		if err := r.listener.Close(); err != nil {
 			log.Printf("Error closing listener: %v", err)
 		}
 	}
-	log.Println("Server stopped")
+	r.mu.Lock()
+	if r.log != nil {
+		if err := r.log.Close(); err != nil {
+			log.Printf("Error closing log: %v", err)
+		}
+	}
+	r.mu.Unlock()
+	return true
 }
 
 func (server *IRReplicaImpl) String() string {
@@ -1,42 +1,1267 @@
 package IR
 
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/pingcap/go-ycsb/tapir/common"
+	"github.com/pingcap/go-ycsb/tapir/common/sim"
+	"github.com/pingcap/go-ycsb/tapir/common/transport"
+)
+
 // test adding and initiating servers and replicas
 
-// func TestRPCConnection(t *testing.T) {
-// 	// Setup the server
-// 	port := 9090
-// 	go func() {
-// 		replica, err := NewReplica(port)
-// 		if err != nil {
-// 			t.Fatal("Server failed to start:", err)
-// 		}
-// 		fmt.Println("Server started", replica.replica_id)
-// 	}()
-
-// 	// Give the server some time to start
-// 	time.Sleep(time.Second)
-
-// 	// Connect the client
-// 	client, err := rpc.DialHTTP("tcp", fmt.Sprintf("localhost: %d", port))
-// 	if err != nil {
-// 		t.Fatal("Failed to dial server:", err)
-// 	}
-// 	// defer client.Close()
-
-// 	// Perform a test call
-// 	args := Message{
-// 		Type:        MsgPropose,
-// 		OperationID: 1,
-// 		Op: &Operation{
-// 			op_type:   "test",
-// 			key:       "test",
-// 			value:     "test",
-// 			timestamp: time.Now(),
-// 		},
-// 	} // fill this with actual arguments
-// 	reply := Message{}
-// 	err = client.Call("Replica.HAndleOperation", args, &reply)
-// 	if err != nil {
-// 		t.Fatal("RPC call failed:", err)
-// 	}
-// }
+// Start a replica group on the given ports, ids are the ports themselves.
+// Replicas keep their records in memory if storage is nil, and talk over
+// TCP if tr is nil.
+func startGroup(t *testing.T, ports []string, storage *StorageConfiguration, tr Transport) (*Configuration, map[int]*IRReplicaImpl) {
+	replicas := make(map[int]*ReplicaAddress)
+	for _, port := range ports {
+		id, _ := strconv.Atoi(port)
+		replicas[id] = NewReplicaAddress("localhost", port)
+	}
+	config := NewConfiguration(NewClientConfiguration(1, 1, 0), replicas)
+	config.Storage = storage
+	config.Transport = tr
+	servers := make(map[int]*IRReplicaImpl)
+	t.Cleanup(func() {
+		for _, server := range servers {
+			server.Stop()
+		}
+	})
+	for id := range replicas {
+		servers[id] = startReplica(t, id, config, newFakeApp())
+	}
+	return config, servers
+}
+
+// Start a replica, failing the test if it can't restore its record or listen
+func startReplica(t *testing.T, id int, config *Configuration, app IRAppReplica) *IRReplicaImpl {
+	server, err := NewIRReplicaWithConfig(id, config, app)
+	if err != nil {
+		t.Fatal("Failed to start replica:", err)
+	}
+	return server.(*IRReplicaImpl)
+}
+
+// Transaction seq of the test client
+func tid(seq int) TxnID {
+	return NewTxnID(1, seq)
+}
+
+func prepareRequest(txnID int) *Request {
+	return &Request{
+		Op:      OP_PREPARE,
+		TxnID:   tid(txnID),
+		Prepare: &PrepareMessage{Txn: NewTransaction(tid(txnID)), Timestamp: NewTimestamp(1)},
+	}
+}
+
+// Operation by what it does. The app and the tests know operations by it,
+// the ids replicas know them by are up to the client.
+type opKey struct {
+	Op    OpType
+	TxnID TxnID
+}
+
+func keyOf(req *Request) opKey {
+	return opKey{Op: req.Op, TxnID: req.TxnID}
+}
+
+// Entry of the operation in the record, must hold the lock of the replica
+func entryOf(record *Record, key opKey) (*RecordEntry, bool) {
+	for _, entry := range record.Entries() {
+		if keyOf(entry.Request) == key {
+			return entry, true
+		}
+	}
+	return nil, false
+}
+
+// fakeApp records the upcalls made by an IR replica
+type fakeApp struct {
+	mu        sync.Mutex
+	consensus ReplyType // result of every consensus operation
+	synced    map[opKey]*RecordEntry
+	merged    map[opKey]bool
+	executed  map[opKey]int // how often each inconsistent or consensus operation ran
+	restores  int           // checkpoints restored
+}
+
+func newFakeApp() *fakeApp {
+	return &fakeApp{
+		consensus: RPLY_OK,
+		synced:    make(map[opKey]*RecordEntry),
+		merged:    make(map[opKey]bool),
+		executed:  make(map[opKey]int),
+	}
+}
+
+func (a *fakeApp) ExecInconsistentUpcall(op *Request) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.executed[keyOf(op)]++
+	return nil
+}
+
+func (a *fakeApp) ExecConsensusUpcall(op *Request) (*Response, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.executed[keyOf(op)]++
+	return NewResponse(a.consensus), nil
+}
+
+func (a *fakeApp) executions(key opKey) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.executed[key]
+}
+
+func (a *fakeApp) ExecUnloggedUpcall(op *Request) (*Response, error) {
+	return NewReadResponse("", nil), nil
+}
+
+func (a *fakeApp) Sync(record *Record) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, entry := range record.Entries() {
+		a.synced[keyOf(entry.Request)] = entry
+	}
+	return nil
+}
+
+// A checkpoint of the fake app lists the operations it executed
+func (a *fakeApp) Checkpoint() ([]byte, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(a.executed)
+	return buf.Bytes(), err
+}
+
+func (a *fakeApp) Restore(data []byte) error {
+	var executed map[opKey]int
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&executed); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.restores++
+	for key, n := range executed {
+		if a.executed[key] == 0 {
+			a.executed[key] = n
+		}
+	}
+	return nil
+}
+
+func (a *fakeApp) Merge(d, u []*RecordEntry) (map[OpID]*Response, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	results := make(map[OpID]*Response)
+	for _, entry := range append(d, u...) {
+		a.merged[keyOf(entry.Request)] = true
+		results[entry.ID] = NewResponse(RPLY_ABORT)
+	}
+	return results, nil
+}
+
+func tentative(txnID int, status ReplyType) *RecordEntry {
+	return &RecordEntry{
+		ID:      OpID{ClientID: 2, Seq: txnID},
+		Request: &Request{Op: OP_PREPARE, TxnID: tid(txnID)},
+		Proto:   CONSENSUS,
+		State:   TENTATIVE,
+		Result:  NewResponse(status),
+	}
+}
+
+func TestMergeRecords(t *testing.T) {
+	commit := &RecordEntry{
+		ID:      OpID{ClientID: 1, Seq: 1},
+		Request: &Request{Op: OP_COMMIT, TxnID: tid(1)},
+		Proto:   INCONSISTENT,
+		State:   TENTATIVE,
+	}
+	finalized := tentative(2, RPLY_OK)
+	finalized.State = FINALIZED
+
+	records := [][]*RecordEntry{
+		{commit, tentative(2, RPLY_ABORT), tentative(3, RPLY_OK), tentative(4, RPLY_OK)},
+		{finalized, tentative(3, RPLY_OK), tentative(4, RPLY_ABORT)},
+		{tentative(3, RPLY_OK)},
+	}
+	master, d, u := mergeRecords(records, 2)
+
+	if entry, ok := master.Get(commit.ID); !ok || entry.State != FINALIZED {
+		t.Errorf("Expected inconsistent op in master record as finalized, got: %v", entry)
+	}
+	if entry, ok := master.Get(finalized.ID); !ok || entry.Result.Status != RPLY_OK {
+		t.Errorf("Expected finalized prepare to keep its result, got: %v", entry)
+	}
+	if len(d) != 1 || d[0].Request.TxnID != tid(3) || d[0].Result.Status != RPLY_OK {
+		t.Errorf("Expected txn 3 to be decided by majority, got: %v", d)
+	}
+	if len(u) != 1 || u[0].Request.TxnID != tid(4) {
+		t.Errorf("Expected txn 4 to be undecided, got: %v", u)
+	}
+}
+
+func TestRecoverReplica(t *testing.T) {
+	config, servers := startGroup(t, []string{"56201", "56202", "56203"}, nil, nil)
+	client, err := NewIRClient(config)
+	if err != nil {
+		t.Fatal("Failed to create client:", err)
+	}
+	for txnID := 1; txnID <= 3; txnID++ {
+		req := &Request{Op: OP_COMMIT, TxnID: tid(txnID), Commit: &CommitMessage{Timestamp: NewTimestamp(1)}}
+		if err := client.InvokeInconsistent(req); err != nil {
+			t.Fatal("InvokeInconsistent failed:", err)
+		}
+	}
+
+	// Crash one replica, losing its record and application state
+	crashed := servers[56203]
+	app := newFakeApp()
+	crashed.mu.Lock()
+	crashed.app = app
+	crashed.mu.Unlock()
+
+	if err := crashed.Recover(); err != nil {
+		t.Fatal("Recover failed:", err)
+	}
+	if crashed.View() != 1 {
+		t.Errorf("Expected recovered replica in view 1, got: %d", crashed.View())
+	}
+	if crashed.record.Len() != 3 {
+		t.Errorf("Expected 3 entries in recovered record, got: %d", crashed.record.Len())
+	}
+	for txnID := 1; txnID <= 3; txnID++ {
+		if _, ok := app.synced[opKey{Op: OP_COMMIT, TxnID: tid(txnID)}]; !ok {
+			t.Errorf("Expected commit of txn %d to be synced to recovered app", txnID)
+		}
+	}
+}
+
+func TestConsensusFastPath(t *testing.T) {
+	config, _ := startGroup(t, []string{"56211", "56212", "56213"}, nil, nil)
+	config.FastPathTimeout = time.Minute
+	client, _ := NewIRClient(config)
+
+	decide := func(results []*Response, n, f int) *Response {
+		t.Errorf("Expected fast path, decide was called with %d results", len(results))
+		return NewResponse(RPLY_ABORT)
+	}
+	start := time.Now()
+	result, err := client.InvokeConsensus(prepareRequest(1), decide)
+	if err != nil {
+		t.Fatal("InvokeConsensus failed:", err)
+	}
+	if result.Status != RPLY_OK {
+		t.Errorf("Expected RPLY_OK, got: %s", ReplyTypeString(result.Status))
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected fast path to return without waiting, took %v", elapsed)
+	}
+}
+
+func TestConsensusSlowPath(t *testing.T) {
+	config, servers := startGroup(t, []string{"56221", "56222", "56223"}, nil, nil)
+	servers[56223].app.(*fakeApp).consensus = RPLY_ABSTAIN
+	config.FastPathTimeout = 50 * time.Millisecond
+	client, _ := NewIRClient(config)
+
+	decided, group, tolerated := 0, 0, 0
+	decide := func(results []*Response, n, f int) *Response {
+		decided, group, tolerated = len(results), n, f
+		return NewResponse(RPLY_ABORT)
+	}
+	result, err := client.InvokeConsensus(prepareRequest(1), decide)
+	if err != nil {
+		t.Fatal("InvokeConsensus failed:", err)
+	}
+	if decided < config.F+1 {
+		t.Errorf("Expected decide to see at least %d results, got: %d", config.F+1, decided)
+	}
+	if group != 3 || tolerated != config.F {
+		t.Errorf("Expected decide to get the group of 3 replicas tolerating %d failures, got: %d and %d", config.F, group, tolerated)
+	}
+	if result.Status != RPLY_ABORT {
+		t.Errorf("Expected decided result RPLY_ABORT, got: %s", ReplyTypeString(result.Status))
+	}
+
+	// The slow path waits for f+1 confirmations, so a quorum has finalized the decision
+	finalized := 0
+	for _, server := range servers {
+		server.mu.Lock()
+		if entry, ok := entryOf(server.record, opKey{Op: OP_PREPARE, TxnID: tid(1)}); ok && entry.State == FINALIZED && entry.Result.Status == RPLY_ABORT {
+			finalized++
+		}
+		server.mu.Unlock()
+	}
+	if finalized < config.F+1 {
+		t.Errorf("Expected at least %d replicas to finalize, got: %d", config.F+1, finalized)
+	}
+}
+
+func TestRestartFromLog(t *testing.T) {
+	config, servers := startGroup(t, []string{"56231", "56232", "56233"}, NewStorageConfiguration(t.TempDir()), nil)
+	client, _ := NewIRClient(config)
+	for txnID := 1; txnID <= 3; txnID++ {
+		req := &Request{Op: OP_COMMIT, TxnID: tid(txnID), Commit: &CommitMessage{Timestamp: NewTimestamp(1)}}
+		if err := client.InvokeInconsistent(req); err != nil {
+			t.Fatal("InvokeInconsistent failed:", err)
+		}
+	}
+	if _, err := client.InvokeConsensus(prepareRequest(4), func(results []*Response, n, f int) *Response { return results[0] }); err != nil {
+		t.Fatal("InvokeConsensus failed:", err)
+	}
+
+	// Wait for the replica to see every operation before it goes down
+	crashed := servers[56233]
+	deadline := time.Now().Add(time.Second)
+	for {
+		crashed.mu.Lock()
+		n := crashed.record.Len()
+		crashed.mu.Unlock()
+		if n == 4 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	crashed.mu.Lock()
+	before := crashed.record.Entries()
+	crashed.mu.Unlock()
+	crashed.Stop()
+
+	app := newFakeApp()
+	restarted := startReplica(t, 56233, config, app)
+	defer restarted.Stop()
+	after := restarted.record.Entries()
+	if len(after) != len(before) || len(after) != 4 {
+		t.Fatalf("Expected 4 entries after restart, had %d, got: %d", len(before), len(after))
+	}
+	for i, entry := range after {
+		if entry.ID != before[i].ID || entry.State != before[i].State || !SameResult(entry.Result, before[i].Result) {
+			t.Errorf("Expected entry %v after restart, got: %v", before[i], entry)
+		}
+		if _, ok := app.synced[keyOf(entry.Request)]; !ok {
+			t.Errorf("Expected %v to be synced to the restarted app", entry.ID)
+		}
+	}
+}
+
+// Clients number their transactions on their own, the same number from
+// different clients names different operations
+func TestConcurrentClients(t *testing.T) {
+	config, servers := startGroup(t, []string{"1", "2", "3"}, nil, transport.NewNetwork())
+	const clients = 8
+	var wg sync.WaitGroup
+	for i := 1; i <= clients; i++ {
+		own := *config
+		own.Client = NewClientConfiguration(i, i, 1)
+		client, _ := NewIRClient(&own)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := &Request{Op: OP_COMMIT, TxnID: NewTxnID(i, 1), Commit: &CommitMessage{Timestamp: NewTimestamp(i)}}
+			if err := client.InvokeInconsistent(req); err != nil {
+				t.Errorf("Client %d: InvokeInconsistent failed: %v", i, err)
+			}
+			prepare := &Request{Op: OP_PREPARE, TxnID: NewTxnID(i, 1), Prepare: &PrepareMessage{Txn: NewTransaction(NewTxnID(i, 1)), Timestamp: NewTimestamp(i)}}
+			if _, err := client.InvokeConsensus(prepare, func(results []*Response, n, f int) *Response { return results[0] }); err != nil {
+				t.Errorf("Client %d: InvokeConsensus failed: %v", i, err)
+			}
+		}()
+	}
+	wg.Wait()
+	for i := 1; i <= clients; i++ {
+		waitFinalized(t, servers, opKey{Op: OP_COMMIT, TxnID: NewTxnID(i, 1)}, RPLY_OK)
+		waitFinalized(t, servers, opKey{Op: OP_PREPARE, TxnID: NewTxnID(i, 1)}, RPLY_OK)
+	}
+	for id, server := range servers {
+		server.mu.Lock()
+		if n := server.record.Len(); n != 2*clients {
+			t.Errorf("Expected %d operations on replica %d, got: %d", 2*clients, id, n)
+		}
+		server.mu.Unlock()
+	}
+}
+
+// A stopped replica costs the client failed calls, not progress
+func TestSurviveStoppedReplica(t *testing.T) {
+	config, servers := startGroup(t, []string{"56241", "56242", "56243"}, nil, nil)
+	config.FastPathTimeout = 50 * time.Millisecond
+	client, _ := NewIRClient(config)
+	servers[56243].Stop()
+
+	for txnID := 1; txnID <= 10; txnID++ {
+		req := &Request{Op: OP_COMMIT, TxnID: tid(txnID), Commit: &CommitMessage{Timestamp: NewTimestamp(1)}}
+		if err := client.InvokeInconsistent(req); err != nil {
+			t.Fatal("InvokeInconsistent failed:", err)
+		}
+		if _, err := client.InvokeConsensus(prepareRequest(txnID), func(results []*Response, n, f int) *Response { return results[0] }); err != nil {
+			t.Fatal("InvokeConsensus failed:", err)
+		}
+	}
+}
+
+func TestGroupOverNetwork(t *testing.T) {
+	// No ports are opened, addresses only name the replicas on the network
+	config, servers := startGroup(t, []string{"1", "2", "3"}, nil, transport.NewNetwork())
+	client, err := NewIRClient(config)
+	if err != nil {
+		t.Fatal("Failed to create client:", err)
+	}
+	req := &Request{Op: OP_COMMIT, TxnID: tid(1), Commit: &CommitMessage{Timestamp: NewTimestamp(1)}}
+	if err := client.InvokeInconsistent(req); err != nil {
+		t.Fatal("InvokeInconsistent failed:", err)
+	}
+	result, err := client.InvokeConsensus(prepareRequest(2), func(results []*Response, n, f int) *Response { return results[0] })
+	if err != nil || result.Status != RPLY_OK {
+		t.Fatalf("Expected RPLY_OK, got: %v, %v", result, err)
+	}
+
+	// View changes reach the peers over the network too
+	recovering := servers[3]
+	recovering.mu.Lock()
+	recovering.app = newFakeApp()
+	recovering.mu.Unlock()
+	if err := recovering.Recover(); err != nil {
+		t.Fatal("Recover failed:", err)
+	}
+	if _, ok := entryOf(recovering.record, opKey{Op: OP_PREPARE, TxnID: tid(2)}); !ok || recovering.View() != 1 {
+		t.Errorf("Expected recovered replica to learn txn 2 in view 1, got view %d", recovering.View())
+	}
+}
+
+// Node of the client on a faulty network, replicas are nodes 1 to n
+const clientNode = 0
+
+// Start n replicas on a faulty network, each on its own node. The returned
+// configuration is the one of the client.
+func startFaultyGroup(t *testing.T, n int, network *transport.FaultyNetwork) (*Configuration, map[int]*IRReplicaImpl) {
+	replicas := make(map[int]*ReplicaAddress)
+	for id := 1; id <= n; id++ {
+		replicas[id] = NewReplicaAddress("replica"+strconv.Itoa(id), "0")
+	}
+	config := NewConfiguration(NewClientConfiguration(1, 1, 0), replicas)
+	config.FastPathTimeout = 20 * time.Millisecond
+	config.SlowPathTimeout = time.Second
+	servers := make(map[int]*IRReplicaImpl)
+	t.Cleanup(func() {
+		for _, server := range servers {
+			server.Stop()
+		}
+	})
+	for id := range replicas {
+		own := *config
+		own.Transport = network.Node(id)
+		servers[id] = startReplica(t, id, &own, newFakeApp())
+	}
+	config.Transport = network.Node(clientNode)
+	return config, servers
+}
+
+// Wait until every replica finalized the operation with the given result
+func waitFinalized(t *testing.T, servers map[int]*IRReplicaImpl, key opKey, status ReplyType) {
+	deadline := time.Now().Add(2 * time.Second)
+	for id, server := range servers {
+		for {
+			server.mu.Lock()
+			entry, ok := entryOf(server.record, key)
+			server.mu.Unlock()
+			if ok && entry.State == FINALIZED && (entry.Result == nil || entry.Result.Status == status) {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected replica %d to finalize %v with %s, got: %v", id, key, ReplyTypeString(status), entry)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+}
+
+func TestSurviveReplicaFailure(t *testing.T) {
+	network := transport.NewFaultyNetwork(1)
+	config, servers := startFaultyGroup(t, 3, network)
+	client, _ := NewIRClient(config)
+
+	// f replicas are cut off, f+1 still answer
+	network.Partition([]int{clientNode, 1, 2})
+	for txnID := 1; txnID <= 3; txnID++ {
+		req := &Request{Op: OP_COMMIT, TxnID: tid(txnID), Commit: &CommitMessage{Timestamp: NewTimestamp(1)}}
+		if err := client.InvokeInconsistent(req); err != nil {
+			t.Fatal("InvokeInconsistent failed:", err)
+		}
+	}
+	result, err := client.InvokeConsensus(prepareRequest(4), func(results []*Response, n, f int) *Response { return results[0] })
+	if err != nil || result.Status != RPLY_OK {
+		t.Fatalf("Expected slow path to decide without the lost replica, got: %v, %v", result, err)
+	}
+	if _, err := client.InvokeUnlogged(3, &Request{Op: OP_GET, Get: &GetMessage{Key: "a"}}); err == nil {
+		t.Errorf("Expected call to the cut off replica to fail")
+	}
+	if servers[3].record.Len() != 0 {
+		t.Errorf("Expected cut off replica to miss every operation, got: %d", servers[3].record.Len())
+	}
+
+	// Once the network heals the replica catches up through a view change
+	network.Heal()
+	if err := servers[3].Recover(); err != nil {
+		t.Fatal("Recover failed:", err)
+	}
+	if n := servers[3].record.Len(); n != 4 {
+		t.Errorf("Expected recovered replica to learn 4 operations, got: %d", n)
+	}
+
+	// A link lost in one direction only is a failure too
+	network.SetRule(clientNode, 2, transport.Rule{Drop: 1})
+	if _, err := client.InvokeConsensus(prepareRequest(5), func(results []*Response, n, f int) *Response { return results[0] }); err != nil {
+		t.Errorf("Expected consensus without replica 2, got: %v", err)
+	}
+}
+
+func TestSurviveReordering(t *testing.T) {
+	network := transport.NewFaultyNetwork(2)
+	network.SetDefaultRule(transport.Rule{Duplicate: 0.2, MaxDelay: 10 * time.Millisecond})
+	config, servers := startFaultyGroup(t, 3, network)
+
+	// Operations of concurrent clients overtake each other, and finalizes
+	// may reach a replica before the proposes they finalize
+	var wg sync.WaitGroup
+	for c := 0; c < 4; c++ {
+		own := *config
+		own.Client = NewClientConfiguration(c+1, c+1, 0)
+		client, _ := NewIRClient(&own)
+		wg.Add(1)
+		go func(first int) {
+			defer wg.Done()
+			for txnID := first; txnID < first+5; txnID++ {
+				if _, err := client.InvokeConsensus(prepareRequest(txnID), func(results []*Response, n, f int) *Response { return results[0] }); err != nil {
+					t.Errorf("InvokeConsensus of txn %d failed: %v", txnID, err)
+				}
+				req := &Request{Op: OP_COMMIT, TxnID: tid(txnID), Commit: &CommitMessage{Timestamp: NewTimestamp(1)}}
+				if err := client.InvokeInconsistent(req); err != nil {
+					t.Errorf("InvokeInconsistent of txn %d failed: %v", txnID, err)
+				}
+			}
+		}(c * 10)
+	}
+	wg.Wait()
+	for c := 0; c < 4; c++ {
+		for txnID := c * 10; txnID < c*10+5; txnID++ {
+			waitFinalized(t, servers, opKey{Op: OP_PREPARE, TxnID: tid(txnID)}, RPLY_OK)
+			waitFinalized(t, servers, opKey{Op: OP_COMMIT, TxnID: tid(txnID)}, RPLY_OK)
+		}
+	}
+}
+
+func TestDuplicateOperations(t *testing.T) {
+	_, servers := startGroup(t, []string{"1"}, nil, transport.NewNetwork())
+	server := servers[1]
+	app := server.app.(*fakeApp)
+	opID := OpID{ClientID: 1, Seq: 1}
+
+	// A duplicate propose gets the result of the first one
+	prepare := prepareRequest(1)
+	for i := 0; i < 2; i++ {
+		msg, reply := NewPropose(opID, prepare, CONSENSUS), Message{}
+		if err := server.HandleOperation(&msg, &reply); err != nil || reply.Response.Status != RPLY_OK {
+			t.Fatalf("Expected propose %d to return RPLY_OK, got: %v, %v", i, reply.Response, err)
+		}
+	}
+	// Duplicate finalizes leave the application alone
+	for i := 0; i < 2; i++ {
+		msg := Finalize(opID, NewResponse(RPLY_OK))
+		msg.Request = prepare
+		msg.ProtoType = CONSENSUS
+		if err := server.HandleOperation(&msg, &Message{}); err != nil {
+			t.Fatal("Finalize failed:", err)
+		}
+	}
+	if n := app.executions(keyOf(prepare)); n != 1 {
+		t.Errorf("Expected prepare to execute once, got: %d", n)
+	}
+	if len(app.synced) != 0 {
+		t.Errorf("Expected finalizes with the same result not to sync, got: %v", app.synced)
+	}
+
+	commit := &Request{Op: OP_COMMIT, TxnID: tid(1), Commit: &CommitMessage{Timestamp: NewTimestamp(1)}}
+	abort := &Request{Op: OP_ABORT, TxnID: tid(2)}
+	for seq, req := range map[int]*Request{2: commit, 3: abort} {
+		for i := 0; i < 3; i++ {
+			msg := NewFinalize(OpID{ClientID: 1, Seq: seq}, INCONSISTENT)
+			msg.Request = req
+			if err := server.HandleOperation(&msg, &Message{}); err != nil {
+				t.Fatal("Finalize failed:", err)
+			}
+		}
+		if n := app.executions(keyOf(req)); n != 1 {
+			t.Errorf("Expected %s to execute once, got: %d", req.Op.ToString(), n)
+		}
+	}
+
+	// A propose that arrives after its finalize doesn't bring it back
+	msg := NewPropose(OpID{ClientID: 1, Seq: 2}, commit, INCONSISTENT)
+	if err := server.HandleOperation(&msg, &Message{}); err != nil {
+		t.Fatal("Propose failed:", err)
+	}
+	if entry, _ := entryOf(server.record, keyOf(commit)); entry.State != FINALIZED || app.executions(keyOf(commit)) != 1 {
+		t.Errorf("Expected late propose to leave commit finalized and executed once, got: %v", entry)
+	}
+}
+
+// Replicas know operations by the ids clients give them. A client that
+// restarts numbers its operations after the ones it invoked before, the
+// replicas don't take them for duplicates.
+func TestRestartedClientOperations(t *testing.T) {
+	config, servers := startGroup(t, []string{"1", "2", "3"}, nil, transport.NewNetwork())
+	decide := func(results []*Response, n, f int) *Response { return results[0] }
+	before, _ := NewIRClient(config)
+	if result, err := before.InvokeConsensus(prepareRequest(1), decide); err != nil || result.Status != RPLY_OK {
+		t.Fatalf("Expected prepare to return RPLY_OK, got: %v, %v", result, err)
+	}
+
+	for _, server := range servers {
+		app := server.app.(*fakeApp)
+		app.mu.Lock()
+		app.consensus = RPLY_ABORT
+		app.mu.Unlock()
+	}
+	after, _ := NewIRClient(config)
+	if result, err := after.InvokeConsensus(prepareRequest(2), decide); err != nil || result.Status != RPLY_ABORT {
+		t.Fatalf("Expected prepare of the restarted client to return RPLY_ABORT, got: %v, %v", result, err)
+	}
+	waitFinalized(t, servers, opKey{Op: OP_PREPARE, TxnID: tid(1)}, RPLY_OK)
+	waitFinalized(t, servers, opKey{Op: OP_PREPARE, TxnID: tid(2)}, RPLY_ABORT)
+}
+
+func TestRetransmit(t *testing.T) {
+	network := transport.NewFaultyNetwork(3)
+	config, servers := startFaultyGroup(t, 3, network)
+	config.Retransmit = 5 * time.Millisecond
+	client, _ := NewIRClient(config)
+
+	// Every replica loses requests and replies, and sees some requests twice
+	network.SetDefaultRule(transport.Rule{Drop: 0.3, Duplicate: 0.3, MaxDelay: 2 * time.Millisecond})
+	for txnID := 1; txnID <= 10; txnID++ {
+		if _, err := client.InvokeConsensus(prepareRequest(txnID), func(results []*Response, n, f int) *Response { return results[0] }); err != nil {
+			t.Fatalf("InvokeConsensus of txn %d failed: %v", txnID, err)
+		}
+		req := &Request{Op: OP_COMMIT, TxnID: tid(txnID), Commit: &CommitMessage{Timestamp: NewTimestamp(1)}}
+		if err := client.InvokeInconsistent(req); err != nil {
+			t.Fatalf("InvokeInconsistent of txn %d failed: %v", txnID, err)
+		}
+	}
+
+	// Resent finalizes reach every replica in the end, and run once there
+	for txnID := 1; txnID <= 10; txnID++ {
+		commit := opKey{Op: OP_COMMIT, TxnID: tid(txnID)}
+		waitFinalized(t, servers, commit, RPLY_OK)
+		for id, server := range servers {
+			app := server.app.(*fakeApp)
+			if n := app.executions(commit); n != 1 {
+				t.Errorf("Expected replica %d to commit txn %d once, got: %d", id, txnID, n)
+			}
+			if n := app.executions(opKey{Op: OP_PREPARE, TxnID: tid(txnID)}); n > 1 {
+				t.Errorf("Expected replica %d to prepare txn %d at most once, got: %d", id, txnID, n)
+			}
+		}
+	}
+}
+
+func TestInvokeContext(t *testing.T) {
+	network := transport.NewFaultyNetwork(4)
+	config, _ := startFaultyGroup(t, 3, network)
+	client, _ := NewIRClient(config)
+	network.SetDefaultRule(transport.Rule{MinDelay: time.Second, MaxDelay: time.Second})
+	decide := func(results []*Response, n, f int) *Response { return results[0] }
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := client.InvokeConsensusContext(ctx, prepareRequest(1), decide); !errors.Is(err, ErrTimeout) {
+		t.Errorf("Expected consensus to time out at the deadline, got: %v", err)
+	}
+	if err := client.InvokeInconsistentContext(ctx, &Request{Op: OP_ABORT, TxnID: tid(1)}); !errors.Is(err, ErrTimeout) {
+		t.Errorf("Expected inconsistent operation to time out, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected operations to end at the deadline, took %v", elapsed)
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	if _, err := client.InvokeUnloggedContext(cancelled, 1, &Request{Op: OP_GET, Get: &GetMessage{Key: "a"}}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected cancel to end the call, got: %v", err)
+	}
+}
+
+// On a virtual clock a deadline and a cancel end operations in virtual
+// time, nothing waits on the wall clock
+func TestInvokeContextOnClock(t *testing.T) {
+	s := sim.New(1)
+	defer s.Close()
+	replicas := make(map[int]*ReplicaAddress)
+	for id := 1; id <= 3; id++ {
+		replicas[id] = NewReplicaAddress("replica"+strconv.Itoa(id), "0")
+	}
+	config := NewConfiguration(NewClientConfiguration(1, 1, 0), replicas)
+	config.Clock = s
+	for id := range replicas {
+		own := *config
+		own.Transport = s.Network().Node(id)
+		startReplica(t, id, &own, newFakeApp())
+	}
+	config.Transport = s.Network().Node(clientNode)
+	client, _ := NewIRClient(config)
+	s.Network().SetDefaultRule(transport.Rule{MinDelay: time.Second, MaxDelay: time.Second})
+	decide := func(results []*Response, n, f int) *Response { return results[0] }
+
+	err := s.Run(func() {
+		start := s.Now()
+		ctx := WithClockTimeout(context.Background(), s, 50*time.Millisecond)
+		if _, err := client.InvokeConsensusContext(ctx, prepareRequest(1), decide); !errors.Is(err, ErrTimeout) {
+			t.Errorf("Expected consensus to time out at the deadline, got: %v", err)
+		}
+		if elapsed := s.Now().Sub(start); elapsed != 50*time.Millisecond {
+			t.Errorf("Expected consensus to end 50ms later on the clock, took %v", elapsed)
+		}
+		if !errors.Is(ContextError(ctx), ErrTimeout) {
+			t.Errorf("Expected the context to be past its deadline, got: %v", ctx.Err())
+		}
+
+		cancelled, cancel := context.WithCancel(context.Background())
+		s.Go(func() {
+			s.Sleep(20 * time.Millisecond)
+			cancel()
+		})
+		start = s.Now()
+		if _, err := client.InvokeUnloggedContext(cancelled, 1, &Request{Op: OP_GET, Get: &GetMessage{Key: "a"}}); !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected cancel to end the call, got: %v", err)
+		}
+		if elapsed := s.Now().Sub(start); elapsed >= time.Second {
+			t.Errorf("Expected the call to end soon after the cancel, took %v", elapsed)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// App that tells whether the replica closed it
+type closingApp struct {
+	*fakeApp
+	closed bool
+}
+
+func (a *closingApp) Close() error {
+	a.closed = true
+	return nil
+}
+
+// A replica stops and starts again on the same port, the restarted replica
+// serves the calls
+func TestNewIRReplicaWithConfig(t *testing.T) {
+	config := NewConfiguration(NewClientConfiguration(1, 1, 56251), map[int]*ReplicaAddress{56251: NewReplicaAddress("localhost", "56251")})
+	if _, err := NewIRReplicaWithConfig(56252, config, newFakeApp()); err == nil {
+		t.Error("Expected error starting a replica missing from the configuration")
+	}
+	first := &closingApp{fakeApp: newFakeApp()}
+	replica, err := NewIRReplicaWithConfig(56251, config, first)
+	if err != nil {
+		t.Fatal("NewIRReplicaWithConfig failed:", err)
+	}
+	// The caller still owns the app of a replica that failed to start
+	failed := &closingApp{fakeApp: newFakeApp()}
+	if _, err := NewIRReplicaWithConfig(56251, config, failed); err == nil {
+		t.Error("Expected error starting a replica on a port in use")
+	}
+	if failed.closed {
+		t.Error("Expected the app of a replica that failed to start to stay open")
+	}
+	client, _ := NewIRClient(config)
+	defer client.Close()
+	commit := func(txnID int) error {
+		return client.InvokeInconsistent(&Request{Op: OP_COMMIT, TxnID: tid(txnID), Commit: &CommitMessage{Timestamp: NewTimestamp(1)}})
+	}
+	if err := commit(1); err != nil {
+		t.Fatal("InvokeInconsistent failed:", err)
+	}
+	replica.Stop()
+	replica.Stop()
+	if !first.closed {
+		t.Error("Expected Stop to close the app")
+	}
+
+	second := newFakeApp()
+	replica, err = NewIRReplicaWithConfig(56251, config, second)
+	if err != nil {
+		t.Fatal("Restarting on the same port failed:", err)
+	}
+	defer replica.Stop()
+	// The client may still be backing off from the broken connection, and
+	// the commit runs once it is finalized
+	deadline := time.Now().Add(time.Second)
+	for commit(2) != nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for second.executions(opKey{Op: OP_COMMIT, TxnID: tid(2)}) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := second.executions(opKey{Op: OP_COMMIT, TxnID: tid(2)}); n != 1 {
+		t.Errorf("Expected the restarted replica to run the commit once, got: %d", n)
+	}
+	if n := first.executions(opKey{Op: OP_COMMIT, TxnID: tid(2)}); n != 0 {
+		t.Errorf("Expected the stopped replica not to run the commit, got: %d", n)
+	}
+}
+
+// Group of the given replica ids on a network, addresses are the ids
+func members(ids ...int) map[int]*ReplicaAddress {
+	replicas := make(map[int]*ReplicaAddress)
+	for _, id := range ids {
+		replicas[id] = NewReplicaAddress("localhost", strconv.Itoa(id))
+	}
+	return replicas
+}
+
+// Start a replica that joins the group of config once a reconfiguration
+// adds it, Join runs in the background and reports on the returned channel
+func startJoining(t *testing.T, id int, config *Configuration, group map[int]*ReplicaAddress) (*IRReplicaImpl, *fakeApp, chan error) {
+	own := *config
+	own.Replicas = group
+	app := newFakeApp()
+	replica, err := NewIRReplicaWithConfig(id, &own, app)
+	if err != nil {
+		t.Fatal("NewIRReplicaWithConfig failed:", err)
+	}
+	t.Cleanup(replica.Stop)
+	joined := make(chan error, 1)
+	go func() { joined <- replica.Join() }()
+	return replica.(*IRReplicaImpl), app, joined
+}
+
+func TestReconfigureAddReplica(t *testing.T) {
+	config, servers := startGroup(t, []string{"1", "2", "3"}, nil, transport.NewNetwork())
+	client, _ := NewIRClient(config)
+	defer client.Close()
+	before := &Request{Op: OP_COMMIT, TxnID: tid(1), Commit: &CommitMessage{Timestamp: NewTimestamp(1)}}
+	if err := client.InvokeInconsistent(before); err != nil {
+		t.Fatal("InvokeInconsistent failed:", err)
+	}
+	waitFinalized(t, servers, keyOf(before), RPLY_OK)
+	if client.Epoch() != 0 {
+		t.Errorf("Expected client to learn epoch 0, got: %d", client.Epoch())
+	}
+
+	joining, app, joined := startJoining(t, 4, config, members(1, 2, 3, 4))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Reconfigure(ctx, members(1, 2, 3, 4)); err != nil {
+		t.Fatal("Reconfigure failed:", err)
+	}
+	select {
+	case err := <-joined:
+		if err != nil {
+			t.Fatal("Join failed:", err)
+		}
+	case <-ctx.Done():
+		t.Fatal("Replica 4 never joined")
+	}
+
+	// The new replica got the record and synced its application from it
+	if _, ok := app.synced[keyOf(before)]; !ok {
+		t.Errorf("Expected the commit before the reconfiguration to be synced to replica 4")
+	}
+	servers[4] = joining
+	for id, server := range servers {
+		if server.Epoch() != 1 {
+			t.Errorf("Expected replica %d in epoch 1, got: %d", id, server.Epoch())
+		}
+	}
+	if ids, f := client.Members(); len(ids) != 4 || f != 1 || client.Epoch() != 1 {
+		t.Errorf("Expected client to send to 4 replicas tolerating 1 failure in epoch 1, got: %v, %d in epoch %d", ids, f, client.Epoch())
+	}
+
+	// Operations after the reconfiguration reach the new replica
+	after := &Request{Op: OP_COMMIT, TxnID: tid(2), Commit: &CommitMessage{Timestamp: NewTimestamp(2)}}
+	if err := client.InvokeInconsistent(after); err != nil {
+		t.Fatal("InvokeInconsistent failed:", err)
+	}
+	waitFinalized(t, servers, keyOf(after), RPLY_OK)
+	if result, err := client.InvokeConsensus(prepareRequest(3), func(results []*Response, n, f int) *Response { return results[0] }); err != nil || result.Status != RPLY_OK {
+		t.Errorf("Expected RPLY_OK after the reconfiguration, got: %v, %v", result, err)
+	}
+}
+
+// A replica replaced by another retires, clients still sending to the old
+// group learn the new one
+func TestReconfigureReplaceReplica(t *testing.T) {
+	storage := NewStorageConfiguration(t.TempDir())
+	network := transport.NewNetwork()
+	config, servers := startGroup(t, []string{"1", "2", "3"}, storage, network)
+	admin, _ := NewIRClient(config)
+	own := *config
+	own.Client = NewClientConfiguration(2, 2, 0)
+	stale, _ := NewIRClient(&own)
+	defer stale.Close()
+	if err := stale.InvokeInconsistent(&Request{Op: OP_COMMIT, TxnID: NewTxnID(2, 1), Commit: &CommitMessage{Timestamp: NewTimestamp(1)}}); err != nil {
+		t.Fatal("InvokeInconsistent failed:", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := admin.Reconfigure(ctx, members(4, 5, 6)); err == nil {
+		t.Error("Expected a group sharing no replicas with the old one to be refused")
+	}
+	_, _, joined := startJoining(t, 4, config, members(1, 2, 4))
+	if err := admin.Reconfigure(ctx, members(1, 2, 4)); err != nil {
+		t.Fatal("Reconfigure failed:", err)
+	}
+	if err := <-joined; err != nil {
+		t.Fatal("Join failed:", err)
+	}
+	retired := servers[3]
+	deadline := time.Now().Add(time.Second)
+	for retired.Epoch() != 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	retired.mu.Lock()
+	status := retired.status
+	retired.mu.Unlock()
+	if status != STATUS_RETIRED {
+		t.Errorf("Expected replica 3 to retire, got status %d in epoch %d", status, retired.Epoch())
+	}
+
+	// The client still sends to replicas 1 to 3 in epoch 0
+	req := &Request{Op: OP_COMMIT, TxnID: NewTxnID(2, 2), Commit: &CommitMessage{Timestamp: NewTimestamp(2)}}
+	if err := stale.InvokeInconsistent(req); err != nil {
+		t.Fatal("InvokeInconsistent after the reconfiguration failed:", err)
+	}
+	if ids, _ := stale.Members(); stale.Epoch() != 1 || len(ids) != 3 || ids[2] != 4 {
+		t.Errorf("Expected client to learn replicas [1 2 4] in epoch 1, got: %v in epoch %d", ids, stale.Epoch())
+	}
+	retired.mu.Lock()
+	_, ok := entryOf(retired.record, keyOf(req))
+	retired.mu.Unlock()
+	if ok {
+		t.Errorf("Expected the retired replica to handle nothing after the reconfiguration")
+	}
+
+	// The group is in the log, a restart with the old configuration keeps it
+	servers[1].Stop()
+	restarted := startReplica(t, 1, config, newFakeApp())
+	servers[1] = restarted
+	if restarted.Epoch() != 1 || restarted.peers[3] != nil || restarted.peers[4] == nil {
+		t.Errorf("Expected restarted replica in epoch 1 with replicas [1 2 4], got: %v in epoch %d", memberIDs(restarted.peers), restarted.Epoch())
+	}
+}
+
+// A replica cut off during a reconfiguration catches up once a client of the
+// new epoch reaches it
+func TestReconfigureCatchUp(t *testing.T) {
+	network := transport.NewFaultyNetwork(3)
+	config, servers := startFaultyGroup(t, 3, network)
+	client, _ := NewIRClient(config)
+	defer client.Close()
+
+	group := make(map[int]*ReplicaAddress)
+	for id := 1; id <= 4; id++ {
+		group[id] = NewReplicaAddress("replica"+strconv.Itoa(id), "0")
+	}
+	own := *config
+	own.Replicas = group
+	own.Transport = network.Node(4)
+	joining, err := NewIRReplicaWithConfig(4, &own, newFakeApp())
+	if err != nil {
+		t.Fatal("NewIRReplicaWithConfig failed:", err)
+	}
+	defer joining.Stop()
+	joined := make(chan error, 1)
+	go func() { joined <- joining.Join() }()
+
+	network.Partition([]int{clientNode, 1, 2, 4}, []int{3})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Reconfigure(ctx, group); err != nil {
+		t.Fatal("Reconfigure failed:", err)
+	}
+	if err := <-joined; err != nil {
+		t.Fatal("Join failed:", err)
+	}
+	if servers[3].Epoch() != 0 {
+		t.Fatalf("Expected the cut off replica to stay in epoch 0, got: %d", servers[3].Epoch())
+	}
+
+	network.Heal()
+	req := &Request{Op: OP_COMMIT, TxnID: tid(1), Commit: &CommitMessage{Timestamp: NewTimestamp(1)}}
+	if err := client.InvokeInconsistent(req); err != nil {
+		t.Fatal("InvokeInconsistent failed:", err)
+	}
+	servers[4] = joining.(*IRReplicaImpl)
+	waitFinalized(t, servers, keyOf(req), RPLY_OK)
+	if servers[3].Epoch() != 1 {
+		t.Errorf("Expected the cut off replica to catch up to epoch 1, got: %d", servers[3].Epoch())
+	}
+}
+
+// Wait until the replica finalized every operation of the client
+func waitRecord(t *testing.T, server *IRReplicaImpl, n int) {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		server.mu.Lock()
+		finalized := server.finalizedRecord().Len()
+		server.mu.Unlock()
+		if finalized == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected replica %d to finalize %d operations, got: %d", server.id, n, finalized)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// A replica that missed operations the others replaced by checkpoints gets
+// them by state transfer
+func TestCheckpointStateTransfer(t *testing.T) {
+	network := transport.NewFaultyNetwork(1)
+	config, servers := startFaultyGroup(t, 3, network)
+	config.SlowPathTimeout = 200 * time.Millisecond
+	client, _ := NewIRClient(config)
+
+	network.Partition([]int{clientNode, 1, 2})
+	var keys []opKey
+	for txnID := 1; txnID <= 3; txnID++ {
+		req := &Request{Op: OP_COMMIT, TxnID: tid(txnID), Commit: &CommitMessage{Timestamp: NewTimestamp(1)}}
+		if err := client.InvokeInconsistent(req); err != nil {
+			t.Fatal("InvokeInconsistent failed:", err)
+		}
+		keys = append(keys, keyOf(req))
+	}
+	for _, id := range []int{1, 2} {
+		waitRecord(t, servers[id], 3)
+		servers[id].mu.Lock()
+		servers[id].recordRetention = 0
+		servers[id].checkpointChunk = 16
+		servers[id].mu.Unlock()
+		if err := servers[id].Checkpoint(); err != nil {
+			t.Fatal("Checkpoint failed:", err)
+		}
+		if n := servers[id].record.Len(); n != 0 {
+			t.Errorf("Expected the checkpoint to replace the record of replica %d, got %d entries", id, n)
+		}
+	}
+
+	// Finalizes resent to the lagging replica give up before it is back
+	client.Close()
+	network.Heal()
+	if err := servers[3].Recover(); err != nil {
+		t.Fatal("Recover failed:", err)
+	}
+	app := servers[3].app.(*fakeApp)
+	deadline := time.Now().Add(2 * time.Second)
+	for _, key := range keys {
+		for app.executions(key) == 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if app.executions(key) == 0 {
+			t.Errorf("Expected %v to reach the lagging replica with a checkpoint", key)
+		}
+	}
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	if app.restores != 1 {
+		t.Errorf("Expected the lagging replica to restore the checkpoint of the leader once, got: %d", app.restores)
+	}
+}
+
+func TestCheckpointRestart(t *testing.T) {
+	config, servers := startGroup(t, []string{"56252", "56253", "56254"}, NewStorageConfiguration(t.TempDir()), nil)
+	client, _ := NewIRClient(config)
+	var keys []opKey
+	for txnID := 1; txnID <= 3; txnID++ {
+		req := &Request{Op: OP_COMMIT, TxnID: tid(txnID), Commit: &CommitMessage{Timestamp: NewTimestamp(1)}}
+		if err := client.InvokeInconsistent(req); err != nil {
+			t.Fatal("InvokeInconsistent failed:", err)
+		}
+		keys = append(keys, keyOf(req))
+	}
+	crashed := servers[56254]
+	waitRecord(t, crashed, 3)
+
+	// Entries stay in the record for the retention period
+	if err := crashed.Checkpoint(); err != nil {
+		t.Fatal("Checkpoint failed:", err)
+	}
+	if n := crashed.record.Len(); n != 3 || crashed.truncatedAt() != 0 {
+		t.Errorf("Expected recent entries to stay, got %d entries", n)
+	}
+	crashed.mu.Lock()
+	crashed.recordRetention = 0
+	crashed.mu.Unlock()
+	if err := crashed.Checkpoint(); err != nil {
+		t.Fatal("Checkpoint failed:", err)
+	}
+	crashed.Stop()
+
+	app := newFakeApp()
+	restarted := startReplica(t, 56254, config, app)
+	defer restarted.Stop()
+	if n := restarted.record.Len(); n != 0 {
+		t.Errorf("Expected the truncated log to stay truncated, got %d entries", n)
+	}
+	if seq := restarted.truncatedAt(); seq != 2 {
+		t.Errorf("Expected the restarted replica to name checkpoint 2, got: %d", seq)
+	}
+	for _, key := range keys {
+		if app.executions(key) != 1 {
+			t.Errorf("Expected %v to come back with the checkpoint, got %d executions", key, app.executions(key))
+		}
+	}
+}
+
+// Late duplicates of operations the record dropped don't execute again, on
+// a restarted replica neither. Newer operations of the client still do.
+func TestDuplicatesAfterTruncation(t *testing.T) {
+	config, servers := startGroup(t, []string{"1"}, NewStorageConfiguration(t.TempDir()), transport.NewNetwork())
+	server := servers[1]
+	prepare := prepareRequest(1)
+	commit := &Request{Op: OP_COMMIT, TxnID: tid(1), Commit: &CommitMessage{Timestamp: NewTimestamp(1)}}
+	finalizePrepare := Finalize(OpID{ClientID: 1, Seq: 1}, NewResponse(RPLY_OK))
+	finalizePrepare.Request, finalizePrepare.ProtoType = prepare, CONSENSUS
+	finalizeCommit := NewFinalize(OpID{ClientID: 1, Seq: 2}, INCONSISTENT)
+	finalizeCommit.Request = commit
+	proposes := []Message{NewPropose(OpID{ClientID: 1, Seq: 1}, prepare, CONSENSUS), NewPropose(OpID{ClientID: 1, Seq: 2}, commit, INCONSISTENT)}
+	finalizes := []Message{finalizePrepare, finalizeCommit}
+	for _, msg := range append(proposes, finalizes...) {
+		if err := server.HandleOperation(&msg, &Message{}); err != nil {
+			t.Fatal("HandleOperation failed:", err)
+		}
+	}
+	server.mu.Lock()
+	server.recordRetention = 0
+	server.mu.Unlock()
+	if err := server.Checkpoint(); err != nil || server.record.Len() != 0 {
+		t.Fatalf("Expected the checkpoint to drop every entry, %d left: %v", server.record.Len(), err)
+	}
+
+	duplicate := func(server *IRReplicaImpl) {
+		for _, msg := range proposes {
+			if err := server.HandleOperation(&msg, &Message{}); err == nil {
+				t.Errorf("Expected propose of dropped %v to fail", msg.OperationID)
+			}
+		}
+		for _, msg := range finalizes {
+			reply := Message{}
+			if err := server.HandleOperation(&msg, &reply); err != nil || reply.Response == nil {
+				t.Errorf("Expected finalize of dropped %v to succeed, got: %v, %v", msg.OperationID, reply.Response, err)
+			}
+		}
+		app := server.app.(*fakeApp)
+		for _, req := range []*Request{prepare, commit} {
+			if n := app.executions(keyOf(req)); n != 1 {
+				t.Errorf("Expected %s to execute once, got: %d", req.Op.ToString(), n)
+			}
+		}
+		if n := server.record.Len(); n != 0 {
+			t.Errorf("Expected duplicates to stay out of the record, got %d entries", n)
+		}
+	}
+	duplicate(server)
+
+	server.Stop()
+	restarted := startReplica(t, 1, config, newFakeApp())
+	defer restarted.Stop()
+	duplicate(restarted)
+	msg := NewPropose(OpID{ClientID: 1, Seq: 3}, prepareRequest(2), CONSENSUS)
+	if err := restarted.HandleOperation(&msg, &Message{}); err != nil {
+		t.Fatal("Propose of a new operation failed:", err)
+	}
+	if n := restarted.app.(*fakeApp).executions(keyOf(prepareRequest(2))); n != 1 {
+		t.Errorf("Expected the new operation to execute, got %d executions", n)
+	}
+}
+
+func TestLateOperationsAfterTruncation(t *testing.T) {
+	config, servers := startGroup(t, []string{"1"}, NewStorageConfiguration(t.TempDir()), transport.NewNetwork())
+	server := servers[1]
+	propose := func(server *IRReplicaImpl, seq, completed, txn int) error {
+		msg := NewPropose(OpID{ClientID: 1, Seq: seq}, prepareRequest(txn), CONSENSUS)
+		msg.Completed = completed
+		return server.HandleOperation(&msg, &Message{})
+	}
+	if err := propose(server, 5, 3, 5); err != nil {
+		t.Fatal("Propose failed:", err)
+	}
+	finalize := Finalize(OpID{ClientID: 1, Seq: 5}, NewResponse(RPLY_OK))
+	finalize.Request, finalize.ProtoType, finalize.Completed = prepareRequest(5), CONSENSUS, 3
+	if err := server.HandleOperation(&finalize, &Message{}); err != nil {
+		t.Fatal("Finalize failed:", err)
+	}
+	server.mu.Lock()
+	server.recordRetention = 0
+	server.mu.Unlock()
+	if err := server.Checkpoint(); err != nil || server.record.Len() != 0 {
+		t.Fatalf("Expected the checkpoint to drop every entry, %d left: %v", server.record.Len(), err)
+	}
+
+	// An operation of a lower sequence than the dropped one was still in flight
+	if err := propose(server, 4, 3, 4); err != nil {
+		t.Fatal("Expected a late operation the client is not done with to execute, got:", err)
+	}
+	if err := propose(server, 5, 3, 5); err == nil {
+		t.Error("Expected propose of dropped operation 5 to fail")
+	}
+
+	// The client is done with everything up to 7, operation 6 never got here
+	if err := propose(server, 8, 7, 8); err != nil {
+		t.Fatal("Propose failed:", err)
+	}
+	if err := server.Checkpoint(); err != nil {
+		t.Fatal("Checkpoint failed:", err)
+	}
+	if len(server.dropped) != 0 {
+		t.Errorf("Expected the completed sequence to cover the dropped operations, got: %v", server.dropped)
+	}
+	server.Stop()
+	restarted := startReplica(t, 1, config, newFakeApp())
+	defer restarted.Stop()
+	if err := propose(restarted, 6, 0, 6); err == nil {
+		t.Error("Expected propose of operation 6 the client is done with to fail")
+	}
+	if n := restarted.app.(*fakeApp).executions(keyOf(prepareRequest(6))); n != 0 {
+		t.Errorf("Expected operation 6 not to execute, got %d executions", n)
+	}
+}
+
+func TestClientCompleted(t *testing.T) {
+	client, err := NewIRClient(NewConfiguration(NewClientConfiguration(1, 1, 0), map[int]*ReplicaAddress{0: NewReplicaAddress("localhost", "56255")}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := client.startOp()
+	second := client.startOp()
+	client.nextOpID()
+	client.hold(first)
+	client.release(second)
+	client.release(first)
+	if done := client.completed(); done != first.Seq-1 {
+		t.Errorf("Expected operations up to %d to be done while a call of %d is out, got: %d", first.Seq-1, first.Seq, done)
+	}
+	client.release(first)
+	if done := client.completed(); done != second.Seq+1 {
+		t.Errorf("Expected every operation to be done, got: %d", done)
+	}
+}
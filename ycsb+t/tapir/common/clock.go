@@ -0,0 +1,115 @@
+package common
+
+import (
+	"context"
+	"time"
+)
+
+// Clock tells time and runs the goroutines of clients and replicas. Outside
+// of simulations it is SystemClock, a simulation swaps in a virtual clock
+// that decides itself when every goroutine runs.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+
+	// Run f in a new goroutine
+	Go(f func())
+
+	// Create a signal goroutines of this clock can wait on
+	NewSignal() Signal
+}
+
+// Signal wakes up a goroutine waiting on it. A notify while nobody waits is
+// kept for the next wait, so a wait never misses a notify sent before it.
+type Signal interface {
+	Notify()
+
+	// Wait for a notify, false if timeout passed first. A timeout of 0 waits
+	// as long as it takes.
+	Wait(timeout time.Duration) bool
+}
+
+// SystemClock is the wall clock and plain goroutines
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+type systemSignal chan struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (systemClock) Go(f func()) {
+	go f()
+}
+
+func (systemClock) NewSignal() Signal {
+	return make(systemSignal, 1)
+}
+
+func (s systemSignal) Notify() {
+	select {
+	case s <- struct{}{}:
+	default:
+		// A notify is already pending
+	}
+}
+
+func (s systemSignal) Wait(timeout time.Duration) bool {
+	if timeout <= 0 {
+		<-s
+		return true
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-s:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// WithClockTimeout is context.WithTimeout on clock, the deadline of the
+// returned context is timeout from now on clock
+func WithClockTimeout(ctx context.Context, clock Clock, timeout time.Duration) context.Context {
+	return WithClockDeadline(ctx, clock, clock.Now().Add(timeout))
+}
+
+// WithClockDeadline is context.WithDeadline on clock. Deadlines of contexts
+// are times on the clock of the client they are passed to, on a virtual
+// clock they must be set with this. No timer runs: Err reports
+// context.DeadlineExceeded once the clock passes the deadline, but Done only
+// closes when ctx is canceled. Clients wait on their clock up to the
+// deadline and check Err instead of waiting on Done.
+func WithClockDeadline(ctx context.Context, clock Clock, deadline time.Time) context.Context {
+	if d, ok := ctx.Deadline(); ok && !deadline.Before(d) {
+		return ctx
+	}
+	return &clockContext{Context: ctx, clock: clock, deadline: deadline}
+}
+
+type clockContext struct {
+	context.Context
+	clock    Clock
+	deadline time.Time
+}
+
+func (c *clockContext) Deadline() (time.Time, bool) {
+	return c.deadline, true
+}
+
+func (c *clockContext) Err() error {
+	if err := c.Context.Err(); err != nil {
+		return err
+	}
+	if !c.clock.Now().Before(c.deadline) {
+		return context.DeadlineExceeded
+	}
+	return nil
+}
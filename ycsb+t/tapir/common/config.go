@@ -1,7 +1,34 @@
 package common
 
 import (
+	"fmt"
 	"math"
+	"path/filepath"
+	"time"
+)
+
+const (
+	DefaultFastPathTimeout    = 200 * time.Millisecond
+	DefaultSlowPathTimeout    = 2 * time.Second
+	DefaultRetransmit         = 100 * time.Millisecond
+	DefaultMaxRetries         = 5
+	DefaultMaxAttempts        = 10
+	DefaultRetryBackoff       = 10 * time.Millisecond
+	DefaultFsyncInterval      = 10 * time.Millisecond
+	DefaultGCInterval         = time.Second
+	DefaultGCRetention        = 10 * time.Second
+	DefaultCheckpointInterval = 10 * time.Second
+	DefaultRecordRetention    = time.Minute
+	DefaultSegmentSize        = 64 << 20
+)
+
+// When a write-ahead log forces appended records to disk
+type FsyncPolicy int
+
+const (
+	FSYNC_ALWAYS   FsyncPolicy = iota // fsync before every append returns
+	FSYNC_INTERVAL                    // fsync in the background every FsyncInterval
+	FSYNC_NEVER                       // leave flushing to the operating system
 )
 
 type ReplicaAddress struct {
@@ -19,19 +46,90 @@ func (addr *ReplicaAddress) SpecificString() string {
 
 type ClientConfiguration struct {
 	TAPIR_ID         int
-	IR_ID            int
+	IR_ID            int // unique among the clients of a replica group, replicas tell operations apart by it
 	ClosestReplicaID int
+	MaxRetries       int           // times a prepare is retried at a later timestamp before aborting
+	MaxAttempts      int           // times RunTxn runs a transaction that keeps aborting
+	RetryBackoff     time.Duration // longest wait of RunTxn before the second attempt, doubles after every abort
 }
 
 func NewClientConfiguration(tapir_id, ir_id, closest_replica_id int) *ClientConfiguration {
-	return &ClientConfiguration{TAPIR_ID: tapir_id, IR_ID: ir_id, ClosestReplicaID: closest_replica_id}
+	return &ClientConfiguration{
+		TAPIR_ID:         tapir_id,
+		IR_ID:            ir_id,
+		ClosestReplicaID: closest_replica_id,
+		MaxRetries:       DefaultMaxRetries,
+		MaxAttempts:      DefaultMaxAttempts,
+		RetryBackoff:     DefaultRetryBackoff,
+	}
 }
 
 type Configuration struct {
 	N        int // Number of replicas
 	F        int // Number of failures tolerated
 	Client   *ClientConfiguration
-	Replicas map[int]*ReplicaAddress // <replica_id, replica_address>
+	Replicas map[int]*ReplicaAddress // <replica_id, replica_address>, every replica of every shard
+
+	Shards []map[int]*ReplicaAddress // replica groups of a sharded deployment, nil for a single group
+	ShardF int                       // failures every shard tolerates, (n-1)/2 of the shard if 0
+
+	FastPathTimeout time.Duration // how long a consensus operation waits for a fast quorum
+	SlowPathTimeout time.Duration // how long the slow path waits for f+1 replies
+	Retransmit      time.Duration // how long a client waits before it resends a failed call, 0 never resends
+
+	Storage *StorageConfiguration // nil keeps replica state in memory only
+
+	Transport Transport // nil for net/rpc over TCP
+	Clock     Clock     // SystemClock unless a simulation runs the deployment
+
+	GCInterval  time.Duration // how often replicas collect old versions, 0 disables collection
+	GCRetention time.Duration // oldest transaction or snapshot timestamp replicas still serve, unless a snapshot read within it, outcomes are kept PrepareTimeout longer
+
+	CheckpointInterval time.Duration // how often replicas checkpoint their application state, 0 disables checkpoints
+	RecordRetention    time.Duration // how long a finalized operation stays in the record before a checkpoint replaces it
+
+	// How long a transaction stays prepared before its replicas presume the
+	// client gone and end it themselves, 0 (the default) leaves it prepared
+	// until its client ends it. Nothing orders the decision of the replicas
+	// against the commit or abort of the client yet, they decide from what
+	// they prepared alone. A client gives up on commits whose prepare took
+	// half of it and its commit or abort is assumed to reach the replicas
+	// within the other half, a client stalled longer can abort a
+	// transaction the replicas commit. Only set it where no client stalls
+	// that long.
+	PrepareTimeout time.Duration
+}
+
+// Engine holding the versioned data of a replica
+type StorageEngine int
+
+const (
+	ENGINE_MEMORY StorageEngine = iota // in memory, changes logged to a write-ahead log
+	ENGINE_DISK                        // versions and their index on disk, memory holds a bounded cache
+)
+
+// StorageConfiguration describes where and how replicas persist their state
+type StorageConfiguration struct {
+	DataDir       string // every replica keeps its files under DataDir/replica<id>
+	Engine        StorageEngine
+	Fsync         FsyncPolicy
+	FsyncInterval time.Duration // only used by FSYNC_INTERVAL
+	SegmentSize   int64         // start a new log segment once the current one is this large
+}
+
+func NewStorageConfiguration(dataDir string) *StorageConfiguration {
+	return &StorageConfiguration{
+		DataDir:       dataDir,
+		Engine:        ENGINE_MEMORY,
+		Fsync:         FSYNC_INTERVAL,
+		FsyncInterval: DefaultFsyncInterval,
+		SegmentSize:   DefaultSegmentSize,
+	}
+}
+
+// Directory of the named component of a replica, e.g. its IR record
+func (s *StorageConfiguration) Dir(replicaID int, name string) string {
+	return filepath.Join(s.DataDir, fmt.Sprintf("replica%d", replicaID), name)
 }
 
 func NewConfiguration(client *ClientConfiguration, replicas map[int]*ReplicaAddress) *Configuration {
@@ -40,13 +138,78 @@ func NewConfiguration(client *ClientConfiguration, replicas map[int]*ReplicaAddr
 		F:        int(math.Floor(float64((len(replicas) - 1)) / 2)),
 		Client:   client,
 		Replicas: replicas,
+
+		FastPathTimeout: DefaultFastPathTimeout,
+		SlowPathTimeout: DefaultSlowPathTimeout,
+		Retransmit:      DefaultRetransmit,
+
+		Clock: SystemClock,
+
+		GCInterval:  DefaultGCInterval,
+		GCRetention: DefaultGCRetention,
+
+		CheckpointInterval: DefaultCheckpointInterval,
+		RecordRetention:    DefaultRecordRetention,
 	}
 }
 
+// NewShardedConfiguration creates the configuration of a deployment with one
+// replica group per shard, replica IDs must be unique across shards
+func NewShardedConfiguration(client *ClientConfiguration, shards []map[int]*ReplicaAddress) *Configuration {
+	replicas := make(map[int]*ReplicaAddress)
+	for _, shard := range shards {
+		for id, addr := range shard {
+			replicas[id] = addr
+		}
+	}
+	config := NewConfiguration(client, replicas)
+	config.Shards = shards
+	return config
+}
+
+// Number of shards, a configuration without shards is a single one
+func (c *Configuration) NumShards() int {
+	if len(c.Shards) == 0 {
+		return 1
+	}
+	return len(c.Shards)
+}
+
+// Configuration of the replica group of shard i
+func (c *Configuration) Shard(i int) *Configuration {
+	if len(c.Shards) == 0 {
+		return c
+	}
+	shard := *c
+	shard.Replicas = c.Shards[i]
+	shard.N = len(shard.Replicas)
+	shard.F = (shard.N - 1) / 2
+	if c.ShardF > 0 {
+		shard.F = c.ShardF
+	}
+	shard.Shards = nil
+	return &shard
+}
+
+// Configuration of the replica group the given replica belongs to
+func (c *Configuration) GroupOf(replicaID int) *Configuration {
+	for i, shard := range c.Shards {
+		if _, ok := shard[replicaID]; ok {
+			return c.Shard(i)
+		}
+	}
+	return c
+}
+
 func (c *Configuration) QuorumSize() int {
 	return c.N - c.F
 }
 
+// Number of matching replies needed for the consensus fast path, ⌈3f/2⌉+1
+func (c *Configuration) SuperQuorumSize() int {
+	return (3*c.F+1)/2 + 1
+}
+
 // Example Configs
 func GetConfigA() *Configuration {
 	client := NewClientConfiguration(0, 0, 0)
@@ -0,0 +1,32 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Errors returned by clients, wrapped with details. Check for them with errors.Is.
+var (
+	// The transaction did not commit, running it again may succeed
+	ErrAborted = errors.New("transaction aborted")
+
+	// The replicas kept asking for a later timestamp until the client gave
+	// up, errors with it are ErrAborted too
+	ErrRetryExhausted = errors.New("prepare retries exhausted")
+
+	// Replicas did not reply in time, or the deadline of the context passed
+	ErrTimeout = errors.New("timed out")
+
+	// The key has no version to read
+	ErrKeyNotFound = errors.New("key not found")
+)
+
+// Error of a context that is done, ErrTimeout if its deadline passed
+func ContextError(ctx context.Context) error {
+	err := ctx.Err()
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %w", ErrTimeout, err)
+	}
+	return err
+}
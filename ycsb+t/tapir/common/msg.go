@@ -13,6 +13,8 @@ const (
 	OP_PREPARE
 	OP_COMMIT
 	OP_ABORT
+	OP_SCAN
+	OP_STATUS
 )
 
 func (op OpType) ToString() string {
@@ -25,6 +27,10 @@ func (op OpType) ToString() string {
 		return "OP_COMMIT"
 	case OP_ABORT:
 		return "OP_ABORT"
+	case OP_SCAN:
+		return "OP_SCAN"
+	case OP_STATUS:
+		return "OP_STATUS"
 	default:
 		return "Unknown Operation"
 	}
@@ -84,17 +90,48 @@ const (
 	INCONSISTENT
 )
 
+// OpID identifies an IR operation across every client: the IR client that
+// invoked it and its seq at that client. Seqs start from the clock, so they
+// grow across restarts of the client too.
+type OpID struct {
+	ClientID int
+	Seq      int
+}
+
+// Order by client, then by sequence number
+func (id OpID) Less(other OpID) bool {
+	if id.ClientID != other.ClientID {
+		return id.ClientID < other.ClientID
+	}
+	return id.Seq < other.Seq
+}
+
+func (id OpID) String() string {
+	return fmt.Sprintf("%d.%d", id.ClientID, id.Seq)
+}
+
 // Message represents a message used by the LSP protocol.
 type Message struct {
 	Type        MsgType // One of the message types listed above.
 	ConnID      int     // Unique client-server connection ID.
-	OperationID int     // operation ID
+	OperationID OpID    // operation ID
 	Response    *Response
 	Request     *Request
 	ProtoType   ProtoType
+	View        int // view number of the replica that sent the reply
+
+	// Epoch of the replica group membership the client sends in. A replica
+	// in a later epoch answers with its epoch and Members instead of
+	// handling the request.
+	Epoch   int
+	Members map[int]*ReplicaAddress
+
+	// Every logged operation of the client up to this sequence is done, a
+	// replica refuses late duplicates of them
+	Completed int
 }
 
-func NewPropose(opID int, op *Request, proto ProtoType) Message {
+func NewPropose(opID OpID, op *Request, proto ProtoType) Message {
 	return Message{
 		Type:        MsgPropose,
 		OperationID: opID,
@@ -103,7 +140,7 @@ func NewPropose(opID int, op *Request, proto ProtoType) Message {
 	}
 }
 
-func NewReply(opID int, res *Response) Message {
+func NewReply(opID OpID, res *Response) Message {
 	return Message{
 		Type:        MsgReply,
 		OperationID: opID,
@@ -111,22 +148,22 @@ func NewReply(opID int, res *Response) Message {
 	}
 }
 
-func NewUnlogged(op *Request) Message {
+func NewUnlogged(opID OpID, op *Request) Message {
 	return Message{
-		OperationID: op.TxnID,
+		OperationID: opID,
 		Type:        MsgFinalize,
 		Request:     op,
 	}
 }
 
-func NewFinalize(opID int, proto ProtoType) Message {
+func NewFinalize(opID OpID, proto ProtoType) Message {
 	return Message{
 		Type:        MsgFinalize,
 		OperationID: opID,
 		ProtoType:   proto,
 	}
 }
-func Finalize(opID int, res *Response) Message {
+func Finalize(opID OpID, res *Response) Message {
 	return Message{
 		Type:        MsgFinalize,
 		OperationID: opID,
@@ -134,7 +171,7 @@ func Finalize(opID int, res *Response) Message {
 	}
 }
 
-func NewConfirm(opID int) *Message {
+func NewConfirm(opID OpID) *Message {
 	return &Message{
 		Type:        MsgConfirm,
 		OperationID: opID,
@@ -150,7 +187,14 @@ func CheckError(err error) {
 // GetMessage represents the GetMessage message
 type GetMessage struct {
 	Key       string
-	Timestamp *Timestamp
+	Timestamp *Timestamp // read the version valid at this time, nil for the latest version
+}
+
+// ScanMessage represents the ScanMessage message
+type ScanMessage struct {
+	StartKey  string
+	Count     int        // number of keys to read, 0 for all keys after StartKey
+	Timestamp *Timestamp // read the versions valid at this time, nil for the latest versions
 }
 
 // PrepareMessage represents the PrepareMessage message
@@ -162,13 +206,16 @@ type PrepareMessage struct {
 // CommitMessage represents the CommitMessage message
 type CommitMessage struct {
 	Timestamp *Timestamp
+	Txn       *Transaction // part of the transaction on the shard, the commit may reach a replica before its prepare
 }
 
 // Request represents the Request message
 type Request struct {
 	Op      OpType
-	TxnID   int
+	TxnID   TxnID
+	Retry   int // number of times the prepare was retried with a new timestamp
 	Get     *GetMessage
+	Scan    *ScanMessage
 	Prepare *PrepareMessage
 	Commit  *CommitMessage
 }
@@ -201,6 +248,42 @@ type Response struct {
 	Status    ReplyType
 	Value     string
 	Timestamp *Timestamp
+	Rows      []*ScanRow // keys read by a scan, in key order
+
+	TxnStatus TxnStatus    // what the replica knows of the transaction, replies to OP_STATUS
+	Txn       *Transaction // part of the transaction prepared on the replica, replies to OP_STATUS
+}
+
+// What a replica knows of a transaction
+type TxnStatus int
+
+const (
+	TXN_UNKNOWN   TxnStatus = iota // not prepared on the replica
+	TXN_PREPARED                   // prepared at the reply's timestamp
+	TXN_COMMITTED                  // committed at the reply's timestamp
+	TXN_ABORTED
+)
+
+func (s TxnStatus) String() string {
+	switch s {
+	case TXN_UNKNOWN:
+		return "TXN_UNKNOWN"
+	case TXN_PREPARED:
+		return "TXN_PREPARED"
+	case TXN_COMMITTED:
+		return "TXN_COMMITTED"
+	case TXN_ABORTED:
+		return "TXN_ABORTED"
+	default:
+		return fmt.Sprintf("Unknown TxnStatus: %d", s)
+	}
+}
+
+// ScanRow is a key read by a scan and the version of it that was read
+type ScanRow struct {
+	Key       string
+	Value     string
+	Timestamp *Timestamp
 }
 
 func NewResponse(status ReplyType) *Response {
@@ -216,6 +299,13 @@ func NewResponseWithTime(status ReplyType, timestamp *Timestamp) *Response {
 	}
 }
 
+func NewScanResponse(rows []*ScanRow) *Response {
+	return &Response{
+		Status: RPLY_OK,
+		Rows:   rows,
+	}
+}
+
 func NewReadResponse(value string, timestamp *Timestamp) *Response {
 	return &Response{
 		Status:    RPLY_OK,
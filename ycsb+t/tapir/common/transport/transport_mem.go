@@ -0,0 +1,93 @@
+package transport
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net/rpc"
+	"reflect"
+	"sync"
+
+	. "github.com/pingcap/go-ycsb/tapir/common"
+)
+
+// Network is an in-memory Transport. Replicas listen on an address of the
+// network and calls reach them without opening any port. Arguments and
+// replies are copied through gob like they would be on the wire, so callers
+// and replicas never share memory.
+type Network struct {
+	mu        sync.Mutex
+	listeners map[string]*endpoint // <address, replica listening on it>
+}
+
+// A replica listening on the network
+type endpoint struct {
+	network  *Network
+	addr     string
+	id       int
+	receiver reflect.Value
+}
+
+func NewNetwork() *Network {
+	return &Network{
+		listeners: make(map[string]*endpoint),
+	}
+}
+
+func (n *Network) Listen(id int, addr *ReplicaAddress, receiver interface{}) (io.Closer, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.listeners[addr.SpecificString()]; ok {
+		return nil, errors.New(fmt.Sprintf("address %s already in use", addr.SpecificString()))
+	}
+	e := &endpoint{network: n, addr: addr.SpecificString(), id: id, receiver: reflect.ValueOf(receiver)}
+	n.listeners[e.addr] = e
+	return e, nil
+}
+
+func (n *Network) Call(id int, addr *ReplicaAddress, method string, args interface{}, reply interface{}) error {
+	n.mu.Lock()
+	e, ok := n.listeners[addr.SpecificString()]
+	n.mu.Unlock()
+	if !ok {
+		return errors.New(fmt.Sprintf("connection refused: nothing listening on %s", addr.SpecificString()))
+	}
+	return e.call(id, method, args, reply)
+}
+
+// Deliver a call to the receiver the way net/rpc does, a failed call leaves reply untouched
+func (e *endpoint) call(id int, method string, args interface{}, reply interface{}) error {
+	fn := e.receiver.MethodByName(method)
+	if id != e.id || !fn.IsValid() || fn.Type().NumIn() != 2 {
+		return rpc.ServerError(fmt.Sprintf("rpc: can't find method %s.%s", serviceName(id), method))
+	}
+	in := reflect.New(fn.Type().In(0).Elem())
+	if err := copyValue(args, in.Interface()); err != nil {
+		return err
+	}
+	out := reflect.New(fn.Type().In(1).Elem())
+	if err, _ := fn.Call([]reflect.Value{in, out})[0].Interface().(error); err != nil {
+		return rpc.ServerError(err.Error())
+	}
+	return copyValue(out.Interface(), reply)
+}
+
+func (e *endpoint) Close() error {
+	e.network.mu.Lock()
+	defer e.network.mu.Unlock()
+	if e.network.listeners[e.addr] == e {
+		delete(e.network.listeners, e.addr)
+	}
+	return nil
+}
+
+// Deep copy src into dst through gob
+func copyValue(src interface{}, dst interface{}) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(src); err != nil {
+		return err
+	}
+	return gob.NewDecoder(&buf).Decode(dst)
+}
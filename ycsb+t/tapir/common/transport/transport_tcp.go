@@ -0,0 +1,184 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+
+	. "github.com/pingcap/go-ycsb/tapir/common"
+)
+
+const (
+	dialTimeout         = time.Second
+	reconnectBackoff    = 10 * time.Millisecond // wait after the first failed dial, doubles with every failure after it
+	maxReconnectBackoff = time.Second
+)
+
+// TCPTransport sends calls over net/rpc. Every listener has an rpc server of
+// its own with the replica registered as IRReplica<id>, so replicas with the
+// same id can run in one process, and a replica can stop and listen on its
+// port again. Connections are dialed on first use and
+// dropped once they break, the next call dials again. A replica that can't
+// be dialed is left alone for a backoff that grows with every failed dial,
+// calls to it fail right away in the meantime.
+type TCPTransport struct {
+	mu    sync.Mutex
+	peers map[string]*peer // <address, connection health>
+}
+
+// Connection to one replica address
+type peer struct {
+	cli      *rpc.Client // nil while not connected
+	failures int         // dials failed in a row
+	retryAt  time.Time   // no dial before this
+}
+
+func NewTCPTransport() *TCPTransport {
+	return &TCPTransport{
+		peers: make(map[string]*peer),
+	}
+}
+
+func (t *TCPTransport) Listen(id int, addr *ReplicaAddress, receiver interface{}) (io.Closer, error) {
+	server := rpc.NewServer()
+	if err := server.RegisterName(serviceName(id), receiver); err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("tcp", addr.SpecificString())
+	if err != nil {
+		return nil, err
+	}
+	l := &tcpListener{ln: ln, server: server, conns: make(map[net.Conn]bool)}
+	go l.accept()
+	return l, nil
+}
+
+func (t *TCPTransport) Call(id int, addr *ReplicaAddress, method string, args interface{}, reply interface{}) error {
+	cli, err := t.dial(addr.SpecificString())
+	if err != nil {
+		return err
+	}
+	err = cli.Call(serviceName(id)+"."+method, args, reply)
+	if _, ok := err.(rpc.ServerError); err != nil && !ok {
+		// The connection is broken, not just the call. Dial again right
+		// away, the replica may be back already.
+		t.mu.Lock()
+		if p := t.peers[addr.SpecificString()]; p.cli == cli {
+			p.cli = nil
+		}
+		t.mu.Unlock()
+		cli.Close()
+	}
+	return err
+}
+
+// Close every connection of the transport
+func (t *TCPTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for addr, p := range t.peers {
+		if p.cli == nil {
+			continue
+		}
+		if err := p.cli.Close(); err != nil && err != rpc.ErrShutdown {
+			log.Println("Error closing connection to", addr, err)
+		}
+	}
+	t.peers = make(map[string]*peer)
+	return nil
+}
+
+// Connection to addr, dialed if there is none and the backoff has passed
+func (t *TCPTransport) dial(addr string) (*rpc.Client, error) {
+	t.mu.Lock()
+	p, ok := t.peers[addr]
+	if !ok {
+		p = &peer{}
+		t.peers[addr] = p
+	}
+	if p.cli != nil {
+		t.mu.Unlock()
+		return p.cli, nil
+	}
+	if wait := time.Until(p.retryAt); wait > 0 {
+		t.mu.Unlock()
+		return nil, errors.New(fmt.Sprintf("%s unreachable, reconnecting in %v", addr, wait))
+	}
+	t.mu.Unlock()
+
+	// Calls to other replicas go on while this one dials
+	conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err != nil {
+		p.failures++
+		backoff := min(reconnectBackoff<<min(p.failures-1, 16), maxReconnectBackoff)
+		p.retryAt = time.Now().Add(backoff)
+		log.Println("Can't reach", addr, "retrying in", backoff, err)
+		return nil, err
+	}
+	if p.cli != nil {
+		// Another call connected first
+		conn.Close()
+		return p.cli, nil
+	}
+	if p.failures > 0 {
+		log.Println("Reconnected to", addr, "after", p.failures, "failed dials")
+	}
+	p.failures = 0
+	p.cli = rpc.NewClient(conn)
+	return p.cli, nil
+}
+
+func serviceName(id int) string {
+	return fmt.Sprintf("IRReplica%d", id)
+}
+
+// tcpListener serves the connections it accepts and closes them with the
+// listener, so a stopped replica stops answering its existing clients too
+type tcpListener struct {
+	ln     net.Listener
+	server *rpc.Server
+	mu     sync.Mutex
+	conns  map[net.Conn]bool
+	closed bool
+}
+
+func (l *tcpListener) accept() {
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			return
+		}
+		l.mu.Lock()
+		if l.closed {
+			l.mu.Unlock()
+			conn.Close()
+			return
+		}
+		l.conns[conn] = true
+		l.mu.Unlock()
+		go func() {
+			l.server.ServeConn(conn)
+			l.mu.Lock()
+			delete(l.conns, conn)
+			l.mu.Unlock()
+		}()
+	}
+}
+
+func (l *tcpListener) Close() error {
+	l.mu.Lock()
+	l.closed = true
+	for conn := range l.conns {
+		conn.Close()
+	}
+	l.mu.Unlock()
+	return l.ln.Close()
+}
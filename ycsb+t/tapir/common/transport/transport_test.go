@@ -0,0 +1,218 @@
+package transport
+
+import (
+	"errors"
+	"net/rpc"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/pingcap/go-ycsb/tapir/common"
+)
+
+// echoReplica answers calls like a replica would
+type echoReplica struct {
+	mu    sync.Mutex
+	calls int
+	last  *Message
+}
+
+func (e *echoReplica) Echo(args *Message, reply *Message) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.calls++
+	e.last = args
+	reply.OperationID = args.OperationID
+	reply.Response = NewReadResponse(args.Request.Get.Key, nil)
+	return nil
+}
+
+func (e *echoReplica) Fail(args *Message, reply *Message) error {
+	reply.OperationID = OpID{Seq: -1}
+	return errors.New("failed on purpose")
+}
+
+func (e *echoReplica) Calls() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.calls
+}
+
+func testTransport(t *testing.T, tr Transport, id int, addr *ReplicaAddress) {
+	replica := &echoReplica{}
+	ln, err := tr.Listen(id, addr, replica)
+	if err != nil {
+		t.Fatal("Listen failed:", err)
+	}
+
+	args := &Message{OperationID: OpID{ClientID: 1, Seq: 7}, Request: &Request{Op: OP_GET, Get: &GetMessage{Key: "a"}}}
+	reply := &Message{}
+	if err := tr.Call(id, addr, "Echo", args, reply); err != nil {
+		t.Fatal("Call failed:", err)
+	}
+	if reply.OperationID.Seq != 7 || reply.Response.Value != "a" {
+		t.Errorf("Expected echo of operation 7, got: %+v", reply)
+	}
+
+	// Errors of the replica come back as server errors and leave the reply alone
+	reply = &Message{}
+	err = tr.Call(id, addr, "Fail", args, reply)
+	if _, ok := err.(rpc.ServerError); !ok || err.Error() != "failed on purpose" || reply.OperationID != (OpID{}) {
+		t.Errorf("Expected server error and untouched reply, got: %v, %+v", err, reply)
+	}
+	if _, ok := tr.Call(id, addr, "Missing", args, &Message{}).(rpc.ServerError); !ok {
+		t.Errorf("Expected unknown method to fail")
+	}
+	if _, ok := tr.Call(id+1, addr, "Echo", args, &Message{}).(rpc.ServerError); !ok {
+		t.Errorf("Expected call to another replica id to fail")
+	}
+
+	ln.Close()
+	if err := tr.Call(id, addr, "Echo", args, &Message{}); err == nil {
+		t.Errorf("Expected call after close to fail")
+	}
+}
+
+func TestTCPTransport(t *testing.T) {
+	tr := NewTCPTransport()
+	defer tr.Close()
+	testTransport(t, tr, 57001, NewReplicaAddress("localhost", "57001"))
+}
+
+func TestTCPReconnect(t *testing.T) {
+	tr := NewTCPTransport()
+	defer tr.Close()
+	addr := NewReplicaAddress("localhost", "57002")
+	args := &Message{OperationID: OpID{ClientID: 1, Seq: 7}, Request: &Request{Op: OP_GET, Get: &GetMessage{Key: "a"}}}
+
+	if err := tr.Call(57002, addr, "Echo", args, &Message{}); err == nil {
+		t.Fatal("Expected call to a replica that is not listening to fail")
+	}
+	ln, err := tr.Listen(57002, addr, &echoReplica{})
+	if err != nil {
+		t.Fatal("Listen failed:", err)
+	}
+	// Still backing off, the call fails without dialing
+	if err := tr.Call(57002, addr, "Echo", args, &Message{}); err == nil {
+		t.Errorf("Expected call during the backoff to fail")
+	}
+	time.Sleep(2 * reconnectBackoff)
+	if err := tr.Call(57002, addr, "Echo", args, &Message{}); err != nil {
+		t.Fatal("Expected call after the backoff to reconnect:", err)
+	}
+
+	// A replica that restarts is dialed again on the next call after the break
+	ln.Close()
+	if err := tr.Call(57002, addr, "Echo", args, &Message{}); err == nil {
+		t.Errorf("Expected call to a stopped replica to fail")
+	}
+	restarted := &echoReplica{}
+	ln, err = tr.Listen(57002, addr, restarted)
+	if err != nil {
+		t.Fatal("Listen failed:", err)
+	}
+	defer ln.Close()
+	if err := tr.Call(57002, addr, "Echo", args, &Message{}); err != nil {
+		t.Errorf("Expected call to the restarted replica to reconnect: %v", err)
+	}
+	if restarted.Calls() != 1 {
+		t.Errorf("Expected the restarted replica to serve the call, got %d calls", restarted.Calls())
+	}
+}
+
+// Listeners have their own rpc servers, replicas with the same id don't
+// take each other's calls
+func TestTCPSameID(t *testing.T) {
+	tr := NewTCPTransport()
+	defer tr.Close()
+	addrs := []*ReplicaAddress{NewReplicaAddress("localhost", "57003"), NewReplicaAddress("localhost", "57004")}
+	replicas := []*echoReplica{{}, {}}
+	for i, addr := range addrs {
+		ln, err := tr.Listen(1, addr, replicas[i])
+		if err != nil {
+			t.Fatal("Listen failed:", err)
+		}
+		defer ln.Close()
+	}
+	args := &Message{OperationID: OpID{ClientID: 1, Seq: 7}, Request: &Request{Op: OP_GET, Get: &GetMessage{Key: "a"}}}
+	for i, addr := range addrs {
+		if err := tr.Call(1, addr, "Echo", args, &Message{}); err != nil {
+			t.Fatal("Call failed:", err)
+		}
+		if replicas[i].Calls() != 1 {
+			t.Errorf("Expected replica on %s to serve its call, got %d calls", addr.SpecificString(), replicas[i].Calls())
+		}
+	}
+	if _, err := tr.Listen(2, addrs[0], &echoReplica{}); err == nil {
+		t.Errorf("Expected listening on a port in use to fail")
+	}
+}
+
+func TestNetwork(t *testing.T) {
+	network := NewNetwork()
+	addr := NewReplicaAddress("replica", "1")
+	testTransport(t, network, 1, addr)
+
+	if err := network.Call(1, NewReplicaAddress("nowhere", "1"), "Echo", &Message{}, &Message{}); err == nil {
+		t.Errorf("Expected call to an unknown address to fail")
+	}
+	ln, err := network.Listen(1, addr, &echoReplica{})
+	if err != nil {
+		t.Fatal("Expected address to be free again after close:", err)
+	}
+	defer ln.Close()
+	if _, err := network.Listen(2, addr, &echoReplica{}); err == nil {
+		t.Errorf("Expected second listener on the same address to fail")
+	}
+
+	// Arguments are copies, the caller changing them never reaches the replica
+	replica := &echoReplica{}
+	other := NewReplicaAddress("replica", "2")
+	network.Listen(2, other, replica)
+	args := &Message{Request: &Request{Op: OP_GET, Get: &GetMessage{Key: "a"}}}
+	network.Call(2, other, "Echo", args, &Message{})
+	args.Request.Get.Key = "b"
+	if replica.last.Request.Get.Key != "a" {
+		t.Errorf("Expected replica to keep its own copy of the arguments, got: %s", replica.last.Request.Get.Key)
+	}
+}
+
+func TestFaultyNetwork(t *testing.T) {
+	network := NewFaultyNetwork(1)
+	replica := &echoReplica{}
+	addr := NewReplicaAddress("replica", "1")
+	network.Node(1).Listen(1, addr, replica)
+	client := network.Node(0)
+	args := &Message{Request: &Request{Op: OP_GET, Get: &GetMessage{Key: "a"}}}
+
+	if err := client.Call(1, addr, "Echo", args, &Message{}); err != nil {
+		t.Fatal("Expected delivery without rules:", err)
+	}
+
+	// A reply lost on the way back leaves the reply alone, the call did happen
+	network.SetRule(1, 0, Rule{Drop: 1})
+	reply := &Message{}
+	if err := client.Call(1, addr, "Echo", args, reply); err == nil || reply.Response != nil || replica.Calls() != 2 {
+		t.Errorf("Expected lost reply after the call, got: %v, %+v after %d calls", err, reply, replica.Calls())
+	}
+	network.ClearRule(1, 0)
+
+	network.Partition([]int{0}, []int{1})
+	if err := client.Call(1, addr, "Echo", args, &Message{}); err == nil || replica.Calls() != 2 {
+		t.Errorf("Expected partition to stop the request, got: %v after %d calls", err, replica.Calls())
+	}
+	network.Heal()
+
+	network.SetDefaultRule(Rule{Duplicate: 1, MinDelay: 5 * time.Millisecond, MaxDelay: 10 * time.Millisecond})
+	start := time.Now()
+	if err := client.Call(1, addr, "Echo", args, &Message{}); err != nil {
+		t.Fatal("Expected delayed delivery:", err)
+	}
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+		t.Errorf("Expected request and reply to be delayed, took %v", elapsed)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if replica.Calls() != 4 {
+		t.Errorf("Expected request to be delivered twice, got: %d calls", replica.Calls())
+	}
+}
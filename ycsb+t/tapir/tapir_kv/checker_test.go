@@ -0,0 +1,439 @@
+package tapir_kv
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/pingcap/go-ycsb/tapir/IR"
+	. "github.com/pingcap/go-ycsb/tapir/common"
+	"github.com/pingcap/go-ycsb/tapir/common/sim"
+	"github.com/pingcap/go-ycsb/tapir/common/transport"
+)
+
+// committedTxn is a transaction as seen by the serializability checker
+type committedTxn struct {
+	id     TxnID
+	commit *Timestamp            // commit timestamp
+	reads  map[string]*Timestamp // <key, version read>, nil if the key did not exist
+	writes map[string]string
+}
+
+func newCommittedTxn(txn *Transaction, commit *Timestamp) *committedTxn {
+	reads := make(map[string]*Timestamp)
+	for key := range txn.ReadSet {
+		reads[key] = txn.ReadTime[key]
+	}
+	return &committedTxn{
+		id:     txn.ID,
+		commit: commit,
+		reads:  reads,
+		writes: txn.WriteSet,
+	}
+}
+
+// checkSerializable replays the committed transactions in commit timestamp
+// order, every read must have observed the latest write ordered before it.
+// It returns the final <key, version> state of the replayed history.
+func checkSerializable(history []*committedTxn) (map[string]*Timestamp, error) {
+	ordered := make([]*committedTxn, len(history))
+	copy(ordered, history)
+	sort.Slice(ordered, func(i, j int) bool {
+		return ordered[i].commit.LessThan(ordered[j].commit)
+	})
+
+	latest := make(map[string]*Timestamp)
+	for i, txn := range ordered {
+		if i > 0 && txn.commit.Equals(ordered[i-1].commit) {
+			return nil, fmt.Errorf("transactions %v and %v committed at the same timestamp %v", ordered[i-1].id, txn.id, txn.commit)
+		}
+		for key, version := range txn.reads {
+			expected := latest[key]
+			if (expected == nil) != (version == nil) || (expected != nil && !expected.Equals(version)) {
+				return nil, fmt.Errorf("transaction %v at %v read %s version %v, latest write before it was %v", txn.id, txn.commit, key, version, expected)
+			}
+		}
+		for key := range txn.writes {
+			latest[key] = txn.commit
+		}
+	}
+	return latest, nil
+}
+
+func TestCheckerDetectsStaleRead(t *testing.T) {
+	timestamps := createAscendingTimes(3)
+	writer := &committedTxn{id: tid(1), commit: timestamps[1], reads: map[string]*Timestamp{}, writes: map[string]string{key0: val0}}
+	reader := &committedTxn{id: tid(2), commit: timestamps[2], reads: map[string]*Timestamp{key0: nil}, writes: map[string]string{}}
+
+	if _, err := checkSerializable([]*committedTxn{writer, reader}); err == nil {
+		t.Errorf("Expected checker to reject a read that missed an earlier write")
+	}
+	reader.reads[key0] = timestamps[1]
+	if _, err := checkSerializable([]*committedTxn{reader, writer}); err != nil {
+		t.Errorf("Expected serializable history, got: %v", err)
+	}
+}
+
+// Interleave prepares and commits of many transactions with skewed clocks on
+// one replica, every committed transaction commits at its prepared timestamp.
+func TestReplicaSerializable(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	replica := NewReplica(replica_id)
+	keys := []string{key0, key1, key2, "k3", "k4", "k5", "k6", "k7"}
+	base := time.Now()
+
+	type pending struct {
+		txn       *Transaction
+		timestamp *Timestamp
+		prepared  bool
+	}
+	var active []*pending
+	var history []*committedTxn
+	next_id := 0
+
+	for step := 0; step < 3000; step++ {
+		switch rng.Intn(3) {
+		case 0:
+			// Begin a transaction that reads and writes a few keys
+			next_id++
+			txn := NewTransaction(tid(next_id))
+			for i := 0; i < 2; i++ {
+				key := keys[rng.Intn(len(keys))]
+				val, version, _ := replica.Read(key)
+				txn.AddReadSet(key, val, version)
+			}
+			for i := 0; i < 1+rng.Intn(2); i++ {
+				txn.AddWriteSet(keys[rng.Intn(len(keys))], fmt.Sprintf("%d", next_id))
+			}
+			// Every transaction comes from its own client, clocks are skewed by up to 5ms
+			skew := time.Duration(rng.Intn(10)-5) * time.Millisecond
+			timestamp := NewCustomTimestamp(next_id, base.Add(time.Duration(step)*time.Millisecond+skew))
+			active = append(active, &pending{txn: txn, timestamp: timestamp})
+		case 1:
+			// Prepare a transaction, retrying at the suggested timestamp
+			if len(active) == 0 {
+				continue
+			}
+			i := rng.Intn(len(active))
+			p := active[i]
+			if p.prepared {
+				continue
+			}
+			response, _ := replica.Prepare(p.txn, p.timestamp)
+			for retry := 0; response.Status == RPLY_RETRY && retry < 3; retry++ {
+				p.timestamp = response.Timestamp.Next(p.timestamp.ID)
+				response, _ = replica.Prepare(p.txn, p.timestamp)
+			}
+			if response.Status == RPLY_OK {
+				p.prepared = true
+			} else {
+				replica.Abort(p.txn.ID)
+				active = append(active[:i], active[i+1:]...)
+			}
+		case 2:
+			// Commit a prepared transaction at its prepared timestamp
+			if len(active) == 0 {
+				continue
+			}
+			i := rng.Intn(len(active))
+			p := active[i]
+			if !p.prepared {
+				continue
+			}
+			if err := replica.Commit(p.txn.ID, p.timestamp); err != nil {
+				t.Fatalf("Expected commit of prepared transaction %v, got: %v", p.txn.ID, err)
+			}
+			history = append(history, newCommittedTxn(p.txn, p.timestamp))
+			active = append(active[:i], active[i+1:]...)
+		}
+	}
+
+	if len(history) < 50 {
+		t.Fatalf("Expected a long history, only %d transactions committed", len(history))
+	}
+	latest, err := checkSerializable(history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, version := range latest {
+		_, stored, _ := replica.Read(key)
+		if stored == nil || !stored.Equals(version) {
+			t.Errorf("Expected latest version of %s to be %v, got: %v", key, version, stored)
+		}
+	}
+}
+
+// Many clients begin their transactions with the same sequence numbers and
+// run them against one cluster at once, the history must be serializable
+func TestConcurrentClients(t *testing.T) {
+	replicas := map[int]*ReplicaAddress{
+		1: NewReplicaAddress("replica1", "0"),
+		2: NewReplicaAddress("replica2", "0"),
+		3: NewReplicaAddress("replica3", "0"),
+	}
+	config := NewConfiguration(NewClientConfiguration(1, 1, 1), replicas)
+	config.Transport = transport.NewNetwork()
+	startServers(t, config)
+
+	const clients = 8
+	var mu sync.Mutex
+	var history []*committedTxn
+	var wg sync.WaitGroup
+	for i := 1; i <= clients; i++ {
+		own := *config
+		own.Client = NewClientConfiguration(i, i, 1+i%3)
+		client, _ := NewTapirClient(&own)
+		c := client.(*TapirClientImpl)
+		// Seqs start from the clock, start them all from the same one
+		c.txn_seq = 0
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for seq := 1; seq <= 10; seq++ {
+				txn := c.Begin()
+				txn.Read(key0)
+				txn.Write(key0, txn.ID().String())
+				txn.Write(fmt.Sprintf("client%d", i), txn.ID().String())
+				if txn.Commit() {
+					mu.Lock()
+					history = append(history, newCommittedTxn(txn.txn, txn.commit_ts))
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(history) == 0 {
+		t.Fatal("Expected some transactions to commit")
+	}
+	if _, err := checkSerializable(history); err != nil {
+		t.Fatal(err)
+	}
+	// Every client's last committed write to its own key survived the others
+	latest := make(map[string]TxnID)
+	for _, txn := range history {
+		for key := range txn.writes {
+			if last, ok := latest[key]; key != key0 && (!ok || last.Less(txn.id)) {
+				latest[key] = txn.id
+			}
+		}
+	}
+	reader, _ := NewTapirClient(config)
+	snapshot := reader.BeginReadOnly(nil)
+	for key, id := range latest {
+		if got, err := snapshot.Read(key); err != nil || got != id.String() {
+			t.Errorf("Expected %v for %s, got: %s, %v", id, key, got, err)
+		}
+	}
+	snapshot.Commit()
+}
+
+// One client runs many transactions at once, they neither wait for each
+// other nor share state, and the history must be serializable
+func TestConcurrentTransactions(t *testing.T) {
+	replicas := map[int]*ReplicaAddress{
+		1: NewReplicaAddress("replica1", "0"),
+		2: NewReplicaAddress("replica2", "0"),
+		3: NewReplicaAddress("replica3", "0"),
+	}
+	config := NewConfiguration(NewClientConfiguration(1, 1, 1), replicas)
+	config.Transport = transport.NewNetwork()
+	startServers(t, config)
+	client, _ := NewTapirClient(config)
+
+	// A transaction left open doesn't hold up the others
+	open := client.Begin()
+	open.Write(key1, val1)
+	other := client.Begin()
+	other.Write(key2, val2)
+	if !other.Commit() || !open.Commit() {
+		t.Fatal("Expected overlapping transactions on disjoint keys to commit")
+	}
+	if err := open.Write(key1, val2); err == nil {
+		t.Errorf("Expected write after commit to fail")
+	}
+
+	const workers = 8
+	var mu sync.Mutex
+	var history []*committedTxn
+	var wg sync.WaitGroup
+	for i := 1; i <= workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for seq := 1; seq <= 10; seq++ {
+				txn := client.Begin()
+				txn.Read(key0)
+				txn.Write(key0, txn.ID().String())
+				txn.Write(fmt.Sprintf("worker%d", i), txn.ID().String())
+				if txn.Commit() {
+					mu.Lock()
+					history = append(history, newCommittedTxn(txn.txn, txn.commit_ts))
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(history) == 0 {
+		t.Fatal("Expected some transactions to commit")
+	}
+	ids := make(map[TxnID]bool)
+	for _, txn := range history {
+		if ids[txn.id] {
+			t.Fatalf("Expected every transaction of the client to have its own ID, %v committed twice", txn.id)
+		}
+		ids[txn.id] = true
+	}
+	if _, err := checkSerializable(history); err != nil {
+		t.Fatal(err)
+	}
+	stats := client.Stats()
+	if stats.Committed != len(history)+2 || stats.Committed+stats.Aborted != workers*10+2 {
+		t.Errorf("Expected stats to count every transaction, got: %+v", stats)
+	}
+}
+
+// Clients of a simulated cluster are nodes from simClientNode on
+const simClientNode = 100
+
+var (
+	simSeeds = flag.Int("sim.seeds", 20, "number of seeds TestSimulatedSerializable runs")
+	simSeed  = flag.Int64("sim.seed", 0, "only run this seed of TestSimulatedSerializable, to replay a failure")
+)
+
+// Start n replicas and a few clients on the simulated network, every
+// goroutine of the deployment runs on the simulator's virtual clock
+func startSimCluster(t *testing.T, s *sim.Simulator, n int, clients int) ([]*TapirClientImpl, []*TapirServer) {
+	replicas := make(map[int]*ReplicaAddress)
+	for id := 1; id <= n; id++ {
+		replicas[id] = NewReplicaAddress("replica"+strconv.Itoa(id), "0")
+	}
+	config := NewConfiguration(NewClientConfiguration(1, 1, 1), replicas)
+	config.Clock = s
+	config.GCInterval = 0
+	config.FastPathTimeout = 20 * time.Millisecond
+	config.SlowPathTimeout = 200 * time.Millisecond
+
+	var apps []*TapirServer
+	for id := 1; id <= n; id++ {
+		own := *config
+		own.Transport = s.Network().Node(id)
+		app, _ := NewTapirServerWithConfig(id, &own)
+		if _, err := NewIRReplicaWithConfig(id, &own, app); err != nil {
+			t.Fatal("Failed to start server:", err)
+		}
+		apps = append(apps, app.(*TapirServer))
+	}
+	var result []*TapirClientImpl
+	for i := 0; i < clients; i++ {
+		own := *config
+		own.Client = NewClientConfiguration(simClientNode+i, simClientNode+i, 1+i%n)
+		own.Transport = s.Network().Node(simClientNode + i)
+		client, _ := NewTapirClient(&own)
+		result = append(result, client.(*TapirClientImpl))
+	}
+	return result, apps
+}
+
+// Run random read-write transactions from a few clients over a network
+// that delays, reorders and loses messages. Returns the committed history
+// and the final value of every key on every replica.
+func simulate(t *testing.T, seed int64) ([]*committedTxn, []string) {
+	s := sim.New(seed)
+	defer s.Close()
+	s.Network().SetDefaultRule(transport.Rule{Drop: 0.02, MinDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond})
+	clients, apps := startSimCluster(t, s, 3, 3)
+	keys := []string{key0, key1, key2, "k3"}
+
+	var history []*committedTxn
+	var state []string
+	err := s.Run(func() {
+		rng := s.Rand()
+		done := s.NewSignal()
+		finished := 0
+		for _, client := range clients {
+			s.Go(func() {
+				for i := 0; i < 10; i++ {
+					txn := client.Begin()
+					ok := true
+					for j := 0; j < 1+rng.Intn(2); j++ {
+						if _, err := txn.Read(keys[rng.Intn(len(keys))]); err != nil && !errors.Is(err, ErrKeyNotFound) {
+							ok = false
+						}
+					}
+					txn.Write(keys[rng.Intn(len(keys))], txn.ID().String())
+					if !ok {
+						txn.Abort()
+					} else if txn.Commit() {
+						history = append(history, newCommittedTxn(txn.txn, txn.commit_ts))
+					}
+					s.Sleep(time.Duration(rng.Intn(20)) * time.Millisecond)
+				}
+				finished++
+				done.Notify()
+			})
+		}
+		for finished < len(clients) {
+			done.Wait(0)
+		}
+		// Let the last commits reach every replica
+		s.Sleep(time.Second)
+		for _, app := range apps {
+			for _, key := range keys {
+				val, version, _ := app.store.Read(key)
+				state = append(state, fmt.Sprintf("%s=%s@%v", key, val, version))
+			}
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return history, state
+}
+
+// Drive a simulated cluster from many seeds, every run must be serializable
+// and a seed must replay the same run. Run thousands of seeds with
+// go test -run TestSimulatedSerializable -sim.seeds 5000
+func TestSimulatedSerializable(t *testing.T) {
+	first, last := int64(1), int64(*simSeeds)
+	if testing.Short() {
+		last = 3
+	}
+	if *simSeed != 0 {
+		// Keep the log of a replayed seed
+		first, last = *simSeed, *simSeed
+	} else {
+		log.SetOutput(io.Discard)
+		defer log.SetOutput(os.Stderr)
+	}
+	committed := 0
+	for seed := first; seed <= last; seed++ {
+		history, state := simulate(t, seed)
+		if _, err := checkSerializable(history); err != nil {
+			t.Fatalf("seed %d: %v", seed, err)
+		}
+		committed += len(history)
+		if seed == first {
+			again, replayed := simulate(t, seed)
+			if len(again) != len(history) || !reflect.DeepEqual(state, replayed) {
+				t.Fatalf("seed %d: expected replay to commit %d transactions to %v, got %d to %v", seed, len(history), state, len(again), replayed)
+			}
+		}
+	}
+	if committed == 0 {
+		t.Errorf("Expected some transactions to commit")
+	}
+}
@@ -2,21 +2,76 @@ package tapir_kv
 
 // import "time"
 
+import (
+	"context"
+
+	. "github.com/pingcap/go-ycsb/tapir/common"
+)
+
 // TapirClient represents a client for interacting with the Tapir protocol
 type TapirClient interface {
 
-	// Begin a transaction
-	Begin()
+	// Begin a transaction. Transactions of a client don't wait for each
+	// other, many of them may run at once and share its connections.
+	Begin() *Txn
+
+	// Begin a read-only transaction that reads a consistent snapshot at the
+	// given timestamp, or at the current time if it is nil. It never prepares
+	// and its Commit always succeeds.
+	BeginReadOnly(timestamp *Timestamp) *Txn
+
+	// Run fn in a transaction and commit it, running it again with a random
+	// backoff while the transaction aborts. Returns the number of attempts.
+	// fn must only use the transaction it gets, the error it returns aborts it.
+	RunTxn(ctx context.Context, fn func(txn *Txn) error) (int, error)
+
+	// Counters of committed, aborted and retried transactions.
+	Stats() ClientStats
+
+	// Wait until the commits and aborts of finished transactions are sent,
+	// call it before the process exits.
+	Close()
+}
+
+// TapirTxn is a transaction begun by a TapirClient, used by one goroutine at
+// a time. Every operation has a variant that gives up once its context is
+// done. Errors wrap ErrAborted, ErrRetryExhausted, ErrTimeout or
+// ErrKeyNotFound where they apply, check for them with errors.Is.
+type TapirTxn interface {
+	// ID of the transaction, unique among all clients
+	ID() TxnID
 
-	// Read the value corresponding to key.
+	// Read the value corresponding to key, ErrKeyNotFound if it has none.
 	Read(key string) (string, error)
+	ReadContext(ctx context.Context, key string) (string, error)
+
+	// Read up to count keys at or after startKey in key order, a count of 0
+	// reads every key after it. Writes of the transaction are included. In a
+	// read-write transaction, keys inserted into the scanned range by others
+	// before it commits abort it.
+	Scan(startKey string, count int) ([]*ScanRow, error)
+	ScanContext(ctx context.Context, startKey string, count int) ([]*ScanRow, error)
 
 	// Set the value for the given key.
 	Write(key string, value string) error
+	WriteContext(ctx context.Context, key string, value string) error
 
-	// Commit all Get(s) and Put(s) since Begin().
+	// Commit all Read(s) and Write(s) since Begin(), false if it aborted.
 	Commit() bool
 
-	// Abort all Get(s) and Put(s) since Begin().
+	// Commit all Read(s) and Write(s) since Begin(), nil if it committed.
+	// A transaction that can't commit is aborted, the error tells why.
+	CommitContext(ctx context.Context) error
+
+	// Abort all Read(s) and Write(s) since Begin().
 	Abort()
+	AbortContext(ctx context.Context) error
+}
+
+// ClientStats counts transaction outcomes of a client
+type ClientStats struct {
+	Committed   int // transactions committed
+	Aborted     int // transactions aborted
+	Retries     int // prepares retried with a new timestamp
+	LastRetries int // prepares retried by the most recently finished transaction
 }
@@ -1,27 +1,40 @@
 package tapir_kv
 
-// TapirApp is a table database storing records
+import "context"
+
+// TapirApp is a table database storing records. Operations give up once
+// their context is done, errors of the client such as ErrAborted, ErrTimeout
+// and ErrKeyNotFound are passed through.
 type TapirApp interface {
 	// Read reads a record from the database and returns a map of each field/value pair.
-	Read(table string, key string, fields []string) (map[string][]byte, error)
+	Read(ctx context.Context, table string, key string, fields []string) (map[string][]byte, error)
+
+	// Scan scans count records in key order starting from startKey and returns
+	// a map of the field/value pairs of each of them.
+	Scan(ctx context.Context, table string, startKey string, count int, fields []string) ([]map[string][]byte, error)
 
 	// Update updates a record in the database.
-	Update(table string, key string, values map[string][]byte) error
+	Update(ctx context.Context, table string, key string, values map[string][]byte) error
 
 	// Insert inserts a record into the database.
-	Insert(table string, key string, values map[string][]byte) error
+	Insert(ctx context.Context, table string, key string, values map[string][]byte) error
 
 	// Delete deletes a record from the database.
-	Delete(table string, key string) error
+	Delete(ctx context.Context, table string, key string) error
+
+	// InitThread returns a context for a thread of the app. Start, the
+	// operations and Commit or Abort with it run in the transaction of the
+	// thread, threads run their transactions side by side.
+	InitThread(ctx context.Context) context.Context
 
 	// Start starts a transaction.
-	Start() error
+	Start(ctx context.Context) error
 
 	// Commit commits a transaction.
-	Commit() error
+	Commit(ctx context.Context) error
 
 	// Abort aborts a transaction.
-	Abort() error
+	Abort(ctx context.Context) error
 
 	// Close the application
 	Close()
@@ -1,6 +1,7 @@
 package tapir_kv
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
@@ -13,110 +14,245 @@ import (
 // TapirDB represents the implementation of the TapirApp interface.
 type TapirAppImpl struct {
 	client   TapirClient
-	replicas []IRReplica
+	replicas []IRReplica // replicas the app started itself, stopped on Close
 }
 
-// NewTapirApp creates a new TapirApp instance.
-func NewTapirApp(config *Configuration) TapirApp {
+// Thread of an app, runs one transaction at a time. The table API doesn't
+// say which transaction an operation belongs to, the context of the thread
+// that runs it does.
+type thread struct {
+	txn *Txn // between Start and Commit or Abort
+}
+
+type threadKey struct{}
+
+// NewTapirApp creates a new TapirApp instance, it starts every replica of
+// the configuration in this process.
+func NewTapirApp(config *Configuration) (TapirApp, error) {
 	if config == nil {
 		config = GetConfigB()
 	}
 	var replicas = []IRReplica{}
-	for id, addr := range config.Replicas {
-		store := NewTapirServer(id)
-		replica := NewIRReplica(id, addr, store)
+	stop := func() {
+		for _, replica := range replicas {
+			replica.Stop()
+		}
+	}
+	for id := range config.Replicas {
+		store, err := NewTapirServerWithConfig(id, config)
+		if err != nil {
+			stop()
+			return nil, err
+		}
+		replica, err := NewIRReplicaWithConfig(id, config, store)
+		if err != nil {
+			store.(*TapirServer).Close()
+			stop()
+			return nil, err
+		}
 		replicas = append(replicas, replica)
 		log.Println("ok", replica)
 	}
 
+	app, err := AttachTapirApp(config)
+	if err != nil {
+		stop()
+		return nil, err
+	}
+	app.(*TapirAppImpl).replicas = replicas
+	return app, nil
+}
+
+// AttachTapirApp creates a TapirApp on a cluster that already runs, e.g.
+// replicas started by tapir-replica. config must name the client.
+func AttachTapirApp(config *Configuration) (TapirApp, error) {
+	if config.Client == nil {
+		return nil, errors.New("no client in the configuration")
+	}
 	client, err := NewTapirClient(config)
 	if err != nil {
-		fmt.Println("Error:", err.Error())
-		return nil
+		return nil, err
 	}
-	return &TapirAppImpl{
-		client:   client,
-		replicas: replicas,
+	return &TapirAppImpl{client: client}, nil
+}
+
+// InitThread gives the thread of ctx a transaction of its own
+func (app *TapirAppImpl) InitThread(ctx context.Context) context.Context {
+	return context.WithValue(ctx, threadKey{}, &thread{})
+}
+
+func threadOf(ctx context.Context) (*thread, error) {
+	th, ok := ctx.Value(threadKey{}).(*thread)
+	if !ok {
+		return nil, errors.New("context of no thread, see InitThread")
 	}
+	return th, nil
 }
 
-// Read reads a record from the database and returns a map of each field/value pair.
-func (app *TapirAppImpl) Read(table string, key string, fields []string) (map[string][]byte, error) {
-	val, err := app.client.Read(table + key)
+// Transaction the thread of ctx started
+func txnOf(ctx context.Context) (*Txn, error) {
+	th, err := threadOf(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if th.txn == nil {
+		return nil, errors.New("no transaction started")
+	}
+	return th.txn, nil
+}
 
-	if err != nil || val == "" {
+// Current value of a record, ErrKeyNotFound if it doesn't exist or was deleted
+func (app *TapirAppImpl) get(ctx context.Context, table string, key string) (TableRow, error) {
+	txn, err := txnOf(ctx)
+	if err != nil {
+		return nil, err
+	}
+	val, err := txn.ReadContext(ctx, table+key)
+	if err != nil {
 		return nil, err
 	}
+	if val == "" {
+		return nil, fmt.Errorf("%w: %s was deleted", ErrKeyNotFound, table+key)
+	}
+	return NewTableRow(val), nil
+}
 
-	row := NewTableRow(val)
+// Read reads a record from the database and returns a map of each field/value pair.
+func (app *TapirAppImpl) Read(ctx context.Context, table string, key string, fields []string) (map[string][]byte, error) {
+	row, err := app.get(ctx, table, key)
+	if err != nil {
+		return nil, err
+	}
 	return row.FilterFields(fields)
 }
 
-// Update updates a record in the database.
-func (app *TapirAppImpl) Update(table string, key string, values map[string][]byte) error {
-	val, err := app.client.Read(table + key)
-	var row TableRow = values
+// Scan scans count records in key order starting from startKey and returns
+// a map of the field/value pairs of each of them.
+func (app *TapirAppImpl) Scan(ctx context.Context, table string, startKey string, count int, fields []string) ([]map[string][]byte, error) {
+	txn, err := txnOf(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var result []map[string][]byte
+	next := table + startKey
+	for len(result) < count {
+		// Deleted records take up room in a scan, keep going until count records are found
+		want := count - len(result)
+		rows, err := txn.ScanContext(ctx, next, want)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range rows {
+			if !strings.HasPrefix(r.Key, table) {
+				// Past the last record of the table
+				return result, nil
+			}
+			next = r.Key + "\x00"
+			if r.Value == "" {
+				continue
+			}
+			row, err := NewTableRow(r.Value).FilterFields(fields)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, row)
+		}
+		if len(rows) < want {
+			// No more keys
+			break
+		}
+	}
+	return result, nil
+}
 
-	if err != nil || val == "" {
-		return errors.New("Key to update does not exist, key: " + table + key)
+// Update updates a record in the database.
+func (app *TapirAppImpl) Update(ctx context.Context, table string, key string, values map[string][]byte) error {
+	existingRow, err := app.get(ctx, table, key)
+	if err != nil {
+		return err
 	}
 
 	// Update values
-	existingRow := NewTableRow(val)
-	existingRow.Merge(row)
-	return app.client.Write(table+key, existingRow.String())
+	existingRow.Merge(values)
+	return app.write(ctx, table+key, existingRow.String())
 }
 
 // Insert inserts a record into the database.
-func (app *TapirAppImpl) Insert(table string, key string, values map[string][]byte) error {
-	val, err := app.client.Read(table + key)
-	var row TableRow = values
-
-	if err != nil || val == "" {
+func (app *TapirAppImpl) Insert(ctx context.Context, table string, key string, values map[string][]byte) error {
+	existingRow, err := app.get(ctx, table, key)
+	if errors.Is(err, ErrKeyNotFound) {
 		// Key does not exist, insert the whole row
-		app.client.Write(table+key, row.String())
+		existingRow = make(TableRow)
+	} else if err != nil {
+		return err
 	}
 
 	// If key exists, merge with new values
-	existingRow := NewTableRow(val)
-	existingRow.Merge(row)
-	return app.client.Write(table+key, existingRow.String())
+	existingRow.Merge(values)
+	return app.write(ctx, table+key, existingRow.String())
 }
 
 // Delete deletes a record from the database.
-func (app *TapirAppImpl) Delete(table string, key string) error {
-	val, err := app.client.Read(table + key)
-
-	if err != nil || val == "" {
-		return errors.New("Key to be delete not exist, key: " + table + key)
+func (app *TapirAppImpl) Delete(ctx context.Context, table string, key string) error {
+	if _, err := app.get(ctx, table, key); err != nil {
+		return err
 	}
 	// Zero out the record
-	return app.client.Write(table+key, "")
+	return app.write(ctx, table+key, "")
+}
+
+func (app *TapirAppImpl) write(ctx context.Context, key string, value string) error {
+	txn, err := txnOf(ctx)
+	if err != nil {
+		return err
+	}
+	return txn.WriteContext(ctx, key, value)
 }
 
 // Start starts a transaction.
-func (app *TapirAppImpl) Start() error {
-	app.client.Begin()
+func (app *TapirAppImpl) Start(ctx context.Context) error {
+	th, err := threadOf(ctx)
+	if err != nil {
+		return err
+	}
+	if th.txn != nil {
+		return errors.New(fmt.Sprintf("transaction %v is still running", th.txn.ID()))
+	}
+	th.txn = app.client.Begin()
 	return nil
 }
 
 // Commit commits a transaction.
-func (app *TapirAppImpl) Commit() error {
-	ok := app.client.Commit()
-	if ok {
-		return nil
-	} else {
-		return errors.New("Commit failed.")
+func (app *TapirAppImpl) Commit(ctx context.Context) error {
+	txn, err := finish(ctx)
+	if err != nil {
+		return err
 	}
+	return txn.CommitContext(ctx)
 }
 
 // Abort aborts a transaction.
-func (app *TapirAppImpl) Abort() error {
-	app.client.Abort()
-	return nil
+func (app *TapirAppImpl) Abort(ctx context.Context) error {
+	txn, err := finish(ctx)
+	if err != nil {
+		return err
+	}
+	return txn.AbortContext(ctx)
+}
+
+// Take the transaction of the thread of ctx, the thread may start the next
+func finish(ctx context.Context) (*Txn, error) {
+	txn, err := txnOf(ctx)
+	if err != nil {
+		return nil, err
+	}
+	th, _ := threadOf(ctx)
+	th.txn = nil
+	return txn, nil
 }
 
 func (app *TapirAppImpl) Close() {
+	app.client.Close()
 	for _, replica := range app.replicas {
 		replica.Stop()
 	}
@@ -0,0 +1,721 @@
+package versionstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/pingcap/go-ycsb/tapir/common"
+)
+
+const (
+	versionPrefix  = 'v' // <key, write_time> -> value
+	lastReadPrefix = 'r' // <key, write_time> -> last_read_time
+	scanPrefix     = 's' // <start key, end key> -> last_scan_time
+
+	recordPut        = 1
+	recordDelete     = 2
+	recordHeaderSize = 13 // <kind, key length, value length, crc32>
+	timeSize         = 16 // <nanos, id> of an encoded timestamp
+	signBit          = 1 << 63
+
+	compactMinGarbage = 1 << 20 // rewrite the data file once this many bytes are dead
+)
+
+// Position of a value in the data file
+type location struct {
+	offset int64
+	length int
+}
+
+// DiskVersionedKVStore keeps versions and last reads in an append-only data
+// file. Keys are encoded so that byte order matches <key, timestamp> order,
+// an on-disk index orders them (see diskIndex) and only a bounded part of it
+// is held in memory.
+type DiskVersionedKVStore struct {
+	dir      string
+	data     string // name of the data file in dir
+	file     *os.File
+	size     int64
+	live     int64 // bytes of records still in the index
+	keys     int   // encoded keys in the index
+	fsync    FsyncPolicy
+	index    *diskIndex
+	nextData int // generation of the data file the next compaction writes
+	lock     sync.Mutex
+	dirty    bool // appended since the last fsync
+	closed   bool
+	stopped  Signal // stops background fsyncs
+
+	compactMinGarbage int64
+}
+
+// What the runs of the index cover, replaced atomically whenever they change
+type storeManifest struct {
+	Data     string // data file
+	Runs     []int  // runs of the index, oldest first
+	NextRun  int
+	NextData int
+	Covered  int64 // records of the data file before this offset are in the runs
+	Live     int64
+	Keys     int
+}
+
+// NewDiskVersionedKVStore opens the data file in dir, creating it if needed
+func NewDiskVersionedKVStore(dir string, storage *StorageConfiguration, clock Clock) (VersionedKVStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	manifest, err := loadManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	removeStale(dir, manifest)
+	file, err := os.OpenFile(filepath.Join(dir, manifest.Data), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	index, err := openIndex(dir, manifest.Runs, manifest.NextRun)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	vs := &DiskVersionedKVStore{
+		dir:      dir,
+		data:     manifest.Data,
+		file:     file,
+		live:     manifest.Live,
+		keys:     manifest.Keys,
+		fsync:    storage.Fsync,
+		index:    index,
+		nextData: manifest.NextData,
+		stopped:  clock.NewSignal(),
+
+		compactMinGarbage: compactMinGarbage,
+	}
+	if err := vs.load(manifest.Covered); err != nil {
+		index.close()
+		file.Close()
+		return nil, err
+	}
+	log.Println("Loaded", vs.keys, "keys from", dir)
+
+	if vs.fsync == FSYNC_INTERVAL {
+		interval := storage.FsyncInterval
+		if interval <= 0 {
+			interval = DefaultFsyncInterval
+		}
+		clock.Go(func() { vs.syncLoop(interval) })
+	}
+	return vs, nil
+}
+
+func (vs *DiskVersionedKVStore) Get(key string) (*VersionedValue, bool) {
+	vs.lock.Lock()
+	defer vs.lock.Unlock()
+	prefix := keyPrefix(versionPrefix, key)
+	return vs.versionAt(prefix, prefix+strings.Repeat("\xff", timeSize+1))
+}
+
+func (vs *DiskVersionedKVStore) GetAt(key string, time *Timestamp) (*VersionedValue, bool) {
+	vs.lock.Lock()
+	defer vs.lock.Unlock()
+	return vs.getValue(key, time)
+}
+
+func (vs *DiskVersionedKVStore) Scan(startKey string, count int, time *Timestamp) []*KeyVersion {
+	vs.lock.Lock()
+	defer vs.lock.Unlock()
+	var result []*KeyVersion
+	it := vs.index.iterate(keyPrefix(versionPrefix, startKey))
+	for it.valid && it.current.key[0] == versionPrefix && (count <= 0 || len(result) < count) {
+		encoded := it.current.key
+		prefix := encoded[:len(encoded)-timeSize]
+		last := prefix + strings.Repeat("\xff", timeSize+1)
+		bound := last
+		if time != nil {
+			bound = prefix + string(encodeTime(time))
+		}
+		if versionedVal, ok := vs.versionAt(prefix, bound); ok {
+			key, _ := decodeKey(prefix[1:])
+			result = append(result, &KeyVersion{Key: key, VersionedValue: versionedVal})
+		}
+		// Versions of a key are next to each other, skip to the next key
+		it.seek(last)
+	}
+	return result
+}
+
+func (vs *DiskVersionedKVStore) Put(key string, value string, time *Timestamp) {
+	log.Println("Commiting to disk KV: ", key, value)
+	vs.lock.Lock()
+	defer vs.lock.Unlock()
+	vs.append(encodeKey(versionPrefix, key, time), []byte(value))
+}
+
+func (vs *DiskVersionedKVStore) CommitGet(key string, readTime *Timestamp, commitTime *Timestamp) {
+	vs.lock.Lock()
+	defer vs.lock.Unlock()
+	k := encodeKey(lastReadPrefix, key, readTime)
+	lastRead, ok := vs.readTime(k)
+	if ok && !lastRead.LessThan(commitTime) {
+		return
+	}
+	vs.append(k, encodeTime(commitTime))
+}
+
+func (vs *DiskVersionedKVStore) CommitScan(startKey string, endKey string, commitTime *Timestamp) {
+	vs.lock.Lock()
+	defer vs.lock.Unlock()
+	k := keyPrefix(scanPrefix, startKey) + keyPrefix(scanPrefix, endKey)[1:]
+	lastScan, ok := vs.readTime(k)
+	if ok && !lastScan.LessThan(commitTime) {
+		return
+	}
+	vs.append(k, encodeTime(commitTime))
+}
+
+func (vs *DiskVersionedKVStore) GetLastScan(key string) (*Timestamp, bool) {
+	vs.lock.Lock()
+	defer vs.lock.Unlock()
+	var lastScan *Timestamp
+	// Scans are ordered by their start key
+	for it := vs.index.iterate(string(scanPrefix)); it.valid && it.current.key[0] == scanPrefix; it.next() {
+		start, rest := decodeKey(it.current.key[1:])
+		if start > key {
+			break
+		}
+		end, _ := decodeKey(rest)
+		if end == "" || key <= end {
+			lastScan = LaterTime(lastScan, vs.timeAt(it.current.loc))
+		}
+	}
+	return lastScan, lastScan != nil
+}
+
+func (vs *DiskVersionedKVStore) GetLastRead(key string, time *Timestamp) (*Timestamp, bool) {
+	vs.lock.Lock()
+	defer vs.lock.Unlock()
+	var writeTime *Timestamp
+	if versionedVal, ok := vs.getValue(key, time); ok {
+		writeTime = versionedVal.WriteTime
+	}
+	return vs.readTime(encodeKey(lastReadPrefix, key, writeTime))
+}
+
+func (vs *DiskVersionedKVStore) GetRange(key string, time *Timestamp) (*Timestamp, *Timestamp, bool) {
+	vs.lock.Lock()
+	defer vs.lock.Unlock()
+	prefix := keyPrefix(versionPrefix, key)
+	entry, ok := vs.index.floor(encodeKey(versionPrefix, key, time))
+	if !ok || !strings.HasPrefix(entry.key, prefix) {
+		return EmptyTime(), EmptyTime(), false
+	}
+	endTime := EmptyTime()
+	it := vs.index.iterate(entry.key)
+	if it.next(); it.valid && strings.HasPrefix(it.current.key, prefix) {
+		endTime = decodeTime([]byte(it.current.key[len(prefix):]))
+	}
+	return decodeTime([]byte(entry.key[len(prefix):])), endTime, true
+}
+
+func (vs *DiskVersionedKVStore) CollectGarbage(watermark *Timestamp) (int, int) {
+	vs.lock.Lock()
+	defer vs.lock.Unlock()
+	removed := make(map[string]bool)
+	versions, reads := 0, 0
+
+	// Versions of a key are next to each other in key order, keep the one
+	// valid at the watermark and everything after it
+	var prefix string
+	var older []string // versions of the current key at or before the watermark
+	flush := func() {
+		for i := 0; i < len(older)-1; i++ {
+			removed[older[i]] = true
+			versions++
+			lastRead := string(lastReadPrefix) + older[i][1:]
+			if _, ok := vs.index.get(lastRead); ok {
+				removed[lastRead] = true
+				reads++
+			}
+		}
+		older = older[:0]
+	}
+	for it := vs.index.iterate(string(versionPrefix)); it.valid && it.current.key[0] == versionPrefix; it.next() {
+		encoded := it.current.key
+		p := encoded[:len(encoded)-timeSize]
+		if p != prefix {
+			flush()
+			prefix = p
+		}
+		if !watermark.LessThan(decodeTime([]byte(encoded[len(p):]))) {
+			older = append(older, encoded)
+		}
+	}
+	flush()
+
+	// Last reads and scans are next to each other, before the versions
+	for it := vs.index.iterate(string(lastReadPrefix)); it.valid && it.current.key[0] <= scanPrefix; it.next() {
+		if removed[it.current.key] {
+			continue
+		}
+		// No write at or after the watermark can be ordered before this read or scan
+		if vs.timeAt(it.current.loc).LessThan(watermark) {
+			removed[it.current.key] = true
+			reads++
+		}
+	}
+	vs.remove(removed)
+
+	if garbage := vs.size - vs.live; garbage >= vs.compactMinGarbage && garbage > vs.live {
+		if err := vs.compact(); err != nil {
+			log.Println("Error compacting store data", err)
+		}
+	}
+	return versions, reads
+}
+
+func (vs *DiskVersionedKVStore) Snapshot() *StoreSnapshot {
+	vs.lock.Lock()
+	defer vs.lock.Unlock()
+	snapshot := &StoreSnapshot{}
+	for it := vs.index.iterate(""); it.valid; it.next() {
+		encoded := it.current.key
+		value, err := vs.readValue(it.current.loc)
+		if err != nil {
+			log.Panicf("Error reading store data: %v", err)
+		}
+		switch encoded[0] {
+		case versionPrefix, lastReadPrefix:
+			key, rest := decodeKey(encoded[1:])
+			writeTime := decodeTime([]byte(rest))
+			if encoded[0] == versionPrefix {
+				snapshot.Versions = append(snapshot.Versions, &KeyVersion{Key: key, VersionedValue: &VersionedValue{WriteTime: writeTime, Value: string(value)}})
+			} else {
+				snapshot.Reads = append(snapshot.Reads, &StoreRead{Key: key, Version: timeOf(versionOf(writeTime)), ReadTime: decodeTime(value)})
+			}
+		case scanPrefix:
+			start, rest := decodeKey(encoded[1:])
+			end, _ := decodeKey(rest)
+			snapshot.Scans = append(snapshot.Scans, &StoreScan{Range: KeyRange{Start: start, End: end}, ScanTime: decodeTime(value)})
+		}
+	}
+	return snapshot
+}
+
+func (vs *DiskVersionedKVStore) Restore(snapshot *StoreSnapshot) {
+	restore(vs, snapshot)
+}
+
+// Rewrite the data file with only the records in the index, and the index
+// as a single run. Must hold vs.lock.
+func (vs *DiskVersionedKVStore) compact() error {
+	name := fmt.Sprintf("data.%d", vs.nextData)
+	file, err := os.OpenFile(filepath.Join(vs.dir, name), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	index, err := openIndex(vs.dir, nil, vs.index.nextRun)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	w, err := index.newRun()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	var size int64
+	for it := vs.index.iterate(""); it.valid; it.next() {
+		value, err := vs.readValue(it.current.loc)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		loc := vs.writeRecord(file, size, recordPut, it.current.key, value)
+		size += recordSize(it.current.key, len(value))
+		w.add(indexEntry{key: it.current.key, loc: loc})
+	}
+	run, err := w.finish()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	index.runs = []*indexRun{run}
+	if err := file.Sync(); err != nil {
+		index.close()
+		file.Close()
+		return err
+	}
+	manifest := &storeManifest{Data: name, Runs: index.runIDs(), NextRun: index.nextRun, NextData: vs.nextData + 1, Covered: size, Live: size, Keys: vs.keys}
+	if err := saveManifest(vs.dir, manifest); err != nil {
+		index.close()
+		file.Close()
+		return err
+	}
+	log.Println("Compacted store data from", vs.size, "to", size, "bytes")
+	vs.file.Close()
+	if err := os.Remove(filepath.Join(vs.dir, vs.data)); err != nil {
+		log.Println("Error removing old store data", err)
+	}
+	vs.index.removeRuns(vs.index.runs)
+	vs.data = name
+	vs.file = file
+	vs.index = index
+	vs.nextData++
+	vs.size = size
+	vs.live = size
+	vs.dirty = false
+	return nil
+}
+
+func (vs *DiskVersionedKVStore) Close() error {
+	vs.lock.Lock()
+	defer vs.lock.Unlock()
+	if vs.closed {
+		return nil
+	}
+	vs.closed = true
+	vs.stopped.Notify()
+	err := vs.syncLocked()
+	if e := vs.index.close(); err == nil {
+		err = e
+	}
+	if e := vs.file.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// Return <value, write_time> valid at the given timestamp, must hold vs.lock
+func (vs *DiskVersionedKVStore) getValue(key string, validTime *Timestamp) (*VersionedValue, bool) {
+	return vs.versionAt(keyPrefix(versionPrefix, key), encodeKey(versionPrefix, key, validTime))
+}
+
+// The latest version under prefix that is at or before the encoded key, must hold vs.lock
+func (vs *DiskVersionedKVStore) versionAt(prefix string, encoded string) (*VersionedValue, bool) {
+	entry, ok := vs.index.floor(encoded)
+	if !ok || !strings.HasPrefix(entry.key, prefix) {
+		return EmptyEntry(), false
+	}
+	value, err := vs.readValue(entry.loc)
+	if err != nil {
+		log.Panicf("Error reading store data: %v", err)
+	}
+	return &VersionedValue{
+		WriteTime: decodeTime([]byte(entry.key[len(prefix):])),
+		Value:     string(value),
+	}, true
+}
+
+// Must hold vs.lock
+func (vs *DiskVersionedKVStore) readTime(encoded string) (*Timestamp, bool) {
+	loc, ok := vs.index.get(encoded)
+	if !ok {
+		return nil, false
+	}
+	return vs.timeAt(loc), true
+}
+
+// The timestamp stored at loc, must hold vs.lock
+func (vs *DiskVersionedKVStore) timeAt(loc location) *Timestamp {
+	value, err := vs.readValue(loc)
+	if err != nil {
+		log.Panicf("Error reading store data: %v", err)
+	}
+	return decodeTime(value)
+}
+
+func (vs *DiskVersionedKVStore) readValue(loc location) ([]byte, error) {
+	value := make([]byte, loc.length)
+	_, err := vs.file.ReadAt(value, loc.offset)
+	return value, err
+}
+
+// Write a record to the end of the data file and index it, must hold vs.lock
+func (vs *DiskVersionedKVStore) append(encoded string, value []byte) {
+	loc := vs.writeRecord(vs.file, vs.size, recordPut, encoded, value)
+	vs.size += recordSize(encoded, loc.length)
+	if err := vs.apply(indexEntry{key: encoded, loc: loc}, vs.size); err != nil {
+		log.Panicf("Error writing store index: %v", err)
+	}
+}
+
+// Write a tombstone for every encoded key and drop them from the index, must hold vs.lock
+func (vs *DiskVersionedKVStore) remove(removed map[string]bool) {
+	for encoded := range removed {
+		vs.writeRecord(vs.file, vs.size, recordDelete, encoded, nil)
+		vs.size += recordSize(encoded, 0)
+		if err := vs.apply(indexEntry{key: encoded, deleted: true}, vs.size); err != nil {
+			log.Panicf("Error writing store index: %v", err)
+		}
+	}
+}
+
+// Index a record of the data file that ends before covered, and write the
+// index out once the memtable is full. Must hold vs.lock.
+func (vs *DiskVersionedKVStore) apply(entry indexEntry, covered int64) error {
+	if old, ok := vs.index.get(entry.key); ok {
+		vs.live -= recordSize(entry.key, old.length)
+	} else if !entry.deleted {
+		vs.keys++
+	} else {
+		return nil
+	}
+	if entry.deleted {
+		vs.keys--
+	} else {
+		vs.live += recordSize(entry.key, entry.loc.length)
+	}
+	if !vs.index.set(entry) {
+		return nil
+	}
+	// The runs must not point past what is durable in the data file
+	if err := vs.file.Sync(); err != nil {
+		return err
+	}
+	merged, err := vs.index.flush()
+	if err != nil {
+		return err
+	}
+	manifest := &storeManifest{Data: vs.data, Runs: vs.index.runIDs(), NextRun: vs.index.nextRun, NextData: vs.nextData, Covered: covered, Live: vs.live, Keys: vs.keys}
+	if err := saveManifest(vs.dir, manifest); err != nil {
+		return err
+	}
+	vs.index.removeRuns(merged)
+	return nil
+}
+
+// Write a record at the given offset of file and return where its value is
+func (vs *DiskVersionedKVStore) writeRecord(file *os.File, offset int64, kind byte, encoded string, value []byte) location {
+	if vs.closed {
+		log.Panicf("Write to closed store")
+	}
+	record := make([]byte, recordSize(encoded, len(value)))
+	record[0] = kind
+	binary.LittleEndian.PutUint32(record[1:5], uint32(len(encoded)))
+	binary.LittleEndian.PutUint32(record[5:9], uint32(len(value)))
+	copy(record[recordHeaderSize:], encoded)
+	copy(record[recordHeaderSize+len(encoded):], value)
+	binary.LittleEndian.PutUint32(record[9:13], recordChecksum(record))
+	if _, err := file.WriteAt(record, offset); err != nil {
+		log.Panicf("Error writing store data: %v", err)
+	}
+	if file == vs.file {
+		vs.dirty = true
+		if vs.fsync == FSYNC_ALWAYS {
+			if err := vs.syncLocked(); err != nil {
+				log.Panicf("Error syncing store data: %v", err)
+			}
+		}
+	}
+	return location{offset: offset + int64(recordHeaderSize+len(encoded)), length: len(value)}
+}
+
+func recordSize(encoded string, valueLen int) int64 {
+	return int64(recordHeaderSize + len(encoded) + valueLen)
+}
+
+// Index the records the runs don't cover yet, cutting off a torn record at
+// the end of the data file
+func (vs *DiskVersionedKVStore) load(covered int64) error {
+	info, err := vs.file.Stat()
+	if err != nil {
+		return err
+	}
+	header := make([]byte, recordHeaderSize)
+	offset := covered
+	for offset+recordHeaderSize <= info.Size() {
+		if _, err := vs.file.ReadAt(header, offset); err != nil {
+			return err
+		}
+		keyLen := int64(binary.LittleEndian.Uint32(header[1:5]))
+		valueLen := int64(binary.LittleEndian.Uint32(header[5:9]))
+		end := offset + recordHeaderSize + keyLen + valueLen
+		if (header[0] != recordPut && header[0] != recordDelete) || end > info.Size() {
+			break
+		}
+		record := make([]byte, end-offset)
+		if _, err := vs.file.ReadAt(record, offset); err != nil {
+			return err
+		}
+		if recordChecksum(record) != binary.LittleEndian.Uint32(header[9:13]) {
+			break
+		}
+		entry := indexEntry{key: string(record[recordHeaderSize : recordHeaderSize+keyLen]), deleted: header[0] == recordDelete}
+		if !entry.deleted {
+			entry.loc = location{offset: offset + recordHeaderSize + keyLen, length: int(valueLen)}
+		}
+		if err := vs.apply(entry, end); err != nil {
+			return err
+		}
+		offset = end
+	}
+	if offset != info.Size() {
+		log.Println("Dropping", info.Size()-offset, "bytes of torn store data")
+		if err := vs.file.Truncate(offset); err != nil {
+			return err
+		}
+	}
+	vs.size = offset
+	return nil
+}
+
+// Read the manifest of the store in dir. A store without one has all of
+// its records in the data file.
+func loadManifest(dir string) (*storeManifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "manifest"))
+	if os.IsNotExist(err) {
+		return &storeManifest{Data: "data"}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var manifest storeManifest
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("decoding store manifest in %s: %w", dir, err)
+	}
+	return &manifest, nil
+}
+
+// Replace the manifest of the store in dir atomically
+func saveManifest(dir string, manifest *storeManifest) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(manifest); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, "manifest")
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(buf.Bytes()); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Remove the runs and data files the manifest doesn't name, a crash left
+// them behind
+func removeStale(dir string, manifest *storeManifest) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	keep := map[string]bool{manifest.Data: true}
+	for _, id := range manifest.Runs {
+		keep[filepath.Base(runPath(dir, id))] = true
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !keep[name] && (name == "data" || strings.HasPrefix(name, "index.") || strings.HasPrefix(name, "data.")) {
+			if err := os.Remove(filepath.Join(dir, name)); err != nil {
+				log.Println("Error removing stale store file", name, err)
+			}
+		}
+	}
+}
+
+// Must hold vs.lock
+func (vs *DiskVersionedKVStore) syncLocked() error {
+	if !vs.dirty || vs.fsync == FSYNC_NEVER {
+		return nil
+	}
+	vs.dirty = false
+	return vs.file.Sync()
+}
+
+func (vs *DiskVersionedKVStore) syncLoop(interval time.Duration) {
+	for !vs.stopped.Wait(interval) {
+		vs.lock.Lock()
+		if err := vs.syncLocked(); err != nil {
+			log.Println("Error syncing store data", err)
+		}
+		vs.lock.Unlock()
+	}
+}
+
+func (vs *DiskVersionedKVStore) String() string {
+	vs.lock.Lock()
+	defer vs.lock.Unlock()
+	return fmt.Sprintf("DiskVersionedKVStore: %d keys, %d bytes", vs.keys, vs.size)
+}
+
+// Checksum of a record, skipping the checksum field itself
+func recordChecksum(record []byte) uint32 {
+	crc := crc32.ChecksumIEEE(record[:9])
+	return crc32.Update(crc, crc32.IEEETable, record[recordHeaderSize:])
+}
+
+// Escape key so that no encoded key is a prefix of another one and byte order
+// of encoded keys matches the order of the keys
+func keyPrefix(prefix byte, key string) string {
+	var b strings.Builder
+	b.WriteByte(prefix)
+	for i := 0; i < len(key); i++ {
+		if key[i] == 0 {
+			b.WriteString("\x00\xff")
+		} else {
+			b.WriteByte(key[i])
+		}
+	}
+	b.WriteString("\x00\x01")
+	return b.String()
+}
+
+// Undo the escaping of keyPrefix, returns the key and what follows it
+func decodeKey(escaped string) (string, string) {
+	var b strings.Builder
+	for i := 0; i+1 < len(escaped); i++ {
+		if escaped[i] != 0 {
+			b.WriteByte(escaped[i])
+			continue
+		}
+		if escaped[i+1] == 0x01 {
+			return b.String(), escaped[i+2:]
+		}
+		b.WriteByte(0)
+		i++
+	}
+	log.Panicf("Invalid encoded key %q", escaped)
+	return "", ""
+}
+
+// Encoded <key, timestamp>, a nil timestamp stands for reads of a key before its first write
+func encodeKey(prefix byte, key string, t *Timestamp) string {
+	return keyPrefix(prefix, key) + string(encodeTime(t))
+}
+
+// Big endian <nanos, id> with the sign bits flipped, so byte order is timestamp order
+func encodeTime(t *Timestamp) []byte {
+	v := versionOf(t)
+	b := make([]byte, timeSize)
+	binary.BigEndian.PutUint64(b[0:8], uint64(v.nanos)^signBit)
+	binary.BigEndian.PutUint64(b[8:16], uint64(int64(v.id))^signBit)
+	return b
+}
+
+func decodeTime(b []byte) *Timestamp {
+	if len(b) != timeSize {
+		log.Panicf("Invalid encoded timestamp %v", b)
+	}
+	nanos := int64(binary.BigEndian.Uint64(b[0:8]) ^ signBit)
+	id := int(int64(binary.BigEndian.Uint64(b[8:16]) ^ signBit))
+	return NewCustomTimestamp(id, time.Unix(0, nanos))
+}
@@ -0,0 +1,616 @@
+package versionstore
+
+import (
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	indexBlockSize   = 4096    // bytes of entries in a block of a run
+	memtableEntries  = 1 << 14 // entries the index holds in memory before it writes a run
+	blockCacheBlocks = 256     // decoded blocks of runs kept in memory
+	runFooterSize    = 20      // <block index offset, entries, crc32 of the block index>
+	blockTrailerSize = 4       // crc32 of the entries of a block
+)
+
+// Entry of the index, where the record of an encoded key is in the data file
+type indexEntry struct {
+	key     string
+	loc     location
+	deleted bool // the key was removed, hides it in older runs
+}
+
+// diskIndex maps encoded keys to their records in the data file in key
+// order. Entries go to a sorted memtable, which is written out as an
+// immutable run once it is full. Runs are merged so there are about log(n)
+// of them, a run keeps the first key of each of its blocks in memory and
+// blocks are read through a bounded cache.
+type diskIndex struct {
+	dir      string
+	memtable []indexEntry // ascending
+	runs     []*indexRun  // oldest first, newer runs hide entries of older ones
+	cache    *blockCache
+	nextRun  int // id of the next run written
+
+	memtableEntries int
+}
+
+// Immutable sorted run of index entries in its own file
+type indexRun struct {
+	id     int
+	file   *os.File
+	count  int           // entries in the run
+	blocks []blockHandle // ascending
+}
+
+type blockHandle struct {
+	first  string // key of the first entry of the block
+	offset int64
+	size   int // with the trailer
+}
+
+func runPath(dir string, id int) string {
+	return filepath.Join(dir, fmt.Sprintf("index.%d", id))
+}
+
+// Open the runs of an index in dir, oldest first
+func openIndex(dir string, runs []int, nextRun int) (*diskIndex, error) {
+	ix := &diskIndex{
+		dir:             dir,
+		cache:           newBlockCache(blockCacheBlocks),
+		nextRun:         nextRun,
+		memtableEntries: memtableEntries,
+	}
+	for _, id := range runs {
+		run, err := openRun(dir, id)
+		if err != nil {
+			ix.close()
+			return nil, err
+		}
+		ix.runs = append(ix.runs, run)
+	}
+	return ix, nil
+}
+
+func (ix *diskIndex) close() error {
+	var err error
+	for _, run := range ix.runs {
+		if e := run.file.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Ids of the runs, oldest first
+func (ix *diskIndex) runIDs() []int {
+	ids := make([]int, 0, len(ix.runs))
+	for _, run := range ix.runs {
+		ids = append(ids, run.id)
+	}
+	return ids
+}
+
+// Point the key at a record, or remove it. Returns whether the memtable is
+// full and should be flushed.
+func (ix *diskIndex) set(entry indexEntry) bool {
+	i := sort.Search(len(ix.memtable), func(i int) bool { return ix.memtable[i].key >= entry.key })
+	if i < len(ix.memtable) && ix.memtable[i].key == entry.key {
+		ix.memtable[i] = entry
+	} else {
+		ix.memtable = append(ix.memtable, indexEntry{})
+		copy(ix.memtable[i+1:], ix.memtable[i:])
+		ix.memtable[i] = entry
+	}
+	return len(ix.memtable) >= ix.memtableEntries
+}
+
+// Record of the key, if the index has it
+func (ix *diskIndex) get(key string) (location, bool) {
+	for _, source := range ix.sources() {
+		if entry, ok := source.floor(key, true); ok && entry.key == key {
+			return entry.loc, !entry.deleted
+		}
+	}
+	return location{}, false
+}
+
+// The greatest key at or before key that is not removed
+func (ix *diskIndex) floor(key string) (indexEntry, bool) {
+	sources := ix.sources()
+	inclusive := true
+	for {
+		var best indexEntry
+		found := false
+		for _, source := range sources {
+			// Sources are newest first, the newest entry of a key wins
+			if entry, ok := source.floor(key, inclusive); ok && (!found || entry.key > best.key) {
+				best, found = entry, true
+			}
+		}
+		if !found {
+			return indexEntry{}, false
+		}
+		if !best.deleted {
+			return best, true
+		}
+		key, inclusive = best.key, false
+	}
+}
+
+// Iterator over the keys at or after start. It is invalid once the index
+// changes.
+func (ix *diskIndex) iterate(start string) *indexIterator {
+	it := &indexIterator{sources: ix.sources()}
+	it.seek(start)
+	return it
+}
+
+// Memtable and runs, newest first
+func (ix *diskIndex) sources() []entrySource {
+	sources := []entrySource{&memSource{entries: ix.memtable}}
+	for i := len(ix.runs) - 1; i >= 0; i-- {
+		sources = append(sources, &runSource{ix: ix, run: ix.runs[i]})
+	}
+	return sources
+}
+
+// Write the memtable out as a new run and merge runs of similar size.
+// Returns the runs merged away, their files can go once nothing refers to
+// them anymore.
+func (ix *diskIndex) flush() ([]*indexRun, error) {
+	if len(ix.memtable) > 0 {
+		w, err := ix.newRun()
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range ix.memtable {
+			// Nothing older is left to hide
+			if !entry.deleted || len(ix.runs) > 0 {
+				w.add(entry)
+			}
+		}
+		run, err := w.finish()
+		if err != nil {
+			return nil, err
+		}
+		if run.count > 0 {
+			ix.runs = append(ix.runs, run)
+		} else {
+			ix.removeRuns([]*indexRun{run})
+		}
+		ix.memtable = nil
+	}
+	var merged []*indexRun
+	for n := len(ix.runs); n >= 2 && ix.runs[n-2].count <= ix.runs[n-1].count; n = len(ix.runs) {
+		run, err := ix.mergeRuns(n - 2)
+		if err != nil {
+			return merged, err
+		}
+		merged = append(merged, ix.runs[n-2:]...)
+		ix.runs = append(ix.runs[:n-2], run)
+	}
+	return merged, nil
+}
+
+// Merge the runs from the given one on into a new run
+func (ix *diskIndex) mergeRuns(from int) (*indexRun, error) {
+	it := &indexIterator{tombstones: from > 0}
+	for i := len(ix.runs) - 1; i >= from; i-- {
+		it.sources = append(it.sources, &runSource{ix: ix, run: ix.runs[i]})
+	}
+	it.seek("")
+	w, err := ix.newRun()
+	if err != nil {
+		return nil, err
+	}
+	for ; it.valid; it.next() {
+		w.add(it.current)
+	}
+	return w.finish()
+}
+
+// Drop runs from the cache and delete their files
+func (ix *diskIndex) removeRuns(runs []*indexRun) {
+	for _, run := range runs {
+		ix.cache.drop(run.id)
+		run.file.Close()
+		if err := os.Remove(runPath(ix.dir, run.id)); err != nil {
+			log.Println("Error removing index run", run.id, err)
+		}
+	}
+}
+
+// Writes the entries of a run in ascending order
+type runWriter struct {
+	id     int
+	file   *os.File
+	offset int64
+	block  []byte
+	first  string
+	count  int
+	blocks []blockHandle
+	err    error // of the first write that failed
+}
+
+func (ix *diskIndex) newRun() (*runWriter, error) {
+	id := ix.nextRun
+	ix.nextRun++
+	file, err := os.OpenFile(runPath(ix.dir, id), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &runWriter{id: id, file: file}, nil
+}
+
+func (w *runWriter) add(entry indexEntry) {
+	if len(w.block) == 0 {
+		w.first = entry.key
+	}
+	w.block = appendEntry(w.block, entry)
+	w.count++
+	if len(w.block) >= indexBlockSize {
+		w.finishBlock()
+	}
+}
+
+func (w *runWriter) finishBlock() {
+	if len(w.block) == 0 {
+		return
+	}
+	w.block = binary.LittleEndian.AppendUint32(w.block, crc32.ChecksumIEEE(w.block))
+	w.blocks = append(w.blocks, blockHandle{first: w.first, offset: w.offset, size: len(w.block)})
+	w.offset += int64(len(w.block))
+	w.write(w.block)
+	w.block = w.block[:0]
+}
+
+// Keeps the error of a failed write for finish
+func (w *runWriter) write(b []byte) {
+	if w.err == nil {
+		_, w.err = w.file.Write(b)
+	}
+}
+
+// Write the block index and footer and sync the run
+func (w *runWriter) finish() (*indexRun, error) {
+	w.finishBlock()
+	var index []byte
+	for _, handle := range w.blocks {
+		index = binary.AppendUvarint(index, uint64(len(handle.first)))
+		index = append(index, handle.first...)
+		index = binary.AppendUvarint(index, uint64(handle.offset))
+		index = binary.AppendUvarint(index, uint64(handle.size))
+	}
+	footer := binary.LittleEndian.AppendUint64(nil, uint64(w.offset))
+	footer = binary.LittleEndian.AppendUint64(footer, uint64(w.count))
+	footer = binary.LittleEndian.AppendUint32(footer, crc32.ChecksumIEEE(index))
+	w.write(index)
+	w.write(footer)
+	if w.err == nil {
+		w.err = w.file.Sync()
+	}
+	if w.err != nil {
+		w.file.Close()
+		return nil, w.err
+	}
+	return &indexRun{id: w.id, file: w.file, count: w.count, blocks: w.blocks}, nil
+}
+
+// Open a run and read its block index
+func openRun(dir string, id int) (*indexRun, error) {
+	file, err := os.OpenFile(runPath(dir, id), os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	run, err := readRun(file, id)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("index run %d: %w", id, err)
+	}
+	return run, nil
+}
+
+func readRun(file *os.File, id int) (*indexRun, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < runFooterSize {
+		return nil, errors.New("missing footer")
+	}
+	footer := make([]byte, runFooterSize)
+	if _, err := file.ReadAt(footer, info.Size()-runFooterSize); err != nil {
+		return nil, err
+	}
+	indexOffset := int64(binary.LittleEndian.Uint64(footer[0:8]))
+	if indexOffset < 0 || indexOffset > info.Size()-runFooterSize {
+		return nil, errors.New(fmt.Sprintf("block index at %d is outside the run", indexOffset))
+	}
+	index := make([]byte, info.Size()-runFooterSize-indexOffset)
+	if _, err := file.ReadAt(index, indexOffset); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(index) != binary.LittleEndian.Uint32(footer[16:20]) {
+		return nil, errors.New("corrupt block index")
+	}
+	run := &indexRun{id: id, file: file, count: int(binary.LittleEndian.Uint64(footer[8:16]))}
+	for len(index) > 0 {
+		var first string
+		var offset, size uint64
+		var ok bool
+		if first, index, ok = readString(index); ok {
+			if offset, index, ok = readUvarint(index); ok {
+				size, index, ok = readUvarint(index)
+			}
+		}
+		if !ok {
+			return nil, errors.New("corrupt block index")
+		}
+		run.blocks = append(run.blocks, blockHandle{first: first, offset: int64(offset), size: int(size)})
+	}
+	return run, nil
+}
+
+// Entries of a block of the run, read through the cache
+func (ix *diskIndex) block(run *indexRun, i int) []indexEntry {
+	if entries, ok := ix.cache.get(run.id, i); ok {
+		return entries
+	}
+	handle := run.blocks[i]
+	data := make([]byte, handle.size)
+	if _, err := run.file.ReadAt(data, handle.offset); err != nil {
+		log.Panicf("Error reading index run %d: %v", run.id, err)
+	}
+	body := data[:len(data)-blockTrailerSize]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(data[len(body):]) {
+		log.Panicf("Corrupt block %d of index run %d", i, run.id)
+	}
+	var entries []indexEntry
+	for len(body) > 0 {
+		entry, rest, ok := readEntry(body)
+		if !ok {
+			log.Panicf("Corrupt block %d of index run %d", i, run.id)
+		}
+		entries = append(entries, entry)
+		body = rest
+	}
+	ix.cache.put(run.id, i, entries)
+	return entries
+}
+
+// <key length, key, value offset, value length, removed>
+func appendEntry(b []byte, entry indexEntry) []byte {
+	b = binary.AppendUvarint(b, uint64(len(entry.key)))
+	b = append(b, entry.key...)
+	b = binary.AppendUvarint(b, uint64(entry.loc.offset))
+	b = binary.AppendUvarint(b, uint64(entry.loc.length))
+	if entry.deleted {
+		return append(b, 1)
+	}
+	return append(b, 0)
+}
+
+func readEntry(b []byte) (indexEntry, []byte, bool) {
+	var entry indexEntry
+	var offset, length uint64
+	var ok bool
+	if entry.key, b, ok = readString(b); !ok {
+		return entry, nil, false
+	}
+	if offset, b, ok = readUvarint(b); !ok {
+		return entry, nil, false
+	}
+	if length, b, ok = readUvarint(b); !ok || len(b) == 0 {
+		return entry, nil, false
+	}
+	entry.loc = location{offset: int64(offset), length: int(length)}
+	entry.deleted = b[0] == 1
+	return entry, b[1:], true
+}
+
+func readUvarint(b []byte) (uint64, []byte, bool) {
+	v, n := binary.Uvarint(b)
+	if n <= 0 {
+		return 0, nil, false
+	}
+	return v, b[n:], true
+}
+
+func readString(b []byte) (string, []byte, bool) {
+	n, b, ok := readUvarint(b)
+	if !ok || uint64(len(b)) < n {
+		return "", nil, false
+	}
+	return string(b[:n]), b[n:], true
+}
+
+// Sorted entries of the memtable or of a run
+type entrySource interface {
+	seek(key string)                                     // move to the first entry at or after key
+	entry() (indexEntry, bool)                           // the current entry, false past the end
+	next()                                               // move to the following entry
+	floor(key string, inclusive bool) (indexEntry, bool) // the last entry at or before key, before it if not inclusive
+}
+
+type memSource struct {
+	entries []indexEntry
+	pos     int
+}
+
+func (s *memSource) seek(key string) {
+	s.pos = sort.Search(len(s.entries), func(i int) bool { return s.entries[i].key >= key })
+}
+
+func (s *memSource) entry() (indexEntry, bool) {
+	if s.pos < len(s.entries) {
+		return s.entries[s.pos], true
+	}
+	return indexEntry{}, false
+}
+
+func (s *memSource) next() {
+	s.pos++
+}
+
+func (s *memSource) floor(key string, inclusive bool) (indexEntry, bool) {
+	i := sort.Search(len(s.entries), func(i int) bool { return !before(s.entries[i].key, key, inclusive) }) - 1
+	if i < 0 {
+		return indexEntry{}, false
+	}
+	return s.entries[i], true
+}
+
+type runSource struct {
+	ix      *diskIndex
+	run     *indexRun
+	block   int
+	entries []indexEntry // of the current block
+	pos     int
+}
+
+func (s *runSource) seek(key string) {
+	blocks := s.run.blocks
+	s.block = max(sort.Search(len(blocks), func(i int) bool { return blocks[i].first > key })-1, 0)
+	s.entries, s.pos = nil, 0
+	if s.block < len(blocks) {
+		s.entries = s.ix.block(s.run, s.block)
+		s.pos = sort.Search(len(s.entries), func(i int) bool { return s.entries[i].key >= key })
+		if s.pos == len(s.entries) {
+			s.pos--
+			s.next()
+		}
+	}
+}
+
+func (s *runSource) entry() (indexEntry, bool) {
+	if s.block < len(s.run.blocks) && s.pos < len(s.entries) {
+		return s.entries[s.pos], true
+	}
+	return indexEntry{}, false
+}
+
+func (s *runSource) next() {
+	s.pos++
+	if s.pos < len(s.entries) {
+		return
+	}
+	s.block++
+	s.entries, s.pos = nil, 0
+	if s.block < len(s.run.blocks) {
+		s.entries = s.ix.block(s.run, s.block)
+	}
+}
+
+func (s *runSource) floor(key string, inclusive bool) (indexEntry, bool) {
+	blocks := s.run.blocks
+	b := sort.Search(len(blocks), func(i int) bool { return !before(blocks[i].first, key, inclusive) }) - 1
+	if b < 0 {
+		return indexEntry{}, false
+	}
+	entries := s.ix.block(s.run, b)
+	i := sort.Search(len(entries), func(i int) bool { return !before(entries[i].key, key, inclusive) }) - 1
+	return entries[i], true
+}
+
+// Whether a comes before b, or is b if inclusive
+func before(a, b string, inclusive bool) bool {
+	return a < b || inclusive && a == b
+}
+
+// Merges the sources of an index in key order, the newest entry of a key wins
+type indexIterator struct {
+	sources    []entrySource // newest first
+	tombstones bool          // stop at removed keys too
+	current    indexEntry
+	valid      bool
+}
+
+func (it *indexIterator) seek(key string) {
+	for _, source := range it.sources {
+		source.seek(key)
+	}
+	it.next()
+}
+
+func (it *indexIterator) next() {
+	for {
+		best := -1
+		var entry indexEntry
+		for i, source := range it.sources {
+			if e, ok := source.entry(); ok && (best < 0 || e.key < entry.key) {
+				best, entry = i, e
+			}
+		}
+		if best < 0 {
+			it.valid = false
+			return
+		}
+		for _, source := range it.sources {
+			if e, ok := source.entry(); ok && e.key == entry.key {
+				source.next()
+			}
+		}
+		if !entry.deleted || it.tombstones {
+			it.current, it.valid = entry, true
+			return
+		}
+	}
+}
+
+// Least recently used blocks of runs
+type blockCache struct {
+	capacity int
+	order    *list.List // of *cachedBlock, most recently used first
+	blocks   map[blockKey]*list.Element
+}
+
+type blockKey struct {
+	run   int
+	block int
+}
+
+type cachedBlock struct {
+	key     blockKey
+	entries []indexEntry
+}
+
+func newBlockCache(capacity int) *blockCache {
+	return &blockCache{capacity: capacity, order: list.New(), blocks: make(map[blockKey]*list.Element)}
+}
+
+func (c *blockCache) get(run, block int) ([]indexEntry, bool) {
+	elem, ok := c.blocks[blockKey{run, block}]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*cachedBlock).entries, true
+}
+
+func (c *blockCache) put(run, block int, entries []indexEntry) {
+	key := blockKey{run, block}
+	c.blocks[key] = c.order.PushFront(&cachedBlock{key: key, entries: entries})
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.blocks, oldest.Value.(*cachedBlock).key)
+	}
+}
+
+// Forget the blocks of a run
+func (c *blockCache) drop(run int) {
+	for key, elem := range c.blocks {
+		if key.run == run {
+			c.order.Remove(elem)
+			delete(c.blocks, key)
+		}
+	}
+}